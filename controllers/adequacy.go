@@ -0,0 +1,76 @@
+package controllers
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// AdequacyController reports the dialysis dose (Kt/V and URR) patients receive
+type AdequacyController struct {
+    AdequacyGateway *gateways.AdequacyGateway
+}
+
+func NewAdequacyController(db *mongo.Database) *AdequacyController {
+    return &AdequacyController{
+        AdequacyGateway: gateways.NewAdequacyGateway(db),
+    }
+}
+
+// Handle GET requests for adequacy. identifier=trend (the default) gives the per-session trend of the patient
+// with the given id between from and to, identifier=flagged lists the patients below target and
+// identifier=targets shows the targets in use. Patients only see their own trend.
+func (ac *AdequacyController) GetAdequacy(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    switch r.URL.Query().Get("identifier") {
+    case "", "trend":
+        if patientID == 0 {
+            id, err := idParam(r, "id")
+            if err != nil {
+                utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+                return
+            }
+            patientID = id
+        }
+        trend, err := ac.AdequacyGateway.GetTrend(patientID, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch adequacy trend")
+            return
+        }
+        json.NewEncoder(w).Encode(trend)
+    case "flagged":
+        if patientID != 0 {
+            utils.ErrorHandler(w, http.StatusForbidden, nil, "Patients can only see their own adequacy")
+            return
+        }
+        limit := r.Context().Value("limit").(int)
+        page := r.Context().Value("page").(int)
+
+        patients, err := ac.AdequacyGateway.GetFlaggedPatients(limit, (page-1)*limit)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch flagged patients")
+            return
+        }
+        totalEntries, err := ac.AdequacyGateway.CountFlaggedPatients()
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count flagged patients")
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "data":          patients,
+            "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+            "page":          page,
+            "total_entries": totalEntries,
+        })
+    case "targets":
+        json.NewEncoder(w).Encode(gateways.Adequacy)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+    }
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// AdherenceController reports how reliably patients attend their dialysis sessions
+type AdherenceController struct {
+    AdherenceGateway *gateways.AdherenceGateway
+}
+
+func NewAdherenceController(db *mongo.Database) *AdherenceController {
+    return &AdherenceController{
+        AdherenceGateway: gateways.NewAdherenceGateway(db),
+    }
+}
+
+// Handle GET requests for adherence. identifier=patient (the default) summarizes the patient with the given id,
+// identifier=flagged lists the patients over a threshold and identifier=thresholds shows the thresholds in use.
+// Patients only see their own summary.
+func (ac *AdherenceController) GetAdherence(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    switch r.URL.Query().Get("identifier") {
+    case "", "patient":
+        if patientID == 0 {
+            id, err := idParam(r, "id")
+            if err != nil {
+                utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+                return
+            }
+            patientID = id
+        }
+        summary, err := ac.AdherenceGateway.GetSummary(patientID)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to compute adherence")
+            return
+        }
+        json.NewEncoder(w).Encode(summary)
+    case "flagged":
+        if patientID != 0 {
+            utils.ErrorHandler(w, http.StatusForbidden, nil, "Patients can only see their own adherence")
+            return
+        }
+        limit := r.Context().Value("limit").(int)
+        page := r.Context().Value("page").(int)
+
+        patients, err := ac.AdherenceGateway.GetFlaggedPatients(limit, (page-1)*limit)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch flagged patients")
+            return
+        }
+        totalEntries, err := ac.AdherenceGateway.CountFlaggedPatients()
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count flagged patients")
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "data":          patients,
+            "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+            "page":          page,
+            "total_entries": totalEntries,
+        })
+    case "thresholds":
+        json.NewEncoder(w).Encode(gateways.Adherence)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+    }
+}
@@ -2,8 +2,12 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"math"
 	"net/http"
+	"time"
 
 	"github.com/BrianKasina/dialysis-scheduling/gateways"
 	"github.com/BrianKasina/dialysis-scheduling/models"
@@ -15,6 +19,9 @@ import (
 type AppointmentController struct {
     DialysisGateway       *gateways.DialysisGateway
     NephrologistGateway   *gateways.NephrologistAppointmentGateway
+    WaitlistGateway       *gateways.WaitlistGateway
+    AdherenceGateway      *gateways.AdherenceGateway
+    MachineGateway        *gateways.MachineGateway
 }
 
 // NewAppointmentController creates a new AppointmentController instance
@@ -22,27 +29,55 @@ func NewAppointmentController(db *mongo.Database) *AppointmentController {
     return &AppointmentController{
         DialysisGateway:     gateways.NewDialysisGateway(db),
         NephrologistGateway: gateways.NewNephrologistAppointmentGateway(db),
+        WaitlistGateway:     gateways.NewWaitlistGateway(db),
+        AdherenceGateway:    gateways.NewAdherenceGateway(db),
+        MachineGateway:      gateways.NewMachineGateway(db),
     }
 }
 
-// Handle GET requests for appointments, type distinguishes between dialysis and nephrologist
+// Handle GET requests for appointments. identifier=dialysis or identifier=nephrologist lists appointments
+// narrowed by the filter parameters (see appointmentFilter), identifier=search runs a name search within type
+// and identifier=reschedules reports on rescheduling.
 func (ac *AppointmentController) GetAppointments(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("identifier") == "reschedules" {
+        ac.GetRescheduleReport(w, r)
+        return
+    }
+
     limit := r.Context().Value("limit").(int)
     page := r.Context().Value("page").(int)
     appointmentType := r.URL.Query().Get("type")
     identifier := r.URL.Query().Get("identifier")
 
     offset := (page - 1) * limit
+    // Patients only ever see their own appointments, whatever the query says
+    patientID := utils.PatientScope(r)
 
-    query := r.URL.Query().Get("query")
     var appointments interface{}
+    var totalEntries int
     var err error
 
     switch identifier {
-    case "dialysis":
-        appointments, err = ac.DialysisGateway.GetAppointments( limit, offset )
-    case "nephrologist":
-        appointments, err = ac.NephrologistGateway.GetAppointments( limit, offset )
+    case "dialysis", "nephrologist":
+        filter, filterErr := appointmentFilter(r)
+        if filterErr != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, filterErr, "Invalid appointment filter")
+            return
+        }
+        if patientID != 0 {
+            filter.PatientID = patientID
+        }
+        if identifier == "dialysis" {
+            appointments, err = ac.DialysisGateway.GetAppointments(filter, limit, offset)
+            if err == nil {
+                totalEntries, err = ac.DialysisGateway.CountAppointments(filter)
+            }
+        } else {
+            appointments, err = ac.NephrologistGateway.GetAppointments(filter, limit, offset)
+            if err == nil {
+                totalEntries, err = ac.NephrologistGateway.CountAppointments(filter)
+            }
+        }
     case "search":
         query := r.URL.Query().Get("name")
         if query == "" {
@@ -50,9 +85,15 @@ func (ac *AppointmentController) GetAppointments(w http.ResponseWriter, r *http.
             return
         }
         if appointmentType == "dialysis" {
-            appointments, err = ac.DialysisGateway.SearchAppointments(query, limit, offset)
+            appointments, err = ac.DialysisGateway.SearchAppointments(query, patientID, limit, offset)
+            if err == nil {
+                totalEntries, err = ac.DialysisGateway.GetTotalDialysisAppointmentCount(query, patientID)
+            }
         } else if appointmentType == "nephrologist" {
-            appointments, err = ac.NephrologistGateway.SearchAppointments(query, limit, offset)
+            appointments, err = ac.NephrologistGateway.SearchAppointments(query, patientID, limit, offset)
+            if err == nil {
+                totalEntries, err = ac.NephrologistGateway.GetTotalNephrologistAppointmentCount(query, patientID)
+            }
         } else {
             utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type for search")
             return
@@ -62,20 +103,12 @@ func (ac *AppointmentController) GetAppointments(w http.ResponseWriter, r *http.
         return
     }
 
-    if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch appointments")
+    if errors.Is(err, gateways.ErrInvalidFilter) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid appointment filter")
         return
     }
-
-    var totalEntries int
-    if appointmentType == "dialysis" {
-        totalEntries, err = ac.DialysisGateway.GetTotalDialysisAppointmentCount(query)
-    } else if appointmentType == "nephrologist" {
-        totalEntries, err = ac.NephrologistGateway.GetTotalNephrologistAppointmentCount(query)
-    }
-
     if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch total appointments count")
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch appointments")
         return
     }
 
@@ -94,20 +127,63 @@ func (ac *AppointmentController) GetAppointments(w http.ResponseWriter, r *http.
 // Handle POST requests for creating appointments
 func (ac *AppointmentController) CreateAppointment(w http.ResponseWriter, r *http.Request) {
     appointmentType := r.URL.Query().Get("type")
+    patientID := utils.PatientScope(r)
 
     switch appointmentType {
     case "dialysis":
-        ac.DialysisGateway.CreateAppointment(w, r)
+        var appointment models.DialysisAppointment
+        if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        appointment.ClearServerFields()
+        // Patients can only book for themselves
+        if patientID != 0 {
+            appointment.PatientID = patientID
+        }
+        appointment.Status, appointment.StatusHistory = initialStatus(r, appointment.Status)
+        if err := ac.DialysisGateway.CreateAppointment(&appointment); err != nil {
+            bookingError(w, err, "Failed to create dialysis appointment")
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(appointment)
     case "nephrologist":
-        ac.NephrologistGateway.CreateAppointment(w, r)
+        var appointment models.NephrologistAppointment
+        if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        appointment.ClearServerFields()
+        if patientID != 0 {
+            appointment.PatientID = patientID
+        }
+        appointment.Status, appointment.StatusHistory = initialStatus(r, appointment.Status)
+        if err := ac.NephrologistGateway.CreateAppointment(&appointment); err != nil {
+            bookingError(w, err, "Failed to create nephrologist appointment")
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(appointment)
     default:
         utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
     }
 }
 
-// Handle PUT requests for updating appointments
+// Handle PUT requests for updating appointments, an identifier from statusActions changes the status instead
+// and identifier=reschedule moves the appointment
 func (ac *AppointmentController) UpdateAppointment(w http.ResponseWriter, r *http.Request) {
+    if _, ok := statusActions[r.URL.Query().Get("identifier")]; ok {
+        ac.ChangeStatus(w, r)
+        return
+    }
+    if r.URL.Query().Get("identifier") == "reschedule" {
+        ac.Reschedule(w, r)
+        return
+    }
+
     appointmentType := r.URL.Query().Get("type")
+    patientID := utils.PatientScope(r)
 
     switch appointmentType {
     case "dialysis":
@@ -116,29 +192,311 @@ func (ac *AppointmentController) UpdateAppointment(w http.ResponseWriter, r *htt
             utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
             return
         }
-        ac.DialysisGateway.UpdateAppointment(&appointment)
+        if err := ac.DialysisGateway.UpdateAppointment(&appointment, patientID); err != nil {
+            bookingError(w, err, "Failed to update dialysis appointment")
+            return
+        }
+        json.NewEncoder(w).Encode(appointment)
     case "nephrologist":
         var appointment models.NephrologistAppointment
         if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
             utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
             return
         }
-        ac.NephrologistGateway.UpdateAppointment(&appointment)
+        if err := ac.NephrologistGateway.UpdateAppointment(&appointment, patientID); err != nil {
+            bookingError(w, err, "Failed to update nephrologist appointment")
+            return
+        }
+        json.NewEncoder(w).Encode(appointment)
     default:
         utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
     }
 }
 
+// statusActions maps each status endpoint identifier to the status it moves an appointment to
+var statusActions = map[string]string{
+    "confirm":  models.StatusConfirmed,
+    "check-in": models.StatusCheckedIn,
+    "start":    models.StatusInProgress,
+    "complete": models.StatusCompleted,
+    "cancel":   models.StatusCancelled,
+    "no-show":  models.StatusNoShow,
+}
+
+// Move an appointment to the status named by the identifier, e.g. PUT /appointments?type=dialysis&identifier=check-in&id=12.
+// Cancelling needs a reason in the body, and patients may only cancel their own appointments. Staff recording
+// a change afterwards give the time it happened as occurred_at.
+func (ac *AppointmentController) ChangeStatus(w http.ResponseWriter, r *http.Request) {
+    status := statusActions[r.URL.Query().Get("identifier")]
+    patientID := utils.PatientScope(r)
+
+    appointmentID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing appointment ID")
+        return
+    }
+
+    var body struct {
+        Reason     string     `json:"reason"`
+        OccurredAt *time.Time `json:"occurred_at"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if body.OccurredAt != nil && body.OccurredAt.After(time.Now()) {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A status change cannot be recorded as happening in the future")
+        return
+    }
+    if status == models.StatusCancelled && body.Reason == "" {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A reason is required to cancel an appointment")
+        return
+    }
+    if patientID != 0 && status != models.StatusCancelled {
+        utils.ErrorHandler(w, http.StatusForbidden, nil, "Patients can only cancel their appointments")
+        return
+    }
+
+    var freed *models.SlotOffer
+    if status == models.StatusCancelled {
+        freed = ac.freedSlot(r.URL.Query().Get("type"), appointmentID)
+    }
+
+    change := statusChange(r, status, body.Reason)
+    change.OccurredAt = body.OccurredAt
+    switch r.URL.Query().Get("type") {
+    case "dialysis":
+        err = ac.DialysisGateway.TransitionStatus(appointmentID, patientID, &change)
+    case "nephrologist":
+        err = ac.NephrologistGateway.TransitionStatus(appointmentID, patientID, &change)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
+        return
+    }
+
+    if err != nil {
+        bookingError(w, err, "Failed to change appointment status")
+        return
+    }
+    ac.backfill(freed)
+    if r.URL.Query().Get("type") == "dialysis" {
+        ac.refreshAdherence(appointmentID, status)
+        ac.recordMachineUse(appointmentID, status)
+    }
+    json.NewEncoder(w).Encode(change)
+}
+
+// Move an appointment to a new slot, e.g. PUT /appointments?type=dialysis&identifier=reschedule&id=12 with the new
+// date, time and optionally station_id in the body. A reason is required; the original stays on record as rescheduled.
+func (ac *AppointmentController) Reschedule(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    appointmentID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing appointment ID")
+        return
+    }
+
+    var request models.RescheduleRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if request.Date == "" || request.Time == "" {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A new date and time are required")
+        return
+    }
+    if request.Reason == "" {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A reason is required to reschedule an appointment")
+        return
+    }
+
+    freed := ac.freedSlot(r.URL.Query().Get("type"), appointmentID)
+    change := statusChange(r, models.StatusRescheduled, request.Reason)
+    var moved interface{}
+    switch r.URL.Query().Get("type") {
+    case "dialysis":
+        moved, err = ac.DialysisGateway.Reschedule(appointmentID, patientID, request, change)
+    case "nephrologist":
+        moved, err = ac.NephrologistGateway.Reschedule(appointmentID, patientID, request, change)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
+        return
+    }
+
+    if err != nil {
+        bookingError(w, err, "Failed to reschedule appointment")
+        return
+    }
+    ac.backfill(freed)
+    json.NewEncoder(w).Encode(moved)
+}
+
+// Report how many appointments of a type were rescheduled between from and to, and by whom,
+// e.g. GET /appointments?type=dialysis&identifier=reschedules&from=2024-05-01&to=2024-05-31
+func (ac *AppointmentController) GetRescheduleReport(w http.ResponseWriter, r *http.Request) {
+    if utils.PatientScope(r) != 0 {
+        utils.ErrorHandler(w, http.StatusForbidden, nil, "Reschedule reports are for staff only")
+        return
+    }
+
+    from, err := timeParam(r.URL.Query().Get("from"), false)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid from date")
+        return
+    }
+    to, err := timeParam(r.URL.Query().Get("to"), true)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid to date")
+        return
+    }
+
+    var report *models.RescheduleReport
+    switch r.URL.Query().Get("type") {
+    case "dialysis":
+        report, err = ac.DialysisGateway.GetRescheduleReport(from, to)
+    case "nephrologist":
+        report, err = ac.NephrologistGateway.GetRescheduleReport(from, to)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
+        return
+    }
+
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to build reschedule report")
+        return
+    }
+    json.NewEncoder(w).Encode(report)
+}
+
+// statusChange describes a status transition made by the caller
+func statusChange(r *http.Request, to, reason string) models.StatusChange {
+    return models.StatusChange{
+        To:        to,
+        ChangedBy: utils.GetAccountID(r),
+        Role:      utils.GetRole(r),
+        Reason:    reason,
+        ChangedAt: time.Now(),
+    }
+}
+
+// initialStatus gives a new booking its first status and history entry. Bookings start as requested,
+// staff may book straight into confirmed.
+func initialStatus(r *http.Request, requested string) (string, []models.StatusChange) {
+    status := models.StatusRequested
+    if requested == models.StatusConfirmed && utils.PatientScope(r) == 0 {
+        status = models.StatusConfirmed
+    }
+    return status, []models.StatusChange{statusChange(r, status, "")}
+}
+
 // Handle DELETE requests for deleting appointments
 func (ac *AppointmentController) DeleteAppointment(w http.ResponseWriter, r *http.Request) {
     appointmentType := r.URL.Query().Get("type")
+    patientID := utils.PatientScope(r)
+
+    appointmentID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing appointment ID")
+        return
+    }
 
+    freed := ac.freedSlot(appointmentType, appointmentID)
     switch appointmentType {
     case "dialysis":
-        ac.DialysisGateway.DeleteAppointment(w, r)
+        err = ac.DialysisGateway.DeleteAppointment(appointmentID, patientID)
     case "nephrologist":
-        ac.NephrologistGateway.DeleteAppointment(w, r)
+        err = ac.NephrologistGateway.DeleteAppointment(appointmentID, patientID)
     default:
         utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid appointment type")
+        return
+    }
+
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to delete appointment")
+        return
+    }
+    ac.backfill(freed)
+    json.NewEncoder(w).Encode(map[string]string{"message": "Appointment deleted successfully"})
+}
+
+// freedSlot describes the slot an appointment holds, to offer to the waitlist once it is cancelled, rescheduled or deleted.
+// It returns nil when the appointment cannot be found or no longer holds a slot.
+func (ac *AppointmentController) freedSlot(appointmentType string, appointmentID int) *models.SlotOffer {
+    switch appointmentType {
+    case "dialysis":
+        appointment, err := ac.DialysisGateway.GetAppointment(appointmentID, 0)
+        if err != nil || !models.HoldsSlot(appointment.Status) {
+            return nil
+        }
+        freed := appointment.FreedSlot()
+        return &freed
+    case "nephrologist":
+        appointment, err := ac.NephrologistGateway.GetAppointment(appointmentID, 0)
+        if err != nil || !models.HoldsSlot(appointment.Status) {
+            return nil
+        }
+        return &models.SlotOffer{
+            Type:               appointmentType,
+            Date:               appointment.Date,
+            Time:               appointment.Time,
+            DurationMinutes:    appointment.DurationMinutes,
+            StaffID:            appointment.StaffID,
+            StaffName:          appointment.StaffName,
+            PatientID:          appointment.PatientID,
+            FreedAppointmentID: appointment.ID,
+        }
+    }
+    return nil
+}
+
+// backfill offers a freed slot to the waitlist. The cancellation has already gone through, so a failure is only logged.
+func (ac *AppointmentController) backfill(freed *models.SlotOffer) {
+    if freed == nil {
+        return
+    }
+    if _, err := ac.WaitlistGateway.OfferFreedSlot(*freed); err != nil {
+        log.Printf("failed to offer freed %s slot of appointment %d: %v", freed.Type, freed.FreedAppointmentID, err)
+    }
+}
+
+// refreshAdherence updates the patient's adherence flag once a dialysis session is attended, finished or missed.
+// The status change has already gone through, so a failure is only logged.
+func (ac *AppointmentController) refreshAdherence(appointmentID int, status string) {
+    switch status {
+    case models.StatusCheckedIn, models.StatusCompleted, models.StatusNoShow:
+        if err := ac.AdherenceGateway.RefreshForAppointment(appointmentID); err != nil {
+            log.Printf("failed to refresh adherence after appointment %d: %v", appointmentID, err)
+        }
+    }
+}
+
+// recordMachineUse puts a completed session's hours on the station's machine and marks it for disinfection.
+// The session is already completed, so a failure is only logged.
+func (ac *AppointmentController) recordMachineUse(appointmentID int, status string) {
+    if status != models.StatusCompleted {
+        return
+    }
+    if err := ac.MachineGateway.RecordSession(appointmentID); err != nil {
+        log.Printf("failed to record machine use for appointment %d: %v", appointmentID, err)
+    }
+}
+
+// bookingError reports an error from booking an appointment, clashes come back as a 409 listing the clashing appointments
+func bookingError(w http.ResponseWriter, err error, message string) {
+    var conflict *gateways.ConflictError
+    switch {
+    case errors.As(err, &conflict):
+        utils.ConflictHandler(w, err, message, conflict.Conflicts)
+    case errors.Is(err, gateways.ErrStationTaken), errors.Is(err, gateways.ErrSlotUnavailable), errors.Is(err, gateways.ErrIllegalTransition),
+        errors.Is(err, gateways.ErrClinicClosed), errors.Is(err, gateways.ErrIsolationMismatch),
+        errors.Is(err, gateways.ErrMachineUnavailable), errors.Is(err, gateways.ErrMachineNeedsDisinfection):
+        utils.ErrorHandler(w, http.StatusConflict, err, message)
+    case errors.Is(err, gateways.ErrStationUnavailable), errors.Is(err, gateways.ErrInvalidSlot), errors.Is(err, gateways.ErrMoveNeedsReschedule):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrAppointmentNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
     }
 }
@@ -0,0 +1,434 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// asCaller attaches the claims of an authenticated caller, as AuthMiddleware would
+func asCaller(r *http.Request, role string, accountID int) *http.Request {
+    claims := map[string]interface{}{"role": role, "sub": float64(accountID)}
+    return r.WithContext(context.WithValue(r.Context(), "claims", claims))
+}
+
+// paginated sets the page and limit the pagination middleware would put in the context
+func paginated(r *http.Request) *http.Request {
+    ctx := context.WithValue(r.Context(), "limit", 10)
+    return r.WithContext(context.WithValue(ctx, "page", 1))
+}
+
+// sentFilters returns the filter of every command of the given name sent to the mock database
+func sentFilters(mt *mtest.T, commandName string) []bson.Raw {
+    mt.Helper()
+    var filters []bson.Raw
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName != commandName {
+            continue
+        }
+        switch commandName {
+        case "find":
+            filters = append(filters, event.Command.Lookup("filter").Document())
+        case "delete":
+            filters = append(filters, event.Command.Lookup("deletes", "0", "q").Document())
+        case "update":
+            filters = append(filters, event.Command.Lookup("updates", "0", "q").Document())
+        case "aggregate":
+            filters = append(filters, event.Command.Lookup("pipeline", "0", "$match").Document())
+        }
+    }
+    return filters
+}
+
+// scopedTo reports whether a filter can only match records of the given patient
+func scopedTo(filter bson.Raw, patientID int) bool {
+    if value, err := filter.LookupErr("patient_id"); err == nil {
+        id, ok := value.AsInt64OK()
+        return ok && int(id) == patientID
+    }
+    clauses, err := filter.LookupErr("$and")
+    if err != nil {
+        return false
+    }
+    values, _ := clauses.Array().Values()
+    for _, clause := range values {
+        if scopedTo(clause.Document(), patientID) {
+            return true
+        }
+    }
+    return false
+}
+
+func TestPatientSeesOnlyOwnAppointments(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    for _, appointmentType := range []string{"dialysis", "nephrologist"} {
+        mt.Run(appointmentType, func(mt *mtest.T) {
+            collection := appointmentType + "_appointments"
+            mt.AddMockResponses(
+                found(collection, bson.D{{Key: "appointment_id", Value: 1}, {Key: "patient_id", Value: 7}}),
+                found(collection, bson.D{{Key: "n", Value: 1}}),
+            )
+
+            w := httptest.NewRecorder()
+            r := httptest.NewRequest(http.MethodGet, "/appointments?type="+appointmentType+"&identifier="+appointmentType+"&patient_id=99", nil)
+            NewAppointmentController(mt.DB).GetAppointments(w, asCaller(paginated(r), utils.RolePatient, 7))
+            if w.Code != http.StatusOK {
+                mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+            }
+
+            filters := append(sentFilters(mt, "find"), sentFilters(mt, "aggregate")...)
+            if len(filters) != 2 {
+                mt.Fatalf("sent %d reads, want a find and a count", len(filters))
+            }
+            for _, filter := range filters {
+                if !scopedTo(filter, 7) {
+                    mt.Errorf("filter %v is not limited to patient 7", filter)
+                }
+            }
+        })
+    }
+
+    mt.Run("staff see every patient", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments"), found("dialysis_appointments", bson.D{{Key: "n", Value: 0}}))
+
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodGet, "/appointments?type=dialysis&identifier=dialysis", nil)
+        NewAppointmentController(mt.DB).GetAppointments(w, asCaller(paginated(r), utils.RoleFrontDesk, 3))
+        for _, filter := range sentFilters(mt, "find") {
+            if scopedTo(filter, 3) {
+                mt.Errorf("staff filter %v is limited to the caller's account ID", filter)
+            }
+        }
+    })
+}
+
+func TestPatientBooksOnlyForThemselves(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("nephrologist", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("counters", bson.D{{Key: "_id", Value: "nephrologist_appointments"}, {Key: "seq", Value: 11}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "seq", Value: 12}}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("closures", bson.D{{Key: "n", Value: 0}}),
+            found("dialysis_appointments"),
+            found("nephrologist_appointments"),
+            mtest.CreateSuccessResponse(),
+            mtest.CreateSuccessResponse(),
+        )
+
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/appointments?type=nephrologist", strings.NewReader(`{"patient_id":99,"date":"2024-03-04","time":"09:00"}`))
+        NewAppointmentController(mt.DB).CreateAppointment(w, asCaller(r, utils.RolePatient, 7))
+        if w.Code != http.StatusCreated {
+            mt.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+        }
+
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName != "insert" {
+                continue
+            }
+            inserted := event.Command.Lookup("documents", "0").Document()
+            if id, _ := inserted.Lookup("patient_id").AsInt64OK(); id != 7 {
+                mt.Errorf("inserted patient_id = %d, want the caller 7", id)
+            }
+            return
+        }
+        mt.Error("no appointment was inserted")
+    })
+}
+
+func TestNewAppointmentIgnoresServerFields(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("dialysis", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("counters", bson.D{{Key: "_id", Value: "dialysis_appointments"}, {Key: "seq", Value: 11}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "seq", Value: 12}}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("closures", bson.D{{Key: "n", Value: 0}}),
+            found("dialysis_appointments"),
+            found("nephrologist_appointments"),
+            mtest.CreateSuccessResponse(),
+            mtest.CreateSuccessResponse(),
+        )
+
+        body := `{"id":3,"patient_id":7,"date":"2024-03-04","time":"06:00","schedule_id":5,"checked_in_at":"2024-03-04T06:00:00Z",
+            "late_minutes":4,"rescheduled_from":2,"transient":true,"status_history":[{"to":"completed"}]}`
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/appointments?type=dialysis", strings.NewReader(body))
+        NewAppointmentController(mt.DB).CreateAppointment(w, asCaller(r, utils.RoleFrontDesk, 2))
+        if w.Code != http.StatusCreated {
+            mt.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+        }
+
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName != "insert" {
+                continue
+            }
+            inserted := event.Command.Lookup("documents", "0").Document()
+            if id := inserted.Lookup("appointment_id").AsInt64(); id != 12 {
+                mt.Errorf("inserted appointment_id = %d, want the next ID 12", id)
+            }
+            for _, field := range []string{"schedule_id", "checked_in_at", "late_minutes", "rescheduled_from", "transient"} {
+                if _, err := inserted.LookupErr(field); err == nil {
+                    mt.Errorf("inserted %s from the request", field)
+                }
+            }
+            history, _ := inserted.Lookup("status_history").Array().Values()
+            if len(history) != 1 || history[0].Document().Lookup("to").StringValue() == "completed" {
+                mt.Errorf("inserted status history %v, want only the initial status", history)
+            }
+            return
+        }
+        mt.Error("no appointment was inserted")
+    })
+}
+
+func TestBookingClashIsReported(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("patient already has an overlapping session", func(mt *mtest.T) {
+        // Both appointment collections are searched for the patient, each reply holds the same clash
+        clash := bson.D{
+            {Key: "appointment_id", Value: 3},
+            {Key: "date", Value: "2024-03-04"},
+            {Key: "time", Value: "08:00"},
+            {Key: "starts_at", Value: time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)},
+            {Key: "ends_at", Value: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)},
+            {Key: "patient_id", Value: 7},
+        }
+        mt.AddMockResponses(
+            found("counters", bson.D{{Key: "_id", Value: "dialysis_appointments"}, {Key: "seq", Value: 11}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "seq", Value: 12}}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("closures", bson.D{{Key: "n", Value: 0}}),
+            found("dialysis_appointments", clash),
+            found("nephrologist_appointments", clash),
+            mtest.CreateSuccessResponse(),
+        )
+
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/appointments?type=dialysis", strings.NewReader(`{"patient_id":7,"date":"2024-03-04","time":"06:00"}`))
+        NewAppointmentController(mt.DB).CreateAppointment(w, asCaller(r, utils.RoleFrontDesk, 2))
+        if w.Code != http.StatusConflict {
+            mt.Fatalf("status = %d, want 409: %s", w.Code, w.Body)
+        }
+
+        var body struct {
+            Conflicts []struct {
+                AppointmentID int    `json:"appointment_id"`
+                Resource      string `json:"resource"`
+            } `json:"conflicts"`
+        }
+        json.NewDecoder(w.Body).Decode(&body)
+        if len(body.Conflicts) == 0 || body.Conflicts[0].AppointmentID != 3 || body.Conflicts[0].Resource != "patient" {
+            mt.Errorf("conflicts = %+v, want the patient's appointment 3", body.Conflicts)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "insert" {
+                mt.Error("a clashing appointment was inserted")
+            }
+        }
+    })
+}
+
+func TestPatientCannotDeleteOthersAppointments(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("another patient's appointment is not found", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("nephrologist_appointments", bson.D{{Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 8}, {Key: "status", Value: "confirmed"}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+        )
+
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodDelete, "/appointments?type=nephrologist&id=12", nil)
+        NewAppointmentController(mt.DB).DeleteAppointment(w, asCaller(r, utils.RolePatient, 7))
+        if w.Code != http.StatusNotFound {
+            mt.Errorf("status = %d, want 404", w.Code)
+        }
+        filters := sentFilters(mt, "delete")
+        if len(filters) != 1 || !scopedTo(filters[0], 7) {
+            mt.Errorf("delete filters %v are not limited to patient 7", filters)
+        }
+    })
+}
+
+func TestChangeStatus(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    change := func(db *mongo.Database, url, body, role string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPut, url, strings.NewReader(body))
+        NewAppointmentController(db).UpdateAppointment(w, asCaller(r, role, 7))
+        return w
+    }
+
+    mt.Run("cancelling needs a reason", func(mt *mtest.T) {
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=cancel&id=12", `{}`, utils.RoleFrontDesk)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+
+    mt.Run("patients cannot check themselves in", func(mt *mtest.T) {
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=check-in&id=12", ``, utils.RolePatient)
+        if w.Code != http.StatusForbidden {
+            mt.Errorf("status = %d, want 403", w.Code)
+        }
+    })
+
+    mt.Run("patients cancel only their own appointments", func(mt *mtest.T) {
+        mt.AddMockResponses(found("nephrologist_appointments"), found("nephrologist_appointments"))
+        w := change(mt.DB, "/appointments?type=nephrologist&identifier=cancel&id=12&patient_id=3", `{"reason":"travelling"}`, utils.RolePatient)
+        if w.Code != http.StatusNotFound {
+            mt.Errorf("status = %d, want 404", w.Code)
+        }
+        filters := sentFilters(mt, "find")
+        if scoped := filters[len(filters)-1]; !strings.Contains(scoped.String(), `{"patient_id": {"$numberInt":"7"}}`) {
+            mt.Errorf("status change filter = %v, want it scoped to patient 7", scoped)
+        }
+    })
+
+    mt.Run("changes cannot be recorded in the future", func(mt *mtest.T) {
+        body := fmt.Sprintf(`{"occurred_at":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=check-in&id=12", body, utils.RoleNurse)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+
+    mt.Run("late check-in is measured from the recorded arrival", func(mt *mtest.T) {
+        startsAt := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+        confirmed := bson.D{{Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 3}, {Key: "status", Value: "confirmed"}, {Key: "starts_at", Value: startsAt}}
+        mt.AddMockResponses(
+            found("dialysis_appointments", confirmed),
+            found("dialysis_appointments", confirmed),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("dialysis_appointments", confirmed),
+            found("dialysis_appointments"),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+        body := fmt.Sprintf(`{"occurred_at":%q}`, startsAt.Add(25*time.Minute).Format(time.RFC3339))
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=check-in&id=12", body, utils.RoleNurse)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName != "update" {
+                continue
+            }
+            set := event.Command.Lookup("updates", "0", "u", "$set").Document()
+            if late, _ := set.Lookup("late_minutes").AsInt64OK(); late != 25 {
+                mt.Errorf("late_minutes = %v, want 25 from the recorded arrival", set.Lookup("late_minutes"))
+            }
+            if arrived := set.Lookup("checked_in_at").Time(); !arrived.Equal(startsAt.Add(25 * time.Minute)) {
+                mt.Errorf("checked_in_at = %v, want the recorded arrival", arrived)
+            }
+            break
+        }
+    })
+
+    mt.Run("final status cannot change", func(mt *mtest.T) {
+        completed := bson.D{{Key: "appointment_id", Value: 12}, {Key: "status", Value: "completed"}}
+        mt.AddMockResponses(found("dialysis_appointments", completed), found("dialysis_appointments", completed), found("dialysis_appointments", completed))
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=cancel&id=12", `{"reason":"unwell"}`, utils.RoleFrontDesk)
+        if w.Code != http.StatusConflict {
+            mt.Errorf("status = %d, want 409", w.Code)
+        }
+    })
+
+    mt.Run("check-in records who made the change", func(mt *mtest.T) {
+        confirmed := bson.D{{Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 3}, {Key: "status", Value: "confirmed"}}
+        mt.AddMockResponses(
+            found("dialysis_appointments", confirmed),
+            found("dialysis_appointments", confirmed),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            // The patient's adherence is refreshed once they arrive
+            found("dialysis_appointments", confirmed),
+            found("dialysis_appointments"),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+        w := change(mt.DB, "/appointments?type=dialysis&identifier=check-in&id=12", ``, utils.RoleNurse)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+
+        var recorded struct {
+            From      string `json:"from"`
+            To        string `json:"to"`
+            ChangedBy int    `json:"changed_by"`
+            Role      string `json:"role"`
+        }
+        json.NewDecoder(w.Body).Decode(&recorded)
+        if recorded.From != "confirmed" || recorded.To != "checked-in" || recorded.ChangedBy != 7 || recorded.Role != utils.RoleNurse {
+            mt.Errorf("change = %+v, want confirmed to checked-in by nurse 7", recorded)
+        }
+        filters := sentFilters(mt, "update")
+        if flagged := filters[len(filters)-1]; flagged.Lookup("patient_id").Int32() != 3 {
+            mt.Errorf("last update filter = %v, want the adherence flag of patient 3", flagged)
+        }
+    })
+}
+
+func TestRescheduleRequest(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    reschedule := func(db *mongo.Database, url, body string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPut, url, strings.NewReader(body))
+        NewAppointmentController(db).UpdateAppointment(w, asCaller(r, utils.RoleFrontDesk, 2))
+        return w
+    }
+
+    for name, body := range map[string]string{
+        "no reason":   `{"date":"2024-03-05","time":"06:00"}`,
+        "no new time": `{"date":"2024-03-05","reason":"transport"}`,
+        "not json":    `tomorrow`,
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            w := reschedule(mt.DB, "/appointments?type=dialysis&identifier=reschedule&id=12", body)
+            if w.Code != http.StatusBadRequest {
+                mt.Errorf("status = %d, want 400", w.Code)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+
+    mt.Run("plain update cannot move the appointment", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", bson.D{
+            {Key: "appointment_id", Value: 12},
+            {Key: "date", Value: "2024-03-04"},
+            {Key: "time", Value: "06:00"},
+            {Key: "starts_at", Value: time.Date(2024, 3, 4, 3, 0, 0, 0, time.UTC)},
+        }))
+        w := reschedule(mt.DB, "/appointments?type=dialysis&id=12", `{"date":"2024-03-05","time":"06:00"}`)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+        }
+        if !strings.Contains(w.Body.String(), "rescheduling") {
+            mt.Errorf("body = %s, want it to point at rescheduling", w.Body)
+        }
+        if updates := sentFilters(mt, "update"); len(updates) != 0 {
+            mt.Errorf("sent %d updates, want none", len(updates))
+        }
+    })
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// AuthController issues access and refresh tokens for account credentials
+type AuthController struct {
+    AuthGateway *gateways.AuthGateway
+    JWT         *utils.JWTUtil
+}
+
+func NewAuthController(db *mongo.Database, jwtUtil *utils.JWTUtil) *AuthController {
+    return &AuthController{
+        AuthGateway: gateways.NewAuthGateway(db),
+        JWT:         jwtUtil,
+    }
+}
+
+// Handle POST requests to log in with a username and password
+func (ac *AuthController) Login(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    credential, err := ac.AuthGateway.Authenticate(request.Username, request.Password)
+    if errors.Is(err, gateways.ErrInvalidCredentials) {
+        utils.ErrorHandler(w, http.StatusUnauthorized, err, "Invalid username or password")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to log in")
+        return
+    }
+
+    ac.issueTokens(w, credential)
+}
+
+// Handle POST requests to exchange a refresh token for a new pair of tokens
+func (ac *AuthController) Refresh(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    claims, err := ac.JWT.Decode(request.RefreshToken)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusUnauthorized, err, "Invalid refresh token")
+        return
+    }
+    if claims["token_type"] != "refresh" {
+        utils.ErrorHandler(w, http.StatusUnauthorized, errors.New("not a refresh token"), "Invalid refresh token")
+        return
+    }
+
+    // Look the account up again so removed credentials cannot keep refreshing
+    username, _ := claims["username"].(string)
+    credential, err := ac.AuthGateway.GetCredential(username)
+    if errors.Is(err, gateways.ErrInvalidCredentials) {
+        utils.ErrorHandler(w, http.StatusUnauthorized, err, "Invalid refresh token")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to refresh token")
+        return
+    }
+    // Refresh tokens issued before the password last changed are refused
+    if version, _ := claims["token_version"].(float64); int(version) != credential.TokenVersion {
+        utils.ErrorHandler(w, http.StatusUnauthorized, errors.New("password changed since the token was issued"), "Invalid refresh token")
+        return
+    }
+
+    ac.issueTokens(w, credential)
+}
+
+// issueTokens signs an access and a refresh token for the credential and writes them to the response
+func (ac *AuthController) issueTokens(w http.ResponseWriter, credential *models.Credential) {
+    payload := map[string]interface{}{
+        "sub":          credential.AccountID,
+        "username":     credential.Username,
+        "account_type": credential.AccountType,
+        "role":         credential.Role,
+        "token_type":   "access",
+    }
+
+    accessToken, err := ac.JWT.Encode(payload, utils.AccessTokenTTL)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to issue access token")
+        return
+    }
+
+    payload["token_type"] = "refresh"
+    payload["token_version"] = credential.TokenVersion
+    refreshToken, err := ac.JWT.Encode(payload, utils.RefreshTokenTTL)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to issue refresh token")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "access_token":  accessToken,
+        "refresh_token": refreshToken,
+        "token_type":    "Bearer",
+        "expires_in":    int(utils.AccessTokenTTL.Seconds()),
+    })
+}
+
+// Handle POST requests for credentials, an admin either sets an account's password or issues a reset token
+func (ac *AuthController) CreateCredential(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("identifier") == "reset" {
+        ac.CreateResetToken(w, r)
+        return
+    }
+
+    var request struct {
+        models.Credential
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    credential := request.Credential
+    if credential.Username == "" || !roleMatchesAccount(credential.AccountType, credential.AccountID, credential.Role) {
+        utils.ErrorHandler(w, http.StatusBadRequest, errors.New("invalid credential"), "A username and a role matching the account type are required")
+        return
+    }
+
+    err := ac.AuthGateway.SetPassword(&credential, request.Password)
+    if errors.Is(err, gateways.ErrWeakPassword) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Password is too short")
+        return
+    }
+    if errors.Is(err, gateways.ErrUsernameTaken) {
+        utils.ErrorHandler(w, http.StatusConflict, err, "Username is already taken")
+        return
+    }
+    if errors.Is(err, gateways.ErrUnknownAccount) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "The account has no patient or staff record")
+        return
+    }
+    if errors.Is(err, gateways.ErrStaffRoleMismatch) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "The role must be the one on the staff record")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to set password")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(credential)
+}
+
+// Handle PUT requests for credentials, the caller changes their own password
+func (ac *AuthController) ChangePassword(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        CurrentPassword string `json:"current_password"`
+        NewPassword     string `json:"new_password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    username, _ := utils.GetClaims(r)["username"].(string)
+    err := ac.AuthGateway.ChangePassword(username, request.CurrentPassword, request.NewPassword)
+    if errors.Is(err, gateways.ErrInvalidCredentials) {
+        utils.ErrorHandler(w, http.StatusUnauthorized, err, "Current password is incorrect")
+        return
+    }
+    if errors.Is(err, gateways.ErrWeakPassword) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Password is too short")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to change password")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
+}
+
+// Handle admin-initiated password resets by issuing a one-time reset token
+func (ac *AuthController) CreateResetToken(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Username string `json:"username"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    token, expires, err := ac.AuthGateway.CreateResetToken(request.Username)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to create reset token")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "username":    request.Username,
+        "reset_token": token,
+        "expires_at":  expires,
+    })
+}
+
+// Handle POST requests that complete a password reset with a one-time token
+func (ac *AuthController) ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Token       string `json:"reset_token"`
+        NewPassword string `json:"new_password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    err := ac.AuthGateway.ResetPassword(request.Token, request.NewPassword)
+    if errors.Is(err, gateways.ErrInvalidResetToken) {
+        utils.ErrorHandler(w, http.StatusUnauthorized, err, "Invalid or expired reset token")
+        return
+    }
+    if errors.Is(err, gateways.ErrWeakPassword) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Password is too short")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to reset password")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
+
+// roleMatchesAccount checks that a role can be given to the kind of account it is attached to.
+// Patient and staff credentials must name their account, PatientScope relies on a non-zero ID. Staff may leave
+// the role out, it is then taken from their staff record.
+func roleMatchesAccount(accountType string, accountID int, role string) bool {
+    switch accountType {
+    case models.AccountAdmin:
+        return role == utils.RoleSystemAdmin
+    case models.AccountPatient:
+        return accountID != 0 && role == utils.RolePatient
+    case models.AccountStaff:
+        return accountID != 0 && (role == "" || utils.IsStaffRole(role))
+    }
+    return false
+}
@@ -0,0 +1,392 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialDoc is a stored credential as the mock database returns it
+func credentialDoc(t *testing.T, password string) bson.D {
+    t.Helper()
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return bson.D{
+        {Key: "username", Value: "jane"},
+        {Key: "password_hash", Value: string(hash)},
+        {Key: "account_type", Value: "patient"},
+        {Key: "account_id", Value: 42},
+        {Key: "role", Value: utils.RolePatient},
+    }
+}
+
+func found(collection string, docs ...bson.D) bson.D {
+    return mtest.CreateCursorResponse(0, "dialysis."+collection, mtest.FirstBatch, docs...)
+}
+
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    handler(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(body)))
+    return w
+}
+
+type tokenPair struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+func TestLogin(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    jwtUtil := utils.NewJWTUtil("test-secret")
+
+    mt.Run("correct password", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")))
+        w := post(NewAuthController(mt.DB, jwtUtil).Login, `{"username":"jane","password":"correct horse"}`)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+
+        var tokens tokenPair
+        json.NewDecoder(w.Body).Decode(&tokens)
+        access, err := jwtUtil.Decode(tokens.AccessToken)
+        if err != nil {
+            mt.Fatalf("access token does not decode: %v", err)
+        }
+        if access["token_type"] != "access" || access["sub"] != float64(42) || access["role"] != utils.RolePatient {
+            mt.Errorf("access token claims = %v", access)
+        }
+        refresh, err := jwtUtil.Decode(tokens.RefreshToken)
+        if err != nil || refresh["token_type"] != "refresh" {
+            mt.Errorf("refresh token claims = %v, error %v", refresh, err)
+        }
+    })
+
+    mt.Run("wrong password", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")))
+        w := post(NewAuthController(mt.DB, jwtUtil).Login, `{"username":"jane","password":"battery staple"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+    })
+
+    mt.Run("unknown username", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials"))
+        w := post(NewAuthController(mt.DB, jwtUtil).Login, `{"username":"nobody","password":"correct horse"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+    })
+
+    mt.Run("empty password never reaches the database", func(mt *mtest.T) {
+        w := post(NewAuthController(mt.DB, jwtUtil).Login, `{"username":"jane","password":""}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+}
+
+func TestRefresh(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    jwtUtil := utils.NewJWTUtil("test-secret")
+    claims := func(tokenType string) map[string]interface{} {
+        return map[string]interface{}{"sub": 42, "username": "jane", "account_type": "patient", "token_type": tokenType}
+    }
+    sign := func(tokenType string, ttl time.Duration) string {
+        signed, _ := jwtUtil.Encode(claims(tokenType), ttl)
+        return signed
+    }
+
+    mt.Run("refresh token is exchanged for new tokens", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")))
+        w := post(NewAuthController(mt.DB, jwtUtil).Refresh, `{"refresh_token":"`+sign("refresh", time.Hour)+`"}`)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+        var tokens tokenPair
+        json.NewDecoder(w.Body).Decode(&tokens)
+        if _, err := jwtUtil.Decode(tokens.AccessToken); err != nil {
+            mt.Errorf("new access token does not decode: %v", err)
+        }
+    })
+
+    mt.Run("credential removed since the token was issued", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials"))
+        w := post(NewAuthController(mt.DB, jwtUtil).Refresh, `{"refresh_token":"`+sign("refresh", time.Hour)+`"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+    })
+
+    mt.Run("password changed since the token was issued", func(mt *mtest.T) {
+        changed := append(credentialDoc(t, "correct horse"), bson.E{Key: "token_version", Value: 1})
+        mt.AddMockResponses(found("credentials", changed))
+        w := post(NewAuthController(mt.DB, jwtUtil).Refresh, `{"refresh_token":"`+sign("refresh", time.Hour)+`"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+    })
+
+    mt.Run("token issued after the password changed", func(mt *mtest.T) {
+        changed := append(credentialDoc(t, "correct horse"), bson.E{Key: "token_version", Value: 1})
+        mt.AddMockResponses(found("credentials", changed), found("credentials", changed))
+        w := post(NewAuthController(mt.DB, jwtUtil).Login, `{"username":"jane","password":"correct horse"}`)
+        var tokens tokenPair
+        json.NewDecoder(w.Body).Decode(&tokens)
+
+        w = post(NewAuthController(mt.DB, jwtUtil).Refresh, `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+        if w.Code != http.StatusOK {
+            mt.Errorf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+    })
+
+    for name, token := range map[string]string{
+        "access token":          sign("access", time.Hour),
+        "expired refresh token": sign("refresh", -time.Minute),
+        "garbage":               "not.a.token",
+    } {
+        mt.Run(name+" is refused", func(mt *mtest.T) {
+            w := post(NewAuthController(mt.DB, jwtUtil).Refresh, `{"refresh_token":"`+token+`"}`)
+            if w.Code != http.StatusUnauthorized {
+                mt.Errorf("status = %d, want 401", w.Code)
+            }
+        })
+    }
+}
+
+func updated(n int) bson.D {
+    return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// lastUpdate returns the update document of the last update command sent to the mock database
+func lastUpdate(mt *mtest.T) (filter, update bson.Raw) {
+    mt.Helper()
+    var found bool
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName == "update" {
+            statement := event.Command.Lookup("updates", "0").Document()
+            filter, update, found = statement.Lookup("q").Document(), statement.Lookup("u").Document(), true
+        }
+    }
+    if !found {
+        mt.Fatal("no update command was sent")
+    }
+    return filter, update
+}
+
+func withUsername(r *http.Request, username string) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), "claims", map[string]interface{}{"username": username}))
+}
+
+func TestCreateCredential(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    jwtUtil := utils.NewJWTUtil("test-secret")
+
+    for name, body := range map[string]string{
+        "missing username":           `{"account_type":"patient","account_id":7,"role":"patient","password":"correct horse"}`,
+        "patient given a staff role": `{"username":"jane","account_type":"patient","account_id":7,"role":"nurse","password":"correct horse"}`,
+        "staff given the admin role": `{"username":"jane","account_type":"staff","account_id":7,"role":"system_admin","password":"correct horse"}`,
+        "unknown account type":       `{"username":"jane","account_type":"robot","account_id":7,"role":"patient","password":"correct horse"}`,
+        "password below the minimum": `{"username":"jane","account_type":"patient","account_id":7,"role":"patient","password":"short"}`,
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential, body)
+            if w.Code != http.StatusBadRequest {
+                mt.Errorf("status = %d, want 400", w.Code)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+
+    mt.Run("password is stored as a bcrypt hash", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients", bson.D{{Key: "n", Value: 1}}), updated(1))
+        w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential,
+            `{"username":"jane","account_type":"patient","account_id":7,"role":"patient","password":"correct horse"}`)
+        if w.Code != http.StatusCreated {
+            mt.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+        }
+        if strings.Contains(w.Body.String(), "correct horse") {
+            mt.Errorf("response echoes the password: %s", w.Body)
+        }
+
+        _, update := lastUpdate(mt)
+        hash := update.Lookup("$set", "password_hash").StringValue()
+        if bcrypt.CompareHashAndPassword([]byte(hash), []byte("correct horse")) != nil {
+            mt.Errorf("stored hash %q does not match the password", hash)
+        }
+    })
+
+    mt.Run("staff get the role on their staff record", func(mt *mtest.T) {
+        mt.AddMockResponses(found("hospital_staff", bson.D{{Key: "staff_id", Value: 7}, {Key: "role", Value: utils.RoleNurse}}), updated(1))
+        w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential,
+            `{"username":"amina","account_type":"staff","account_id":7,"password":"correct horse"}`)
+        if w.Code != http.StatusCreated {
+            mt.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+        }
+        if _, update := lastUpdate(mt); update.Lookup("$set", "role").StringValue() != utils.RoleNurse {
+            mt.Errorf("update = %v, want the nurse role from the staff record", update)
+        }
+    })
+
+    for name, role := range map[string]string{
+        "staff given a role other than their record's": `"role":"nephrologist",`,
+        "staff record without a role":                  ``,
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            member := bson.D{{Key: "staff_id", Value: 7}}
+            if role != "" {
+                member = append(member, bson.E{Key: "role", Value: utils.RoleFrontDesk})
+            }
+            mt.AddMockResponses(found("hospital_staff", member))
+            w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential,
+                `{"username":"amina","account_type":"staff","account_id":7,`+role+`"password":"correct horse"}`)
+            if w.Code != http.StatusBadRequest {
+                mt.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+            }
+            for _, event := range mt.GetAllStartedEvents() {
+                if event.CommandName == "update" {
+                    mt.Error("stored a credential with a role the staff record does not give")
+                }
+            }
+        })
+    }
+
+    mt.Run("account without a patient record", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients"))
+        w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential,
+            `{"username":"jane","account_type":"patient","account_id":7,"role":"patient","password":"correct horse"}`)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "update" {
+                mt.Error("stored a credential for an account that does not exist")
+            }
+        }
+    })
+
+    mt.Run("username taken by another account", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients", bson.D{{Key: "n", Value: 1}}))
+        mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"}))
+        w := post(NewAuthController(mt.DB, jwtUtil).CreateCredential,
+            `{"username":"jane","account_type":"patient","account_id":7,"role":"patient","password":"correct horse"}`)
+        if w.Code != http.StatusConflict {
+            mt.Errorf("status = %d, want 409", w.Code)
+        }
+    })
+}
+
+func TestChangePassword(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    jwtUtil := utils.NewJWTUtil("test-secret")
+    change := func(db *mongo.Database, body string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPut, "/credentials", strings.NewReader(body))
+        NewAuthController(db, jwtUtil).ChangePassword(w, withUsername(r, "jane"))
+        return w
+    }
+
+    mt.Run("current password is checked", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")))
+        w := change(mt.DB, `{"current_password":"battery staple","new_password":"another password"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "update" {
+                mt.Error("password was updated after a wrong current password")
+            }
+        }
+    })
+
+    mt.Run("new password replaces the hash of the caller", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")), updated(1))
+        w := change(mt.DB, `{"current_password":"correct horse","new_password":"another password"}`)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+
+        filter, update := lastUpdate(mt)
+        if filter.Lookup("username").StringValue() != "jane" {
+            mt.Errorf("update filter = %v, want the caller", filter)
+        }
+        hash := update.Lookup("$set", "password_hash").StringValue()
+        if bcrypt.CompareHashAndPassword([]byte(hash), []byte("another password")) != nil {
+            mt.Errorf("stored hash %q does not match the new password", hash)
+        }
+        if _, err := update.LookupErr("$unset", "reset_token_hash"); err != nil {
+            mt.Errorf("update %v leaves an outstanding reset token usable", update)
+        }
+        if _, err := update.LookupErr("$inc", "token_version"); err != nil {
+            mt.Errorf("update %v leaves earlier refresh tokens usable", update)
+        }
+    })
+
+    mt.Run("short new password", func(mt *mtest.T) {
+        mt.AddMockResponses(found("credentials", credentialDoc(t, "correct horse")))
+        w := change(mt.DB, `{"current_password":"correct horse","new_password":"short"}`)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+    })
+}
+
+func TestResetPassword(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    jwtUtil := utils.NewJWTUtil("test-secret")
+
+    mt.Run("token is matched by its hash and consumed", func(mt *mtest.T) {
+        mt.AddMockResponses(updated(1))
+        w := post(NewAuthController(mt.DB, jwtUtil).ResetPassword, `{"reset_token":"abc123","new_password":"another password"}`)
+        if w.Code != http.StatusOK {
+            mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+
+        filter, update := lastUpdate(mt)
+        if stored := filter.Lookup("reset_token_hash").StringValue(); stored == "abc123" || stored == "" {
+            mt.Errorf("filter matches reset_token_hash %q, want the hash of the token", stored)
+        }
+        if _, err := update.LookupErr("$unset", "reset_token_hash"); err != nil {
+            mt.Error("reset token is not cleared, so it could be used again")
+        }
+    })
+
+    mt.Run("unknown, used or expired token", func(mt *mtest.T) {
+        mt.AddMockResponses(updated(0))
+        w := post(NewAuthController(mt.DB, jwtUtil).ResetPassword, `{"reset_token":"abc123","new_password":"another password"}`)
+        if w.Code != http.StatusUnauthorized {
+            mt.Errorf("status = %d, want 401", w.Code)
+        }
+    })
+
+    mt.Run("short new password", func(mt *mtest.T) {
+        w := post(NewAuthController(mt.DB, jwtUtil).ResetPassword, `{"reset_token":"abc123","new_password":"short"}`)
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+    })
+
+    mt.Run("reset token for an unknown username", func(mt *mtest.T) {
+        mt.AddMockResponses(updated(0))
+        w := post(NewAuthController(mt.DB, jwtUtil).CreateResetToken, `{"username":"nobody"}`)
+        if w.Code != http.StatusNotFound {
+            mt.Errorf("status = %d, want 404", w.Code)
+        }
+    })
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// AvailabilityController manages nephrologist working hours, exceptions and booking from open slots
+type AvailabilityController struct {
+    AvailabilityGateway *gateways.AvailabilityGateway
+}
+
+func NewAvailabilityController(db *mongo.Database) *AvailabilityController {
+    return &AvailabilityController{
+        AvailabilityGateway: gateways.NewAvailabilityGateway(db),
+    }
+}
+
+// Handle GET requests for availability, identifier picks between open slots (the default),
+// working hours and exceptions. staff_id narrows the result to one nephrologist.
+func (ac *AvailabilityController) GetAvailability(w http.ResponseWriter, r *http.Request) {
+    staffID, _ := strconv.Atoi(r.URL.Query().Get("staff_id"))
+
+    from := r.URL.Query().Get("from")
+    if from == "" {
+        from = models.LocalDate(time.Now())
+    }
+    to := r.URL.Query().Get("to")
+    if to == "" {
+        to = from
+    }
+
+    var data interface{}
+    var err error
+    switch r.URL.Query().Get("identifier") {
+    case "", "slots":
+        data, err = ac.AvailabilityGateway.GetOpenSlots(staffID, from, to)
+    case "hours":
+        data, err = ac.AvailabilityGateway.GetWorkingHours(staffID)
+    case "exceptions":
+        data, err = ac.AvailabilityGateway.GetExceptions(staffID, from, to)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+    if err != nil {
+        bookingError(w, err, "Failed to fetch availability")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "from": from,
+        "to":   to,
+        "data": data,
+    })
+}
+
+// Handle POST requests for availability, identifier=hours and identifier=exceptions add to a
+// nephrologist's schedule, identifier=book reserves one of the open slots
+func (ac *AvailabilityController) CreateAvailability(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "hours":
+        var hours models.WorkingHours
+        if err := json.NewDecoder(r.Body).Decode(&hours); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        if err := ac.AvailabilityGateway.CreateWorkingHours(&hours, utils.NephrologistScope(r)); err != nil {
+            availabilityError(w, err, http.StatusBadRequest, "Failed to create working hours")
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(hours)
+    case "exceptions":
+        var exception models.AvailabilityException
+        if err := json.NewDecoder(r.Body).Decode(&exception); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        if err := ac.AvailabilityGateway.CreateException(&exception, utils.NephrologistScope(r)); err != nil {
+            availabilityError(w, err, http.StatusBadRequest, "Failed to create exception")
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(exception)
+    case "book":
+        ac.BookSlot(w, r)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+    }
+}
+
+// Book a nephrologist appointment into an open slot, patients always book for themselves
+func (ac *AvailabilityController) BookSlot(w http.ResponseWriter, r *http.Request) {
+    var appointment models.NephrologistAppointment
+    if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if patientID := utils.PatientScope(r); patientID != 0 {
+        appointment.PatientID = patientID
+    }
+    if appointment.PatientID == 0 || appointment.StaffID == 0 {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A patient and a nephrologist are required")
+        return
+    }
+
+    appointment.Status, appointment.StatusHistory = initialStatus(r, appointment.Status)
+
+    if err := ac.AvailabilityGateway.BookSlot(&appointment); err != nil {
+        bookingError(w, err, "Failed to book slot")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(appointment)
+}
+
+// Handle DELETE requests for availability, identifier=hours or identifier=exceptions with the id to remove.
+// Nephrologists only add and remove their own.
+func (ac *AvailabilityController) DeleteAvailability(w http.ResponseWriter, r *http.Request) {
+    id, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing ID")
+        return
+    }
+
+    switch r.URL.Query().Get("identifier") {
+    case "hours":
+        err = ac.AvailabilityGateway.DeleteWorkingHours(id, utils.NephrologistScope(r))
+    case "exceptions":
+        err = ac.AvailabilityGateway.DeleteException(id, utils.NephrologistScope(r))
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+    if err != nil {
+        availabilityError(w, err, http.StatusInternalServerError, "Failed to delete availability")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Availability deleted successfully"})
+}
+
+// availabilityError reports an error changing working hours or exceptions, with status for anything other
+// than a nephrologist reaching for someone else's schedule or an entry that does not exist
+func availabilityError(w http.ResponseWriter, err error, status int, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrNotOwnSchedule):
+        utils.ErrorHandler(w, http.StatusForbidden, err, message)
+    case errors.Is(err, gateways.ErrAvailabilityNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, status, err, message)
+    }
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChairPlanController previews and books the weekly dialysis chair plan
+type ChairPlanController struct {
+    ChairPlanGateway *gateways.ChairPlanGateway
+}
+
+func NewChairPlanController(db *mongo.Database) *ChairPlanController {
+    return &ChairPlanController{
+        ChairPlanGateway: gateways.NewChairPlanGateway(db),
+    }
+}
+
+// Handle GET requests for a preview of the chair plan for the week containing the date in week, next week by default.
+// Nothing is booked.
+func (cc *ChairPlanController) PreviewPlan(w http.ResponseWriter, r *http.Request) {
+    plan, err := cc.ChairPlanGateway.PreviewWeek(planWeek(r))
+    if err != nil {
+        chairPlanError(w, err, "Failed to plan the week")
+        return
+    }
+    json.NewEncoder(w).Encode(plan)
+}
+
+// Handle POST requests to book the chair plan for the week containing the date in week, next week by default.
+// version is the version of the previewed plan; when bookings changed since, nothing is booked and the new
+// plan is returned with a 409 to look over again.
+func (cc *ChairPlanController) CommitPlan(w http.ResponseWriter, r *http.Request) {
+    version := r.URL.Query().Get("version")
+    if version == "" {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Preview the plan first and give its version")
+        return
+    }
+
+    plan, booked, err := cc.ChairPlanGateway.CommitWeek(planWeek(r), version, statusChange(r, models.StatusConfirmed, ""))
+    if errors.Is(err, gateways.ErrPlanChanged) {
+        utils.ConflictHandler(w, err, "Bookings changed since the preview, look over the new plan", plan)
+        return
+    }
+    if err != nil {
+        chairPlanError(w, err, "Failed to book the chair plan")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "plan":         plan,
+        "appointments": booked,
+    })
+}
+
+// planWeek reads the week to plan, defaulting to next week
+func planWeek(r *http.Request) string {
+    if week := r.URL.Query().Get("week"); week != "" {
+        return week
+    }
+    return models.LocalDate(time.Now().AddDate(0, 0, 7))
+}
+
+func chairPlanError(w http.ResponseWriter, err error, message string) {
+    if errors.Is(err, gateways.ErrInvalidSlot) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+        return
+    }
+    utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+}
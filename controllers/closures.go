@@ -0,0 +1,121 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// ClosuresController manages the calendar of holidays and unit closures
+type ClosuresController struct {
+    ClosuresGateway *gateways.ClosuresGateway
+}
+
+func NewClosuresController(db *mongo.Database) *ClosuresController {
+    return &ClosuresController{
+        ClosuresGateway: gateways.NewClosuresGateway(db),
+    }
+}
+
+// Handle GET requests for closures between the from and to dates, either of which may be left out
+func (cc *ClosuresController) GetClosures(w http.ResponseWriter, r *http.Request) {
+    closures, err := cc.ClosuresGateway.GetClosures(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch closures")
+        return
+    }
+    json.NewEncoder(w).Encode(closures)
+}
+
+// Handle POST requests for closures. Without an identifier the body is a new closure;
+// identifier=relocate moves the sessions booked on the closure with the given id to other days.
+func (cc *ClosuresController) CreateClosure(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "relocate":
+        cc.Relocate(w, r)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var closure models.Closure
+    if err := json.NewDecoder(r.Body).Decode(&closure); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    closure.CreatedBy = utils.GetAccountID(r)
+
+    if err := cc.ClosuresGateway.CreateClosure(&closure); err != nil {
+        if errors.Is(err, gateways.ErrInvalidSlot) {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid closure")
+            return
+        }
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to create closure")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(closure)
+}
+
+// Move every session booked on a closed day, e.g. POST /closures?identifier=relocate&id=3 with
+// {"dates": ["2024-12-27", "2024-12-28"]}. The report lists where each patient went or why they could not be moved.
+func (cc *ClosuresController) Relocate(w http.ResponseWriter, r *http.Request) {
+    closureID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing closure ID")
+        return
+    }
+
+    var request models.RelocateRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    report, err := cc.ClosuresGateway.Relocate(closureID, request, statusChange(r, models.StatusRescheduled, ""))
+    if err != nil {
+        if errors.Is(err, gateways.ErrInvalidSlot) {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid alternative dates")
+            return
+        }
+        if errors.Is(err, gateways.ErrClosureNotFound) {
+            utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to relocate sessions")
+            return
+        }
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to relocate sessions")
+        return
+    }
+    json.NewEncoder(w).Encode(report)
+}
+
+// Handle DELETE requests to reopen the day of a closure. Sessions already relocated off the day are not moved
+// back, the response lists them with where they went.
+func (cc *ClosuresController) DeleteClosure(w http.ResponseWriter, r *http.Request) {
+    closureID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing closure ID")
+        return
+    }
+
+    relocated, err := cc.ClosuresGateway.DeleteClosure(closureID)
+    if errors.Is(err, gateways.ErrClosureNotFound) {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to delete closure")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete closure")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":   "Closure deleted successfully",
+        "relocated": relocated,
+    })
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+    "encoding/json"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// DialysisScheduleController manages recurring dialysis schedules and their occurrences
+type DialysisScheduleController struct {
+    ScheduleGateway *gateways.DialysisScheduleGateway
+    WaitlistGateway *gateways.WaitlistGateway
+}
+
+func NewDialysisScheduleController(db *mongo.Database) *DialysisScheduleController {
+    return &DialysisScheduleController{
+        ScheduleGateway: gateways.NewDialysisScheduleGateway(db),
+        WaitlistGateway: gateways.NewWaitlistGateway(db),
+    }
+}
+
+// Handle GET requests for recurring schedules with pagination
+func (sc *DialysisScheduleController) GetSchedules(w http.ResponseWriter, r *http.Request) {
+    limit, _ := r.Context().Value("limit").(int) // Retrieve limit from context
+    page, _ := r.Context().Value("page").(int)   // Retrieve page from context
+
+    offset := (page - 1) * limit // Calculate the actual offset
+    patientID := utils.PatientScope(r)
+
+    schedules, err := sc.ScheduleGateway.GetSchedules(patientID, limit, offset)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch dialysis schedules")
+        return
+    }
+
+    totalEntries, err := sc.ScheduleGateway.GetTotalScheduleCount(patientID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch total dialysis schedules count")
+        return
+    }
+
+    totalPages := int(math.Ceil(float64(totalEntries) / float64(limit)))
+
+    response := map[string]interface{}{
+        "data":          schedules,
+        "total_pages":   totalPages,
+        "page":          page,
+        "total_entries": totalEntries,
+    }
+
+    json.NewEncoder(w).Encode(response)
+}
+
+// Handle POST requests for recurring schedules, identifier=materialize extends all series
+func (sc *DialysisScheduleController) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("identifier") == "materialize" {
+        sc.MaterializeSchedules(w, r)
+        return
+    }
+
+    var schedule models.DialysisSchedule
+    if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    if err := sc.ScheduleGateway.CreateSchedule(&schedule); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to create dialysis schedule")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(schedule)
+}
+
+// Materialize all running schedules up to a horizon given in weeks, listing the sessions that could not be booked
+func (sc *DialysisScheduleController) MaterializeSchedules(w http.ResponseWriter, r *http.Request) {
+    horizon := gateways.DefaultScheduleHorizon
+    if weeks, err := strconv.Atoi(r.URL.Query().Get("weeks")); err == nil && weeks > 0 {
+        horizon = time.Duration(weeks) * 7 * 24 * time.Hour
+    }
+
+    created, skipped, err := sc.ScheduleGateway.MaterializeAll(time.Now().Add(horizon))
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to materialize dialysis schedules")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"created": created, "skipped": skipped})
+}
+
+// Handle PUT requests, identifier=occurrence edits one session and identifier=series edits the series from a date onward
+func (sc *DialysisScheduleController) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "occurrence":
+        var appointment models.DialysisAppointment
+        if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        if err := sc.ScheduleGateway.UpdateOccurrence(&appointment); err != nil {
+            bookingError(w, err, "Failed to update session")
+            return
+        }
+        json.NewEncoder(w).Encode(appointment)
+    case "series":
+        scheduleID, err := idParam(r, "id")
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing schedule ID")
+            return
+        }
+        var changes models.DialysisSchedule
+        if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+            return
+        }
+        schedule, freed, err := sc.ScheduleGateway.UpdateSeriesFrom(scheduleID, r.URL.Query().Get("from"), &changes)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to update dialysis schedule")
+            return
+        }
+        sc.backfill(freed)
+        json.NewEncoder(w).Encode(schedule)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid operation")
+    }
+}
+
+// Handle DELETE requests, identifier=occurrence cancels one session with the reason in the query
+// and identifier=series ends the series from a date onward
+func (sc *DialysisScheduleController) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+    id, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing ID")
+        return
+    }
+
+    var freed []models.SlotOffer
+    switch r.URL.Query().Get("identifier") {
+    case "occurrence":
+        reason := r.URL.Query().Get("reason")
+        if reason == "" {
+            utils.ErrorHandler(w, http.StatusBadRequest, nil, "A reason is required to cancel a session")
+            return
+        }
+        change := statusChange(r, models.StatusCancelled, reason)
+        err = sc.ScheduleGateway.CancelOccurrence(id, &change)
+    case "series":
+        freed, err = sc.ScheduleGateway.EndSeriesFrom(id, r.URL.Query().Get("from"))
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid operation")
+        return
+    }
+
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to cancel dialysis schedule")
+        return
+    }
+    sc.backfill(freed)
+    json.NewEncoder(w).Encode(map[string]string{"message": "Dialysis schedule cancelled successfully"})
+}
+
+// backfill offers the slots a series gave up to the waitlist. The series has already changed, so a failure is only logged.
+func (sc *DialysisScheduleController) backfill(freed []models.SlotOffer) {
+    for _, slot := range freed {
+        if _, err := sc.WaitlistGateway.OfferFreedSlot(slot); err != nil {
+            log.Printf("failed to offer freed dialysis slot of appointment %d: %v", slot.FreedAppointmentID, err)
+        }
+    }
+}
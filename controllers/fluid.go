@@ -0,0 +1,104 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// FluidController manages patients' dry weights and reports the weight they gain between sessions
+type FluidController struct {
+    FluidGateway *gateways.FluidGateway
+}
+
+func NewFluidController(db *mongo.Database) *FluidController {
+    return &FluidController{
+        FluidGateway: gateways.NewFluidGateway(db),
+    }
+}
+
+// Handle GET requests for fluid. identifier=trend (the default) gives the dry weights and per-session weight
+// gain of the patient with the given id between from and to, identifier=dry_weights only their dry weight
+// history and identifier=thresholds the gains that raise an alert. Patients only see their own.
+func (fc *FluidController) GetFluid(w http.ResponseWriter, r *http.Request) {
+    identifier := r.URL.Query().Get("identifier")
+    if identifier == "thresholds" {
+        json.NewEncoder(w).Encode(gateways.WeightGain)
+        return
+    }
+
+    patientID := utils.PatientScope(r)
+    if patientID == 0 {
+        id, err := idParam(r, "id")
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+            return
+        }
+        patientID = id
+    }
+
+    switch identifier {
+    case "", "trend":
+        trend, err := fc.FluidGateway.GetTrend(patientID, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch fluid trend")
+            return
+        }
+        json.NewEncoder(w).Encode(trend)
+    case "dry_weights":
+        dryWeights, err := fc.FluidGateway.GetDryWeights(patientID)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch dry weights")
+            return
+        }
+        json.NewEncoder(w).Encode(dryWeights)
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+    }
+}
+
+// Handle POST requests for fluid, setting a patient's dry weight, e.g.
+// {"patient_id": 7, "weight_kg": 68.5, "effective_from": "2024-03-01", "reason": "cramping, BP low post"}
+func (fc *FluidController) SetDryWeight(w http.ResponseWriter, r *http.Request) {
+    var dryWeight models.DryWeight
+    if err := json.NewDecoder(r.Body).Decode(&dryWeight); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := fc.FluidGateway.SetDryWeight(&dryWeight, utils.GetAccountID(r)); err != nil {
+        fluidError(w, err, "Failed to set dry weight")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(dryWeight)
+}
+
+// Handle DELETE requests for fluid, removing the dry weight with the given id
+func (fc *FluidController) DeleteDryWeight(w http.ResponseWriter, r *http.Request) {
+    id, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing dry weight ID")
+        return
+    }
+    if err := fc.FluidGateway.DeleteDryWeight(id); err != nil {
+        fluidError(w, err, "Failed to delete dry weight")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Dry weight deleted successfully"})
+}
+
+func fluidError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidDryWeight):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrDryWeightNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+    }
+}
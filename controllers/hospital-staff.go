@@ -71,6 +71,10 @@ func (hsc *HospitalStaffController) CreateHospitalStaff(w http.ResponseWriter, r
         utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
         return
     }
+    if !utils.IsStaffRole(member.Role) {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "A role of nurse, nephrologist, front_desk or technician is required")
+        return
+    }
 
     err = hsc.HospitalStaffGateway.CreateHospitalStaff(&member)
     if err != nil {
@@ -81,7 +85,7 @@ func (hsc *HospitalStaffController) CreateHospitalStaff(w http.ResponseWriter, r
     json.NewEncoder(w).Encode(member)
 }
 
-// Handle PUT requests for hospital staff
+// Handle PUT requests for hospital staff. A new role is carried over to the staff member's credential.
 func (hsc *HospitalStaffController) UpdateHospitalStaff(w http.ResponseWriter, r *http.Request) {
     var member models.HospitalStaff
     err := json.NewDecoder(r.Body).Decode(&member)
@@ -89,6 +93,10 @@ func (hsc *HospitalStaffController) UpdateHospitalStaff(w http.ResponseWriter, r
         utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
         return
     }
+    if member.Role != "" && !utils.IsStaffRole(member.Role) {
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "The role must be nurse, nephrologist, front_desk or technician")
+        return
+    }
 
     err = hsc.HospitalStaffGateway.UpdateHospitalStaff(&member)
     if err != nil {
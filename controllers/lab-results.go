@@ -0,0 +1,160 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxLabUpload is the largest lab CSV or HL7 batch taken in one request
+const maxLabUpload = 10 << 20
+
+// LabResultController manages lab results imported from the laboratory
+type LabResultController struct {
+    LabResultGateway *gateways.LabResultGateway
+}
+
+func NewLabResultController(db *mongo.Database) *LabResultController {
+    return &LabResultController{
+        LabResultGateway: gateways.NewLabResultGateway(db),
+    }
+}
+
+// Handle GET requests for lab results. identifier=trend gives the per-test trend of the patient with the given
+// id between from and to, with out of range values flagged, and identifier=panel the monthly panel with its
+// LOINC codes and target ranges. Otherwise results are listed newest first, narrowed by patient_id, loinc
+// (or a panel code such as "hb"), from and to. Patients only ever see their own.
+func (lc *LabResultController) GetResults(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    switch r.URL.Query().Get("identifier") {
+    case "trend":
+        if patientID == 0 {
+            id, err := idParam(r, "id")
+            if err != nil {
+                utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+                return
+            }
+            patientID = id
+        }
+        trend, err := lc.LabResultGateway.GetTrend(patientID, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch lab trend")
+            return
+        }
+        json.NewEncoder(w).Encode(trend)
+        return
+    case "panel":
+        json.NewEncoder(w).Encode(models.LabPanel)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    limit := r.Context().Value("limit").(int)
+    page := r.Context().Value("page").(int)
+    if patientID == 0 {
+        patientID, _ = strconv.Atoi(r.URL.Query().Get("patient_id"))
+    }
+    loinc, from, to := r.URL.Query().Get("loinc"), r.URL.Query().Get("from"), r.URL.Query().Get("to")
+
+    results, err := lc.LabResultGateway.GetResults(patientID, loinc, from, to, limit, (page-1)*limit)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch lab results")
+        return
+    }
+    totalEntries, err := lc.LabResultGateway.CountResults(patientID, loinc, from, to)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count lab results")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          results,
+        "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+        "page":          page,
+        "total_entries": totalEntries,
+    })
+}
+
+// Handle POST requests for lab results, importing them. identifier=csv takes a CSV, either as the file field
+// of a multipart form or as the request body, with a header row such as
+// patient_id,loinc,value,unit,collected_at,range_low,range_high. identifier=hl7 takes one or more HL7 v2
+// ORU^R01 messages as the request body. The response reports what was imported and the lines rejected.
+func (lc *LabResultController) ImportResults(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, maxLabUpload)
+
+    var report *models.LabImport
+    var err error
+    switch r.URL.Query().Get("identifier") {
+    case "csv":
+        body := io.Reader(r.Body)
+        if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+            file, _, err := r.FormFile("file")
+            if err != nil {
+                utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing CSV file")
+                return
+            }
+            defer file.Close()
+            body = file
+        }
+        report, err = lc.LabResultGateway.ImportCSV(body, utils.GetAccountID(r))
+    case "hl7":
+        message, readErr := io.ReadAll(r.Body)
+        if readErr != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, readErr, "Failed to read HL7 message")
+            return
+        }
+        report, err = lc.LabResultGateway.ImportHL7(string(message), utils.GetAccountID(r))
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier, expected csv or hl7")
+        return
+    }
+    if err != nil {
+        labResultError(w, err, "Failed to import lab results")
+        return
+    }
+
+    if report.Imported+report.Updated > 0 {
+        w.WriteHeader(http.StatusCreated)
+    } else if len(report.Errors) > 0 {
+        w.WriteHeader(http.StatusBadRequest)
+    }
+    json.NewEncoder(w).Encode(report)
+}
+
+// Handle DELETE requests for lab results, removing the result with the given id
+func (lc *LabResultController) DeleteResult(w http.ResponseWriter, r *http.Request) {
+    id, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing lab result ID")
+        return
+    }
+    if err := lc.LabResultGateway.DeleteResult(id); err != nil {
+        labResultError(w, err, "Failed to delete lab result")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Lab result deleted successfully"})
+}
+
+func labResultError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidLabImport):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrLabResultNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+    }
+}
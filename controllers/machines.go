@@ -0,0 +1,173 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// MachineController manages the dialysis machines, their disinfection and maintenance
+type MachineController struct {
+    MachineGateway *gateways.MachineGateway
+}
+
+func NewMachineController(db *mongo.Database) *MachineController {
+    return &MachineController{
+        MachineGateway: gateways.NewMachineGateway(db),
+    }
+}
+
+// Handle GET requests for machines. With an id the machine and its log are returned, identifier=work_orders
+// lists the jobs due by the end of the week containing week (this week by default), otherwise machines are
+// listed, only the one at station_id when given.
+func (mc *MachineController) GetMachines(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("identifier") == "work_orders" {
+        week := r.URL.Query().Get("week")
+        if week == "" {
+            week = models.LocalDate(time.Now())
+        }
+        orders, err := mc.MachineGateway.GetWorkOrders(week)
+        if err != nil {
+            machineError(w, err, "Failed to list work orders")
+            return
+        }
+        json.NewEncoder(w).Encode(orders)
+        return
+    }
+
+    if machineID, err := idParam(r, "id"); err == nil {
+        machine, err := mc.MachineGateway.GetMachine(machineID)
+        if err != nil {
+            machineError(w, err, "Failed to fetch machine")
+            return
+        }
+        json.NewEncoder(w).Encode(machine)
+        return
+    }
+
+    limit := r.Context().Value("limit").(int)
+    page := r.Context().Value("page").(int)
+    stationID, _ := strconv.Atoi(r.URL.Query().Get("station_id"))
+
+    machines, err := mc.MachineGateway.GetMachines(stationID, limit, (page-1)*limit)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch machines")
+        return
+    }
+    totalEntries, err := mc.MachineGateway.CountMachines(stationID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count machines")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          machines,
+        "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+        "page":          page,
+        "total_entries": totalEntries,
+    })
+}
+
+// Handle POST requests for machines. Without an identifier the body is a new machine; identifier=disinfect
+// and identifier=maintenance record a disinfection or a maintenance visit on the machine with the given id,
+// with optional notes in the body.
+func (mc *MachineController) CreateMachine(w http.ResponseWriter, r *http.Request) {
+    switch identifier := r.URL.Query().Get("identifier"); identifier {
+    case "disinfect", "maintenance":
+        mc.RecordService(w, r, identifier)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var machine models.Machine
+    if err := json.NewDecoder(r.Body).Decode(&machine); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := mc.MachineGateway.CreateMachine(&machine, utils.GetAccountID(r)); err != nil {
+        machineError(w, err, "Failed to create machine")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(machine)
+}
+
+// Record a disinfection or maintenance visit, e.g. POST /machines?identifier=disinfect&id=4
+func (mc *MachineController) RecordService(w http.ResponseWriter, r *http.Request, identifier string) {
+    machineID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing machine ID")
+        return
+    }
+
+    var service models.MachineService
+    if err := json.NewDecoder(r.Body).Decode(&service); err != nil && err != io.EOF {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    var machine *models.Machine
+    if identifier == "disinfect" {
+        machine, err = mc.MachineGateway.RecordDisinfection(machineID, service, utils.GetAccountID(r))
+    } else {
+        machine, err = mc.MachineGateway.RecordMaintenance(machineID, service, utils.GetAccountID(r))
+    }
+    if err != nil {
+        machineError(w, err, "Failed to record "+identifier)
+        return
+    }
+    json.NewEncoder(w).Encode(machine)
+}
+
+// Handle PUT requests for machines, including taking them out of and back into service
+func (mc *MachineController) UpdateMachine(w http.ResponseWriter, r *http.Request) {
+    var machine models.Machine
+    if err := json.NewDecoder(r.Body).Decode(&machine); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    if err := mc.MachineGateway.UpdateMachine(&machine, utils.GetAccountID(r)); err != nil {
+        machineError(w, err, "Failed to update machine")
+        return
+    }
+    json.NewEncoder(w).Encode(machine)
+}
+
+// Handle DELETE requests for machines
+func (mc *MachineController) DeleteMachine(w http.ResponseWriter, r *http.Request) {
+    machineID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing machine ID")
+        return
+    }
+
+    if err := mc.MachineGateway.DeleteMachine(machineID); err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete machine")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Machine deleted successfully"})
+}
+
+func machineError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidMachine), errors.Is(err, gateways.ErrInvalidSlot):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrMachineNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+    }
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// MedicationController manages patients' medication lists and the doses nurses chart at sessions
+type MedicationController struct {
+    MedicationGateway *gateways.MedicationGateway
+}
+
+func NewMedicationController(db *mongo.Database) *MedicationController {
+    return &MedicationController{
+        MedicationGateway: gateways.NewMedicationGateway(db),
+    }
+}
+
+// Handle GET requests for medications. With an appointment_id the session's medication administration record
+// is returned and identifier=doses lists charted doses newest first, narrowed by patient_id, from and to.
+// Otherwise the medication list of the patient with the given id is returned, only the orders active today
+// with active=true. Patients only ever see their own.
+func (mc *MedicationController) GetMedications(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    if r.URL.Query().Get("identifier") == "doses" {
+        mc.GetAdministrations(w, r)
+        return
+    }
+
+    if appointmentID, err := idParam(r, "appointment_id"); err == nil {
+        chart, err := mc.MedicationGateway.GetChart(appointmentID, patientID)
+        if err != nil {
+            medicationError(w, err, "Failed to fetch medication chart")
+            return
+        }
+        json.NewEncoder(w).Encode(chart)
+        return
+    }
+
+    if patientID == 0 {
+        id, err := idParam(r, "id")
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+            return
+        }
+        patientID = id
+    }
+    orders, err := mc.MedicationGateway.GetOrders(patientID, r.URL.Query().Get("active") == "true")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch medications")
+        return
+    }
+    json.NewEncoder(w).Encode(orders)
+}
+
+// List charted doses, e.g. GET /medications?identifier=doses&patient_id=7&from=2024-03-01
+func (mc *MedicationController) GetAdministrations(w http.ResponseWriter, r *http.Request) {
+    limit := r.Context().Value("limit").(int)
+    page := r.Context().Value("page").(int)
+    patientID := utils.PatientScope(r)
+    if patientID == 0 {
+        patientID, _ = strconv.Atoi(r.URL.Query().Get("patient_id"))
+    }
+    from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+
+    administrations, err := mc.MedicationGateway.GetAdministrations(patientID, from, to, limit, (page-1)*limit)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch charted doses")
+        return
+    }
+    totalEntries, err := mc.MedicationGateway.CountAdministrations(patientID, from, to)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count charted doses")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          administrations,
+        "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+        "page":          page,
+        "total_entries": totalEntries,
+    })
+}
+
+// Handle POST requests for medications. Without an identifier the body is a new order, prescribed by the
+// nephrologist placing it unless a prescriber_id is given; identifier=doses charts a dose at a session and
+// identifier=stop stops the order with the given id.
+func (mc *MedicationController) CreateMedication(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "doses":
+        mc.ChartDose(w, r)
+        return
+    case "stop":
+        mc.StopOrder(w, r)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var order models.MedicationOrder
+    if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    // A nephrologist's account ID is their staff ID
+    if order.PrescriberID == 0 && utils.GetRole(r) == utils.RoleNephrologist {
+        order.PrescriberID = utils.GetAccountID(r)
+    }
+    if err := mc.MedicationGateway.CreateOrder(&order, utils.GetAccountID(r)); err != nil {
+        medicationError(w, err, "Failed to create medication order")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(order)
+}
+
+// Chart a dose, e.g. POST /medications?identifier=doses with
+// {"appointment_id": 42, "order_id": 5, "outcome": "held", "reason": "Hb 12.4, above target"}
+func (mc *MedicationController) ChartDose(w http.ResponseWriter, r *http.Request) {
+    var administration models.MedicationAdministration
+    if err := json.NewDecoder(r.Body).Decode(&administration); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := mc.MedicationGateway.ChartDose(&administration, utils.GetAccountID(r)); err != nil {
+        medicationError(w, err, "Failed to chart dose")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(administration)
+}
+
+// Stop an order, e.g. POST /medications?identifier=stop&id=5 with {"reason": "ferritin above 800"}
+func (mc *MedicationController) StopOrder(w http.ResponseWriter, r *http.Request) {
+    orderID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing medication order ID")
+        return
+    }
+    var body struct {
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    order, err := mc.MedicationGateway.StopOrder(orderID, body.Reason, utils.GetAccountID(r))
+    if err != nil {
+        medicationError(w, err, "Failed to stop medication order")
+        return
+    }
+    json.NewEncoder(w).Encode(order)
+}
+
+func medicationError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidMedication):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrNoActiveOrder):
+        utils.ErrorHandler(w, http.StatusConflict, err, message)
+    case errors.Is(err, gateways.ErrMedicationNotFound), errors.Is(err, gateways.ErrAppointmentNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+    }
+}
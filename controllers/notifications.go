@@ -28,15 +28,16 @@ func (nc *NotificationController) GetNotifications(w http.ResponseWriter, r *htt
     identifier := r.URL.Query().Get("identifier")
 
     offset := (page - 1) * limit // Calculate the actual offset
+    patientID := utils.PatientScope(r) // Patients only see their own notifications
 
     query := r.URL.Query().Get("query")
     var notifications []models.Notification
     var err error
 
     if identifier == "search" {
-        notifications, err = nc.NotificationGateway.SearchNotifications(query, limit, offset)
+        notifications, err = nc.NotificationGateway.SearchNotifications(query, patientID, limit, offset)
     } else {
-        notifications, err = nc.NotificationGateway.GetNotifications(limit, offset)
+        notifications, err = nc.NotificationGateway.GetNotifications(patientID, limit, offset)
     }
 
     if err != nil {
@@ -44,7 +45,7 @@ func (nc *NotificationController) GetNotifications(w http.ResponseWriter, r *htt
         return
     }
 
-    totalEntries, err := nc.NotificationGateway.GetTotalNotificationCount(query)
+    totalEntries, err := nc.NotificationGateway.GetTotalNotificationCount(query, patientID)
     if err != nil {
         utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch total notifications count")
         return
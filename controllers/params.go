@@ -0,0 +1,86 @@
+package controllers
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/gorilla/mux"
+)
+
+// idParam reads a numeric ID from the route variables, falling back to the query string
+func idParam(r *http.Request, name string) (int, error) {
+    value := mux.Vars(r)[name]
+    if value == "" {
+        value = r.URL.Query().Get(name)
+    }
+    if value == "" {
+        return 0, fmt.Errorf("missing %s", name)
+    }
+    return strconv.Atoi(value)
+}
+
+// appointmentFilter reads the filter and sort parameters of an appointment listing:
+// from and to (a clinic date, to inclusive, or an RFC 3339 timestamp), upcoming=true to start from now,
+// patient_id, staff_id, status (comma separated), station, shift and sort (e.g. date, -date, status, staff).
+func appointmentFilter(r *http.Request) (gateways.AppointmentFilter, error) {
+    query := r.URL.Query()
+    filter := gateways.AppointmentFilter{
+        Shift: query.Get("shift"),
+        Sort:  query.Get("sort"),
+    }
+
+    var err error
+    if filter.From, err = timeParam(query.Get("from"), false); err != nil {
+        return filter, err
+    }
+    if filter.To, err = timeParam(query.Get("to"), true); err != nil {
+        return filter, err
+    }
+    if query.Get("upcoming") == "true" && filter.From.Before(time.Now()) {
+        filter.From = time.Now()
+    }
+
+    for name, target := range map[string]*int{
+        "patient_id": &filter.PatientID,
+        "staff_id":   &filter.StaffID,
+        "station":    &filter.StationID,
+    } {
+        if value := query.Get(name); value != "" {
+            if *target, err = strconv.Atoi(value); err != nil {
+                return filter, fmt.Errorf("invalid %s %q", name, value)
+            }
+        }
+    }
+
+    if status := query.Get("status"); status != "" {
+        filter.Statuses = strings.Split(status, ",")
+    }
+    if _, ok := models.ShiftStartTimes[filter.Shift]; filter.Shift != "" && !ok {
+        return filter, fmt.Errorf("invalid shift %q", filter.Shift)
+    }
+    return filter, nil
+}
+
+// timeParam parses a clinic date or an RFC 3339 timestamp. A date used as the end of a range
+// covers the whole day, so the returned time is the start of the next day.
+func timeParam(value string, endOfRange bool) (time.Time, error) {
+    if value == "" {
+        return time.Time{}, nil
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    t, err := models.ParseLocal(value, "00:00")
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or an RFC 3339 timestamp", value)
+    }
+    if endOfRange {
+        t = t.AddDate(0, 0, 1)
+    }
+    return t, nil
+}
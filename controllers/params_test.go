@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/gateways"
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"github.com/gorilla/mux"
+)
+
+func TestIDParam(t *testing.T) {
+    r := httptest.NewRequest(http.MethodGet, "/appointments?id=12", nil)
+    if id, err := idParam(r, "id"); err != nil || id != 12 {
+        t.Errorf("idParam() from the query = %d, %v, want 12", id, err)
+    }
+
+    r = mux.SetURLVars(r, map[string]string{"id": "15"})
+    if id, err := idParam(r, "id"); err != nil || id != 15 {
+        t.Errorf("idParam() with a route variable = %d, %v, want the route's 15", id, err)
+    }
+
+    for _, url := range []string{"/appointments", "/appointments?id=twelve"} {
+        if _, err := idParam(httptest.NewRequest(http.MethodGet, url, nil), "id"); err == nil {
+            t.Errorf("idParam(%s) accepted a missing or invalid ID", url)
+        }
+    }
+}
+
+func TestAppointmentFilter(t *testing.T) {
+    defer func(location *time.Location) { models.ClinicLocation = location }(models.ClinicLocation)
+    models.ClinicLocation = time.FixedZone("EAT", 3*60*60)
+    monday := time.Date(2024, 3, 4, 0, 0, 0, 0, models.ClinicLocation)
+
+    tests := []struct {
+        name    string
+        query   string
+        want    gateways.AppointmentFilter
+        wantErr bool
+    }{
+        {"no parameters", "", gateways.AppointmentFilter{}, false},
+        {"date range includes the last day", "from=2024-03-04&to=2024-03-10", gateways.AppointmentFilter{From: monday, To: monday.AddDate(0, 0, 7)}, false},
+        {"timestamps are taken as given", "from=2024-03-04T06:00:00Z", gateways.AppointmentFilter{From: time.Date(2024, 3, 4, 6, 0, 0, 0, time.UTC)}, false},
+        {
+            name:  "people, statuses and sort",
+            query: "patient_id=7&staff_id=3&station=4&status=confirmed,checked-in&shift=evening&sort=-date",
+            want:  gateways.AppointmentFilter{PatientID: 7, StaffID: 3, StationID: 4, Statuses: []string{"confirmed", "checked-in"}, Shift: "evening", Sort: "-date"},
+        },
+        {"unreadable date", "from=04/03/2024", gateways.AppointmentFilter{}, true},
+        {"unreadable ID", "staff_id=three", gateways.AppointmentFilter{}, true},
+        {"unknown shift", "shift=night", gateways.AppointmentFilter{}, true},
+    }
+
+    for _, tt := range tests {
+        got, err := appointmentFilter(httptest.NewRequest(http.MethodGet, "/appointments?"+tt.query, nil))
+        if (err != nil) != tt.wantErr {
+            t.Errorf("%s: appointmentFilter() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+            continue
+        }
+        if err == nil && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: appointmentFilter() = %+v, want %+v", tt.name, got, tt.want)
+        }
+    }
+
+    t.Run("upcoming starts no earlier than now", func(t *testing.T) {
+        before := time.Now()
+        got, err := appointmentFilter(httptest.NewRequest(http.MethodGet, "/appointments?upcoming=true&from=2024-03-04", nil))
+        if err != nil || got.From.Before(before) {
+            t.Errorf("appointmentFilter() from = %v, %v, want no earlier than %v", got.From, err, before)
+        }
+    })
+}
@@ -3,25 +3,59 @@ package controllers
 import (
     "archive/zip"
     "encoding/json"
+    "errors"
     "io"
+    "mime/multipart"
     "net/http"
     "os"
     "path/filepath"
     "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
     "github.com/BrianKasina/dialysis-scheduling/utils"
     "go.mongodb.org/mongo-driver/mongo"
 )
 
 type PatientHistoryController struct {
-    PatientHistoryGateway *gateways.PatientHistoryGateway
+    PatientHistoryGateway  *gateways.PatientHistoryGateway
+    PatientGateway         *gateways.PatientGateway
+    TreatmentRecordGateway *gateways.TreatmentRecordGateway
+    LabResultGateway       *gateways.LabResultGateway
 }
 
 func NewPatientHistoryController(db *mongo.Database) *PatientHistoryController {
     return &PatientHistoryController{
-        PatientHistoryGateway: gateways.NewPatientHistoryGateway(db),
+        PatientHistoryGateway:  gateways.NewPatientHistoryGateway(db),
+        PatientGateway:         gateways.NewPatientGateway(db),
+        TreatmentRecordGateway: gateways.NewTreatmentRecordGateway(db),
+        LabResultGateway:       gateways.NewLabResultGateway(db),
     }
 }
 
+// patient resolves whose history a request refers to: patients always get their own, whatever they pass,
+// and staff name the patient with patient_id or, when the name is unambiguous, patient_name
+func (phc *PatientHistoryController) patient(r *http.Request) (*models.Patient, error) {
+    if patientID := utils.PatientScope(r); patientID != 0 {
+        return phc.PatientGateway.GetPatientByID(patientID)
+    }
+    if r.URL.Query().Get("patient_id") != "" {
+        patientID, err := idParam(r, "patient_id")
+        if err != nil {
+            return nil, err
+        }
+        return phc.PatientGateway.GetPatientByID(patientID)
+    }
+    return phc.PatientGateway.GetPatientByName(r.URL.Query().Get("patient_name"))
+}
+
+// patientError reports a patient that could not be resolved
+func patientError(w http.ResponseWriter, err error) {
+    if errors.Is(err, gateways.ErrAmbiguousPatientName) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, err.Error())
+        return
+    }
+    utils.ErrorHandler(w, http.StatusNotFound, err, "Patient not found")
+}
+
 func (phc *PatientHistoryController) HandlePatientHistory(w http.ResponseWriter, r *http.Request) {
     operation := r.URL.Query().Get("identifier")
 
@@ -30,6 +64,10 @@ func (phc *PatientHistoryController) HandlePatientHistory(w http.ResponseWriter,
         phc.ListPatientHistory(w, r)
     case "download":
         phc.DownloadPatientHistoryZip(w, r)
+    case "treatments":
+        phc.ListTreatmentRecords(w, r)
+    case "labs":
+        phc.ListLabResults(w, r)
     default:
         utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid operation")
     }
@@ -46,39 +84,11 @@ func (phc *PatientHistoryController) UploadPatientHistory(w http.ResponseWriter,
         return
     }
 
-    // Ensure patient-specific folder exists
-    patientFolder := filepath.Join("patients-history-folder", patientName)
-    os.MkdirAll(patientFolder, os.ModePerm)
-
-    // Prepare a slice to hold the file names
-    var fileNames []string
-
-    // Loop through files and save them in the patient's folder
-    files := r.MultipartForm.File["files"]
-    for _, fileHeader := range files {
-        file, err := fileHeader.Open()
-        if err != nil {
-            utils.ErrorHandler(w, http.StatusBadRequest, err, "Error reading file")
-            return
-        }
-        defer file.Close()
-
-        filePath := filepath.Join(patientFolder, fileHeader.Filename)
-        f, err := os.Create(filePath)
-        if err != nil {
-            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to save file")
-            return
-        }
-        defer f.Close()
-
-        _, err = io.Copy(f, file)
-        if err != nil {
-            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error saving file content")
-            return
-        }
-
-        // Append the file name to the list
-        fileNames = append(fileNames, fileHeader.Filename)
+    // Save the files in the patient-specific folder
+    fileNames, err := saveHistoryFiles(patientName, r.MultipartForm.File["files"])
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to save file")
+        return
     }
 
     // Update the patient's history in the database with the file names
@@ -92,11 +102,49 @@ func (phc *PatientHistoryController) UploadPatientHistory(w http.ResponseWriter,
     json.NewEncoder(w).Encode(map[string]string{"message": "Files uploaded successfully"})
 }
 
+// saveHistoryFiles copies uploaded files into a folder under patients-history-folder, creating it if needed,
+// and returns the names of the files saved
+func saveHistoryFiles(folder string, files []*multipart.FileHeader) ([]string, error) {
+    patientFolder := filepath.Join("patients-history-folder", folder)
+    if err := os.MkdirAll(patientFolder, os.ModePerm); err != nil {
+        return nil, err
+    }
+
+    fileNames := []string{}
+    for _, fileHeader := range files {
+        if err := saveHistoryFile(patientFolder, fileHeader); err != nil {
+            return fileNames, err
+        }
+        fileNames = append(fileNames, fileHeader.Filename)
+    }
+    return fileNames, nil
+}
+
+func saveHistoryFile(folder string, fileHeader *multipart.FileHeader) error {
+    file, err := fileHeader.Open()
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    f, err := os.Create(filepath.Join(folder, filepath.Base(fileHeader.Filename)))
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    _, err = io.Copy(f, file)
+    return err
+}
 
 // List contents of a patient's folder
 func (phc *PatientHistoryController) ListPatientHistory(w http.ResponseWriter, r *http.Request) {
-    patientName := r.URL.Query().Get("patient_name")
-    patientFolder := filepath.Join("patients-history-folder", patientName)
+    patient, err := phc.patient(r)
+    if err != nil {
+        patientError(w, err)
+        return
+    }
+    patientFolder := filepath.Join("patients-history-folder", patient.Name)
 
     files, err := os.ReadDir(patientFolder)
     if err != nil {
@@ -114,19 +162,79 @@ func (phc *PatientHistoryController) ListPatientHistory(w http.ResponseWriter, r
     json.NewEncoder(w).Encode(fileNames)
 }
 
-// Download patient folder as a zip file
+// List the patient's dialysis treatment records, newest first
+func (phc *PatientHistoryController) ListTreatmentRecords(w http.ResponseWriter, r *http.Request) {
+    patient, err := phc.patient(r)
+    if err != nil {
+        patientError(w, err)
+        return
+    }
+
+    records, err := phc.TreatmentRecordGateway.GetPatientRecords(patient.ID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error reading treatment records")
+        return
+    }
+    json.NewEncoder(w).Encode(records)
+}
+
+// List the patient's lab results, newest first
+func (phc *PatientHistoryController) ListLabResults(w http.ResponseWriter, r *http.Request) {
+    patient, err := phc.patient(r)
+    if err != nil {
+        patientError(w, err)
+        return
+    }
+
+    results, err := phc.LabResultGateway.GetPatientResults(patient.ID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error reading lab results")
+        return
+    }
+    json.NewEncoder(w).Encode(results)
+}
+
+// Download patient folder as a zip file, with the treatment records and lab results alongside the files
 func (phc *PatientHistoryController) DownloadPatientHistoryZip(w http.ResponseWriter, r *http.Request) {
-    patientName := r.URL.Query().Get("patient_name")
-    patientFolder := filepath.Join("patients-history-folder", patientName)
+    patient, err := phc.patient(r)
+    if err != nil {
+        patientError(w, err)
+        return
+    }
+    patientFolder := filepath.Join("patients-history-folder", patient.Name)
 
-    zipFileName := patientName + ".zip"
+    zipFileName := patient.Name + ".zip"
     w.Header().Set("Content-Disposition", "attachment; filename="+zipFileName)
     w.Header().Set("Content-Type", "application/zip")
 
+    records, err := phc.TreatmentRecordGateway.GetPatientRecords(patient.ID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error reading treatment records")
+        return
+    }
+    labResults, err := phc.LabResultGateway.GetPatientResults(patient.ID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error reading lab results")
+        return
+    }
+
     zipWriter := zip.NewWriter(w)
     defer zipWriter.Close()
 
-    err := filepath.Walk(patientFolder, func(path string, info os.FileInfo, err error) error {
+    if len(records) > 0 {
+        if err := writeZipJSON(zipWriter, "treatment-records.json", records); err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error creating zip file")
+            return
+        }
+    }
+    if len(labResults) > 0 {
+        if err := writeZipJSON(zipWriter, "lab-results.json", labResults); err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Error creating zip file")
+            return
+        }
+    }
+
+    err = filepath.Walk(patientFolder, func(path string, info os.FileInfo, err error) error {
         if err != nil {
             return err
         }
@@ -154,3 +262,14 @@ func (phc *PatientHistoryController) DownloadPatientHistoryZip(w http.ResponseWr
         return
     }
 }
+
+// writeZipJSON adds a file holding v as indented JSON to a zip
+func writeZipJSON(zipWriter *zip.Writer, name string, v interface{}) error {
+    f, err := zipWriter.Create(name)
+    if err != nil {
+        return err
+    }
+    encoder := json.NewEncoder(f)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(v)
+}
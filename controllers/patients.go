@@ -2,6 +2,7 @@ package controllers
 
 import (
     "encoding/json"
+    "errors"
     "net/http"
     "math"
     "github.com/BrianKasina/dialysis-scheduling/gateways"
@@ -85,6 +86,14 @@ func (pc *PatientController) CreatePatient(w http.ResponseWriter, r *http.Reques
 
     // Create patient in DB
     err = pc.PatientGateway.CreatePatient(&patient)
+    if errors.Is(err, gateways.ErrInvalidPatient) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to create patient")
+        return
+    }
+    if errors.Is(err, gateways.ErrPatientIDTaken) {
+        utils.ErrorHandler(w, http.StatusConflict, err, "Failed to create patient")
+        return
+    }
     if err != nil {
         utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to create patient")
         return
@@ -105,6 +114,10 @@ func (pc *PatientController) UpdatePatient(w http.ResponseWriter, r *http.Reques
 
     // Update patient in DB
     err = pc.PatientGateway.UpdatePatient(&patient)
+    if errors.Is(err, gateways.ErrInvalidPatient) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to update patient")
+        return
+    }
     if err != nil {
         utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to update patient")
         return
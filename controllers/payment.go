@@ -13,16 +13,23 @@ import (
 
 type PaymentDetailsController struct {
     PaymentDetailsGateway *gateways.PaymentDetailsGateway
+    PatientGateway        *gateways.PatientGateway
 }
 
 func NewPaymentDetailsController(db *mongo.Database) *PaymentDetailsController {
     return &PaymentDetailsController{
         PaymentDetailsGateway: gateways.NewPaymentDetailsGateway(db),
+        PatientGateway:        gateways.NewPatientGateway(db),
     }
 }
 
 // Handle GET requests for payment details with pagination
 func (pc *PaymentDetailsController) GetPaymentDetails(w http.ResponseWriter, r *http.Request) {
+    if patientID := utils.PatientScope(r); patientID != 0 {
+        pc.getOwnPaymentDetails(w, patientID)
+        return
+    }
+
     limit, _ := r.Context().Value("limit").(int) // Retrieve limit from context
     page, _ := r.Context().Value("page").(int)   // Retrieve page from context
     identifier := r.URL.Query().Get("identifier")
@@ -112,4 +119,30 @@ func (pc *PaymentDetailsController) DeletePaymentDetail(w http.ResponseWriter, r
         return
     }
     json.NewEncoder(w).Encode(map[string]string{"message": "Payment detail deleted successfully"})
-}
\ No newline at end of file
+}
+
+// getOwnPaymentDetails returns only the payment details linked to the calling patient
+func (pc *PaymentDetailsController) getOwnPaymentDetails(w http.ResponseWriter, patientID int) {
+    patient, err := pc.PatientGateway.GetPatientByID(patientID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to fetch payment details")
+        return
+    }
+
+    paymentDetails := []models.PaymentDetails{}
+    if patient.PaymentDetailsID != 0 {
+        paymentDetail, err := pc.PaymentDetailsGateway.GetPaymentDetailByID(patient.PaymentDetailsID)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to fetch payment details")
+            return
+        }
+        paymentDetails = append(paymentDetails, *paymentDetail)
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          paymentDetails,
+        "total_pages":   1,
+        "page":          1,
+        "total_entries": len(paymentDetails),
+    })
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+    "encoding/json"
+    "html/template"
+    "net/http"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// runSheetRefreshSeconds is how often the printable run-sheet reloads, so check-ins show up during the day
+const runSheetRefreshSeconds = 60
+
+var runSheetTemplate = template.Must(template.New("run-sheet").Funcs(template.FuncMap{
+    "clock": func(t *time.Time) string {
+        if t == nil {
+            return ""
+        }
+        return models.LocalClock(*t)
+    },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Run-sheet {{.Sheet.Date}}</title>
+<style>
+body { font-family: sans-serif; font-size: 12px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 16px; page-break-inside: avoid; }
+th, td { border: 1px solid #444; padding: 4px 6px; text-align: left; }
+th { background: #eee; }
+.checked-in, .in-progress { background: #e3f4e3; }
+.no-show { background: #f8e0e0; }
+</style>
+</head>
+<body>
+<h1>Dialysis run-sheet {{.Sheet.Date}}</h1>
+<p>Generated {{clock .Generated}}</p>
+{{range .Sheet.Shifts}}
+<h2>{{.Shift}} ({{.StartTime}})</h2>
+<table>
+<tr><th>Chair</th><th>Room</th><th>Time</th><th>Patient</th><th>Nurse</th><th>Status</th><th>Checked in</th></tr>
+{{range .Rows}}
+<tr class="{{.Status}}">
+<td>{{if .StationID}}{{.StationID}}{{if .Isolation}} ({{.IsolationFor}}){{end}}{{else}}unassigned{{end}}</td>
+<td>{{.Room}}</td>
+<td>{{.Time}}</td>
+<td>{{.PatientName}}</td>
+<td>{{.NurseName}}</td>
+<td>{{.Status}}</td>
+<td>{{clock .CheckedInAt}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// RunSheetController serves the daily run-sheet of the dialysis floor
+type RunSheetController struct {
+    RunSheetGateway *gateways.RunSheetGateway
+}
+
+func NewRunSheetController(db *mongo.Database) *RunSheetController {
+    return &RunSheetController{
+        RunSheetGateway: gateways.NewRunSheetGateway(db),
+    }
+}
+
+// Handle GET requests for the run-sheet of the date in the query, today by default.
+// format=html returns a printable page that refreshes itself, otherwise JSON is returned.
+func (rc *RunSheetController) GetRunSheet(w http.ResponseWriter, r *http.Request) {
+    date := r.URL.Query().Get("date")
+    if date == "" {
+        date = models.LocalDate(time.Now())
+    }
+    if _, err := time.Parse(models.DateLayout, date); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid date, expected YYYY-MM-DD")
+        return
+    }
+
+    sheet, err := rc.RunSheetGateway.GetRunSheet(date)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to build run-sheet")
+        return
+    }
+
+    if r.URL.Query().Get("format") != "html" {
+        json.NewEncoder(w).Encode(sheet)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    runSheetTemplate.Execute(w, map[string]interface{}{
+        "Sheet":     sheet,
+        "Generated": &sheet.GeneratedAt,
+        "Refresh":   runSheetRefreshSeconds,
+    })
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetRunSheet(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("invalid date", func(mt *mtest.T) {
+        w := httptest.NewRecorder()
+        NewRunSheetController(mt.DB).GetRunSheet(w, httptest.NewRequest(http.MethodGet, "/run_sheet?date=04-03-2024", nil))
+        if w.Code != http.StatusBadRequest {
+            mt.Errorf("status = %d, want 400", w.Code)
+        }
+    })
+
+    mt.Run("printable page", func(mt *mtest.T) {
+        mt.AddMockResponses(found("stations"), found("dialysis_appointments"))
+
+        w := httptest.NewRecorder()
+        NewRunSheetController(mt.DB).GetRunSheet(w, httptest.NewRequest(http.MethodGet, "/run_sheet?date=2024-03-04&format=html", nil))
+        if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+            mt.Fatalf("status = %d, content type %q, want a 200 HTML page", w.Code, w.Header().Get("Content-Type"))
+        }
+        if body := w.Body.String(); !strings.Contains(body, "Dialysis run-sheet 2024-03-04") || !strings.Contains(body, `http-equiv="refresh"`) {
+            mt.Errorf("page does not show the date or refresh itself: %s", body)
+        }
+    })
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "time"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// StationController manages dialysis chairs and their occupancy
+type StationController struct {
+    StationGateway *gateways.StationGateway
+}
+
+func NewStationController(db *mongo.Database) *StationController {
+    return &StationController{
+        StationGateway: gateways.NewStationGateway(db),
+    }
+}
+
+// Handle GET requests for stations, identifier=occupancy shows bookings per shift for a date and
+// identifier=isolation_violations lists sessions booked on a station of the wrong isolation group
+func (sc *StationController) GetStations(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "occupancy":
+        sc.GetOccupancy(w, r)
+        return
+    case "isolation_violations":
+        sc.GetIsolationViolations(w, r)
+        return
+    }
+
+    limit, _ := r.Context().Value("limit").(int) // Retrieve limit from context
+    page, _ := r.Context().Value("page").(int)   // Retrieve page from context
+
+    offset := (page - 1) * limit // Calculate the actual offset
+
+    stations, err := sc.StationGateway.GetStations(limit, offset)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch stations")
+        return
+    }
+
+    totalEntries, err := sc.StationGateway.GetTotalStationCount()
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch total stations count")
+        return
+    }
+
+    totalPages := int(math.Ceil(float64(totalEntries) / float64(limit)))
+
+    response := map[string]interface{}{
+        "data":          stations,
+        "total_pages":   totalPages,
+        "page":          page,
+        "total_entries": totalEntries,
+    }
+
+    json.NewEncoder(w).Encode(response)
+}
+
+// Show station occupancy per shift for the date in the query, today by default
+func (sc *StationController) GetOccupancy(w http.ResponseWriter, r *http.Request) {
+    date := r.URL.Query().Get("date")
+    if date == "" {
+        date = models.LocalDate(time.Now())
+    }
+    if _, err := time.Parse("2006-01-02", date); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid date, expected YYYY-MM-DD")
+        return
+    }
+
+    occupancy, err := sc.StationGateway.GetOccupancy(date)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch station occupancy")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "date":   date,
+        "shifts": occupancy,
+    })
+}
+
+// List the dialysis sessions whose station breaks the isolation rules, from today onwards unless from is given
+func (sc *StationController) GetIsolationViolations(w http.ResponseWriter, r *http.Request) {
+    from := r.URL.Query().Get("from")
+    if from == "" {
+        from = models.LocalDate(time.Now())
+    }
+    to := r.URL.Query().Get("to")
+    for _, date := range []string{from, to} {
+        if _, err := time.Parse(models.DateLayout, date); date != "" && err != nil {
+            utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid date, expected YYYY-MM-DD")
+            return
+        }
+    }
+
+    violations, err := sc.StationGateway.GetIsolationViolations(from, to)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to check isolation")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "from":       from,
+        "to":         to,
+        "violations": violations,
+    })
+}
+
+// Handle POST requests for stations
+func (sc *StationController) CreateStation(w http.ResponseWriter, r *http.Request) {
+    var station models.Station
+    if err := json.NewDecoder(r.Body).Decode(&station); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    if err := sc.StationGateway.CreateStation(&station); errors.Is(err, gateways.ErrInvalidStation) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to create station")
+        return
+    } else if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to create station")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(station)
+}
+
+// Handle PUT requests for stations
+func (sc *StationController) UpdateStation(w http.ResponseWriter, r *http.Request) {
+    var station models.Station
+    if err := json.NewDecoder(r.Body).Decode(&station); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    if err := sc.StationGateway.UpdateStation(&station); errors.Is(err, gateways.ErrInvalidStation) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to update station")
+        return
+    } else if err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to update station")
+        return
+    }
+    json.NewEncoder(w).Encode(station)
+}
+
+// Handle DELETE requests for stations, refused while sessions or schedules are still booked on the station
+func (sc *StationController) DeleteStation(w http.ResponseWriter, r *http.Request) {
+    stationID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing station ID")
+        return
+    }
+
+    if err := sc.StationGateway.DeleteStation(stationID); errors.Is(err, gateways.ErrStationInUse) {
+        utils.ErrorHandler(w, http.StatusConflict, err, "Failed to delete station")
+        return
+    } else if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete station")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Station deleted successfully"})
+}
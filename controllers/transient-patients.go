@@ -0,0 +1,210 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// TransientPatientController manages patients visiting from other centres
+type TransientPatientController struct {
+    TransientGateway      *gateways.TransientPatientGateway
+    PatientHistoryGateway *gateways.PatientHistoryGateway
+}
+
+func NewTransientPatientController(db *mongo.Database) *TransientPatientController {
+    return &TransientPatientController{
+        TransientGateway:      gateways.NewTransientPatientGateway(db),
+        PatientHistoryGateway: gateways.NewPatientHistoryGateway(db),
+    }
+}
+
+// Handle GET requests for visiting patients. With an id the one patient is returned, identifier=spare lists
+// the spare chairs on date, otherwise visiting patients are listed, only those visiting on the date in on when given.
+func (tc *TransientPatientController) GetTransients(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("identifier") == "spare" {
+        date := r.URL.Query().Get("date")
+        if date == "" {
+            utils.ErrorHandler(w, http.StatusBadRequest, nil, "Missing date")
+            return
+        }
+        spare, err := tc.TransientGateway.GetSpareChairs(date)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch spare chairs")
+            return
+        }
+        json.NewEncoder(w).Encode(spare)
+        return
+    }
+
+    if patientID, err := idParam(r, "id"); err == nil {
+        transient, err := tc.TransientGateway.GetTransient(patientID)
+        if err != nil {
+            utils.ErrorHandler(w, http.StatusNotFound, err, "Visiting patient not found")
+            return
+        }
+        json.NewEncoder(w).Encode(transient)
+        return
+    }
+
+    limit := r.Context().Value("limit").(int)
+    page := r.Context().Value("page").(int)
+    on := r.URL.Query().Get("on")
+
+    transients, err := tc.TransientGateway.GetTransients(on, limit, (page-1)*limit)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch visiting patients")
+        return
+    }
+    totalEntries, err := tc.TransientGateway.CountTransients(on)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count visiting patients")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          transients,
+        "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+        "page":          page,
+        "total_entries": totalEntries,
+    })
+}
+
+// Handle POST requests for visiting patients. Without an identifier the body is a new visiting patient;
+// identifier=referral uploads referral documents and identifier=book books a spare chair, both for the given id.
+func (tc *TransientPatientController) CreateTransient(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "referral":
+        tc.UploadReferral(w, r)
+        return
+    case "book":
+        tc.Book(w, r)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var transient models.TransientPatient
+    if err := json.NewDecoder(r.Body).Decode(&transient); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := tc.TransientGateway.CreateTransient(&transient); err != nil {
+        transientError(w, err, "Failed to create visiting patient")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(transient)
+}
+
+// Upload referral documents for a visiting patient. They are stored like patient history files, in the
+// patient's referral folder, so they can be listed and downloaded through patient_history as well.
+func (tc *TransientPatientController) UploadReferral(w http.ResponseWriter, r *http.Request) {
+    patientID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+        return
+    }
+    transient, err := tc.TransientGateway.GetTransient(patientID)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Visiting patient not found")
+        return
+    }
+
+    if err := r.ParseMultipartForm(10 << 20); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Error parsing form data")
+        return
+    }
+    fileNames, err := saveHistoryFiles(transient.ReferralFolder, r.MultipartForm.File["files"])
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to save file")
+        return
+    }
+
+    if err := tc.TransientGateway.AddReferralFiles(patientID, fileNames); err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to record referral files")
+        return
+    }
+    if transient, err = tc.TransientGateway.GetTransient(patientID); err == nil {
+        err = tc.PatientHistoryGateway.CreateOrUpdatePatientHistory(transient.ReferralFolder, transient.ReferralFiles)
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to update patient history")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(transient)
+}
+
+// Book a spare chair for a visiting patient, e.g. POST /transient_patients?identifier=book&id=812
+// with {"date": "2024-08-14", "shift": "afternoon"}
+func (tc *TransientPatientController) Book(w http.ResponseWriter, r *http.Request) {
+    patientID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+        return
+    }
+
+    var booking models.TransientBooking
+    if err := json.NewDecoder(r.Body).Decode(&booking); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+
+    appointment, err := tc.TransientGateway.Book(patientID, booking, statusChange(r, models.StatusConfirmed, "visiting patient"))
+    if err != nil {
+        transientError(w, err, "Failed to book a spare chair")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(appointment)
+}
+
+// Handle PUT requests to update a visiting patient's details, visit and prescription
+func (tc *TransientPatientController) UpdateTransient(w http.ResponseWriter, r *http.Request) {
+    var transient models.TransientPatient
+    if err := json.NewDecoder(r.Body).Decode(&transient); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := tc.TransientGateway.UpdateTransient(&transient); err != nil {
+        transientError(w, err, "Failed to update visiting patient")
+        return
+    }
+    json.NewEncoder(w).Encode(transient)
+}
+
+// Handle DELETE requests for visiting patients
+func (tc *TransientPatientController) DeleteTransient(w http.ResponseWriter, r *http.Request) {
+    patientID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing patient ID")
+        return
+    }
+    if err := tc.TransientGateway.DeleteTransient(patientID); err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete visiting patient")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Visiting patient deleted successfully"})
+}
+
+// transientError reports an error about a visiting patient, booking errors are reported as for any appointment
+func transientError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidTransient):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrOutsideVisit), errors.Is(err, gateways.ErrNoSpareChair):
+        utils.ErrorHandler(w, http.StatusConflict, err, message)
+    default:
+        bookingError(w, err, message)
+    }
+}
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// TreatmentRecordController manages the flowsheets kept for dialysis sessions
+type TreatmentRecordController struct {
+    TreatmentRecordGateway *gateways.TreatmentRecordGateway
+    AdequacyGateway        *gateways.AdequacyGateway
+    FluidGateway           *gateways.FluidGateway
+}
+
+func NewTreatmentRecordController(db *mongo.Database) *TreatmentRecordController {
+    return &TreatmentRecordController{
+        TreatmentRecordGateway: gateways.NewTreatmentRecordGateway(db),
+        AdequacyGateway:        gateways.NewAdequacyGateway(db),
+        FluidGateway:           gateways.NewFluidGateway(db),
+    }
+}
+
+// Handle GET requests for treatment records. With an appointment_id the session's record is returned, otherwise
+// records are listed newest first, narrowed by patient_id, from and to. Patients only ever see their own.
+func (tc *TreatmentRecordController) GetRecords(w http.ResponseWriter, r *http.Request) {
+    patientID := utils.PatientScope(r)
+
+    if appointmentID, err := idParam(r, "appointment_id"); err == nil {
+        record, err := tc.TreatmentRecordGateway.GetRecord(appointmentID, patientID)
+        if err != nil {
+            treatmentRecordError(w, err, "Failed to fetch treatment record")
+            return
+        }
+        json.NewEncoder(w).Encode(record)
+        return
+    }
+
+    limit := r.Context().Value("limit").(int)
+    page := r.Context().Value("page").(int)
+    if patientID == 0 {
+        patientID, _ = strconv.Atoi(r.URL.Query().Get("patient_id"))
+    }
+    from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+
+    records, err := tc.TreatmentRecordGateway.GetRecords(patientID, from, to, limit, (page-1)*limit)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch treatment records")
+        return
+    }
+    totalEntries, err := tc.TreatmentRecordGateway.CountRecords(patientID, from, to)
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to count treatment records")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data":          records,
+        "total_pages":   int(math.Ceil(float64(totalEntries) / float64(limit))),
+        "page":          page,
+        "total_entries": totalEntries,
+    })
+}
+
+// Handle POST requests for treatment records. Without an identifier the body opens the record of the session in
+// its appointment_id; identifier=observation and identifier=complication add readings or a complication to the
+// record of the session in the appointment_id query parameter while it runs.
+func (tc *TreatmentRecordController) CreateRecord(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "observation":
+        tc.AddObservation(w, r)
+        return
+    case "complication":
+        tc.AddComplication(w, r)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var record models.TreatmentRecord
+    if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := tc.TreatmentRecordGateway.CreateRecord(&record, utils.GetAccountID(r)); err != nil {
+        treatmentRecordError(w, err, "Failed to create treatment record")
+        return
+    }
+    tc.refreshAdequacy(r, &record)
+    tc.assessWeightGain(&record)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(record)
+}
+
+// Add a set of readings, e.g. POST /treatment_records?identifier=observation&appointment_id=42 with
+// {"systolic_bp": 128, "diastolic_bp": 76, "pulse": 80, "blood_flow_rate": 350, "dialysate_flow_rate": 500}
+func (tc *TreatmentRecordController) AddObservation(w http.ResponseWriter, r *http.Request) {
+    appointmentID, err := idParam(r, "appointment_id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing appointment ID")
+        return
+    }
+
+    var observation models.Observation
+    if err := json.NewDecoder(r.Body).Decode(&observation); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    record, err := tc.TreatmentRecordGateway.AddObservation(appointmentID, observation, utils.GetAccountID(r))
+    if err != nil {
+        treatmentRecordError(w, err, "Failed to add observation")
+        return
+    }
+    json.NewEncoder(w).Encode(record)
+}
+
+// Add a complication, e.g. POST /treatment_records?identifier=complication&appointment_id=42 with
+// {"kind": "hypotension", "description": "BP 82/50, dizzy", "action": "UF paused, 200 ml saline"}
+func (tc *TreatmentRecordController) AddComplication(w http.ResponseWriter, r *http.Request) {
+    appointmentID, err := idParam(r, "appointment_id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing appointment ID")
+        return
+    }
+
+    var complication models.Complication
+    if err := json.NewDecoder(r.Body).Decode(&complication); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    record, err := tc.TreatmentRecordGateway.AddComplication(appointmentID, complication, utils.GetAccountID(r))
+    if err != nil {
+        treatmentRecordError(w, err, "Failed to add complication")
+        return
+    }
+    json.NewEncoder(w).Encode(record)
+}
+
+// Handle PUT requests for treatment records, replacing the entries of the record of the session in appointment_id
+func (tc *TreatmentRecordController) UpdateRecord(w http.ResponseWriter, r *http.Request) {
+    var record models.TreatmentRecord
+    if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    if err := tc.TreatmentRecordGateway.UpdateRecord(&record, utils.GetAccountID(r)); err != nil {
+        treatmentRecordError(w, err, "Failed to update treatment record")
+        return
+    }
+    tc.refreshAdequacy(r, &record)
+    tc.assessWeightGain(&record)
+    json.NewEncoder(w).Encode(record)
+}
+
+// refreshAdequacy updates the patient's adequacy flag once a record with urea results is saved, which may
+// request a nephrologist review. The record is already saved, so a failure is only logged.
+func (tc *TreatmentRecordController) refreshAdequacy(r *http.Request, record *models.TreatmentRecord) {
+    if record.PreUrea == 0 && record.PostUrea == 0 {
+        return
+    }
+    if _, err := tc.AdequacyGateway.Refresh(record.PatientID, statusChange(r, models.StatusRequested, "")); err != nil {
+        log.Printf("failed to refresh adequacy of patient %d: %v", record.PatientID, err)
+    }
+}
+
+// assessWeightGain measures the weight the patient gained since their previous session, alerting the care team
+// and the patient when it is too much. As with adequacy, a failure does not undo the saved record.
+func (tc *TreatmentRecordController) assessWeightGain(record *models.TreatmentRecord) {
+    if record.PreWeightKg == 0 && record.PostWeightKg == 0 {
+        return
+    }
+    gain, err := tc.FluidGateway.Assess(record.AppointmentID)
+    if err != nil {
+        log.Printf("failed to assess weight gain of appointment %d: %v", record.AppointmentID, err)
+        return
+    }
+    record.WeightGain = gain
+}
+
+func treatmentRecordError(w http.ResponseWriter, err error, message string) {
+    switch {
+    case errors.Is(err, gateways.ErrInvalidRecord):
+        utils.ErrorHandler(w, http.StatusBadRequest, err, message)
+    case errors.Is(err, gateways.ErrRecordNotFound), errors.Is(err, gateways.ErrAppointmentNotFound):
+        utils.ErrorHandler(w, http.StatusNotFound, err, message)
+    default:
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, message)
+    }
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/BrianKasina/dialysis-scheduling/gateways"
+    "github.com/BrianKasina/dialysis-scheduling/models"
+    "github.com/BrianKasina/dialysis-scheduling/utils"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// WaitlistController manages the waitlist and the offers of freed slots made from it
+type WaitlistController struct {
+    WaitlistGateway *gateways.WaitlistGateway
+    PatientGateway  *gateways.PatientGateway
+}
+
+func NewWaitlistController(db *mongo.Database) *WaitlistController {
+    return &WaitlistController{
+        WaitlistGateway: gateways.NewWaitlistGateway(db),
+        PatientGateway:  gateways.NewPatientGateway(db),
+    }
+}
+
+// Handle GET requests for the waitlist, identifier=offers lists slot offers instead of entries.
+// Patients only see their own entries and offers.
+func (wc *WaitlistController) GetWaitlist(w http.ResponseWriter, r *http.Request) {
+    limit, _ := r.Context().Value("limit").(int)
+    page, _ := r.Context().Value("page").(int)
+    offset := (page - 1) * limit
+    patientID := utils.PatientScope(r)
+
+    var data interface{}
+    var err error
+    if r.URL.Query().Get("identifier") == "offers" {
+        data, err = wc.WaitlistGateway.GetOffers(patientID, limit, offset)
+    } else {
+        data, err = wc.WaitlistGateway.GetEntries(patientID, r.URL.Query().Get("status"), limit, offset)
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to fetch waitlist")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "data": data,
+        "page": page,
+    })
+}
+
+// Handle POST requests for the waitlist. Without an identifier the body is a new entry;
+// identifier=accept or identifier=decline answers the offer with the given id.
+func (wc *WaitlistController) CreateWaitlist(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("identifier") {
+    case "accept", "decline":
+        wc.AnswerOffer(w, r)
+        return
+    case "":
+    default:
+        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Invalid identifier")
+        return
+    }
+
+    var entry models.WaitlistEntry
+    if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
+        return
+    }
+    // Patients queue themselves at the default priority, staff decide who goes first
+    if patientID := utils.PatientScope(r); patientID != 0 {
+        entry.PatientID = patientID
+        entry.Priority = 0
+    }
+    if entry.PatientName == "" && entry.PatientID != 0 {
+        if patient, err := wc.PatientGateway.GetPatientByID(entry.PatientID); err == nil {
+            entry.PatientName = patient.Name
+        }
+    }
+
+    err := wc.WaitlistGateway.CreateEntry(&entry)
+    if errors.Is(err, gateways.ErrInvalidWaitlistEntry) {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Failed to join waitlist")
+        return
+    }
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to join waitlist")
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(entry)
+}
+
+// Accept or decline a slot offer, patients can only answer their own offers
+func (wc *WaitlistController) AnswerOffer(w http.ResponseWriter, r *http.Request) {
+    offerID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing offer ID")
+        return
+    }
+    patientID := utils.PatientScope(r)
+
+    var offer *models.SlotOffer
+    if r.URL.Query().Get("identifier") == "accept" {
+        offer, err = wc.WaitlistGateway.AcceptOffer(offerID, patientID, statusChange(r, models.StatusConfirmed, "accepted waitlist offer"))
+    } else {
+        offer, err = wc.WaitlistGateway.DeclineOffer(offerID, patientID)
+    }
+
+    if errors.Is(err, gateways.ErrOfferNotOpen) {
+        utils.ErrorHandler(w, http.StatusConflict, err, "The offer can no longer be answered")
+        return
+    }
+    if err != nil {
+        bookingError(w, err, "Failed to answer offer")
+        return
+    }
+    json.NewEncoder(w).Encode(offer)
+}
+
+// Handle DELETE requests for the waitlist, withdrawing the entry with the given id
+func (wc *WaitlistController) DeleteWaitlist(w http.ResponseWriter, r *http.Request) {
+    entryID, err := idParam(r, "id")
+    if err != nil {
+        utils.ErrorHandler(w, http.StatusBadRequest, err, "Missing waitlist entry ID")
+        return
+    }
+
+    if err := wc.WaitlistGateway.WithdrawEntry(entryID, utils.PatientScope(r)); err != nil {
+        utils.ErrorHandler(w, http.StatusNotFound, err, "Failed to leave waitlist")
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Waitlist entry withdrawn successfully"})
+}
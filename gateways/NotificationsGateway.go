@@ -21,15 +21,16 @@ func NewNotificationGateway(db *mongo.Database) *NotificationGateway {
     }
 }
 
-func (ng *NotificationGateway) GetNotifications(limit, offset int) ([]models.Notification, error) {
+func (ng *NotificationGateway) GetNotifications(patientID, limit, offset int) ([]models.Notification, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"sent_at": -1})
 
-    cursor, err := ng.collection.Find(ctx, bson.M{}, opts)
+    cursor, err := ng.collection.Find(ctx, visibleTo(bson.M{}, patientID), opts)
     if err != nil {
         return nil, err
     }
@@ -46,7 +47,7 @@ func (ng *NotificationGateway) GetNotifications(limit, offset int) ([]models.Not
     return notifications, nil
 }
 
-func (ng *NotificationGateway) SearchNotifications(query string, limit, offset int) ([]models.Notification, error) {
+func (ng *NotificationGateway) SearchNotifications(query string, patientID, limit, offset int) ([]models.Notification, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -62,8 +63,9 @@ func (ng *NotificationGateway) SearchNotifications(query string, limit, offset i
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"sent_at": -1})
 
-    cursor, err := ng.collection.Find(ctx, filter, opts)
+    cursor, err := ng.collection.Find(ctx, visibleTo(filter, patientID), opts)
     if err != nil {
         return nil, err
     }
@@ -80,7 +82,7 @@ func (ng *NotificationGateway) SearchNotifications(query string, limit, offset i
     return notifications, nil
 }
 
-func (ng *NotificationGateway) GetTotalNotificationCount(query string) (int, error) {
+func (ng *NotificationGateway) GetTotalNotificationCount(query string, patientID int) (int, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -92,7 +94,7 @@ func (ng *NotificationGateway) GetTotalNotificationCount(query string) (int, err
         },
     }
 
-    count, err := ng.collection.CountDocuments(ctx, filter)
+    count, err := ng.collection.CountDocuments(ctx, visibleTo(filter, patientID))
     return int(count), err
 }
 
@@ -100,6 +102,10 @@ func (ng *NotificationGateway) CreateNotification(notification *models.Notificat
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
+    if err := notification.ResolveTimes(); err != nil {
+        return err
+    }
+
     _, err := ng.collection.InsertOne(ctx, notification)
     return err
 
@@ -110,16 +116,21 @@ func (ng *NotificationGateway) UpdateNotification(notification *models.Notificat
     defer cancel()
 
     filter := bson.M{"notification_id": notification.ID}
-    update := bson.M{
-        "$set": bson.M{
-            "message":     notification.Message,
-            "admin_name":  notification.AdminName,
-            "patient_name": notification.PatientName,
-            "sent_date":   notification.SentDate,
-            "sent_time":   notification.SentTime,
-
-        },
+    fields := bson.M{
+        "message":      notification.Message,
+        "admin_name":   notification.AdminName,
+        "patient_name": notification.PatientName,
     }
+    // The sending time only changes when a new one is given
+    if notification.SentDate != "" || !notification.SentAt.IsZero() {
+        if err := notification.ResolveTimes(); err != nil {
+            return err
+        }
+        fields["sent_date"] = notification.SentDate
+        fields["sent_time"] = notification.SentTime
+        fields["sent_at"] = notification.SentAt
+    }
+    update := bson.M{"$set": fields}
 
     result, err := ng.collection.UpdateOne(ctx, filter, update)
     if err != nil {
@@ -139,4 +150,13 @@ func (ng *NotificationGateway) DeleteNotification(notificationID string) error {
 
     _, err := ng.collection.DeleteOne(ctx, bson.M{"notification_id": notificationID})
     return err
-}
\ No newline at end of file
+}
+
+// visibleTo narrows notifications to those a patient may see: their own, leaving out alerts meant for their
+// care team. Staff, with a patientID of zero, see them all.
+func visibleTo(filter bson.M, patientID int) bson.M {
+    if patientID == 0 {
+        return filter
+    }
+    return scopeToPatient(bson.M{"$and": []bson.M{filter, {"audience": bson.M{"$ne": models.AudienceCareTeam}}}}, patientID)
+}
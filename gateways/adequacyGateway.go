@@ -0,0 +1,268 @@
+package gateways
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Adequacy holds the targets sessions are measured against, overridden from the environment at startup
+var Adequacy = models.AdequacyTargets{
+    MinKtV: 1.2,
+    MinURR: 65,
+}
+
+// adequacyReviewDays is how far ahead an open nephrologist slot is looked for when a review is suggested
+const adequacyReviewDays = 14
+
+// AdequacyGateway trends the dialysis dose patients receive and flags those below target for nephrologist review
+type AdequacyGateway struct {
+    db           *mongo.Database
+    records      *mongo.Collection
+    patients     *mongo.Collection
+    appointments *mongo.Collection
+    availability *AvailabilityGateway
+}
+
+// NewAdequacyGateway creates a new instance of AdequacyGateway
+func NewAdequacyGateway(db *mongo.Database) *AdequacyGateway {
+    return &AdequacyGateway{
+        db:           db,
+        records:      db.Collection("treatment_records"),
+        patients:     db.Collection("patients"),
+        appointments: db.Collection("nephrologist_appointments"),
+        availability: NewAvailabilityGateway(db),
+    }
+}
+
+// GetTrend returns a patient's adequacy per session between two dates, either of which may be left empty
+func (ag *AdequacyGateway) GetTrend(patientID int, from, to string) (*models.AdequacyTrend, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    trend, err := ag.trend(ctx, patientID, from, to)
+    if err != nil {
+        return nil, err
+    }
+
+    var patient models.Patient
+    err = ag.patients.FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&patient)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return nil, err
+    }
+    trend.Flagged = patient.AdequacyFlagged
+    trend.ReviewAppointmentID = patient.AdequacyReviewID
+    return trend, nil
+}
+
+// Refresh flags a patient whose latest measured session fell below target and clears the flag once a session
+// is back on target. A newly flagged patient without a nephrologist appointment coming up is given a requested
+// appointment in the first open slot, for the front desk to confirm, and is told about it. A flagged patient
+// still without a review, because no slot was open, is tried again on every refresh. change records who
+// entered the result that led to the appointment.
+func (ag *AdequacyGateway) Refresh(patientID int, change models.StatusChange) (*models.AdequacyTrend, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    trend, err := ag.trend(ctx, patientID, "", "")
+    if err != nil || len(trend.Sessions) == 0 {
+        return trend, err
+    }
+    latest := trend.Sessions[len(trend.Sessions)-1]
+
+    var patient models.Patient
+    err = ag.patients.FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&patient)
+    if err == mongo.ErrNoDocuments {
+        // Visiting patients are reviewed by their home centre
+        return trend, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    trend.Flagged = latest.BelowTarget
+    trend.ReviewAppointmentID = patient.AdequacyReviewID
+    if trend.Flagged && (!patient.AdequacyFlagged || patient.AdequacyReviewID == 0) {
+        reviewID, err := ag.suggestReview(ctx, &patient, latest, change)
+        if err != nil {
+            return nil, err
+        }
+        trend.ReviewAppointmentID = reviewID
+    }
+
+    update := bson.M{"$set": bson.M{"adequacy_flagged": trend.Flagged, "adequacy_review_id": trend.ReviewAppointmentID}}
+    if _, err := ag.patients.UpdateOne(ctx, bson.M{"patient_id": patientID}, update); err != nil {
+        return nil, err
+    }
+    return trend, nil
+}
+
+// GetFlaggedPatients lists the patients currently flagged for inadequate dialysis
+func (ag *AdequacyGateway) GetFlaggedPatients(limit, offset int) ([]models.Patient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().SetSort(bson.M{"name": 1}).SetLimit(int64(limit)).SetSkip(int64(offset))
+    cursor, err := ag.patients.Find(ctx, bson.M{"adequacy_flagged": true}, opts)
+    if err != nil {
+        return nil, err
+    }
+    patients := []models.Patient{}
+    if err := cursor.All(ctx, &patients); err != nil {
+        return nil, err
+    }
+    return patients, nil
+}
+
+// CountFlaggedPatients counts the patients currently flagged for inadequate dialysis
+func (ag *AdequacyGateway) CountFlaggedPatients() (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := ag.patients.CountDocuments(ctx, bson.M{"adequacy_flagged": true})
+    return int(count), err
+}
+
+// trend collects the measured sessions of a patient, oldest first, and averages them
+func (ag *AdequacyGateway) trend(ctx context.Context, patientID int, from, to string) (*models.AdequacyTrend, error) {
+    filter := recordFilter(patientID, from, to)
+    // Records written before a null adequacy was unset may still hold one
+    filter["adequacy"] = bson.M{"$type": "object"}
+    cursor, err := ag.records.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "appointment_id", Value: 1}}))
+    if err != nil {
+        return nil, err
+    }
+    var records []models.TreatmentRecord
+    if err := cursor.All(ctx, &records); err != nil {
+        return nil, err
+    }
+
+    trend := &models.AdequacyTrend{PatientID: patientID, Targets: Adequacy, Sessions: []models.AdequacyPoint{}}
+    var ktv, urr float64
+    measured := 0
+    for _, record := range records {
+        if record.Adequacy == nil {
+            continue
+        }
+        measured++
+        trend.PatientName = record.PatientName
+        trend.Sessions = append(trend.Sessions, models.AdequacyPoint{
+            AppointmentID: record.AppointmentID,
+            Date:          record.Date,
+            URR:           record.Adequacy.URR,
+            KtV:           record.Adequacy.KtV,
+            BelowTarget:   record.Adequacy.BelowTarget,
+        })
+        ktv += record.Adequacy.KtV
+        urr += record.Adequacy.URR
+    }
+    if n := float64(measured); n > 0 {
+        trend.AverageKtV = math.Round(ktv/n*100) / 100
+        trend.AverageURR = math.Round(urr/n*10) / 10
+    }
+    return trend, nil
+}
+
+// suggestReview books a requested nephrologist appointment in the first open slot for a patient below target,
+// unless one is already coming up, and returns its ID. No open slot leaves the flag for staff to act on.
+func (ag *AdequacyGateway) suggestReview(ctx context.Context, patient *models.Patient, latest models.AdequacyPoint, change models.StatusChange) (int, error) {
+    var upcoming models.NephrologistAppointment
+    err := ag.appointments.FindOne(ctx, bson.M{
+        "patient_id": patient.ID,
+        "starts_at":  bson.M{"$gt": time.Now()},
+        "status":     bson.M{"$nin": releasedStatuses},
+    }, options.FindOne().SetSort(bson.M{"starts_at": 1})).Decode(&upcoming)
+    if err == nil {
+        return upcoming.ID, nil
+    }
+    if err != mongo.ErrNoDocuments {
+        return 0, err
+    }
+
+    today := time.Now().In(models.ClinicLocation)
+    slots, err := ag.availability.openSlots(ctx, 0, today.AddDate(0, 0, 1).Format(dateLayout), today.AddDate(0, 0, adequacyReviewDays).Format(dateLayout))
+    if err != nil || len(slots) == 0 {
+        return 0, err
+    }
+    slot := slots[0]
+    for _, candidate := range slots[1:] {
+        if candidate.Date < slot.Date || (candidate.Date == slot.Date && candidate.Time < slot.Time) {
+            slot = candidate
+        }
+    }
+
+    var staff models.HospitalStaff
+    if err := ag.db.Collection("hospital_staff").FindOne(ctx, bson.M{"staff_id": slot.StaffID}).Decode(&staff); err != nil && err != mongo.ErrNoDocuments {
+        return 0, err
+    }
+
+    change.To = models.StatusRequested
+    change.Reason = fmt.Sprintf("adequacy review: Kt/V %.2f, URR %.1f%% on %s, below target", latest.KtV, latest.URR, latest.Date)
+    appointment := models.NephrologistAppointment{
+        Date:          slot.Date,
+        Time:          slot.Time,
+        Status:        models.StatusRequested,
+        PatientID:     patient.ID,
+        PatientName:   patient.Name,
+        StaffID:       slot.StaffID,
+        StaffName:     staff.Name,
+        StatusHistory: []models.StatusChange{change},
+    }
+    if err := ag.availability.BookSlot(&appointment); err != nil {
+        return 0, err
+    }
+
+    message := fmt.Sprintf("Your recent dialysis results need a review. A nephrologist appointment has been requested for you on %s at %s, the front desk will confirm it.",
+        appointment.Date, appointment.Time)
+    if err := notifyPatient(ctx, ag.db, patient.ID, patient.Name, message); err != nil {
+        return 0, err
+    }
+    return appointment.ID, nil
+}
+
+// assessAdequacy works out the adequacy of a session once both urea samples are in. The treatment time is the
+// time recorded on the flowsheet, else the time between start and finish, else the booked duration; the fluid
+// removed is the ultrafiltration achieved, else the weight lost. A record that cannot be assessed has none.
+func assessAdequacy(record *models.TreatmentRecord, appointment *models.DialysisAppointment, at time.Time) {
+    record.Adequacy = nil
+    if record.PreUrea <= 0 || record.PostUrea <= 0 {
+        return
+    }
+
+    minutes := float64(record.TreatmentMinutes)
+    if minutes == 0 && appointment.StartedAt != nil && appointment.CompletedAt != nil {
+        minutes = appointment.CompletedAt.Sub(*appointment.StartedAt).Minutes()
+    }
+    if minutes <= 0 {
+        minutes = float64(appointment.DurationMinutes)
+    }
+    if minutes <= 0 {
+        minutes = models.DefaultDialysisMinutes
+    }
+
+    uf := record.UFAchievedMl / 1000
+    if uf == 0 && record.PreWeightKg > record.PostWeightKg && record.PostWeightKg > 0 {
+        uf = record.PreWeightKg - record.PostWeightKg
+    }
+
+    hours := minutes / 60
+    urr, ktv, err := models.ComputeAdequacy(record.PreUrea, record.PostUrea, hours, uf, record.PostWeightKg)
+    if err != nil {
+        return
+    }
+    record.Adequacy = &models.Adequacy{
+        URR:            urr,
+        KtV:            ktv,
+        TreatmentHours: math.Round(hours*100) / 100,
+        UFLitres:       uf,
+        PostWeightKg:   record.PostWeightKg,
+        BelowTarget:    (Adequacy.MinKtV > 0 && ktv < Adequacy.MinKtV) || (Adequacy.MinURR > 0 && urr < Adequacy.MinURR),
+        ComputedAt:     at,
+    }
+}
@@ -0,0 +1,109 @@
+package gateways
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAssessAdequacy(t *testing.T) {
+    started := time.Date(2030, 3, 4, 8, 0, 0, 0, time.UTC)
+    finished := started.Add(3 * time.Hour)
+
+    tests := []struct {
+        name        string
+        record      models.TreatmentRecord
+        appointment models.DialysisAppointment
+        wantHours   float64
+        wantUF      float64
+        wantBelow   bool
+        wantNone    bool
+    }{
+        {"flowsheet time and ultrafiltration", models.TreatmentRecord{PreUrea: 25, PostUrea: 7, TreatmentMinutes: 240,
+            UFAchievedMl: 2000, PreWeightKg: 72, PostWeightKg: 70}, models.DialysisAppointment{DurationMinutes: 180}, 4, 2, false, false},
+        {"time between start and finish, weight lost", models.TreatmentRecord{PreUrea: 25, PostUrea: 7, PreWeightKg: 71.5, PostWeightKg: 70},
+            models.DialysisAppointment{StartedAt: &started, CompletedAt: &finished, DurationMinutes: 240}, 3, 1.5, false, false},
+        {"booked duration", models.TreatmentRecord{PreUrea: 25, PostUrea: 7, PostWeightKg: 70},
+            models.DialysisAppointment{DurationMinutes: 150}, 2.5, 0, false, false},
+        {"short session below target", models.TreatmentRecord{PreUrea: 25, PostUrea: 15, TreatmentMinutes: 120, PostWeightKg: 70},
+            models.DialysisAppointment{}, 2, 0, true, false},
+        {"post urea still missing", models.TreatmentRecord{PreUrea: 25, PostWeightKg: 70}, models.DialysisAppointment{}, 0, 0, false, true},
+        {"post weight missing", models.TreatmentRecord{PreUrea: 25, PostUrea: 7}, models.DialysisAppointment{}, 0, 0, false, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tt.record.Adequacy = &models.Adequacy{KtV: 9}
+            assessAdequacy(&tt.record, &tt.appointment, finished)
+            if tt.wantNone {
+                if tt.record.Adequacy != nil {
+                    t.Errorf("Adequacy = %+v, want none", tt.record.Adequacy)
+                }
+                return
+            }
+            if tt.record.Adequacy == nil {
+                t.Fatal("Adequacy = nil, want one")
+            }
+            got := tt.record.Adequacy
+            if got.TreatmentHours != tt.wantHours {
+                t.Errorf("TreatmentHours = %v, want %v", got.TreatmentHours, tt.wantHours)
+            }
+            if got.UFLitres != tt.wantUF {
+                t.Errorf("UFLitres = %v, want %v", got.UFLitres, tt.wantUF)
+            }
+            if got.BelowTarget != tt.wantBelow {
+                t.Errorf("BelowTarget = %v, want %v (Kt/V %v, URR %v)", got.BelowTarget, tt.wantBelow, got.KtV, got.URR)
+            }
+            if !got.ComputedAt.Equal(finished) {
+                t.Errorf("ComputedAt = %v, want %v", got.ComputedAt, finished)
+            }
+        })
+    }
+}
+
+func TestRefreshReview(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    belowTarget := found("treatment_records", bson.D{
+        {Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 3}, {Key: "date", Value: "2030-03-04"},
+        {Key: "adequacy", Value: bson.D{{Key: "ktv", Value: 0.9}, {Key: "urr", Value: 55.0}, {Key: "below_target", Value: true}}},
+    })
+    patient := func(flagged bool, reviewID int) bson.D {
+        return found("patients", bson.D{
+            {Key: "patient_id", Value: 3}, {Key: "adequacy_flagged", Value: flagged}, {Key: "adequacy_review_id", Value: reviewID},
+        })
+    }
+
+    mt.Run("flagged patient with a review keeps it", func(mt *mtest.T) {
+        mt.AddMockResponses(belowTarget, patient(true, 9), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        trend, err := NewAdequacyGateway(mt.DB).Refresh(3, models.StatusChange{})
+        if err != nil {
+            mt.Fatalf("Refresh() error = %v", err)
+        }
+        if !trend.Flagged || trend.ReviewAppointmentID != 9 {
+            mt.Errorf("trend flagged %v with review %d, want flagged with review 9", trend.Flagged, trend.ReviewAppointmentID)
+        }
+        if finds := len(sentFilters(mt, "find")); finds != 2 {
+            mt.Errorf("sent %d finds, want 2 without looking for a review slot", finds)
+        }
+    })
+
+    mt.Run("flagged patient still without a review is tried again", func(mt *mtest.T) {
+        upcoming := found("nephrologist_appointments", bson.D{{Key: "appointment_id", Value: 5}, {Key: "patient_id", Value: 3}})
+        mt.AddMockResponses(belowTarget, patient(true, 0), upcoming, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        trend, err := NewAdequacyGateway(mt.DB).Refresh(3, models.StatusChange{})
+        if err != nil {
+            mt.Fatalf("Refresh() error = %v", err)
+        }
+        if trend.ReviewAppointmentID != 5 {
+            mt.Errorf("review appointment = %d, want the upcoming 5", trend.ReviewAppointmentID)
+        }
+        if got := sentUpdates(mt)[0].Lookup("$set", "adequacy_review_id").AsInt64(); got != 5 {
+            mt.Errorf("patient saved with review %d, want 5", got)
+        }
+    })
+}
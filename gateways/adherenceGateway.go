@@ -0,0 +1,280 @@
+package gateways
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Adherence holds the thresholds patients are flagged against, overridden from the environment at startup
+var Adherence = models.AdherenceThresholds{
+    WindowDays:          30,
+    MinAttendedPercent:  90,
+    MaxNoShows:          2,
+    MaxShortenedMinutes: 120,
+    LateGraceMinutes:    15,
+}
+
+// AdherenceGateway computes attendance of dialysis sessions and keeps the adherence flag on patients up to date
+type AdherenceGateway struct {
+    appointments *mongo.Collection
+    patients     *mongo.Collection
+}
+
+// NewAdherenceGateway creates a new instance of AdherenceGateway
+func NewAdherenceGateway(db *mongo.Database) *AdherenceGateway {
+    return &AdherenceGateway{
+        appointments: db.Collection("dialysis_appointments"),
+        patients:     db.Collection("patients"),
+    }
+}
+
+// GetSummary works out a patient's adherence over each window. Reading it changes nothing: the flag on the
+// patient's record is kept up to date by RefreshAll and as their sessions are attended or missed.
+func (ag *AdherenceGateway) GetSummary(patientID int) (*models.AdherenceSummary, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return ag.summarize(ctx, patientID)
+}
+
+// RefreshForAppointment recomputes the flag of the patient of a dialysis appointment
+func (ag *AdherenceGateway) RefreshForAppointment(appointmentID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var appointment struct {
+        PatientID int `bson:"patient_id"`
+    }
+    err := ag.appointments.FindOne(ctx, bson.M{"appointment_id": appointmentID}).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return err
+    }
+    _, err = ag.refresh(ctx, appointment.PatientID)
+    return err
+}
+
+// RefreshAll recomputes the flag of every patient with a dialysis session in the longest window and of
+// everyone currently flagged, so flags follow the windows as they move on. It returns how many were flagged.
+func (ag *AdherenceGateway) RefreshAll() (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+    defer cancel()
+
+    since := time.Now().AddDate(0, 0, -longestWindow())
+    recent, err := ag.appointments.Distinct(ctx, "patient_id", bson.M{"starts_at": bson.M{"$gte": since}})
+    if err != nil {
+        return 0, err
+    }
+    flagged, err := ag.patients.Distinct(ctx, "patient_id", bson.M{"adherence_flagged": true})
+    if err != nil {
+        return 0, err
+    }
+
+    seen := map[int]bool{}
+    count := 0
+    for _, value := range append(recent, flagged...) {
+        var patientID int
+        switch id := value.(type) {
+        case int32:
+            patientID = int(id)
+        case int64:
+            patientID = int(id)
+        default:
+            continue
+        }
+        if seen[patientID] {
+            continue
+        }
+        seen[patientID] = true
+
+        summary, err := ag.refresh(ctx, patientID)
+        if err != nil {
+            return count, err
+        }
+        if summary.Flagged {
+            count++
+        }
+    }
+    return count, nil
+}
+
+// GetFlaggedPatients lists the patients currently flagged for poor adherence
+func (ag *AdherenceGateway) GetFlaggedPatients(limit, offset int) ([]models.Patient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().SetSort(bson.M{"name": 1}).SetLimit(int64(limit)).SetSkip(int64(offset))
+    cursor, err := ag.patients.Find(ctx, bson.M{"adherence_flagged": true}, opts)
+    if err != nil {
+        return nil, err
+    }
+    patients := []models.Patient{}
+    if err := cursor.All(ctx, &patients); err != nil {
+        return nil, err
+    }
+    return patients, nil
+}
+
+// CountFlaggedPatients counts the patients currently flagged for poor adherence
+func (ag *AdherenceGateway) CountFlaggedPatients() (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := ag.patients.CountDocuments(ctx, bson.M{"adherence_flagged": true})
+    return int(count), err
+}
+
+// refresh summarizes a patient's adherence and writes the resulting flag onto their patient record
+func (ag *AdherenceGateway) refresh(ctx context.Context, patientID int) (*models.AdherenceSummary, error) {
+    summary, err := ag.summarize(ctx, patientID)
+    if err != nil {
+        return nil, err
+    }
+
+    update := bson.M{"$set": bson.M{"adherence_flagged": summary.Flagged, "adherence_flags": summary.Flags}}
+    if _, err := ag.patients.UpdateOne(ctx, bson.M{"patient_id": patientID}, update); err != nil {
+        return nil, err
+    }
+    return summary, nil
+}
+
+func (ag *AdherenceGateway) summarize(ctx context.Context, patientID int) (*models.AdherenceSummary, error) {
+    now := time.Now()
+    filter := bson.M{
+        "patient_id": patientID,
+        "starts_at":  bson.M{"$gte": now.AddDate(0, 0, -longestWindow()), "$lt": now},
+    }
+    cursor, err := ag.appointments.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    var sessions []models.DialysisAppointment
+    if err := cursor.All(ctx, &sessions); err != nil {
+        return nil, err
+    }
+
+    summary := &models.AdherenceSummary{PatientID: patientID, Flags: []string{}, ComputedAt: now}
+    for _, days := range models.AdherenceWindows {
+        window := models.AdherenceWindow{Days: days}
+        since := now.AddDate(0, 0, -days)
+        for _, session := range sessions {
+            if session.StartsAt.Before(since) {
+                continue
+            }
+            if summary.PatientName == "" {
+                summary.PatientName = session.PatientName
+            }
+            countSession(&window, session)
+        }
+        window.AttendedPercent = 100
+        if window.Due > 0 {
+            window.AttendedPercent = math.Round(float64(window.Attended)*1000/float64(window.Due)) / 10
+        }
+        summary.Windows = append(summary.Windows, window)
+    }
+
+    summary.Flags = adherenceFlags(flaggedWindow(summary.Windows))
+    summary.Flagged = len(summary.Flags) > 0
+    return summary, nil
+}
+
+// countSession adds one past dialysis session to a window. A session still requested or confirmed once it is
+// over was not marked attended, so it counts as due and missed until someone records what happened.
+func countSession(window *models.AdherenceWindow, session models.DialysisAppointment) {
+    switch models.CurrentStatus(session.Status) {
+    case models.StatusCheckedIn, models.StatusInProgress, models.StatusCompleted:
+        window.Due++
+        window.Attended++
+        if session.LateMinutes > Adherence.LateGraceMinutes {
+            window.LateArrivals++
+        }
+        window.LateMinutes += session.LateMinutes
+        window.ShortenedMinutes += session.ShortenedMinutes
+    case models.StatusNoShow:
+        window.Due++
+        window.NoShows++
+    case models.StatusRequested, models.StatusConfirmed:
+        window.Due++
+        window.Unrecorded++
+    }
+}
+
+// flaggedWindow picks the window the thresholds apply to, the first one when none matches
+func flaggedWindow(windows []models.AdherenceWindow) models.AdherenceWindow {
+    for _, window := range windows {
+        if window.Days == Adherence.WindowDays {
+            return window
+        }
+    }
+    return windows[0]
+}
+
+// adherenceFlags lists the thresholds a window crosses
+func adherenceFlags(window models.AdherenceWindow) []string {
+    flags := []string{}
+    if Adherence.MinAttendedPercent > 0 && window.AttendedPercent < Adherence.MinAttendedPercent {
+        flags = append(flags, fmt.Sprintf("attended %.1f%% of sessions in %d days, below %.1f%%",
+            window.AttendedPercent, window.Days, Adherence.MinAttendedPercent))
+    }
+    if Adherence.MaxNoShows > 0 && window.NoShows > Adherence.MaxNoShows {
+        flags = append(flags, fmt.Sprintf("%d no-shows in %d days, more than %d",
+            window.NoShows, window.Days, Adherence.MaxNoShows))
+    }
+    if Adherence.MaxShortenedMinutes > 0 && window.ShortenedMinutes > Adherence.MaxShortenedMinutes {
+        flags = append(flags, fmt.Sprintf("%d minutes cut from sessions in %d days, more than %d",
+            window.ShortenedMinutes, window.Days, Adherence.MaxShortenedMinutes))
+    }
+    return flags
+}
+
+// longestWindow is the number of days the longest adherence window reaches back
+func longestWindow() int {
+    longest := 0
+    for _, days := range models.AdherenceWindows {
+        if days > longest {
+            longest = days
+        }
+    }
+    return longest
+}
+
+// attendanceFields records when a dialysis patient arrived, started and finished, as the session moves to status.
+// Arrival is measured against the booked start and the session length against the booked duration.
+func attendanceFields(appointment *models.DialysisAppointment, status string, at time.Time) bson.M {
+    switch status {
+    case models.StatusCheckedIn:
+        late := 0
+        // An appointment whose strings could not be migrated has no start to be late against
+        if !appointment.StartsAt.IsZero() && at.After(appointment.StartsAt) {
+            late = int(at.Sub(appointment.StartsAt) / time.Minute)
+        }
+        return bson.M{"checked_in_at": at, "late_minutes": late}
+    case models.StatusInProgress:
+        return bson.M{"started_at": at}
+    case models.StatusCompleted:
+        fields := bson.M{"completed_at": at}
+        started := appointment.StartedAt
+        if started == nil {
+            started = appointment.CheckedInAt
+        }
+        if started != nil {
+            planned := appointment.DurationMinutes
+            if planned == 0 {
+                planned = models.DefaultDialysisMinutes
+            }
+            if short := planned - int(at.Sub(*started)/time.Minute); short > 0 {
+                fields["shortened_minutes"] = short
+            }
+        }
+        return fields
+    }
+    return nil
+}
@@ -0,0 +1,152 @@
+package gateways
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAttendanceFields(t *testing.T) {
+    startsAt := time.Date(2024, 3, 4, 3, 0, 0, 0, time.UTC)
+    started := startsAt.Add(10 * time.Minute)
+    appointment := &models.DialysisAppointment{StartsAt: startsAt, DurationMinutes: 240, StartedAt: &started}
+
+    if fields := attendanceFields(appointment, models.StatusCheckedIn, startsAt.Add(20*time.Minute)); fields["late_minutes"] != 20 {
+        t.Errorf("late check-in = %v, want 20 late minutes", fields)
+    }
+    if fields := attendanceFields(appointment, models.StatusCheckedIn, startsAt.Add(-5*time.Minute)); fields["late_minutes"] != 0 {
+        t.Errorf("early check-in = %v, want 0 late minutes", fields)
+    }
+    if fields := attendanceFields(&models.DialysisAppointment{}, models.StatusCheckedIn, startsAt); fields["late_minutes"] != 0 {
+        t.Errorf("check-in without a start time = %v, want 0 late minutes", fields)
+    }
+    if fields := attendanceFields(appointment, models.StatusCompleted, started.Add(180*time.Minute)); fields["shortened_minutes"] != 60 {
+        t.Errorf("180 minute session = %v, want 60 shortened minutes", fields)
+    }
+    if fields := attendanceFields(appointment, models.StatusCompleted, started.Add(250*time.Minute)); fields["shortened_minutes"] != nil {
+        t.Errorf("full session = %v, want nothing shortened", fields)
+    }
+    if fields := attendanceFields(&models.DialysisAppointment{StartsAt: startsAt}, models.StatusCompleted, startsAt); fields["shortened_minutes"] != nil {
+        t.Errorf("session never started = %v, want no length measured", fields)
+    }
+    if fields := attendanceFields(appointment, models.StatusNoShow, startsAt); fields != nil {
+        t.Errorf("no-show = %v, want nothing recorded", fields)
+    }
+}
+
+func TestAdherenceFlags(t *testing.T) {
+    tests := []struct {
+        name   string
+        window models.AdherenceWindow
+        want   int
+    }{
+        {"full attendance", models.AdherenceWindow{Days: 30, Due: 12, Attended: 12, AttendedPercent: 100}, 0},
+        {"low attendance", models.AdherenceWindow{Days: 30, Due: 12, Attended: 10, NoShows: 2, AttendedPercent: 83.3}, 1},
+        {"too many no-shows", models.AdherenceWindow{Days: 30, Due: 40, Attended: 37, NoShows: 3, AttendedPercent: 92.5}, 1},
+        {"sessions cut short", models.AdherenceWindow{Days: 30, Due: 12, Attended: 12, ShortenedMinutes: 150, AttendedPercent: 100}, 1},
+        {"every threshold", models.AdherenceWindow{Days: 30, Due: 6, Attended: 3, NoShows: 3, ShortenedMinutes: 200, AttendedPercent: 50}, 3},
+    }
+
+    for _, tt := range tests {
+        if got := adherenceFlags(tt.window); len(got) != tt.want {
+            t.Errorf("%s: adherenceFlags() = %v, want %d flags", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestGetSummary(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    session := func(daysAgo int, status string, extra ...bson.E) bson.D {
+        doc := bson.D{
+            {Key: "appointment_id", Value: daysAgo},
+            {Key: "patient_id", Value: 7},
+            {Key: "patient_name", Value: "Jane"},
+            {Key: "starts_at", Value: time.Now().AddDate(0, 0, -daysAgo)},
+            {Key: "status", Value: status},
+        }
+        return append(doc, extra...)
+    }
+
+    mt.Run("missed sessions flag the patient", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("dialysis_appointments",
+                session(2, models.StatusCompleted, bson.E{Key: "late_minutes", Value: 25}),
+                session(4, models.StatusNoShow),
+                session(6, models.StatusNoShow),
+                session(8, models.StatusNoShow),
+                session(10, models.StatusCancelled),
+                session(12, models.StatusConfirmed),
+                session(60, models.StatusCompleted, bson.E{Key: "shortened_minutes", Value: 30}),
+            ),
+        )
+
+        summary, err := NewAdherenceGateway(mt.DB).GetSummary(7)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        month := summary.Windows[0]
+        // The confirmed session that was never marked counts against the patient
+        if month.Days != 30 || month.Due != 5 || month.Attended != 1 || month.NoShows != 3 || month.LateArrivals != 1 || month.Unrecorded != 1 {
+            mt.Errorf("30 day window = %+v, want 5 due, 1 attended late, 3 no-shows and 1 unrecorded", month)
+        }
+        if month.AttendedPercent != 20 {
+            mt.Errorf("attended %.1f%%, want 20%%", month.AttendedPercent)
+        }
+        if quarter := summary.Windows[1]; quarter.Due != 6 || quarter.ShortenedMinutes != 30 {
+            mt.Errorf("90 day window = %+v, want 6 due with 30 minutes cut short", quarter)
+        }
+        if !summary.Flagged || len(summary.Flags) != 2 {
+            mt.Errorf("flags = %v, want attendance and no-shows flagged", summary.Flags)
+        }
+
+        if updates := sentUpdates(mt); len(updates) != 0 {
+            mt.Errorf("reading the summary sent updates %v, want none", updates)
+        }
+    })
+
+    mt.Run("patient without sessions", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments"))
+
+        summary, err := NewAdherenceGateway(mt.DB).GetSummary(7)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if summary.Flagged || summary.Windows[0].AttendedPercent != 100 {
+            mt.Errorf("summary = %+v, want nothing due and nothing flagged", summary)
+        }
+    })
+}
+
+func TestRefreshAll(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("recent and flagged patients are refreshed once each", func(mt *mtest.T) {
+        missed := bson.D{
+            {Key: "appointment_id", Value: 12},
+            {Key: "patient_id", Value: 7},
+            {Key: "starts_at", Value: time.Now().AddDate(0, 0, -2)},
+            {Key: "status", Value: models.StatusNoShow},
+        }
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{7}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{7}}),
+            found("dialysis_appointments", missed),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+
+        flagged, err := NewAdherenceGateway(mt.DB).RefreshAll()
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if flagged != 1 {
+            mt.Errorf("flagged %d patients, want 1", flagged)
+        }
+        updates := sentUpdates(mt)
+        if len(updates) != 1 || !updates[0].Lookup("$set", "adherence_flagged").Boolean() {
+            mt.Errorf("patient updates = %v, want patient 7 flagged once", updates)
+        }
+    })
+}
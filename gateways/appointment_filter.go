@@ -0,0 +1,113 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidFilter is returned when appointment filter or sort parameters cannot be used
+var ErrInvalidFilter = errors.New("invalid appointment filter")
+
+// AppointmentFilter narrows an appointment listing, zero values match everything.
+// From is inclusive and To exclusive, both compared with the appointment's start.
+type AppointmentFilter struct {
+    From      time.Time
+    To        time.Time
+    PatientID int
+    StaffID   int
+    Statuses  []string
+    StationID int
+    Shift     string
+    Sort      string
+}
+
+// appointmentSortFields maps the sort parameter to stored fields, the start time breaks ties
+var appointmentSortFields = map[string]string{
+    "date":    "starts_at",
+    "status":  "status",
+    "patient": "patient_id",
+    "staff":   "staff_id",
+    "station": "station_id",
+}
+
+// query turns the filter into a Mongo filter. Station and shift only exist on dialysis appointments.
+func (f AppointmentFilter) query(dialysis bool) (bson.M, error) {
+    if !dialysis && (f.StationID != 0 || f.Shift != "") {
+        return nil, fmt.Errorf("%w: station and shift only apply to dialysis appointments", ErrInvalidFilter)
+    }
+
+    filter := bson.M{}
+    starts := bson.M{}
+    if !f.From.IsZero() {
+        starts["$gte"] = f.From
+    }
+    if !f.To.IsZero() {
+        starts["$lt"] = f.To
+    }
+    if len(starts) > 0 {
+        filter["starts_at"] = starts
+    }
+    if f.PatientID != 0 {
+        filter["patient_id"] = f.PatientID
+    }
+    if f.StaffID != 0 {
+        filter["staff_id"] = f.StaffID
+    }
+    if len(f.Statuses) > 0 {
+        filter["status"] = bson.M{"$in": f.Statuses}
+    }
+    if f.StationID != 0 {
+        filter["station_id"] = f.StationID
+    }
+    if f.Shift != "" {
+        filter["shift"] = f.Shift
+    }
+    return filter, nil
+}
+
+// findOptions pages and sorts a filtered listing. A sort prefixed with "-" is descending.
+func (f AppointmentFilter) findOptions(limit, offset int) (*options.FindOptions, error) {
+    direction := 1
+    key := f.Sort
+    if strings.HasPrefix(key, "-") {
+        direction = -1
+        key = key[1:]
+    }
+    if key == "" {
+        key = "date"
+    }
+    field, ok := appointmentSortFields[key]
+    if !ok {
+        return nil, fmt.Errorf("%w: cannot sort by %q", ErrInvalidFilter, key)
+    }
+
+    sort := bson.D{{Key: field, Value: direction}}
+    if field != "starts_at" {
+        sort = append(sort, bson.E{Key: "starts_at", Value: 1})
+    }
+    return options.Find().SetSort(sort).SetLimit(int64(limit)).SetSkip(int64(offset)), nil
+}
+
+// ensureAppointmentIndexes creates the indexes behind the appointment filters and clash checks, and keeps
+// appointment IDs unique
+func ensureAppointmentIndexes(collection *mongo.Collection, extra ...mongo.IndexModel) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "appointment_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "starts_at", Value: 1}}},
+        {Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "starts_at", Value: 1}}},
+        {Keys: bson.D{{Key: "staff_id", Value: 1}, {Key: "starts_at", Value: 1}}},
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "starts_at", Value: 1}}},
+    }
+    _, err := collection.Indexes().CreateMany(ctx, append(indexes, extra...))
+    return err
+}
@@ -0,0 +1,89 @@
+package gateways
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAppointmentFilterQuery(t *testing.T) {
+    from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+    to := from.AddDate(0, 0, 7)
+
+    tests := []struct {
+        name     string
+        filter   AppointmentFilter
+        dialysis bool
+        want     bson.M
+        wantErr  bool
+    }{
+        {"empty filter matches everything", AppointmentFilter{}, true, bson.M{}, false},
+        {"open ended range", AppointmentFilter{From: from}, true, bson.M{"starts_at": bson.M{"$gte": from}}, false},
+        {
+            name:     "every field",
+            filter:   AppointmentFilter{From: from, To: to, PatientID: 7, StaffID: 3, Statuses: []string{"confirmed", "checked-in"}, StationID: 4, Shift: "morning"},
+            dialysis: true,
+            want: bson.M{
+                "starts_at":  bson.M{"$gte": from, "$lt": to},
+                "patient_id": 7,
+                "staff_id":   3,
+                "status":     bson.M{"$in": []string{"confirmed", "checked-in"}},
+                "station_id": 4,
+                "shift":      "morning",
+            },
+        },
+        {"station on a nephrologist listing", AppointmentFilter{StationID: 4}, false, nil, true},
+        {"shift on a nephrologist listing", AppointmentFilter{Shift: "morning"}, false, nil, true},
+    }
+
+    for _, tt := range tests {
+        got, err := tt.filter.query(tt.dialysis)
+        if tt.wantErr {
+            if !errors.Is(err, ErrInvalidFilter) {
+                t.Errorf("%s: query() error = %v, want ErrInvalidFilter", tt.name, err)
+            }
+            continue
+        }
+        if err != nil || !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: query() = %v, %v, want %v", tt.name, got, err, tt.want)
+        }
+    }
+}
+
+func TestAppointmentFilterFindOptions(t *testing.T) {
+    tests := []struct {
+        sort    string
+        want    bson.D
+        wantErr bool
+    }{
+        {"", bson.D{{Key: "starts_at", Value: 1}}, false},
+        {"date", bson.D{{Key: "starts_at", Value: 1}}, false},
+        {"-date", bson.D{{Key: "starts_at", Value: -1}}, false},
+        {"status", bson.D{{Key: "status", Value: 1}, {Key: "starts_at", Value: 1}}, false},
+        {"-staff", bson.D{{Key: "staff_id", Value: -1}, {Key: "starts_at", Value: 1}}, false},
+        {"patient_name", nil, true},
+        {"-", bson.D{{Key: "starts_at", Value: -1}}, false},
+    }
+
+    for _, tt := range tests {
+        opts, err := AppointmentFilter{Sort: tt.sort}.findOptions(20, 40)
+        if tt.wantErr {
+            if !errors.Is(err, ErrInvalidFilter) {
+                t.Errorf("findOptions(%q) error = %v, want ErrInvalidFilter", tt.sort, err)
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatalf("findOptions(%q) error = %v", tt.sort, err)
+        }
+        if !reflect.DeepEqual(opts.Sort, tt.want) {
+            t.Errorf("findOptions(%q) sort = %v, want %v", tt.sort, opts.Sort, tt.want)
+        }
+        if *opts.Limit != 20 || *opts.Skip != 40 {
+            t.Errorf("findOptions(%q) pages with limit %d skip %d, want 20 and 40", tt.sort, *opts.Limit, *opts.Skip)
+        }
+    }
+}
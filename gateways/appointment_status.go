@@ -0,0 +1,56 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrIllegalTransition is returned when an appointment cannot move to the requested status from its current one
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// transitionStatus moves the appointment matching filter to change.To and appends change to its history.
+// The update only applies while the status is still the one that was checked, so two concurrent
+// transitions of the same appointment cannot both succeed. extra holds further fields to set.
+func transitionStatus(ctx context.Context, collection *mongo.Collection, filter bson.M, change *models.StatusChange, extra bson.M) error {
+    var current struct {
+        ID     int    `bson:"appointment_id"`
+        Status string `bson:"status"`
+    }
+    err := collection.FindOne(ctx, filter).Decode(&current)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w for %v", ErrAppointmentNotFound, filter["appointment_id"])
+    }
+    if err != nil {
+        return err
+    }
+
+    if !models.CanTransition(current.Status, change.To) {
+        return fmt.Errorf("%w from %q to %q", ErrIllegalTransition, models.CurrentStatus(current.Status), change.To)
+    }
+    change.From = models.CurrentStatus(current.Status)
+    change.ChangedAt = time.Now()
+
+    guarded := bson.M{"appointment_id": current.ID, "status": current.Status}
+    if current.Status == "" {
+        guarded["status"] = bson.M{"$in": bson.A{nil, ""}}
+    }
+    set := bson.M{"status": change.To}
+    for field, value := range extra {
+        set[field] = value
+    }
+
+    result, err := collection.UpdateOne(ctx, guarded, bson.M{"$set": set, "$push": bson.M{"status_history": change}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("%w: appointment %d was changed by someone else, try again", ErrIllegalTransition, current.ID)
+    }
+    return nil
+}
@@ -0,0 +1,89 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTransitionStatus(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    appointment := func(status string) bson.D {
+        return bson.D{{Key: "appointment_id", Value: 12}, {Key: "status", Value: status}}
+    }
+    transition := func(mt *mtest.T, to string) (*models.StatusChange, error) {
+        change := &models.StatusChange{To: to, ChangedBy: 3, Role: "nurse"}
+        err := transitionStatus(context.Background(), mt.Coll, bson.M{"appointment_id": 12}, change, bson.M{"checked_in_by": 3})
+        return change, err
+    }
+
+    mt.Run("legal transition is guarded and recorded", func(mt *mtest.T) {
+        mt.AddMockResponses(found("appointments", appointment(models.StatusConfirmed)), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        change, err := transition(mt, models.StatusCheckedIn)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if change.From != models.StatusConfirmed || change.ChangedAt.IsZero() {
+            mt.Errorf("change = %+v, want it from confirmed with a time", change)
+        }
+
+        // The update only matches while the status is still the one that was checked
+        if guard := sentFilters(mt, "update")[0]; guard.Lookup("status").StringValue() != models.StatusConfirmed {
+            mt.Errorf("update filter = %v, want it guarded on the confirmed status", guard)
+        }
+        update := sentUpdates(mt)[0]
+        if update.Lookup("$set", "status").StringValue() != models.StatusCheckedIn || update.Lookup("$set", "checked_in_by").Int32() != 3 {
+            mt.Errorf("update sets %v, want the new status and the extra fields", update.Lookup("$set"))
+        }
+        if pushed := update.Lookup("$push", "status_history"); pushed.Document().Lookup("to").StringValue() != models.StatusCheckedIn {
+            mt.Errorf("history entry = %v, want the change", pushed)
+        }
+    })
+
+    mt.Run("status saved before the state machine", func(mt *mtest.T) {
+        mt.AddMockResponses(found("appointments", appointment("")), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        change, err := transition(mt, models.StatusConfirmed)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if change.From != models.StatusRequested {
+            mt.Errorf("change from %q, want %q", change.From, models.StatusRequested)
+        }
+        if _, err := sentFilters(mt, "update")[0].LookupErr("status", "$in"); err != nil {
+            mt.Error("an empty status is not matched as missing or empty")
+        }
+    })
+
+    mt.Run("illegal transition", func(mt *mtest.T) {
+        mt.AddMockResponses(found("appointments", appointment(models.StatusCompleted)))
+
+        if _, err := transition(mt, models.StatusCheckedIn); !errors.Is(err, ErrIllegalTransition) {
+            mt.Errorf("error = %v, want ErrIllegalTransition", err)
+        }
+        if updates := sentUpdates(mt); len(updates) != 0 {
+            mt.Errorf("sent %d updates, want none", len(updates))
+        }
+    })
+
+    mt.Run("changed by someone else in between", func(mt *mtest.T) {
+        mt.AddMockResponses(found("appointments", appointment(models.StatusConfirmed)), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+
+        if _, err := transition(mt, models.StatusCheckedIn); !errors.Is(err, ErrIllegalTransition) {
+            mt.Errorf("error = %v, want ErrIllegalTransition", err)
+        }
+    })
+
+    mt.Run("unknown appointment", func(mt *mtest.T) {
+        mt.AddMockResponses(found("appointments"))
+
+        if _, err := transition(mt, models.StatusCheckedIn); !errors.Is(err, ErrAppointmentNotFound) {
+            mt.Errorf("error = %v, want ErrAppointmentNotFound", err)
+        }
+    })
+}
@@ -0,0 +1,295 @@
+package gateways
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"github.com/BrianKasina/dialysis-scheduling/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned when a username or password does not match a stored credential
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrInvalidResetToken is returned when a password reset token is unknown, used or expired
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// MinPasswordLength is the shortest password accepted when setting or changing a password
+const MinPasswordLength = 8
+
+// ErrWeakPassword is returned when a new password is shorter than MinPasswordLength
+var ErrWeakPassword = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+
+// ErrUsernameTaken is returned when a username already belongs to another account
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// ErrUnknownAccount is returned when a credential is set for an account with no patient, staff or admin record
+var ErrUnknownAccount = errors.New("no record found for the account")
+
+// ErrStaffRoleMismatch is returned when a staff credential is given a role other than the one on the staff record
+var ErrStaffRoleMismatch = errors.New("role does not match the staff record")
+
+// accountRecords maps each account type to the collection and ID field of its records
+var accountRecords = map[string][2]string{
+    models.AccountAdmin:   {"system_admin", "admin_id"},
+    models.AccountStaff:   {"hospital_staff", "staff_id"},
+    models.AccountPatient: {"patients", "patient_id"},
+}
+
+// resetTokenTTL is how long an admin-issued password reset token stays valid
+const resetTokenTTL = time.Hour
+
+// AuthGateway handles database operations for account credentials
+type AuthGateway struct {
+    db         *mongo.Database
+    collection *mongo.Collection
+}
+
+// NewAuthGateway creates a new instance of AuthGateway
+func NewAuthGateway(db *mongo.Database) *AuthGateway {
+    return &AuthGateway{
+        db:         db,
+        collection: db.Collection("credentials"),
+    }
+}
+
+// EnsureIndexes makes usernames unique and allows one credential per account
+func (ag *AuthGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := ag.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "account_type", Value: 1}, {Key: "account_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+    })
+    return err
+}
+
+// GetCredential retrieves the credential stored for a username
+func (ag *AuthGateway) GetCredential(username string) (*models.Credential, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var credential models.Credential
+    err := ag.collection.FindOne(ctx, bson.M{"username": username}).Decode(&credential)
+    if err == mongo.ErrNoDocuments {
+        return nil, ErrInvalidCredentials
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &credential, nil
+}
+
+// Authenticate checks a username and password against the stored password hash
+func (ag *AuthGateway) Authenticate(username, password string) (*models.Credential, error) {
+    if username == "" || password == "" {
+        return nil, ErrInvalidCredentials
+    }
+
+    credential, err := ag.GetCredential(username)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)); err != nil {
+        return nil, ErrInvalidCredentials
+    }
+    return credential, nil
+}
+
+// SetPassword creates or replaces the credential of an account with a new password hash. The account must
+// have a patient, staff or admin record, apart from the bootstrap admin which has none. Staff credentials get
+// the role on the staff record.
+func (ag *AuthGateway) SetPassword(credential *models.Credential, password string) error {
+    hash, err := hashPassword(password)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := ag.checkAccount(ctx, credential); err != nil {
+        return err
+    }
+
+    filter := bson.M{"account_type": credential.AccountType, "account_id": credential.AccountID}
+    update := passwordUpdate(hash)
+    update["$set"].(bson.M)["username"] = credential.Username
+    update["$set"].(bson.M)["role"] = credential.Role
+
+    _, err = ag.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+    if mongo.IsDuplicateKeyError(err) {
+        return ErrUsernameTaken
+    }
+    return err
+}
+
+// checkAccount makes sure a credential belongs to an existing patient, member of staff or admin
+func (ag *AuthGateway) checkAccount(ctx context.Context, credential *models.Credential) error {
+    if credential.AccountType == models.AccountAdmin && credential.AccountID == 0 {
+        return nil
+    }
+    if credential.AccountType == models.AccountStaff {
+        return ag.checkStaffRole(ctx, credential)
+    }
+    record, ok := accountRecords[credential.AccountType]
+    if !ok {
+        return fmt.Errorf("%w: unknown account type %q", ErrUnknownAccount, credential.AccountType)
+    }
+    count, err := ag.db.Collection(record[0]).CountDocuments(ctx, bson.M{record[1]: credential.AccountID})
+    if err != nil {
+        return err
+    }
+    if count == 0 {
+        return fmt.Errorf("%w: %s %d", ErrUnknownAccount, credential.AccountType, credential.AccountID)
+    }
+    return nil
+}
+
+// checkStaffRole gives a staff credential the role on the staff record and refuses any other, so a credential
+// cannot carry more access than the member of staff's job
+func (ag *AuthGateway) checkStaffRole(ctx context.Context, credential *models.Credential) error {
+    var member models.HospitalStaff
+    err := ag.db.Collection("hospital_staff").FindOne(ctx, bson.M{"staff_id": credential.AccountID}).Decode(&member)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: %s %d", ErrUnknownAccount, credential.AccountType, credential.AccountID)
+    }
+    if err != nil {
+        return err
+    }
+    if member.Role == "" {
+        return fmt.Errorf("%w: staff %d has no role on their record", ErrStaffRoleMismatch, member.ID)
+    }
+    if credential.Role != "" && credential.Role != member.Role {
+        return fmt.Errorf("%w: staff %d is a %s", ErrStaffRoleMismatch, member.ID, member.Role)
+    }
+    credential.Role = member.Role
+    return nil
+}
+
+// ChangePassword replaces a password after checking the current one. Any outstanding reset token is
+// withdrawn and earlier refresh tokens stop working, so neither can be used to keep hold of the account.
+func (ag *AuthGateway) ChangePassword(username, currentPassword, newPassword string) error {
+    if _, err := ag.Authenticate(username, currentPassword); err != nil {
+        return err
+    }
+
+    hash, err := hashPassword(newPassword)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err = ag.collection.UpdateOne(ctx, bson.M{"username": username}, passwordUpdate(hash))
+    return err
+}
+
+// CreateResetToken issues a one-time password reset token for a username.
+// Only a hash of the token is stored, the token itself is returned to the admin.
+func (ag *AuthGateway) CreateResetToken(username string) (string, time.Time, error) {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return "", time.Time{}, err
+    }
+    token := hex.EncodeToString(buf)
+    expires := time.Now().Add(resetTokenTTL)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    update := bson.M{"$set": bson.M{"reset_token_hash": hashResetToken(token), "reset_token_expires": expires}}
+    result, err := ag.collection.UpdateOne(ctx, bson.M{"username": username}, update)
+    if err != nil {
+        return "", time.Time{}, err
+    }
+    if result.MatchedCount == 0 {
+        return "", time.Time{}, fmt.Errorf("no credential found for username %s", username)
+    }
+    return token, expires, nil
+}
+
+// ResetPassword sets a new password using a reset token and consumes the token
+func (ag *AuthGateway) ResetPassword(token, newPassword string) error {
+    hash, err := hashPassword(newPassword)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    // Matching on the token hash and clearing it in one update makes the token single use
+    filter := bson.M{
+        "reset_token_hash":    hashResetToken(token),
+        "reset_token_expires": bson.M{"$gt": time.Now()},
+    }
+    result, err := ag.collection.UpdateOne(ctx, filter, passwordUpdate(hash))
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return ErrInvalidResetToken
+    }
+    return nil
+}
+
+// EnsureBootstrapAdmin creates a system admin credential when none exists yet,
+// so a fresh deployment has someone who can set the other passwords
+func (ag *AuthGateway) EnsureBootstrapAdmin(username, password string) error {
+    if username == "" || password == "" {
+        return nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := ag.collection.CountDocuments(ctx, bson.M{"account_type": models.AccountAdmin})
+    if err != nil || count > 0 {
+        return err
+    }
+
+    return ag.SetPassword(&models.Credential{
+        Username:    username,
+        AccountType: models.AccountAdmin,
+        Role:        utils.RoleSystemAdmin,
+    }, password)
+}
+
+// passwordUpdate stores a new password hash, withdraws any outstanding reset token and bumps the token version
+// so refresh tokens issued with the old password stop working
+func passwordUpdate(hash string) bson.M {
+    return bson.M{
+        "$set":   bson.M{"password_hash": hash},
+        "$unset": bson.M{"reset_token_hash": "", "reset_token_expires": ""},
+        "$inc":   bson.M{"token_version": 1},
+    }
+}
+
+func hashPassword(password string) (string, error) {
+    if len(password) < MinPasswordLength {
+        return "", ErrWeakPassword
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return "", err
+    }
+    return string(hash), nil
+}
+
+func hashResetToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,396 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrSlotUnavailable is returned when a booking does not match an open slot in a nephrologist's working hours
+var ErrSlotUnavailable = errors.New("requested time is not an open slot")
+
+// ErrNotOwnSchedule is returned when a nephrologist changes another nephrologist's working hours or exceptions
+var ErrNotOwnSchedule = errors.New("nephrologists can only change their own working hours and exceptions")
+
+// ErrAvailabilityNotFound is returned when there are no working hours or exception with an ID
+var ErrAvailabilityNotFound = errors.New("availability not found")
+
+// maxSlotRangeDays caps how many days of open slots can be computed in one request
+const maxSlotRangeDays = 62
+
+// AvailabilityGateway handles nephrologist working hours, exceptions and open slots
+type AvailabilityGateway struct {
+    db           *mongo.Database
+    hours        *mongo.Collection
+    exceptions   *mongo.Collection
+    appointments *mongo.Collection
+}
+
+// NewAvailabilityGateway creates a new instance of AvailabilityGateway
+func NewAvailabilityGateway(db *mongo.Database) *AvailabilityGateway {
+    return &AvailabilityGateway{
+        db:           db,
+        hours:        db.Collection("working_hours"),
+        exceptions:   db.Collection("availability_exceptions"),
+        appointments: db.Collection("nephrologist_appointments"),
+    }
+}
+
+// GetWorkingHours retrieves the weekly templates of a nephrologist, or of everyone when staffID is 0
+func (ag *AvailabilityGateway) GetWorkingHours(staffID int) ([]models.WorkingHours, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return ag.findWorkingHours(ctx, staffID)
+}
+
+func (ag *AvailabilityGateway) findWorkingHours(ctx context.Context, staffID int) ([]models.WorkingHours, error) {
+    filter := bson.M{}
+    if staffID != 0 {
+        filter["staff_id"] = staffID
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "staff_id", Value: 1}, {Key: "weekday", Value: 1}, {Key: "start_time", Value: 1}})
+    cursor, err := ag.hours.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    hours := []models.WorkingHours{}
+    if err := cursor.All(ctx, &hours); err != nil {
+        return nil, err
+    }
+    return hours, nil
+}
+
+// CreateWorkingHours adds a weekly working-hours block for a nephrologist. A non-zero ownerID is the only
+// nephrologist the block may be for, and the one it is for when no staff ID is given.
+func (ag *AvailabilityGateway) CreateWorkingHours(hours *models.WorkingHours, ownerID int) error {
+    if err := ownSchedule(&hours.StaffID, ownerID); err != nil {
+        return err
+    }
+    if hours.StaffID == 0 || hours.Weekday < 0 || hours.Weekday > 6 {
+        return fmt.Errorf("a staff ID and a weekday between 0 (Sunday) and 6 are required")
+    }
+    if _, err := time.Parse("15:04", hours.StartTime); err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidSlot, hours.StartTime)
+    }
+    if _, err := time.Parse("15:04", hours.EndTime); err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidSlot, hours.EndTime)
+    }
+    if hours.EndTime <= hours.StartTime {
+        return fmt.Errorf("end time must be after start time")
+    }
+    if hours.SlotMinutes == 0 {
+        hours.SlotMinutes = models.DefaultNephrologistMinutes
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, ag.db, "working_hours", "working_hours_id")
+    if err != nil {
+        return err
+    }
+    hours.ID = id
+
+    _, err = ag.hours.InsertOne(ctx, hours)
+    return err
+}
+
+// DeleteWorkingHours removes a working-hours block, only one of ownerID's when it is not zero
+func (ag *AvailabilityGateway) DeleteWorkingHours(hoursID, ownerID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    return ag.deleteOwned(ctx, ag.hours, bson.M{"working_hours_id": hoursID}, ownerID, fmt.Sprintf("working hours %d", hoursID))
+}
+
+// GetExceptions retrieves leave and clinic exceptions between two dates, for one nephrologist or everyone when staffID is 0
+func (ag *AvailabilityGateway) GetExceptions(staffID int, from, to string) ([]models.AvailabilityException, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return ag.findExceptions(ctx, staffID, from, to)
+}
+
+func (ag *AvailabilityGateway) findExceptions(ctx context.Context, staffID int, from, to string) ([]models.AvailabilityException, error) {
+    filter := bson.M{"date": bson.M{"$gte": from, "$lte": to}}
+    if staffID != 0 {
+        filter["staff_id"] = staffID
+    }
+
+    cursor, err := ag.exceptions.Find(ctx, filter, options.Find().SetSort(bson.M{"date": 1}))
+    if err != nil {
+        return nil, err
+    }
+    exceptions := []models.AvailabilityException{}
+    if err := cursor.All(ctx, &exceptions); err != nil {
+        return nil, err
+    }
+    return exceptions, nil
+}
+
+// CreateException records leave or a clinic that takes time out of a nephrologist's working hours. A non-zero
+// ownerID is the only nephrologist the exception may be for, and the one it is for when no staff ID is given.
+func (ag *AvailabilityGateway) CreateException(exception *models.AvailabilityException, ownerID int) error {
+    if err := ownSchedule(&exception.StaffID, ownerID); err != nil {
+        return err
+    }
+    if exception.StaffID == 0 {
+        return fmt.Errorf("a staff ID is required")
+    }
+    if _, err := time.Parse(dateLayout, exception.Date); err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidSlot, exception.Date)
+    }
+    if (exception.StartTime == "") != (exception.EndTime == "") {
+        return fmt.Errorf("give both a start and an end time, or neither for a whole day")
+    }
+    if exception.StartTime != "" {
+        if _, _, err := slotRange(exception.Date, exception.StartTime, 0); err != nil {
+            return err
+        }
+        if _, _, err := slotRange(exception.Date, exception.EndTime, 0); err != nil {
+            return err
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, ag.db, "availability_exceptions", "exception_id")
+    if err != nil {
+        return err
+    }
+    exception.ID = id
+
+    _, err = ag.exceptions.InsertOne(ctx, exception)
+    return err
+}
+
+// DeleteException removes an exception, only one of ownerID's when it is not zero
+func (ag *AvailabilityGateway) DeleteException(exceptionID, ownerID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    return ag.deleteOwned(ctx, ag.exceptions, bson.M{"exception_id": exceptionID}, ownerID, fmt.Sprintf("exception %d", exceptionID))
+}
+
+// deleteOwned removes the entry matching filter, refusing when ownerID is not zero and the entry is someone else's
+func (ag *AvailabilityGateway) deleteOwned(ctx context.Context, collection *mongo.Collection, filter bson.M, ownerID int, name string) error {
+    var entry struct {
+        StaffID int `bson:"staff_id"`
+    }
+    err := collection.FindOne(ctx, filter).Decode(&entry)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: %s", ErrAvailabilityNotFound, name)
+    }
+    if err != nil {
+        return err
+    }
+    if ownerID != 0 && entry.StaffID != ownerID {
+        return ErrNotOwnSchedule
+    }
+    _, err = collection.DeleteOne(ctx, filter)
+    return err
+}
+
+// ownSchedule fills in the staff ID of an entry a nephrologist adds for themselves and refuses one for anyone else
+func ownSchedule(staffID *int, ownerID int) error {
+    if ownerID == 0 {
+        return nil
+    }
+    if *staffID == 0 {
+        *staffID = ownerID
+    }
+    if *staffID != ownerID {
+        return ErrNotOwnSchedule
+    }
+    return nil
+}
+
+// GetOpenSlots computes the free slots between two dates from the working-hours templates,
+// minus exceptions, clinic closures and existing nephrologist appointments. A staffID of 0 covers every nephrologist.
+func (ag *AvailabilityGateway) GetOpenSlots(staffID int, from, to string) ([]models.Slot, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return ag.openSlots(ctx, staffID, from, to)
+}
+
+func (ag *AvailabilityGateway) openSlots(ctx context.Context, staffID int, from, to string) ([]models.Slot, error) {
+    fromDate, err := time.Parse(dateLayout, from)
+    if err != nil {
+        return nil, fmt.Errorf("%w %q", ErrInvalidSlot, from)
+    }
+    toDate, err := time.Parse(dateLayout, to)
+    if err != nil {
+        return nil, fmt.Errorf("%w %q", ErrInvalidSlot, to)
+    }
+    if toDate.Before(fromDate) || toDate.Sub(fromDate) > maxSlotRangeDays*24*time.Hour {
+        return nil, fmt.Errorf("%w: date range must be forward and at most %d days", ErrInvalidSlot, maxSlotRangeDays)
+    }
+
+    templates, err := ag.findWorkingHours(ctx, staffID)
+    if err != nil {
+        return nil, err
+    }
+    exceptions, err := ag.findExceptions(ctx, staffID, from, to)
+    if err != nil {
+        return nil, err
+    }
+    closed, err := closedDates(ctx, ag.db, from, to)
+    if err != nil {
+        return nil, err
+    }
+
+    rangeStart, _ := models.ParseLocal(from, "00:00")
+    rangeEnd, _ := models.ParseLocal(to, "00:00")
+    filter := bson.M{
+        "starts_at": bson.M{"$lt": rangeEnd.AddDate(0, 0, 1)},
+        "ends_at":   bson.M{"$gt": rangeStart},
+        "status":    bson.M{"$nin": releasedStatuses},
+    }
+    if staffID != 0 {
+        filter["staff_id"] = staffID
+    }
+    cursor, err := ag.appointments.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    var booked []bookedAppointment
+    if err := cursor.All(ctx, &booked); err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    slots := []models.Slot{}
+    for day := fromDate; !day.After(toDate); day = day.AddDate(0, 0, 1) {
+        date := day.Format(dateLayout)
+        if closed[date] {
+            continue
+        }
+        for _, template := range templates {
+            if time.Weekday(template.Weekday) != day.Weekday() {
+                continue
+            }
+            for _, slot := range templateSlots(template, date) {
+                start, end, _ := slotRange(slot.Date, slot.Time, slot.DurationMinutes)
+                if start.Before(now) || blockedByException(exceptions, slot.StaffID, date, start, end) || blockedByBooking(booked, slot.StaffID, start, end) {
+                    continue
+                }
+                slots = append(slots, slot)
+            }
+        }
+    }
+    return slots, nil
+}
+
+// BookSlot books a nephrologist appointment into an open slot. The slot is checked again inside
+// the booking transaction, so two patients picking the same slot cannot both get it.
+func (ag *AvailabilityGateway) BookSlot(appointment *models.NephrologistAppointment) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, ag.db, "nephrologist_appointments", "appointment_id")
+    if err != nil {
+        return err
+    }
+    appointment.ID = id
+    if err := appointment.ResolveTimes(); err != nil {
+        return fmt.Errorf("%w: %v", ErrInvalidSlot, err)
+    }
+
+    return withBookingLock(ag.db, nephrologistSlot(appointment), func(ctx context.Context) error {
+        if err := ag.checkOpenSlot(ctx, appointment); err != nil {
+            return err
+        }
+        _, err := ag.appointments.InsertOne(ctx, appointment)
+        return err
+    })
+}
+
+// checkOpenSlot makes sure the appointment starts on an open slot of its nephrologist and takes on the slot's length
+func (ag *AvailabilityGateway) checkOpenSlot(ctx context.Context, appointment *models.NephrologistAppointment) error {
+    slots, err := ag.openSlots(ctx, appointment.StaffID, appointment.Date, appointment.Date)
+    if err != nil {
+        return err
+    }
+
+    for _, slot := range slots {
+        if slot.Time == appointment.Time {
+            appointment.DurationMinutes = slot.DurationMinutes
+            appointment.EndsAt = appointment.StartsAt.Add(time.Duration(slot.DurationMinutes) * time.Minute)
+            return nil
+        }
+    }
+    return ErrSlotUnavailable
+}
+
+// templateSlots splits a working-hours block into slots on a date
+func templateSlots(template models.WorkingHours, date string) []models.Slot {
+    minutes := template.SlotMinutes
+    if minutes <= 0 {
+        minutes = models.DefaultNephrologistMinutes
+    }
+
+    start, _, err := slotRange(date, template.StartTime, 0)
+    if err != nil {
+        return nil
+    }
+    end, _, err := slotRange(date, template.EndTime, 0)
+    if err != nil {
+        return nil
+    }
+
+    slots := []models.Slot{}
+    length := time.Duration(minutes) * time.Minute
+    for at := start; !at.Add(length).After(end); at = at.Add(length) {
+        slots = append(slots, models.Slot{
+            StaffID:         template.StaffID,
+            Date:            date,
+            Time:            at.Format("15:04"),
+            DurationMinutes: minutes,
+        })
+    }
+    return slots
+}
+
+// blockedByException reports whether leave or a clinic covers any part of a slot
+func blockedByException(exceptions []models.AvailabilityException, staffID int, date string, start, end time.Time) bool {
+    for _, exception := range exceptions {
+        if exception.StaffID != staffID || exception.Date != date {
+            continue
+        }
+        if exception.StartTime == "" {
+            return true
+        }
+        exceptionStart, _, err := slotRange(date, exception.StartTime, 0)
+        if err != nil {
+            continue
+        }
+        exceptionEnd, _, err := slotRange(date, exception.EndTime, 0)
+        if err != nil {
+            continue
+        }
+        if start.Before(exceptionEnd) && exceptionStart.Before(end) {
+            return true
+        }
+    }
+    return false
+}
+
+// blockedByBooking reports whether an existing appointment of the nephrologist overlaps a slot
+func blockedByBooking(booked []bookedAppointment, staffID int, start, end time.Time) bool {
+    for _, other := range booked {
+        if other.StaffID != staffID {
+            continue
+        }
+        if start.Before(other.EndsAt) && other.StartsAt.Before(end) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,270 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTemplateSlots(t *testing.T) {
+    tests := []struct {
+        name     string
+        template models.WorkingHours
+        want     []string
+        minutes  int
+    }{
+        {"half hour slots", models.WorkingHours{StaffID: 7, StartTime: "09:00", EndTime: "11:00", SlotMinutes: 30}, []string{"09:00", "09:30", "10:00", "10:30"}, 30},
+        {"default slot length", models.WorkingHours{StaffID: 7, StartTime: "14:00", EndTime: "15:00"}, []string{"14:00", "14:30"}, models.DefaultNephrologistMinutes},
+        {"last slot that does not fit is left out", models.WorkingHours{StaffID: 7, StartTime: "09:00", EndTime: "11:00", SlotMinutes: 45}, []string{"09:00", "09:45"}, 45},
+        {"block shorter than a slot", models.WorkingHours{StaffID: 7, StartTime: "09:00", EndTime: "09:20", SlotMinutes: 30}, []string{}, 30},
+        {"end before start", models.WorkingHours{StaffID: 7, StartTime: "12:00", EndTime: "09:00", SlotMinutes: 30}, []string{}, 30},
+        {"invalid start time", models.WorkingHours{StaffID: 7, StartTime: "nine", EndTime: "11:00", SlotMinutes: 30}, nil, 30},
+        {"invalid end time", models.WorkingHours{StaffID: 7, StartTime: "09:00", EndTime: "", SlotMinutes: 30}, nil, 30},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            slots := templateSlots(tt.template, "2024-03-05")
+            if (slots == nil) != (tt.want == nil) || len(slots) != len(tt.want) {
+                t.Fatalf("templateSlots() = %+v, want slots at %v", slots, tt.want)
+            }
+            for i, slot := range slots {
+                if slot.Time != tt.want[i] || slot.Date != "2024-03-05" || slot.StaffID != 7 || slot.DurationMinutes != tt.minutes {
+                    t.Errorf("slot %d = %+v, want %s for %d minutes", i, slot, tt.want[i], tt.minutes)
+                }
+            }
+        })
+    }
+}
+
+func TestBlockedByException(t *testing.T) {
+    start := time.Date(2024, 3, 5, 9, 0, 0, 0, time.UTC)
+    end := start.Add(30 * time.Minute)
+
+    tests := []struct {
+        name      string
+        exception models.AvailabilityException
+        want      bool
+    }{
+        {"whole day of leave", models.AvailabilityException{StaffID: 7, Date: "2024-03-05"}, true},
+        {"clinic covering the slot", models.AvailabilityException{StaffID: 7, Date: "2024-03-05", StartTime: "08:30", EndTime: "09:15"}, true},
+        {"clinic ending as the slot starts", models.AvailabilityException{StaffID: 7, Date: "2024-03-05", StartTime: "08:00", EndTime: "09:00"}, false},
+        {"clinic starting as the slot ends", models.AvailabilityException{StaffID: 7, Date: "2024-03-05", StartTime: "09:30", EndTime: "10:00"}, false},
+        {"another nephrologist", models.AvailabilityException{StaffID: 8, Date: "2024-03-05"}, false},
+        {"another day", models.AvailabilityException{StaffID: 7, Date: "2024-03-06"}, false},
+        {"unreadable times", models.AvailabilityException{StaffID: 7, Date: "2024-03-05", StartTime: "morning", EndTime: "noon"}, false},
+    }
+
+    for _, tt := range tests {
+        exceptions := []models.AvailabilityException{tt.exception}
+        if got := blockedByException(exceptions, 7, "2024-03-05", start, end); got != tt.want {
+            t.Errorf("%s: blockedByException() = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestBlockedByBooking(t *testing.T) {
+    start := time.Date(2024, 3, 5, 9, 0, 0, 0, time.UTC)
+    end := start.Add(30 * time.Minute)
+
+    tests := []struct {
+        name   string
+        booked bookedAppointment
+        want   bool
+    }{
+        {"same slot", bookedAppointment{StaffID: 7, StartsAt: start, EndsAt: end}, true},
+        {"longer appointment running into the slot", bookedAppointment{StaffID: 7, StartsAt: start.Add(-time.Hour), EndsAt: start.Add(15 * time.Minute)}, true},
+        {"previous slot", bookedAppointment{StaffID: 7, StartsAt: start.Add(-30 * time.Minute), EndsAt: start}, false},
+        {"another nephrologist", bookedAppointment{StaffID: 8, StartsAt: start, EndsAt: end}, false},
+    }
+
+    for _, tt := range tests {
+        if got := blockedByBooking([]bookedAppointment{tt.booked}, 7, start, end); got != tt.want {
+            t.Errorf("%s: blockedByBooking() = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestOpenSlots(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    day := time.Now().AddDate(0, 0, 7)
+    date := day.Format(dateLayout)
+    hours := bson.D{
+        {Key: "staff_id", Value: 7},
+        {Key: "weekday", Value: int(day.Weekday())},
+        {Key: "start_time", Value: "09:00"},
+        {Key: "end_time", Value: "11:00"},
+        {Key: "slot_minutes", Value: 30},
+    }
+
+    mt.Run("exceptions and bookings are taken out", func(mt *mtest.T) {
+        nine, _ := models.ParseLocal(date, "09:00")
+        mt.AddMockResponses(
+            found("working_hours", hours),
+            found("availability_exceptions", bson.D{{Key: "staff_id", Value: 7}, {Key: "date", Value: date}, {Key: "start_time", Value: "10:00"}, {Key: "end_time", Value: "10:30"}}),
+            found("closures"),
+            found("nephrologist_appointments", bson.D{{Key: "staff_id", Value: 7}, {Key: "starts_at", Value: nine}, {Key: "ends_at", Value: nine.Add(30 * time.Minute)}}),
+        )
+
+        slots, err := NewAvailabilityGateway(mt.DB).GetOpenSlots(7, date, date)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        var times []string
+        for _, slot := range slots {
+            times = append(times, slot.Time)
+        }
+        if len(times) != 2 || times[0] != "09:30" || times[1] != "10:30" {
+            mt.Errorf("open slots = %v, want [09:30 10:30]", times)
+        }
+    })
+
+    mt.Run("closed day has no slots", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("working_hours", hours),
+            found("availability_exceptions"),
+            found("closures", bson.D{{Key: "date", Value: date}}),
+            found("nephrologist_appointments"),
+        )
+
+        slots, err := NewAvailabilityGateway(mt.DB).GetOpenSlots(7, date, date)
+        if err != nil || len(slots) != 0 {
+            mt.Errorf("GetOpenSlots() = %v, %v, want no slots", slots, err)
+        }
+    })
+
+    for name, to := range map[string]string{
+        "range ending before it starts": day.AddDate(0, 0, -1).Format(dateLayout),
+        "range too long":                day.AddDate(0, 0, maxSlotRangeDays+1).Format(dateLayout),
+        "unreadable end date":           "next week",
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            if _, err := NewAvailabilityGateway(mt.DB).GetOpenSlots(7, date, to); !errors.Is(err, ErrInvalidSlot) {
+                mt.Errorf("GetOpenSlots() error = %v, want ErrInvalidSlot", err)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+}
+
+func TestBookSlot(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    day := time.Now().AddDate(0, 0, 7)
+    date := day.Format(dateLayout)
+    hours := bson.D{
+        {Key: "staff_id", Value: 7},
+        {Key: "weekday", Value: int(day.Weekday())},
+        {Key: "start_time", Value: "09:00"},
+        {Key: "end_time", Value: "10:00"},
+        {Key: "slot_minutes", Value: 30},
+    }
+    // nextID, the staff lock, the closure check, the clash check over both appointment collections, then the open slots
+    replies := func(booked ...bson.D) []bson.D {
+        replies := nextIDResponses(20)
+        return append(replies,
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            found("dialysis_appointments"),
+            found("nephrologist_appointments"),
+            found("working_hours", hours),
+            found("availability_exceptions"),
+            found("closures"),
+            found("nephrologist_appointments", booked...),
+        )
+    }
+
+    mt.Run("open slot is booked with its length", func(mt *mtest.T) {
+        mt.AddMockResponses(replies()...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+
+        appointment := &models.NephrologistAppointment{StaffID: 7, Date: date, Time: "09:30"}
+        if err := NewAvailabilityGateway(mt.DB).BookSlot(appointment); err != nil {
+            mt.Fatal(err)
+        }
+        if appointment.ID != 20 || appointment.DurationMinutes != 30 {
+            mt.Errorf("booked %+v, want ID 20 lasting 30 minutes", appointment)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 1 {
+            mt.Errorf("inserted %d appointments, want 1", len(inserted))
+        }
+    })
+
+    mt.Run("time outside the working hours", func(mt *mtest.T) {
+        mt.AddMockResponses(replies()...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+        appointment := &models.NephrologistAppointment{StaffID: 7, Date: date, Time: "09:15"}
+        if err := NewAvailabilityGateway(mt.DB).BookSlot(appointment); !errors.Is(err, ErrSlotUnavailable) {
+            mt.Errorf("BookSlot() error = %v, want ErrSlotUnavailable", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d appointments, want none", len(inserted))
+        }
+    })
+}
+
+func TestOwnSchedule(t *testing.T) {
+    tests := []struct {
+        name      string
+        staffID   int
+        ownerID   int
+        wantStaff int
+        wantErr   bool
+    }{
+        {"front desk for anyone", 4, 0, 4, false},
+        {"nephrologist for themselves", 4, 4, 4, false},
+        {"nephrologist without a staff ID", 0, 4, 4, false},
+        {"nephrologist for a colleague", 5, 4, 5, true},
+    }
+
+    for _, tt := range tests {
+        staffID := tt.staffID
+        err := ownSchedule(&staffID, tt.ownerID)
+        if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrNotOwnSchedule)) {
+            t.Errorf("%s: ownSchedule() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+        }
+        if staffID != tt.wantStaff {
+            t.Errorf("%s: staff ID = %d, want %d", tt.name, staffID, tt.wantStaff)
+        }
+    }
+}
+
+func TestDeleteOwnedAvailability(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    hours := found("working_hours", bson.D{{Key: "working_hours_id", Value: 9}, {Key: "staff_id", Value: 5}})
+
+    mt.Run("colleague's hours are left alone", func(mt *mtest.T) {
+        mt.AddMockResponses(hours)
+        if err := NewAvailabilityGateway(mt.DB).DeleteWorkingHours(9, 4); !errors.Is(err, ErrNotOwnSchedule) {
+            mt.Fatalf("DeleteWorkingHours() error = %v, want ErrNotOwnSchedule", err)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "delete" {
+                mt.Error("deleted a colleague's working hours")
+            }
+        }
+    })
+
+    mt.Run("own hours are deleted", func(mt *mtest.T) {
+        mt.AddMockResponses(hours, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        if err := NewAvailabilityGateway(mt.DB).DeleteWorkingHours(9, 5); err != nil {
+            mt.Fatalf("DeleteWorkingHours() error = %v", err)
+        }
+        if filters := sentFilters(mt, "delete"); len(filters) != 1 || filters[0].Lookup("working_hours_id").AsInt64() != 9 {
+            mt.Errorf("delete filters = %v, want working hours 9", filters)
+        }
+    })
+
+    mt.Run("unknown exception", func(mt *mtest.T) {
+        mt.AddMockResponses(found("availability_exceptions"))
+        if err := NewAvailabilityGateway(mt.DB).DeleteException(9, 0); !errors.Is(err, ErrAvailabilityNotFound) {
+            mt.Errorf("DeleteException() error = %v, want ErrAvailabilityNotFound", err)
+        }
+    })
+}
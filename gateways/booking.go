@@ -0,0 +1,266 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrAppointmentNotFound is returned when an appointment does not exist or is not visible to the caller
+var ErrAppointmentNotFound = errors.New("no appointment found")
+
+// ErrInvalidSlot is returned when a booking's date or time cannot be parsed
+var ErrInvalidSlot = errors.New("invalid appointment date or time")
+
+// ConflictError is returned when a booking overlaps existing appointments of the same patient, staff member or station
+type ConflictError struct {
+    Conflicts []models.AppointmentConflict
+}
+
+func (e *ConflictError) Error() string {
+    return fmt.Sprintf("booking clashes with %d existing appointment(s)", len(e.Conflicts))
+}
+
+// bookingRefused reports whether a booking was turned down because the slot or its station cannot be had,
+// rather than because it failed
+func bookingRefused(err error) bool {
+    var conflict *ConflictError
+    return errors.As(err, &conflict) ||
+        errors.Is(err, ErrStationTaken) || errors.Is(err, ErrStationUnavailable) || errors.Is(err, ErrIsolationMismatch) ||
+        errors.Is(err, ErrMachineUnavailable) || errors.Is(err, ErrMachineNeedsDisinfection) ||
+        errors.Is(err, ErrClinicClosed) || errors.Is(err, ErrSlotUnavailable)
+}
+
+// bookingSlot is the time range and resources a booking wants to hold
+type bookingSlot struct {
+    Type          string
+    AppointmentID int
+    Date          string
+    Time          string
+    Minutes       int
+    Shift         string
+    PatientID     int
+    StaffID       int
+    StationID     int
+}
+
+// bookedAppointment holds the fields of either appointment type needed to detect clashes
+type bookedAppointment struct {
+    ID        int       `bson:"appointment_id"`
+    Date      string    `bson:"date"`
+    Time      string    `bson:"time"`
+    StartsAt  time.Time `bson:"starts_at"`
+    EndsAt    time.Time `bson:"ends_at"`
+    Shift     string    `bson:"shift"`
+    PatientID int       `bson:"patient_id"`
+    StaffID   int       `bson:"staff_id"`
+    StationID int       `bson:"station_id"`
+}
+
+// appointmentCollections maps each appointment type to its collection
+var appointmentCollections = map[string]string{
+    "dialysis":     "dialysis_appointments",
+    "nephrologist": "nephrologist_appointments",
+}
+
+// withBookingLock runs write inside a transaction once slot is known to be free and the clinic open that day.
+// Every booking first bumps a lock document per patient, staff member and station for the day,
+// so two concurrent bookings for the same resource write-conflict and one of them is retried
+// against the committed state instead of both inserting.
+func withBookingLock(db *mongo.Database, slot bookingSlot, write func(ctx context.Context) error) error {
+    return inTransaction(db, 15*time.Second, func(ctx context.Context) error {
+        return bookUnderLock(ctx, db, slot, write)
+    })
+}
+
+// inTransaction runs work inside a single transaction, which the driver runs again from the start on a write
+// conflict, so work must not keep state from an earlier attempt
+func inTransaction(db *mongo.Database, timeout time.Duration, work func(ctx context.Context) error) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    session, err := db.Client().StartSession()
+    if err != nil {
+        return err
+    }
+    defer session.EndSession(ctx)
+
+    _, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+        return nil, work(sessCtx)
+    })
+    return err
+}
+
+// bookUnderLock locks the resources of slot, makes sure the clinic is open and nothing clashes with it and then
+// runs write. It must run inside a transaction for the locks to serialise concurrent bookings; several
+// bookings can share one, e.g. when a series is edited.
+func bookUnderLock(ctx context.Context, db *mongo.Database, slot bookingSlot, write func(ctx context.Context) error) error {
+    if err := lockResources(ctx, db, slot); err != nil {
+        return err
+    }
+    if err := checkNotClosed(ctx, db, slot.Date); err != nil {
+        return err
+    }
+
+    conflicts, err := findConflicts(ctx, db, slot)
+    if err != nil {
+        return err
+    }
+    if len(conflicts) > 0 {
+        return &ConflictError{Conflicts: conflicts}
+    }
+
+    return write(ctx)
+}
+
+// lockResources touches the lock document of every resource the slot uses on each clinic date it covers, so
+// a session running past midnight also serialises with bookings made on the next day
+func lockResources(ctx context.Context, db *mongo.Database, slot bookingSlot) error {
+    dates, err := slotDates(slot)
+    if err != nil {
+        return err
+    }
+
+    locks := db.Collection("booking_locks")
+    keys := []string{}
+    for _, date := range dates {
+        if slot.PatientID != 0 {
+            keys = append(keys, fmt.Sprintf("patient:%d:%s", slot.PatientID, date))
+        }
+        if slot.StaffID != 0 {
+            keys = append(keys, fmt.Sprintf("staff:%d:%s", slot.StaffID, date))
+        }
+        if slot.StationID != 0 {
+            keys = append(keys, fmt.Sprintf("station:%d:%s", slot.StationID, date))
+        }
+    }
+
+    for _, key := range keys {
+        _, err := locks.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$inc": bson.M{"version": 1}}, options.Update().SetUpsert(true))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// slotDates lists the clinic dates a slot's time range [start, end) falls on, in order
+func slotDates(slot bookingSlot) ([]string, error) {
+    start, end, err := slotRange(slot.Date, slot.Time, slot.Minutes)
+    if err != nil {
+        return nil, err
+    }
+    dates := []string{models.LocalDate(start)}
+    for day := start; ; {
+        y, m, d := day.In(models.ClinicLocation).Date()
+        day = time.Date(y, m, d+1, 0, 0, 0, 0, models.ClinicLocation)
+        if !day.Before(end) {
+            return dates, nil
+        }
+        dates = append(dates, models.LocalDate(day))
+    }
+}
+
+// findConflicts lists appointments of either type that share the slot's patient or staff member and
+// overlap it in time, or that hold its station during the same shift. Overlap is matched on the stored
+// start and end timestamps, so an appointment running past midnight is still caught. Legacy appointments
+// without timestamps cannot be placed in the day, so any of them on the slot's dates counts as overlapping.
+func findConflicts(ctx context.Context, db *mongo.Database, slot bookingSlot) ([]models.AppointmentConflict, error) {
+    start, end, err := slotRange(slot.Date, slot.Time, slot.Minutes)
+    if err != nil {
+        return nil, err
+    }
+    dates, err := slotDates(slot)
+    if err != nil {
+        return nil, err
+    }
+    overlapping := bson.M{"$or": []bson.M{
+        {"starts_at": bson.M{"$lt": end}, "ends_at": bson.M{"$gt": start}},
+        {"starts_at": nil, "date": bson.M{"$in": dates}},
+    }}
+
+    conflicts := []models.AppointmentConflict{}
+    for appointmentType, collection := range appointmentCollections {
+        resources := []bson.M{}
+        if slot.PatientID != 0 {
+            resources = append(resources, bson.M{"patient_id": slot.PatientID})
+        }
+        if slot.StaffID != 0 {
+            resources = append(resources, bson.M{"staff_id": slot.StaffID})
+        }
+        clashes := []bson.M{}
+        if len(resources) > 0 {
+            clashes = append(clashes, bson.M{"$and": []bson.M{overlapping, {"$or": resources}}})
+        }
+        if slot.StationID != 0 && appointmentType == "dialysis" {
+            clashes = append(clashes,
+                bson.M{"$and": []bson.M{overlapping, {"station_id": slot.StationID}}},
+                bson.M{"date": slot.Date, "shift": slot.Shift, "station_id": slot.StationID},
+            )
+        }
+        if len(clashes) == 0 {
+            continue
+        }
+
+        filter := bson.M{
+            "status": bson.M{"$nin": releasedStatuses},
+            "$or":    clashes,
+        }
+        if appointmentType == slot.Type && slot.AppointmentID != 0 {
+            filter["appointment_id"] = bson.M{"$ne": slot.AppointmentID}
+        }
+
+        cursor, err := db.Collection(collection).Find(ctx, filter)
+        if err != nil {
+            return nil, err
+        }
+        var booked []bookedAppointment
+        if err := cursor.All(ctx, &booked); err != nil {
+            return nil, err
+        }
+
+        for _, other := range booked {
+            overlaps := other.StartsAt.IsZero() || (start.Before(other.EndsAt) && other.StartsAt.Before(end))
+
+            resource := ""
+            switch {
+            case overlaps && slot.PatientID != 0 && other.PatientID == slot.PatientID:
+                resource = "patient"
+            case overlaps && slot.StaffID != 0 && other.StaffID == slot.StaffID:
+                resource = "staff"
+            case slot.StationID != 0 && other.StationID == slot.StationID:
+                resource = "station"
+            }
+            if resource == "" {
+                continue
+            }
+
+            conflicts = append(conflicts, models.AppointmentConflict{
+                AppointmentID: other.ID,
+                Type:          appointmentType,
+                Resource:      resource,
+                Date:          other.Date,
+                Time:          other.Time,
+                PatientID:     other.PatientID,
+                StaffID:       other.StaffID,
+                StationID:     other.StationID,
+            })
+        }
+    }
+    return conflicts, nil
+}
+
+// slotRange turns a clinic date, a start time and a length into a time range
+func slotRange(date, clock string, minutes int) (time.Time, time.Time, error) {
+    start, err := models.ParseLocal(date, clock)
+    if err != nil {
+        return time.Time{}, time.Time{}, fmt.Errorf("%w %q %q", ErrInvalidSlot, date, clock)
+    }
+    return start, start.Add(time.Duration(minutes) * time.Minute), nil
+}
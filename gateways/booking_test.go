@@ -0,0 +1,303 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSlotRange(t *testing.T) {
+    tests := []struct {
+        name        string
+        date, clock string
+        minutes     int
+        wantStart   time.Time
+        wantEnd     time.Time
+        wantErr     bool
+    }{
+        {"dialysis session", "2024-03-05", "06:00", 240, time.Date(2024, 3, 5, 6, 0, 0, 0, time.UTC), time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), false},
+        {"nephrologist slot", "2024-03-05", "09:30", 30, time.Date(2024, 3, 5, 9, 30, 0, 0, time.UTC), time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), false},
+        {"runs past midnight", "2024-03-05", "22:00", 240, time.Date(2024, 3, 5, 22, 0, 0, 0, time.UTC), time.Date(2024, 3, 6, 2, 0, 0, 0, time.UTC), false},
+        {"no length", "2024-03-05", "16:00", 0, time.Date(2024, 3, 5, 16, 0, 0, 0, time.UTC), time.Date(2024, 3, 5, 16, 0, 0, 0, time.UTC), false},
+        {"missing time", "2024-03-05", "", 240, time.Time{}, time.Time{}, true},
+        {"invalid date", "2024-13-05", "06:00", 240, time.Time{}, time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            start, end, err := slotRange(tt.date, tt.clock, tt.minutes)
+            if tt.wantErr {
+                if !errors.Is(err, ErrInvalidSlot) {
+                    t.Fatalf("slotRange() error = %v, want %v", err, ErrInvalidSlot)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("slotRange() unexpected error: %v", err)
+            }
+            if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+                t.Errorf("slotRange() = %v to %v, want %v to %v", start, end, tt.wantStart, tt.wantEnd)
+            }
+        })
+    }
+}
+
+func TestFindConflictsOnStation(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    // Station-only slots query the dialysis collection alone, so the mock replies in a known order
+    slot := bookingSlot{Type: "dialysis", Date: "2024-03-04", Time: "11:00", Minutes: 240, Shift: "afternoon", StationID: 4}
+    booked := func(id int, clock, shift string) bson.D {
+        start, _ := time.Parse("2006-01-02 15:04", "2024-03-04 "+clock)
+        return bson.D{
+            {Key: "appointment_id", Value: id},
+            {Key: "date", Value: "2024-03-04"},
+            {Key: "time", Value: clock},
+            {Key: "starts_at", Value: start},
+            {Key: "ends_at", Value: start.Add(4 * time.Hour)},
+            {Key: "shift", Value: shift},
+            {Key: "station_id", Value: 4},
+        }
+    }
+
+    tests := []struct {
+        name   string
+        booked []bson.D
+        want   []int
+    }{
+        {"station is free", nil, nil},
+        {"overlapping session", []bson.D{booked(1, "09:00", "morning")}, []int{1}},
+        {"same shift without overlap", []bson.D{booked(2, "14:30", "afternoon")}, []int{2}},
+        {"legacy session without timestamps", []bson.D{{{Key: "appointment_id", Value: 3}, {Key: "date", Value: "2024-03-04"}, {Key: "station_id", Value: 4}}}, []int{3}},
+    }
+
+    for _, tt := range tests {
+        mt.Run(tt.name, func(mt *mtest.T) {
+            mt.AddMockResponses(found("dialysis_appointments", tt.booked...))
+            conflicts, err := findConflicts(context.Background(), mt.DB, slot)
+            if err != nil {
+                mt.Fatal(err)
+            }
+
+            var got []int
+            for _, conflict := range conflicts {
+                if conflict.Resource != "station" || conflict.Type != "dialysis" {
+                    mt.Errorf("conflict %+v, want a dialysis station clash", conflict)
+                }
+                got = append(got, conflict.AppointmentID)
+            }
+            if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+                mt.Errorf("conflicting appointments = %v, want %v", got, tt.want)
+            }
+        })
+    }
+
+    mt.Run("station is matched on overlap or shift", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments"))
+        if _, err := findConflicts(context.Background(), mt.DB, slot); err != nil {
+            mt.Fatal(err)
+        }
+
+        clauses, _ := sentFilters(mt, "find")[0].Lookup("$or").Array().Values()
+        if len(clauses) != 2 {
+            mt.Fatalf("station clauses = %v, want an overlap and a same-shift clause", clauses)
+        }
+        overlap, _ := clauses[0].Document().Lookup("$and").Array().Values()
+        times := overlap[0].Document().Lookup("$or", "0").Document()
+        wantStart := time.Date(2024, 3, 4, 11, 0, 0, 0, time.UTC)
+        if !times.Lookup("starts_at", "$lt").Time().Equal(wantStart.Add(4*time.Hour)) || !times.Lookup("ends_at", "$gt").Time().Equal(wantStart) {
+            mt.Errorf("overlap clause = %v, want sessions between 11:00 and 15:00", times)
+        }
+        untimed := overlap[0].Document().Lookup("$or", "1").Document()
+        if untimed.Lookup("starts_at").Type != bson.TypeNull || untimed.Lookup("date", "$in", "0").StringValue() != "2024-03-04" {
+            mt.Errorf("untimed clause = %v, want sessions without a start on 2024-03-04", untimed)
+        }
+        shift := clauses[1].Document()
+        if shift.Lookup("shift").StringValue() != "afternoon" || shift.Lookup("date").StringValue() != "2024-03-04" {
+            mt.Errorf("shift clause = %v, want the afternoon of 2024-03-04", shift)
+        }
+    })
+
+    mt.Run("legacy session of the patient without timestamps", func(mt *mtest.T) {
+        legacy := bson.D{{Key: "appointment_id", Value: 3}, {Key: "date", Value: "2024-03-04"}, {Key: "patient_id", Value: 7}}
+        mt.AddMockResponses(found("dialysis_appointments", legacy), found("nephrologist_appointments", legacy))
+        patientSlot := bookingSlot{Type: "dialysis", Date: "2024-03-04", Time: "11:00", Minutes: 240, PatientID: 7}
+        conflicts, err := findConflicts(context.Background(), mt.DB, patientSlot)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if len(conflicts) != 2 || conflicts[0].Resource != "patient" || conflicts[1].Resource != "patient" {
+            mt.Errorf("conflicts = %+v, want the untimed sessions counted as patient clashes", conflicts)
+        }
+    })
+
+    mt.Run("released and own appointments are left out", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments"))
+        moving := slot
+        moving.AppointmentID = 9
+        if _, err := findConflicts(context.Background(), mt.DB, moving); err != nil {
+            mt.Fatal(err)
+        }
+
+        filter := sentFilters(mt, "find")[0]
+        if _, err := filter.LookupErr("status", "$nin"); err != nil {
+            mt.Errorf("filter %v matches released appointments", filter)
+        }
+        if filter.Lookup("appointment_id", "$ne").Int32() != 9 {
+            mt.Errorf("filter %v lets an appointment clash with itself", filter)
+        }
+    })
+
+    mt.Run("invalid slot", func(mt *mtest.T) {
+        invalid := slot
+        invalid.Time = ""
+        if _, err := findConflicts(context.Background(), mt.DB, invalid); !errors.Is(err, ErrInvalidSlot) {
+            mt.Errorf("findConflicts() error = %v, want ErrInvalidSlot", err)
+        }
+    })
+}
+
+func TestWithBookingLock(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    slot := bookingSlot{Type: "dialysis", Date: "2024-03-04", Time: "06:00", Minutes: 240, Shift: "morning", StationID: 4}
+
+    mt.Run("free slot is locked then written", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            found("dialysis_appointments"),
+            mtest.CreateSuccessResponse(),
+        )
+
+        written := false
+        err := withBookingLock(mt.DB, slot, func(ctx context.Context) error {
+            written = true
+            return nil
+        })
+        if err != nil || !written {
+            mt.Fatalf("withBookingLock() error = %v, written %v", err, written)
+        }
+
+        var commands []string
+        for _, event := range mt.GetAllStartedEvents() {
+            commands = append(commands, event.CommandName)
+        }
+        if len(commands) != 4 || commands[0] != "update" || commands[3] != "commitTransaction" {
+            mt.Errorf("commands = %v, want the lock update, the closure check, the conflict query and a commit", commands)
+        }
+        lock := sentFilters(mt, "update")[0]
+        if key := lock.Lookup("_id").StringValue(); key != "station:4:2024-03-04" {
+            mt.Errorf("locked %q, want station:4:2024-03-04", key)
+        }
+    })
+
+    mt.Run("clash aborts without writing", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            found("dialysis_appointments", bson.D{
+                {Key: "appointment_id", Value: 2},
+                {Key: "date", Value: "2024-03-04"},
+                {Key: "time", Value: "08:00"},
+                {Key: "starts_at", Value: time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)},
+                {Key: "ends_at", Value: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)},
+                {Key: "station_id", Value: 4},
+            }),
+            mtest.CreateSuccessResponse(),
+        )
+
+        err := withBookingLock(mt.DB, slot, func(ctx context.Context) error {
+            mt.Error("write ran despite the clash")
+            return nil
+        })
+        var conflict *ConflictError
+        if !errors.As(err, &conflict) || len(conflict.Conflicts) != 1 || conflict.Conflicts[0].AppointmentID != 2 {
+            mt.Fatalf("withBookingLock() error = %v, want a clash with appointment 2", err)
+        }
+        if name := mt.GetAllStartedEvents()[3].CommandName; name != "abortTransaction" {
+            mt.Errorf("last command = %s, want abortTransaction", name)
+        }
+    })
+
+    mt.Run("closed day is refused", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 1),
+            mtest.CreateSuccessResponse(),
+        )
+
+        err := withBookingLock(mt.DB, slot, func(ctx context.Context) error {
+            mt.Error("write ran on a closed day")
+            return nil
+        })
+        if !errors.Is(err, ErrClinicClosed) {
+            mt.Errorf("withBookingLock() error = %v, want ErrClinicClosed", err)
+        }
+    })
+
+    mt.Run("failed write is returned", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            found("dialysis_appointments"),
+            mtest.CreateSuccessResponse(),
+        )
+
+        failure := errors.New("insert failed")
+        err := withBookingLock(mt.DB, slot, func(ctx context.Context) error { return failure })
+        if !errors.Is(err, failure) {
+            mt.Errorf("withBookingLock() error = %v, want %v", err, failure)
+        }
+    })
+}
+
+func TestSlotDates(t *testing.T) {
+    tests := []struct {
+        name  string
+        clock string
+        mins  int
+        want  []string
+    }{
+        {"morning session", "06:00", 240, []string{"2024-03-04"}},
+        {"ending at midnight", "20:00", 240, []string{"2024-03-04"}},
+        {"running past midnight", "22:00", 240, []string{"2024-03-04", "2024-03-05"}},
+        {"spanning a whole day", "22:00", 1620, []string{"2024-03-04", "2024-03-05", "2024-03-06"}},
+    }
+
+    for _, tt := range tests {
+        got, err := slotDates(bookingSlot{Date: "2024-03-04", Time: tt.clock, Minutes: tt.mins})
+        if err != nil {
+            t.Fatalf("%s: slotDates() error = %v", tt.name, err)
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: slotDates() = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestLockResourcesPastMidnight(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("every date of the session is locked", func(mt *mtest.T) {
+        for i := 0; i < 4; i++ {
+            mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        }
+        slot := bookingSlot{Date: "2024-03-04", Time: "22:00", Minutes: 240, PatientID: 7, StationID: 4}
+        if err := lockResources(context.Background(), mt.DB, slot); err != nil {
+            mt.Fatal(err)
+        }
+
+        var keys []string
+        for _, filter := range sentFilters(mt, "update") {
+            keys = append(keys, filter.Lookup("_id").StringValue())
+        }
+        want := []string{"patient:7:2024-03-04", "station:4:2024-03-04", "patient:7:2024-03-05", "station:4:2024-03-05"}
+        if !reflect.DeepEqual(keys, want) {
+            mt.Errorf("locked %v, want %v", keys, want)
+        }
+    })
+}
@@ -0,0 +1,231 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"github.com/BrianKasina/dialysis-scheduling/scheduler"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrPlanChanged is returned when bookings changed since a chair plan was previewed, so committing would book a
+// different plan from the one that was looked over
+var ErrPlanChanged = errors.New("the chair plan changed since it was previewed")
+
+// ChairPlanGateway feeds the weekly chair planner from the database and books the plans it makes
+type ChairPlanGateway struct {
+    db       *mongo.Database
+    dialysis *DialysisGateway
+}
+
+// NewChairPlanGateway creates a new instance of ChairPlanGateway
+func NewChairPlanGateway(db *mongo.Database) *ChairPlanGateway {
+    return &ChairPlanGateway{
+        db:       db,
+        dialysis: NewDialysisGateway(db),
+    }
+}
+
+// PreviewWeek plans the week starting on the Monday of weekOf without booking anything
+func (cg *ChairPlanGateway) PreviewWeek(weekOf string) (*scheduler.Plan, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    input, err := cg.plannerInput(ctx, weekOf)
+    if err != nil {
+        return nil, err
+    }
+    return scheduler.Build(input), nil
+}
+
+// CommitWeek plans the week again from the current bookings and, when it still matches the previewed plan
+// version, books every planned session as a confirmed dialysis appointment in a single transaction, so a failure
+// books nothing. When a session is refused at booking, the patient's other sessions from the plan are taken back
+// and they move to the unplaced list with the reason. A plan that changed since the preview is returned with
+// ErrPlanChanged and nothing booked.
+func (cg *ChairPlanGateway) CommitWeek(weekOf, version string, change models.StatusChange) (*scheduler.Plan, []models.DialysisAppointment, error) {
+    plan, err := cg.PreviewWeek(weekOf)
+    if err != nil {
+        return nil, nil, err
+    }
+    if plan.Version != version {
+        return plan, nil, ErrPlanChanged
+    }
+
+    change.To = models.StatusConfirmed
+    change.Reason = "chair plan for the week of " + plan.WeekStart
+    var byPatient map[int][]models.DialysisAppointment
+    var refused map[int]string
+    err = inTransaction(cg.db, 60*time.Second, func(ctx context.Context) error {
+        byPatient = map[int][]models.DialysisAppointment{}
+        refused = map[int]string{}
+        for _, appointment := range plan.Appointments() {
+            if _, ok := refused[appointment.PatientID]; ok {
+                continue
+            }
+            err := cg.book(ctx, &appointment, change)
+            if bookingRefused(err) {
+                refused[appointment.PatientID] = fmt.Sprintf("booking %s failed: %v", appointment.Date, err)
+                if err := cg.takeBack(ctx, byPatient[appointment.PatientID]); err != nil {
+                    return err
+                }
+                delete(byPatient, appointment.PatientID)
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            byPatient[appointment.PatientID] = append(byPatient[appointment.PatientID], appointment)
+        }
+        return nil
+    })
+    if err != nil {
+        return plan, nil, err
+    }
+
+    booked := []models.DialysisAppointment{}
+    for _, assignment := range plan.Assignments {
+        booked = append(booked, byPatient[assignment.PatientID]...)
+    }
+
+    if len(refused) > 0 {
+        assignments := []scheduler.Assignment{}
+        for _, assignment := range plan.Assignments {
+            reason, ok := refused[assignment.PatientID]
+            if !ok {
+                assignments = append(assignments, assignment)
+                continue
+            }
+            plan.Unplaced = append(plan.Unplaced, scheduler.Unplaced{
+                PatientID:   assignment.PatientID,
+                PatientName: assignment.PatientName,
+                Reason:      reason,
+            })
+        }
+        plan.Assignments = assignments
+    }
+    return plan, booked, nil
+}
+
+// book books one planned session inside the commit's transaction
+func (cg *ChairPlanGateway) book(ctx context.Context, appointment *models.DialysisAppointment, change models.StatusChange) error {
+    id, err := nextAppointmentID(cg.db)
+    if err != nil {
+        return err
+    }
+    appointment.ID = id
+    appointment.Status = models.StatusConfirmed
+    appointment.StatusHistory = []models.StatusChange{change}
+    if err := appointment.ResolveTimes(); err != nil {
+        return fmt.Errorf("%w: %v", ErrInvalidSlot, err)
+    }
+    appointment.Shift = appointmentShift(appointment)
+
+    return bookUnderLock(ctx, cg.db, dialysisSlot(appointment), func(ctx context.Context) error {
+        if err := checkStationFree(ctx, cg.db, appointment); err != nil {
+            return err
+        }
+        _, err := cg.dialysis.collection.InsertOne(ctx, appointment)
+        return err
+    })
+}
+
+// takeBack removes the sessions of a patient booked earlier in the commit
+func (cg *ChairPlanGateway) takeBack(ctx context.Context, appointments []models.DialysisAppointment) error {
+    if len(appointments) == 0 {
+        return nil
+    }
+    ids := []int{}
+    for _, appointment := range appointments {
+        ids = append(ids, appointment.ID)
+    }
+    _, err := cg.dialysis.collection.DeleteMany(ctx, bson.M{"appointment_id": bson.M{"$in": ids}})
+    return err
+}
+
+// plannerInput gathers the patients with dialysis needs, the active stations and the week's existing bookings
+func (cg *ChairPlanGateway) plannerInput(ctx context.Context, weekOf string) (scheduler.Input, error) {
+    day, err := time.ParseInLocation(dateLayout, weekOf, models.ClinicLocation)
+    if err != nil {
+        return scheduler.Input{}, fmt.Errorf("%w %q", ErrInvalidSlot, weekOf)
+    }
+    weekStart := mondayOf(day)
+    if weekStart.Format(dateLayout) < models.LocalDate(time.Now()) {
+        return scheduler.Input{}, fmt.Errorf("%w: the week of %s has already started", ErrInvalidSlot, weekStart.Format(dateLayout))
+    }
+    weekEnd := weekStart.AddDate(0, 0, 7)
+
+    input := scheduler.Input{WeekStart: weekStart, SessionMinutes: models.DefaultDialysisMinutes}
+
+    closed, err := closedDates(ctx, cg.db, weekStart.Format(dateLayout), weekEnd.AddDate(0, 0, -1).Format(dateLayout))
+    if err != nil {
+        return input, err
+    }
+    for date := range closed {
+        input.Closed = append(input.Closed, date)
+    }
+
+    cursor, err := cg.db.Collection("stations").Find(ctx, bson.M{"active": true})
+    if err != nil {
+        return input, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return input, err
+    }
+    for _, station := range stations {
+        // Stations whose machine is down or overdue for maintenance when the week starts are left out of the plan
+        if err := checkMachine(ctx, cg.db, station.ID, models.LocalDate(weekStart)); errors.Is(err, ErrMachineUnavailable) {
+            continue
+        } else if err != nil {
+            return input, err
+        }
+        input.Stations = append(input.Stations, scheduler.Station{ID: station.ID, Group: station.IsolationGroup()})
+    }
+
+    cursor, err = cg.db.Collection("dialysis_appointments").Find(ctx, bson.M{
+        "starts_at": bson.M{"$gte": weekStart, "$lt": weekEnd},
+        "status":    bson.M{"$nin": releasedStatuses},
+    })
+    if err != nil {
+        return input, err
+    }
+    var booked []models.DialysisAppointment
+    if err := cursor.All(ctx, &booked); err != nil {
+        return input, err
+    }
+    bookedDates := map[int][]string{}
+    for _, appointment := range booked {
+        bookedDates[appointment.PatientID] = append(bookedDates[appointment.PatientID], appointment.Date)
+        if appointment.StationID != 0 {
+            input.Taken = append(input.Taken, scheduler.Booking{
+                Date:      appointment.Date,
+                Shift:     appointmentShift(&appointment),
+                StationID: appointment.StationID,
+            })
+        }
+    }
+
+    cursor, err = cg.db.Collection("patients").Find(ctx, bson.M{"dialysis_needs.sessions_per_week": bson.M{"$gt": 0}})
+    if err != nil {
+        return input, err
+    }
+    var patients []models.Patient
+    if err := cursor.All(ctx, &patients); err != nil {
+        return input, err
+    }
+    for _, patient := range patients {
+        input.Patients = append(input.Patients, scheduler.Patient{
+            ID:          patient.ID,
+            Name:        patient.Name,
+            Needs:       *patient.DialysisNeeds,
+            Group:       patient.IsolationGroup(),
+            BookedDates: bookedDates[patient.ID],
+        })
+    }
+    return input, nil
+}
@@ -0,0 +1,131 @@
+package gateways
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// plannerResponses are the replies plannerInput needs for one station and a patient needing two sessions a week
+func plannerResponses() []bson.D {
+    return []bson.D{
+        found("closures"),
+        found("stations", bson.D{{Key: "station_id", Value: 10}, {Key: "active", Value: true}}),
+        found("machines"),
+        found("dialysis_appointments"),
+        found("patients", bson.D{
+            {Key: "patient_id", Value: 1},
+            {Key: "name", Value: "Jane"},
+            {Key: "dialysis_needs", Value: bson.D{{Key: "sessions_per_week", Value: 2}, {Key: "preferred_shifts", Value: bson.A{"morning"}}}},
+        }),
+    }
+}
+
+func TestCommitWeek(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    weekOf := models.LocalDate(time.Now().AddDate(0, 0, 7))
+
+    previewed := func(mt *mtest.T) string {
+        mt.AddMockResponses(plannerResponses()...)
+        plan, err := NewChairPlanGateway(mt.DB).PreviewWeek(weekOf)
+        if err != nil {
+            mt.Fatalf("PreviewWeek returned error: %v", err)
+        }
+        if len(plan.Assignments) != 1 {
+            mt.Fatalf("previewed %d assignments, want 1", len(plan.Assignments))
+        }
+        mt.ClearEvents()
+        return plan.Version
+    }
+
+    mt.Run("a plan that changed since the preview is not booked", func(mt *mtest.T) {
+        version := previewed(mt)
+        mt.AddMockResponses(plannerResponses()...)
+        plan, booked, err := NewChairPlanGateway(mt.DB).CommitWeek(weekOf, version+"0", models.StatusChange{})
+        if !errors.Is(err, ErrPlanChanged) {
+            mt.Fatalf("err = %v, want ErrPlanChanged", err)
+        }
+        if plan == nil || plan.Version != version || booked != nil {
+            mt.Errorf("plan = %+v, booked = %v, want the new plan and nothing booked", plan, booked)
+        }
+        if updates := sentUpdates(mt); len(updates) != 0 {
+            mt.Errorf("sent %d updates, want none", len(updates))
+        }
+    })
+
+    mt.Run("a refused patient is taken back", func(mt *mtest.T) {
+        version := previewed(mt)
+        mt.AddMockResponses(plannerResponses()...)
+        // The first session is booked
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            found("dialysis_appointments"),
+            found("nephrologist_appointments"),
+            found("stations", bson.D{{Key: "station_id", Value: 10}, {Key: "active", Value: true}}),
+            found("machines"),
+            found("patients"),
+            found("transient_patients"),
+            counted("dialysis_appointments", 0),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+        // The clinic closed on the day of the second
+        mt.AddMockResponses(nextIDResponses(41)...)
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 1),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(),
+        )
+
+        plan, booked, err := NewChairPlanGateway(mt.DB).CommitWeek(weekOf, version, models.StatusChange{})
+        if err != nil {
+            mt.Fatalf("CommitWeek returned error: %v", err)
+        }
+        if len(booked) != 0 || len(plan.Assignments) != 0 {
+            mt.Errorf("booked = %v, assignments = %v, want none", booked, plan.Assignments)
+        }
+        if len(plan.Unplaced) != 1 || plan.Unplaced[0].PatientID != 1 || !strings.Contains(plan.Unplaced[0].Reason, "closed") {
+            mt.Errorf("unplaced = %+v, want patient 1 with the closure", plan.Unplaced)
+        }
+        deletes := sentFilters(mt, "delete")
+        if len(deletes) != 1 || !strings.Contains(deletes[0].String(), `"$in": [{"$numberInt":"40"}]`) {
+            mt.Errorf("delete filters = %v, want the first session taken back", deletes)
+        }
+        if commits := commandCount(mt, "commitTransaction"); commits != 1 {
+            mt.Errorf("sent %d commits, want 1", commits)
+        }
+    })
+
+    mt.Run("a failure books nothing", func(mt *mtest.T) {
+        version := previewed(mt)
+        mt.AddMockResponses(plannerResponses()...)
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(
+            mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutdown in progress"}),
+            mtest.CreateSuccessResponse(),
+        )
+
+        plan, booked, err := NewChairPlanGateway(mt.DB).CommitWeek(weekOf, version, models.StatusChange{})
+        if err == nil {
+            mt.Fatal("CommitWeek returned no error")
+        }
+        if plan == nil || booked != nil {
+            mt.Errorf("plan = %+v, booked = %v, want the plan and nothing booked", plan, booked)
+        }
+        if commits := commandCount(mt, "commitTransaction"); commits != 0 {
+            mt.Errorf("sent %d commits, want none", commits)
+        }
+        if aborts := commandCount(mt, "abortTransaction"); aborts != 1 {
+            mt.Errorf("sent %d aborts, want 1", aborts)
+        }
+    })
+}
@@ -0,0 +1,417 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrClinicClosed is returned when a booking lands on a day the unit is closed
+var ErrClinicClosed = errors.New("the clinic is closed on that day")
+
+// ErrClosureNotFound is returned when there is no closure with an ID
+var ErrClosureNotFound = errors.New("closure not found")
+
+// relocateSearchDays is how many days after a closure are tried when no alternative days are given
+const relocateSearchDays = 7
+
+// ClosuresGateway handles the calendar of holidays and unit closures
+type ClosuresGateway struct {
+    db           *mongo.Database
+    collection   *mongo.Collection
+    dialysis     *DialysisGateway
+    nephrologist *NephrologistAppointmentGateway
+}
+
+// NewClosuresGateway creates a new instance of ClosuresGateway
+func NewClosuresGateway(db *mongo.Database) *ClosuresGateway {
+    return &ClosuresGateway{
+        db:           db,
+        collection:   db.Collection("closures"),
+        dialysis:     NewDialysisGateway(db),
+        nephrologist: NewNephrologistAppointmentGateway(db),
+    }
+}
+
+// EnsureIndexes allows a single closure per day
+func (cg *ClosuresGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := cg.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys:    bson.D{{Key: "date", Value: 1}},
+        Options: options.Index().SetUnique(true),
+    })
+    return err
+}
+
+// GetClosures lists the closures between two dates, either end may be left empty
+func (cg *ClosuresGateway) GetClosures(from, to string) ([]models.Closure, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    period := bson.M{}
+    if from != "" {
+        period["$gte"] = from
+    }
+    if to != "" {
+        period["$lte"] = to
+    }
+    filter := bson.M{}
+    if len(period) > 0 {
+        filter["date"] = period
+    }
+
+    cursor, err := cg.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"date": 1}))
+    if err != nil {
+        return nil, err
+    }
+    closures := []models.Closure{}
+    if err := cursor.All(ctx, &closures); err != nil {
+        return nil, err
+    }
+    return closures, nil
+}
+
+// CreateClosure closes the unit on a day. Sessions already booked that day stay until they are relocated.
+func (cg *ClosuresGateway) CreateClosure(closure *models.Closure) error {
+    if _, err := time.Parse(dateLayout, closure.Date); err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidSlot, closure.Date)
+    }
+    if closure.Reason == "" {
+        return fmt.Errorf("%w: a reason is required", ErrInvalidSlot)
+    }
+    switch closure.Kind {
+    case "":
+        closure.Kind = models.ClosureOther
+    case models.ClosureHoliday, models.ClosureMaintenance, models.ClosureWater, models.ClosureOther:
+    default:
+        return fmt.Errorf("%w: unknown closure kind %q", ErrInvalidSlot, closure.Kind)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, cg.db, "closures", "closure_id")
+    if err != nil {
+        return err
+    }
+    closure.ID = id
+    closure.CreatedAt = time.Now()
+
+    _, err = cg.collection.InsertOne(ctx, closure)
+    if mongo.IsDuplicateKeyError(err) {
+        return fmt.Errorf("%w: %s is already closed", ErrInvalidSlot, closure.Date)
+    }
+    return err
+}
+
+// DeleteClosure reopens the day of a closure. Sessions already relocated off the day stay where they went,
+// so they are reported with the appointment they moved to.
+func (cg *ClosuresGateway) DeleteClosure(closureID int) (*models.RelocationReport, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var closure models.Closure
+    err := cg.collection.FindOne(ctx, bson.M{"closure_id": closureID}).Decode(&closure)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrClosureNotFound, closureID)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    report := &models.RelocationReport{ClosedDate: closure.Date, Relocations: []models.Relocation{}}
+    for _, appointmentType := range []string{"dialysis", "nephrologist"} {
+        relocations, err := cg.relocatedFrom(ctx, appointmentType, closure)
+        if err != nil {
+            return nil, err
+        }
+        for _, relocation := range relocations {
+            addRelocation(report, relocation)
+        }
+    }
+
+    result, err := cg.collection.DeleteOne(ctx, bson.M{"closure_id": closureID})
+    if err != nil {
+        return nil, err
+    }
+    if result.DeletedCount == 0 {
+        return nil, fmt.Errorf("%w with ID %d", ErrClosureNotFound, closureID)
+    }
+    return report, nil
+}
+
+// relocatedAppointment holds the fields of either appointment type needed to report a relocation
+type relocatedAppointment struct {
+    ID            int    `bson:"appointment_id"`
+    Date          string `bson:"date"`
+    Time          string `bson:"time"`
+    PatientID     int    `bson:"patient_id"`
+    PatientName   string `bson:"patient_name"`
+    StationID     int    `bson:"station_id"`
+    RescheduledTo int    `bson:"rescheduled_to"`
+}
+
+// relocatedFrom lists the appointments of one type rescheduled off a closed day since it was closed,
+// with where each one went
+func (cg *ClosuresGateway) relocatedFrom(ctx context.Context, appointmentType string, closure models.Closure) ([]models.Relocation, error) {
+    collection := cg.db.Collection(appointmentCollections[appointmentType])
+    filter := bson.M{
+        "date":           closure.Date,
+        "status":         models.StatusRescheduled,
+        "rescheduled_to": bson.M{"$gt": 0},
+        "status_history": bson.M{"$elemMatch": bson.M{
+            "to":         models.StatusRescheduled,
+            "changed_at": bson.M{"$gte": closure.CreatedAt},
+        }},
+    }
+    cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"time": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var moved []relocatedAppointment
+    if err := cursor.All(ctx, &moved); err != nil {
+        return nil, err
+    }
+    if len(moved) == 0 {
+        return nil, nil
+    }
+
+    ids := []int{}
+    for _, appointment := range moved {
+        ids = append(ids, appointment.RescheduledTo)
+    }
+    cursor, err = collection.Find(ctx, bson.M{"appointment_id": bson.M{"$in": ids}})
+    if err != nil {
+        return nil, err
+    }
+    var replacements []relocatedAppointment
+    if err := cursor.All(ctx, &replacements); err != nil {
+        return nil, err
+    }
+    movedTo := map[int]relocatedAppointment{}
+    for _, replacement := range replacements {
+        movedTo[replacement.ID] = replacement
+    }
+
+    relocations := []models.Relocation{}
+    for _, appointment := range moved {
+        replacement := movedTo[appointment.RescheduledTo]
+        relocations = append(relocations, models.Relocation{
+            Type:             appointmentType,
+            AppointmentID:    appointment.ID,
+            PatientID:        appointment.PatientID,
+            PatientName:      appointment.PatientName,
+            Time:             appointment.Time,
+            Moved:            true,
+            NewAppointmentID: appointment.RescheduledTo,
+            NewDate:          replacement.Date,
+            StationID:        replacement.StationID,
+        })
+    }
+    return relocations, nil
+}
+
+// Relocate reschedules every appointment still booked on a closed day onto the first alternative day
+// that takes it, at the same time. Dialysis sessions keep their station where it is free and otherwise
+// take another station of the same isolation group. Each move keeps the usual lineage and patient notice.
+func (cg *ClosuresGateway) Relocate(closureID int, request models.RelocateRequest, change models.StatusChange) (*models.RelocationReport, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var closure models.Closure
+    err := cg.collection.FindOne(ctx, bson.M{"closure_id": closureID}).Decode(&closure)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrClosureNotFound, closureID)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    dates, err := cg.alternativeDates(ctx, closure.Date, request.Dates)
+    if err != nil {
+        return nil, err
+    }
+    if change.Reason == "" {
+        change.Reason = "clinic closed: " + closure.Reason
+    }
+
+    // Only bookings that have not been acted on yet can move, legacy statuses included
+    filter := bson.M{"date": closure.Date, "status": bson.M{"$in": bson.A{models.StatusRequested, models.StatusConfirmed, "scheduled", "", nil}}}
+    var dialysis []models.DialysisAppointment
+    cursor, err := cg.db.Collection("dialysis_appointments").Find(ctx, filter, options.Find().SetSort(bson.M{"starts_at": 1}))
+    if err != nil {
+        return nil, err
+    }
+    if err := cursor.All(ctx, &dialysis); err != nil {
+        return nil, err
+    }
+    var nephrologist []models.NephrologistAppointment
+    cursor, err = cg.db.Collection("nephrologist_appointments").Find(ctx, filter, options.Find().SetSort(bson.M{"starts_at": 1}))
+    if err != nil {
+        return nil, err
+    }
+    if err := cursor.All(ctx, &nephrologist); err != nil {
+        return nil, err
+    }
+
+    cursor, err = cg.db.Collection("stations").Find(ctx, bson.M{"active": true}, options.Find().SetSort(bson.M{"station_id": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return nil, err
+    }
+
+    report := &models.RelocationReport{ClosedDate: closure.Date, Relocations: []models.Relocation{}}
+    for _, appointment := range dialysis {
+        relocation := models.Relocation{
+            Type:          "dialysis",
+            AppointmentID: appointment.ID,
+            PatientID:     appointment.PatientID,
+            PatientName:   appointment.PatientName,
+            Time:          appointment.Time,
+            Reason:        "no open day to move to",
+        }
+        for _, date := range dates {
+            for _, stationID := range stationsLike(stations, appointment.StationID) {
+                moved, err := cg.dialysis.Reschedule(appointment.ID, 0, models.RescheduleRequest{Date: date, Time: appointment.Time, StationID: stationID, Reason: change.Reason}, change)
+                if err != nil {
+                    relocation.Reason = err.Error()
+                    continue
+                }
+                relocation.Moved, relocation.NewAppointmentID, relocation.NewDate, relocation.StationID, relocation.Reason = true, moved.ID, moved.Date, moved.StationID, ""
+                break
+            }
+            if relocation.Moved {
+                break
+            }
+        }
+        addRelocation(report, relocation)
+    }
+
+    for _, appointment := range nephrologist {
+        relocation := models.Relocation{
+            Type:          "nephrologist",
+            AppointmentID: appointment.ID,
+            PatientID:     appointment.PatientID,
+            PatientName:   appointment.PatientName,
+            Time:          appointment.Time,
+            Reason:        "no open day to move to",
+        }
+        for _, date := range dates {
+            moved, err := cg.nephrologist.Reschedule(appointment.ID, 0, models.RescheduleRequest{Date: date, Time: appointment.Time, Reason: change.Reason}, change)
+            if err != nil {
+                relocation.Reason = err.Error()
+                continue
+            }
+            relocation.Moved, relocation.NewAppointmentID, relocation.NewDate, relocation.Reason = true, moved.ID, moved.Date, ""
+            break
+        }
+        addRelocation(report, relocation)
+    }
+    return report, nil
+}
+
+// alternativeDates picks the days sessions on a closed day may move to: the requested ones, or the
+// clinic days in the week after the closure. Days in the past and closed days are left out.
+func (cg *ClosuresGateway) alternativeDates(ctx context.Context, closed string, requested []string) ([]string, error) {
+    if len(requested) == 0 {
+        day, err := time.Parse(dateLayout, closed)
+        if err != nil {
+            return nil, err
+        }
+        for i := 1; i <= relocateSearchDays; i++ {
+            next := day.AddDate(0, 0, i)
+            if next.Weekday() != time.Sunday {
+                requested = append(requested, next.Format(dateLayout))
+            }
+        }
+    }
+
+    today := models.LocalDate(time.Now())
+    dates := []string{}
+    for _, date := range requested {
+        if _, err := time.Parse(dateLayout, date); err != nil {
+            return nil, fmt.Errorf("%w %q", ErrInvalidSlot, date)
+        }
+        if date == closed || date < today {
+            continue
+        }
+        if err := checkNotClosed(ctx, cg.db, date); err == ErrClinicClosed {
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        dates = append(dates, date)
+    }
+    return dates, nil
+}
+
+// stationsLike lists the station a session was on followed by the other active stations of the same
+// isolation group. A session without a station stays without one.
+func stationsLike(stations []models.Station, stationID int) []int {
+    if stationID == 0 {
+        return []int{0}
+    }
+    group := ""
+    for _, station := range stations {
+        if station.ID == stationID {
+            group = station.IsolationGroup()
+        }
+    }
+
+    ids := []int{stationID}
+    for _, station := range stations {
+        if station.ID != stationID && station.IsolationGroup() == group {
+            ids = append(ids, station.ID)
+        }
+    }
+    return ids
+}
+
+func addRelocation(report *models.RelocationReport, relocation models.Relocation) {
+    if relocation.Moved {
+        report.Moved++
+    } else {
+        report.NotMoved++
+    }
+    report.Relocations = append(report.Relocations, relocation)
+}
+
+// checkNotClosed refuses a booking on a day the unit is closed
+func checkNotClosed(ctx context.Context, db *mongo.Database, date string) error {
+    count, err := db.Collection("closures").CountDocuments(ctx, bson.M{"date": date})
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return ErrClinicClosed
+    }
+    return nil
+}
+
+// closedDates lists the closed days between two dates, inclusive
+func closedDates(ctx context.Context, db *mongo.Database, from, to string) (map[string]bool, error) {
+    cursor, err := db.Collection("closures").Find(ctx, bson.M{"date": bson.M{"$gte": from, "$lte": to}})
+    if err != nil {
+        return nil, err
+    }
+    var closures []models.Closure
+    if err := cursor.All(ctx, &closures); err != nil {
+        return nil, err
+    }
+    closed := map[string]bool{}
+    for _, closure := range closures {
+        closed[closure.Date] = true
+    }
+    return closed, nil
+}
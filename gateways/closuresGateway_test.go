@@ -0,0 +1,189 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCreateClosure(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    for name, closure := range map[string]models.Closure{
+        "unreadable date": {Date: "christmas", Reason: "holiday"},
+        "no reason":       {Date: "2024-12-25"},
+        "unknown kind":    {Date: "2024-12-25", Reason: "party", Kind: "party"},
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            if err := NewClosuresGateway(mt.DB).CreateClosure(&closure); !errors.Is(err, ErrInvalidSlot) {
+                mt.Errorf("CreateClosure() error = %v, want ErrInvalidSlot", err)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+
+    mt.Run("day already closed", func(mt *mtest.T) {
+        mt.AddMockResponses(nextIDResponses(4)...)
+        mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}))
+
+        closure := models.Closure{Date: "2024-12-25", Reason: "Christmas"}
+        if err := NewClosuresGateway(mt.DB).CreateClosure(&closure); !errors.Is(err, ErrInvalidSlot) {
+            mt.Errorf("CreateClosure() error = %v, want ErrInvalidSlot", err)
+        }
+        if closure.Kind != models.ClosureOther {
+            mt.Errorf("kind = %q, want %q", closure.Kind, models.ClosureOther)
+        }
+    })
+}
+
+func TestAlternativeDates(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    // A Monday far enough ahead that none of the following days are past
+    monday := time.Now().AddDate(0, 0, 14)
+    for monday.Weekday() != time.Monday {
+        monday = monday.AddDate(0, 0, 1)
+    }
+    day := func(offset int) string { return monday.AddDate(0, 0, offset).Format(dateLayout) }
+
+    mt.Run("following clinic days that are open", func(mt *mtest.T) {
+        // Tuesday is closed as well
+        mt.AddMockResponses(counted("closures", 1))
+        for i := 0; i < 5; i++ {
+            mt.AddMockResponses(counted("closures", 0))
+        }
+
+        dates, err := NewClosuresGateway(mt.DB).alternativeDates(context.Background(), day(0), nil)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        // Sunday is not a clinic day
+        want := []string{day(2), day(3), day(4), day(5), day(7)}
+        if !reflect.DeepEqual(dates, want) {
+            mt.Errorf("alternativeDates() = %v, want %v", dates, want)
+        }
+    })
+
+    mt.Run("requested days in the past are skipped", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("closures", 0))
+
+        yesterday := time.Now().AddDate(0, 0, -1).Format(dateLayout)
+        dates, err := NewClosuresGateway(mt.DB).alternativeDates(context.Background(), day(0), []string{yesterday, day(0), day(1)})
+        if err != nil || !reflect.DeepEqual(dates, []string{day(1)}) {
+            mt.Errorf("alternativeDates() = %v, %v, want only %s", dates, err, day(1))
+        }
+    })
+
+    mt.Run("unreadable requested day", func(mt *mtest.T) {
+        if _, err := NewClosuresGateway(mt.DB).alternativeDates(context.Background(), day(0), []string{"someday"}); !errors.Is(err, ErrInvalidSlot) {
+            mt.Errorf("alternativeDates() error = %v, want ErrInvalidSlot", err)
+        }
+    })
+}
+
+func TestStationsLike(t *testing.T) {
+    stations := []models.Station{{ID: 1}, {ID: 2, Isolation: true}, {ID: 3}, {ID: 4, Isolation: true}}
+    tests := []struct {
+        stationID int
+        want      []int
+    }{
+        {1, []int{1, 3}},
+        {4, []int{4, 2}},
+        {0, []int{0}},
+    }
+
+    for _, tt := range tests {
+        if got := stationsLike(stations, tt.stationID); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("stationsLike(%d) = %v, want %v", tt.stationID, got, tt.want)
+        }
+    }
+}
+
+func TestRelocateReportsEverySession(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    closedDay := time.Now().AddDate(0, 0, 14).Format(dateLayout)
+    nextDay := time.Now().AddDate(0, 0, 15).Format(dateLayout)
+
+    mt.Run("session that cannot move is reported with the reason", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("closures", bson.D{{Key: "closure_id", Value: 2}, {Key: "date", Value: closedDay}, {Key: "reason", Value: "water"}}),
+            counted("closures", 0),
+            found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 7}, {Key: "time", Value: "06:00"}}),
+            found("nephrologist_appointments"),
+            found("stations"),
+            // Rescheduling finds the session already moved on by someone else
+            found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 12}, {Key: "status", Value: models.StatusCompleted}}),
+        )
+
+        report, err := NewClosuresGateway(mt.DB).Relocate(2, models.RelocateRequest{Dates: []string{nextDay}}, models.StatusChange{})
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if report.Moved != 0 || report.NotMoved != 1 || report.Relocations[0].AppointmentID != 12 || report.Relocations[0].Reason == "" {
+            mt.Errorf("report = %+v, want appointment 12 not moved with a reason", report)
+        }
+    })
+}
+
+func TestDeleteClosureReportsRelocations(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    closedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+    mt.Run("sessions moved off the day are listed with where they went", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("closures", bson.D{{Key: "closure_id", Value: 2}, {Key: "date", Value: "2024-03-04"}, {Key: "created_at", Value: closedAt}}),
+            found("dialysis_appointments", bson.D{
+                {Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 7}, {Key: "time", Value: "06:00"}, {Key: "rescheduled_to", Value: 30},
+            }),
+            found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 30}, {Key: "date", Value: "2024-03-05"}, {Key: "station_id", Value: 4}}),
+            found("nephrologist_appointments"),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+
+        report, err := NewClosuresGateway(mt.DB).DeleteClosure(2)
+        if err != nil {
+            mt.Fatalf("DeleteClosure returned error: %v", err)
+        }
+        want := models.Relocation{
+            Type: "dialysis", AppointmentID: 12, PatientID: 7, Time: "06:00", Moved: true, NewAppointmentID: 30, NewDate: "2024-03-05", StationID: 4,
+        }
+        if report.ClosedDate != "2024-03-04" || report.Moved != 1 || len(report.Relocations) != 1 || report.Relocations[0] != want {
+            mt.Errorf("report = %+v, want appointment 12 moved to 30 on 2024-03-05", report)
+        }
+
+        filters := sentFilters(mt, "find")
+        moved := filters[1]
+        if moved.Lookup("status").StringValue() != models.StatusRescheduled ||
+            !moved.Lookup("status_history", "$elemMatch", "changed_at", "$gte").Time().Equal(closedAt) {
+            mt.Errorf("relocated filter = %v, want sessions rescheduled since the closure", moved)
+        }
+        if deletes := sentFilters(mt, "delete"); len(deletes) != 1 {
+            mt.Errorf("sent %d deletes, want the closure removed", len(deletes))
+        }
+    })
+}
+
+func TestMissingClosure(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("delete", func(mt *mtest.T) {
+        mt.AddMockResponses(found("closures"))
+        if _, err := NewClosuresGateway(mt.DB).DeleteClosure(9); !errors.Is(err, ErrClosureNotFound) {
+            mt.Errorf("DeleteClosure() error = %v, want ErrClosureNotFound", err)
+        }
+    })
+
+    mt.Run("relocate", func(mt *mtest.T) {
+        mt.AddMockResponses(found("closures"))
+        if _, err := NewClosuresGateway(mt.DB).Relocate(9, models.RelocateRequest{}, models.StatusChange{}); !errors.Is(err, ErrClosureNotFound) {
+            mt.Errorf("Relocate() error = %v, want ErrClosureNotFound", err)
+        }
+    })
+}
@@ -2,14 +2,10 @@ package gateways
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"time"
 
 	"github.com/BrianKasina/dialysis-scheduling/models"
-	"github.com/BrianKasina/dialysis-scheduling/utils"
-	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -17,44 +13,81 @@ import (
 
 // DialysisGateway handles database operations for dialysis appointments
 type DialysisGateway struct {
+    db         *mongo.Database
     collection *mongo.Collection
 }
 
 // NewDialysisGateway creates a new instance of DialysisGateway
 func NewDialysisGateway(db *mongo.Database) *DialysisGateway {
     return &DialysisGateway{
+        db:         db,
         collection: db.Collection("dialysis_appointments"),
     }
 }
 
-// GetAppointments retrieves dialysis appointments with patient and staff details
-func (dg *DialysisGateway) GetAppointments(limit, offset int) ([]models.DialysisAppointment, error) {
+// EnsureIndexes creates the indexes the appointment filters and clash checks rely on
+func (dg *DialysisGateway) EnsureIndexes() error {
+    return ensureAppointmentIndexes(dg.collection, mongo.IndexModel{
+        Keys: bson.D{{Key: "date", Value: 1}, {Key: "shift", Value: 1}, {Key: "station_id", Value: 1}},
+    })
+}
+
+// GetAppointments retrieves the dialysis appointments matching filter, one page at a time
+func (dg *DialysisGateway) GetAppointments(filter AppointmentFilter, limit, offset int) ([]models.DialysisAppointment, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    opts := options.Find()
-    opts.SetLimit(int64(limit))
-    opts.SetSkip(int64(offset))
-
-    cursor, err := dg.collection.Find(ctx, bson.M{}, opts)
+    query, err := filter.query(true)
+    if err != nil {
+        return nil, err
+    }
+    opts, err := filter.findOptions(limit, offset)
     if err != nil {
         return nil, err
     }
-    defer cursor.Close(ctx)
 
-    var appointments []models.DialysisAppointment
-    for cursor.Next(ctx) {
-        var appointment models.DialysisAppointment
-        if err := cursor.Decode(&appointment); err != nil {
-            return nil, err
-        }
-        appointments = append(appointments, appointment)
+    cursor, err := dg.collection.Find(ctx, query, opts)
+    if err != nil {
+        return nil, err
+    }
+    appointments := []models.DialysisAppointment{}
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
     }
     return appointments, nil
 }
 
+// GetAppointment retrieves one appointment, a non-zero patientID limits it to that patient's appointments
+func (dg *DialysisGateway) GetAppointment(appointmentID, patientID int) (*models.DialysisAppointment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var appointment models.DialysisAppointment
+    err := dg.collection.FindOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &appointment, nil
+}
+
+// CountAppointments counts the dialysis appointments matching filter
+func (dg *DialysisGateway) CountAppointments(filter AppointmentFilter) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    query, err := filter.query(true)
+    if err != nil {
+        return 0, err
+    }
+    count, err := dg.collection.CountDocuments(ctx, query)
+    return int(count), err
+}
+
 // SearchAppointments searches for dialysis appointments based on a query
-func (dg *DialysisGateway) SearchAppointments(query string, limit, offset int) ([]models.DialysisAppointment, error) {
+func (dg *DialysisGateway) SearchAppointments(query string, patientID, limit, offset int) ([]models.DialysisAppointment, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -70,8 +103,9 @@ func (dg *DialysisGateway) SearchAppointments(query string, limit, offset int) (
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"starts_at": 1})
 
-    cursor, err := dg.collection.Find(ctx, filter, opts)
+    cursor, err := dg.collection.Find(ctx, scopeToPatient(filter, patientID), opts)
     if err != nil {
         return nil, err
     }
@@ -88,7 +122,7 @@ func (dg *DialysisGateway) SearchAppointments(query string, limit, offset int) (
     return appointments, nil
 }
 
-func (dg *DialysisGateway) GetTotalDialysisAppointmentCount(query string) (int, error) {
+func (dg *DialysisGateway) GetTotalDialysisAppointmentCount(query string, patientID int) (int, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -102,75 +136,203 @@ func (dg *DialysisGateway) GetTotalDialysisAppointmentCount(query string) (int,
         },
     }
 
-    count, err := dg.collection.CountDocuments(ctx, filter)
+    count, err := dg.collection.CountDocuments(ctx, scopeToPatient(filter, patientID))
     if err != nil {
         return 0, err
     }
     return int(count), nil
 }
 
-// CreateAppointment creates a new dialysis appointment
-func (dg *DialysisGateway) CreateAppointment(w http.ResponseWriter, r *http.Request) {
+// CreateAppointment creates a new dialysis appointment. The booking is refused with a ConflictError
+// when the patient, nurse or station is already booked at that time.
+func (dg *DialysisGateway) CreateAppointment(appointment *models.DialysisAppointment) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    var appointment models.DialysisAppointment
-    err := json.NewDecoder(r.Body).Decode(&appointment)
+    // IDs are always handed out here, so a booking cannot take over or collide with an existing appointment
+    id, err := nextID(ctx, dg.db, "dialysis_appointments", "appointment_id")
     if err != nil {
-        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
-        return
+        return err
     }
-
-    _, err = dg.collection.InsertOne(ctx, appointment)
-    if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to create dialysis appointment")
-        return
+    appointment.ID = id
+    if err := appointment.ResolveTimes(); err != nil {
+        return fmt.Errorf("%w: %v", ErrInvalidSlot, err)
     }
+    appointment.Shift = appointmentShift(appointment)
 
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(appointment)
-
+    return withBookingLock(dg.db, dialysisSlot(appointment), func(ctx context.Context) error {
+        if err := checkStationFree(ctx, dg.db, appointment); err != nil {
+            return err
+        }
+        _, err := dg.collection.InsertOne(ctx, appointment)
+        return err
+    })
 }
 
-func (dg *DialysisGateway) UpdateAppointment(appointment *models.DialysisAppointment) error {
+// UpdateAppointment corrects the names on a dialysis appointment, a non-zero patientID limits the update to that
+// patient's appointments. Moving it to another date or time goes through Reschedule so the original is kept,
+// and the status only changes through TransitionStatus.
+func (dg *DialysisGateway) UpdateAppointment(appointment *models.DialysisAppointment, patientID int) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    filter := bson.M{"appointment_id": appointment.ID}
+    filter := scopeToPatient(bson.M{"appointment_id": appointment.ID}, patientID)
+
+    var existing models.DialysisAppointment
+    err := dg.collection.FindOne(ctx, filter).Decode(&existing)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointment.ID)
+    }
+    if err != nil {
+        return err
+    }
+    if movesAppointment(appointment.Date, appointment.Time, appointment.StartsAt, existing.StartsAt) {
+        return ErrMoveNeedsReschedule
+    }
+
     update := bson.M{
         "$set": bson.M{
-            "date":         appointment.Date,
-            "time":         appointment.Time,
-            "status":       appointment.Status,
             "staff_name":   appointment.StaffName,
             "patient_name": appointment.PatientName,
         },
     }
+    _, err = dg.collection.UpdateOne(ctx, filter, update)
+    return err
+}
 
-    result, err := dg.collection.UpdateOne(ctx, filter, update)
+// TransitionStatus moves a dialysis appointment to change.To and records change in its history,
+// a non-zero patientID limits it to that patient's appointments. Checking in, starting and completing
+// also record the arrival and session times that adherence is measured from, at change.OccurredAt when
+// they are recorded afterwards.
+func (dg *DialysisGateway) TransitionStatus(appointmentID, patientID int, change *models.StatusChange) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)
+    var appointment models.DialysisAppointment
+    err := dg.collection.FindOne(ctx, filter).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
     if err != nil {
         return err
     }
+    if change.To == models.StatusInProgress {
+        if err := checkDisinfected(ctx, dg.db, appointment.StationID); err != nil {
+            return err
+        }
+    }
 
-    if result.MatchedCount == 0 {
-        return fmt.Errorf("no appointment found with ID %d", appointment.ID)
+    at := time.Now()
+    if change.OccurredAt != nil {
+        at = *change.OccurredAt
     }
+    return transitionStatus(ctx, dg.collection, filter, change, attendanceFields(&appointment, change.To, at))
+}
 
-    return nil
+// Reschedule moves a dialysis appointment to the date, time and station in request, keeping the original
+// as rescheduled and linked to the new appointment, which takes over its status. A zero station keeps the
+// current one. The new slot goes through the usual clash checks and the patient is told of the move.
+func (dg *DialysisGateway) Reschedule(appointmentID, patientID int, request models.RescheduleRequest, change models.StatusChange) (*models.DialysisAppointment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)
+    var original models.DialysisAppointment
+    err := dg.collection.FindOne(ctx, filter).Decode(&original)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !models.CanTransition(original.Status, models.StatusRescheduled) {
+        return nil, fmt.Errorf("%w from %q to %q", ErrIllegalTransition, models.CurrentStatus(original.Status), models.StatusRescheduled)
+    }
+
+    id, err := nextID(ctx, dg.db, "dialysis_appointments", "appointment_id")
+    if err != nil {
+        return nil, err
+    }
+
+    // The new appointment stands on its own, outside the recurring schedule the original came from
+    moved := original
+    moved.ID = id
+    moved.Date, moved.Time = request.Date, request.Time
+    moved.StartsAt, moved.EndsAt = time.Time{}, time.Time{}
+    moved.Shift = ""
+    moved.ScheduleID, moved.OccurrenceDate, moved.IsException = 0, "", false
+    moved.Status = models.CurrentStatus(original.Status)
+    moved.StatusHistory = rescheduledHistory(moved.Status, original.ID, change)
+    moved.RescheduledFrom, moved.RescheduledTo = original.ID, 0
+    if request.StationID != 0 {
+        moved.StationID = request.StationID
+    }
+    if err := moved.ResolveTimes(); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrInvalidSlot, err)
+    }
+    moved.Shift = models.ShiftForTime(moved.Time)
+
+    // The original is left out of the clash checks, it gives up its slot in the same transaction
+    slot := dialysisSlot(&moved)
+    slot.AppointmentID = original.ID
+    err = withBookingLock(dg.db, slot, func(ctx context.Context) error {
+        change.To = models.StatusRescheduled
+        if err := transitionStatus(ctx, dg.collection, filter, &change, bson.M{"rescheduled_to": moved.ID}); err != nil {
+            return err
+        }
+        if err := checkStationFree(ctx, dg.db, &moved); err != nil {
+            return err
+        }
+        if _, err := dg.collection.InsertOne(ctx, moved); err != nil {
+            return err
+        }
+        message := rescheduleMessage("dialysis", original.Date, original.Time, moved.Date, moved.Time, change.Reason)
+        return notifyPatient(ctx, dg.db, moved.PatientID, moved.PatientName, message)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &moved, nil
+}
+
+// GetRescheduleReport counts the dialysis appointments rescheduled between from and to, per account
+func (dg *DialysisGateway) GetRescheduleReport(from, to time.Time) (*models.RescheduleReport, error) {
+    return rescheduleReport(dg.collection, "dialysis", from, to)
 }
 
-// DeleteAppointment deletes a dialysis appointment by its ID
-func (dg *DialysisGateway) DeleteAppointment(w http.ResponseWriter, r *http.Request) {
+// dialysisSlot describes the time and resources a dialysis appointment holds
+func dialysisSlot(appointment *models.DialysisAppointment) bookingSlot {
+    minutes := appointment.DurationMinutes
+    if minutes == 0 {
+        minutes = models.DefaultDialysisMinutes
+    }
+    return bookingSlot{
+        Type:          "dialysis",
+        AppointmentID: appointment.ID,
+        Date:          appointment.Date,
+        Time:          appointment.Time,
+        Minutes:       minutes,
+        Shift:         appointment.Shift,
+        PatientID:     appointment.PatientID,
+        StaffID:       appointment.StaffID,
+        StationID:     appointment.StationID,
+    }
+}
+
+// DeleteAppointment deletes a dialysis appointment by its ID, a non-zero patientID limits it to that patient's appointments
+func (dg *DialysisGateway) DeleteAppointment(appointmentID, patientID int) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
-    vars := mux.Vars(r)
-    appointmentID := vars["id"]
 
-    _, err := dg.collection.DeleteOne(ctx, bson.M{"appointment_id": appointmentID})
+    result, err := dg.collection.DeleteOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID))
     if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete dialysis appointment")
-        return
+        return err
     }
 
-    json.NewEncoder(w).Encode(map[string]string{"message": "Dialysis appointment deleted successfully"})
+    if result.DeletedCount == 0 {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+
+    return nil
 }
@@ -0,0 +1,554 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultScheduleHorizon is how far ahead recurring schedules are materialized into appointments
+const DefaultScheduleHorizon = 28 * 24 * time.Hour
+
+// dateLayout is the format of the date strings stored on appointments and schedules
+const dateLayout = models.DateLayout
+
+// patternDays lists the weekdays each recurring pattern dialyses on
+var patternDays = map[string][]time.Weekday{
+    models.PatternMWF: {time.Monday, time.Wednesday, time.Friday},
+    models.PatternTTS: {time.Tuesday, time.Thursday, time.Saturday},
+}
+
+// DialysisScheduleGateway handles database operations for recurring dialysis schedules
+type DialysisScheduleGateway struct {
+    db           *mongo.Database
+    collection   *mongo.Collection
+    appointments *mongo.Collection
+}
+
+// NewDialysisScheduleGateway creates a new instance of DialysisScheduleGateway
+func NewDialysisScheduleGateway(db *mongo.Database) *DialysisScheduleGateway {
+    return &DialysisScheduleGateway{
+        db:           db,
+        collection:   db.Collection("dialysis_schedules"),
+        appointments: db.Collection("dialysis_appointments"),
+    }
+}
+
+// EnsureIndexes stops a schedule from being materialized twice for the same date
+func (sg *DialysisScheduleGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := sg.appointments.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "schedule_id", Value: 1}, {Key: "occurrence_date", Value: 1}},
+        Options: options.Index().SetUnique(true).
+            SetPartialFilterExpression(bson.M{"schedule_id": bson.M{"$exists": true}}),
+    })
+    return err
+}
+
+// GetSchedules retrieves recurring schedules, a non-zero patientID limits them to that patient
+func (sg *DialysisScheduleGateway) GetSchedules(patientID, limit, offset int) ([]models.DialysisSchedule, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find()
+    opts.SetLimit(int64(limit))
+    opts.SetSkip(int64(offset))
+
+    cursor, err := sg.collection.Find(ctx, scopeToPatient(bson.M{}, patientID), opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    var schedules []models.DialysisSchedule
+    for cursor.Next(ctx) {
+        var schedule models.DialysisSchedule
+        if err := cursor.Decode(&schedule); err != nil {
+            return nil, err
+        }
+        schedules = append(schedules, schedule)
+    }
+    return schedules, nil
+}
+
+func (sg *DialysisScheduleGateway) GetTotalScheduleCount(patientID int) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := sg.collection.CountDocuments(ctx, scopeToPatient(bson.M{}, patientID))
+    return int(count), err
+}
+
+// GetSchedule retrieves a single recurring schedule
+func (sg *DialysisScheduleGateway) GetSchedule(scheduleID int) (*models.DialysisSchedule, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var schedule models.DialysisSchedule
+    err := sg.collection.FindOne(ctx, bson.M{"schedule_id": scheduleID}).Decode(&schedule)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("no schedule found with ID %d", scheduleID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &schedule, nil
+}
+
+// CreateSchedule stores a new recurring schedule and materializes it up to the default horizon
+func (sg *DialysisScheduleGateway) CreateSchedule(schedule *models.DialysisSchedule) error {
+    if err := validateSchedule(schedule); err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, sg.db, "dialysis_schedules", "schedule_id")
+    if err != nil {
+        return err
+    }
+    schedule.ID = id
+
+    if _, err := sg.collection.InsertOne(ctx, schedule); err != nil {
+        return err
+    }
+
+    _, schedule.Skipped, err = sg.Materialize(schedule, time.Now().Add(DefaultScheduleHorizon))
+    return err
+}
+
+// Materialize creates the dialysis appointments of a schedule from today up to horizon.
+// Occurrences that already exist, including edited or cancelled ones, are left untouched,
+// and none are created on days the clinic is closed. Each occurrence is booked like any other
+// appointment, so one that clashes with the patient, staff member or station, or whose station
+// cannot take the patient that day, is not created and is reported back instead.
+func (sg *DialysisScheduleGateway) Materialize(schedule *models.DialysisSchedule, horizon time.Time) (int, []models.SkippedOccurrence, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    created, skipped, err := sg.materialize(ctx, schedule, horizon, func(slot bookingSlot, write func(ctx context.Context) error) error {
+        return withBookingLock(sg.db, slot, write)
+    })
+    return len(created), skipped, err
+}
+
+// bookFunc books one occurrence, either in a transaction of its own or in one already running
+type bookFunc func(slot bookingSlot, write func(ctx context.Context) error) error
+
+// materialize creates the occurrences Materialize describes, booking each with book, and returns them
+func (sg *DialysisScheduleGateway) materialize(ctx context.Context, schedule *models.DialysisSchedule, horizon time.Time, book bookFunc) ([]models.DialysisAppointment, []models.SkippedOccurrence, error) {
+    created := []models.DialysisAppointment{}
+    skipped := []models.SkippedOccurrence{}
+    dates, err := occurrenceDates(schedule, time.Now(), horizon)
+    if err != nil {
+        return created, skipped, err
+    }
+
+    if len(dates) == 0 {
+        return created, skipped, nil
+    }
+    closed, err := closedDates(ctx, sg.db, dates[0], dates[len(dates)-1])
+    if err != nil {
+        return created, skipped, err
+    }
+
+    for _, date := range dates {
+        if closed[date] {
+            continue
+        }
+        exists, err := sg.appointments.CountDocuments(ctx, bson.M{"schedule_id": schedule.ID, "occurrence_date": date})
+        if err != nil {
+            return created, skipped, err
+        }
+        if exists > 0 {
+            continue
+        }
+
+        id, err := nextAppointmentID(sg.db)
+        if err != nil {
+            return created, skipped, err
+        }
+
+        appointment := models.DialysisAppointment{
+            ID:             id,
+            Date:           date,
+            Time:           models.ShiftStartTimes[schedule.Shift],
+            Status:         models.StatusConfirmed,
+            PatientID:      schedule.PatientID,
+            PatientName:    schedule.PatientName,
+            StaffID:        schedule.StaffID,
+            StaffName:      schedule.StaffName,
+            Shift:          schedule.Shift,
+            StationID:      schedule.StationID,
+            ScheduleID:     schedule.ID,
+            OccurrenceDate: date,
+            StatusHistory: []models.StatusChange{{
+                To:        models.StatusConfirmed,
+                Reason:    fmt.Sprintf("materialized from schedule %d", schedule.ID),
+                ChangedAt: time.Now(),
+            }},
+        }
+        if err := appointment.ResolveTimes(); err != nil {
+            return created, skipped, err
+        }
+
+        err = book(dialysisSlot(&appointment), func(ctx context.Context) error {
+            if err := checkStationFree(ctx, sg.db, &appointment); err != nil {
+                return err
+            }
+            _, err := sg.appointments.InsertOne(ctx, appointment)
+            return err
+        })
+        // Another request materialized this date first
+        if mongo.IsDuplicateKeyError(err) {
+            continue
+        }
+        if refused, ok := refusedOccurrence(schedule, date, err); ok {
+            skipped = append(skipped, refused)
+            continue
+        }
+        if err != nil {
+            return created, skipped, err
+        }
+        created = append(created, appointment)
+    }
+    return created, skipped, nil
+}
+
+// nextAppointmentID draws an appointment ID outside of any transaction an appointment is booked in, so a booking
+// that is retried or rolled back only leaves a gap rather than holding the shared counter until it commits
+func nextAppointmentID(db *mongo.Database) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return nextID(ctx, db, "dialysis_appointments", "appointment_id")
+}
+
+// refusedOccurrence reports an occurrence whose booking was refused, rather than failed, so the rest of the
+// series can still be materialized
+func refusedOccurrence(schedule *models.DialysisSchedule, date string, err error) (models.SkippedOccurrence, bool) {
+    skipped := models.SkippedOccurrence{ScheduleID: schedule.ID, PatientID: schedule.PatientID, Date: date}
+    if err == nil || !bookingRefused(err) {
+        return skipped, false
+    }
+    var conflict *ConflictError
+    if errors.As(err, &conflict) {
+        skipped.Conflicts = conflict.Conflicts
+    }
+    skipped.Reason = err.Error()
+    return skipped, true
+}
+
+// MaterializeAll extends every schedule that has not ended yet up to horizon, reporting the occurrences
+// that could not be booked
+func (sg *DialysisScheduleGateway) MaterializeAll(horizon time.Time) (int, []models.SkippedOccurrence, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    today := models.LocalDate(time.Now())
+    filter := bson.M{
+        "$or": []bson.M{
+            {"end_date": bson.M{"$exists": false}},
+            {"end_date": ""},
+            {"end_date": bson.M{"$gte": today}},
+        },
+    }
+
+    skipped := []models.SkippedOccurrence{}
+    cursor, err := sg.collection.Find(ctx, filter)
+    if err != nil {
+        return 0, skipped, err
+    }
+    var schedules []models.DialysisSchedule
+    if err := cursor.All(ctx, &schedules); err != nil {
+        return 0, skipped, err
+    }
+
+    total := 0
+    for i := range schedules {
+        created, refused, err := sg.Materialize(&schedules[i], horizon)
+        total += created
+        skipped = append(skipped, refused...)
+        if err != nil {
+            return total, skipped, err
+        }
+    }
+    return total, skipped, nil
+}
+
+// UpdateOccurrence changes the station or staff of a single materialized appointment and marks it as an
+// exception, so materializing the series again does not overwrite it. Moving it to another date or time is
+// refused with ErrMoveNeedsReschedule, since a move goes through rescheduling to keep the original on record.
+func (sg *DialysisScheduleGateway) UpdateOccurrence(appointment *models.DialysisAppointment) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := bson.M{"appointment_id": appointment.ID, "schedule_id": bson.M{"$exists": true}}
+
+    var existing models.DialysisAppointment
+    err := sg.appointments.FindOne(ctx, filter).Decode(&existing)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointment.ID)
+    }
+    if err != nil {
+        return err
+    }
+    if movesAppointment(appointment.Date, appointment.Time, appointment.StartsAt, existing.StartsAt) {
+        return ErrMoveNeedsReschedule
+    }
+
+    if appointment.StationID != 0 {
+        existing.StationID = appointment.StationID
+    }
+    if appointment.StaffID != 0 {
+        existing.StaffID = appointment.StaffID
+        existing.StaffName = appointment.StaffName
+    }
+
+    update := bson.M{
+        "$set": bson.M{
+            "station_id":   existing.StationID,
+            "staff_id":     existing.StaffID,
+            "staff_name":   existing.StaffName,
+            "is_exception": true,
+        },
+    }
+
+    err = withBookingLock(sg.db, dialysisSlot(&existing), func(ctx context.Context) error {
+        if err := checkStationFree(ctx, sg.db, &existing); err != nil {
+            return err
+        }
+        _, err := sg.appointments.UpdateOne(ctx, filter, update)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    existing.IsException = true
+    *appointment = existing
+    return nil
+}
+
+// CancelOccurrence cancels a single materialized appointment. The row is kept as a cancelled
+// exception so materializing the series again does not bring it back.
+func (sg *DialysisScheduleGateway) CancelOccurrence(appointmentID int, change *models.StatusChange) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := bson.M{"appointment_id": appointmentID, "schedule_id": bson.M{"$exists": true}}
+    change.To = models.StatusCancelled
+    return transitionStatus(ctx, sg.appointments, filter, change, bson.M{"is_exception": true})
+}
+
+// UpdateSeriesFrom applies changes to a schedule from a date onward. When the date falls after
+// the start of the series, the series is split: the original ends the day before and a new
+// schedule carries the changes. Upcoming occurrences from that date are regenerated, all in one
+// transaction so no other booking sees the series half changed. The slots the changed series
+// gives up are returned to be offered to the waitlist.
+func (sg *DialysisScheduleGateway) UpdateSeriesFrom(scheduleID int, from string, changes *models.DialysisSchedule) (*models.DialysisSchedule, []models.SlotOffer, error) {
+    original, err := sg.GetSchedule(scheduleID)
+    if err != nil {
+        return nil, nil, err
+    }
+    fromDate, err := time.Parse(dateLayout, from)
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid from date %q", from)
+    }
+
+    split := from > original.StartDate
+    updated := *changes
+    updated.PatientID = original.PatientID
+    updated.PatientName = original.PatientName
+    if updated.EndDate == "" {
+        updated.EndDate = original.EndDate
+    }
+    if split {
+        updated.StartDate = from
+        updated.ParentID = original.ID
+    } else {
+        // The whole series changes, keep the same schedule
+        updated.ID = original.ID
+        updated.StartDate = original.StartDate
+        updated.ParentID = original.ParentID
+    }
+    if err := validateSchedule(&updated); err != nil {
+        return nil, nil, err
+    }
+
+    if split {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if updated.ID, err = nextID(ctx, sg.db, "dialysis_schedules", "schedule_id"); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    var freed []models.SlotOffer
+    err = inTransaction(sg.db, 30*time.Second, func(ctx context.Context) error {
+        if split {
+            end := fromDate.AddDate(0, 0, -1).Format(dateLayout)
+            if _, err := sg.collection.UpdateOne(ctx, bson.M{"schedule_id": original.ID}, bson.M{"$set": bson.M{"end_date": end}}); err != nil {
+                return err
+            }
+            if _, err := sg.collection.InsertOne(ctx, updated); err != nil {
+                return err
+            }
+        } else if _, err := sg.collection.ReplaceOne(ctx, bson.M{"schedule_id": original.ID}, updated); err != nil {
+            return err
+        }
+
+        removed, err := sg.removeUpcomingOccurrences(ctx, original.ID, from)
+        if err != nil {
+            return err
+        }
+        created, skipped, err := sg.materialize(ctx, &updated, time.Now().Add(DefaultScheduleHorizon), func(slot bookingSlot, write func(ctx context.Context) error) error {
+            return bookUnderLock(ctx, sg.db, slot, write)
+        })
+        if err != nil {
+            return err
+        }
+        updated.Skipped = skipped
+        freed = freedSlots(removed, created)
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return &updated, freed, nil
+}
+
+// EndSeriesFrom stops a schedule from a date onward and removes its upcoming occurrences, returning the slots
+// they held to be offered to the waitlist
+func (sg *DialysisScheduleGateway) EndSeriesFrom(scheduleID int, from string) ([]models.SlotOffer, error) {
+    fromDate, err := time.Parse(dateLayout, from)
+    if err != nil {
+        return nil, fmt.Errorf("invalid from date %q", from)
+    }
+
+    end := fromDate.AddDate(0, 0, -1).Format(dateLayout)
+    var removed []models.DialysisAppointment
+    err = inTransaction(sg.db, 15*time.Second, func(ctx context.Context) error {
+        result, err := sg.collection.UpdateOne(ctx, bson.M{"schedule_id": scheduleID}, bson.M{"$set": bson.M{"end_date": end}})
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return fmt.Errorf("no schedule found with ID %d", scheduleID)
+        }
+        removed, err = sg.removeUpcomingOccurrences(ctx, scheduleID, from)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return freedSlots(removed, nil), nil
+}
+
+// removeUpcomingOccurrences deletes the upcoming occurrences of a schedule from a date onward that still
+// follow the series, and returns them. Past and attended occurrences are kept as a record of what happened,
+// cancelled ones as a record of why, and edited ones because their slot was chosen by hand.
+func (sg *DialysisScheduleGateway) removeUpcomingOccurrences(ctx context.Context, scheduleID int, from string) ([]models.DialysisAppointment, error) {
+    if today := models.LocalDate(time.Now()); from < today {
+        from = today
+    }
+    cursor, err := sg.appointments.Find(ctx, bson.M{
+        "schedule_id":     scheduleID,
+        "occurrence_date": bson.M{"$gte": from},
+        "is_exception":    bson.M{"$ne": true},
+        "status":          bson.M{"$in": []string{"scheduled", models.StatusRequested, models.StatusConfirmed}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    upcoming := []models.DialysisAppointment{}
+    if err := cursor.All(ctx, &upcoming); err != nil {
+        return nil, err
+    }
+    if len(upcoming) == 0 {
+        return upcoming, nil
+    }
+
+    ids := make([]int, len(upcoming))
+    for i, appointment := range upcoming {
+        ids[i] = appointment.ID
+    }
+    _, err = sg.appointments.DeleteMany(ctx, bson.M{"appointment_id": bson.M{"$in": ids}})
+    return upcoming, err
+}
+
+// freedSlots lists the slots of removed occurrences that the changed series did not book again
+func freedSlots(removed, rebooked []models.DialysisAppointment) []models.SlotOffer {
+    taken := map[string]bool{}
+    for _, appointment := range rebooked {
+        taken[fmt.Sprintf("%s %s %d", appointment.Date, appointment.Time, appointment.StationID)] = true
+    }
+
+    freed := []models.SlotOffer{}
+    for _, appointment := range removed {
+        if !taken[fmt.Sprintf("%s %s %d", appointment.Date, appointment.Time, appointment.StationID)] {
+            freed = append(freed, appointment.FreedSlot())
+        }
+    }
+    return freed
+}
+
+// validateSchedule checks the pattern, shift and dates of a schedule
+func validateSchedule(schedule *models.DialysisSchedule) error {
+    if _, ok := patternDays[schedule.Pattern]; !ok {
+        return fmt.Errorf("invalid pattern %q, expected %s or %s", schedule.Pattern, models.PatternMWF, models.PatternTTS)
+    }
+    if _, ok := models.ShiftStartTimes[schedule.Shift]; !ok {
+        return fmt.Errorf("invalid shift %q", schedule.Shift)
+    }
+    if _, err := time.Parse(dateLayout, schedule.StartDate); err != nil {
+        return fmt.Errorf("invalid start date %q", schedule.StartDate)
+    }
+    if schedule.EndDate != "" {
+        if _, err := time.Parse(dateLayout, schedule.EndDate); err != nil {
+            return fmt.Errorf("invalid end date %q", schedule.EndDate)
+        }
+        if schedule.EndDate < schedule.StartDate {
+            return fmt.Errorf("end date is before start date")
+        }
+    }
+    return nil
+}
+
+// occurrenceDates lists the dates a schedule dialyses on between from and until, clipped to the schedule's own dates
+func occurrenceDates(schedule *models.DialysisSchedule, from, until time.Time) ([]string, error) {
+    start, err := time.Parse(dateLayout, schedule.StartDate)
+    if err != nil {
+        return nil, err
+    }
+    from, _ = time.Parse(dateLayout, models.LocalDate(from))
+    if start.After(from) {
+        from = start
+    }
+    if schedule.EndDate != "" {
+        end, err := time.Parse(dateLayout, schedule.EndDate)
+        if err != nil {
+            return nil, err
+        }
+        if end.Before(until) {
+            until = end
+        }
+    }
+
+    var dates []string
+    for day := from; !day.After(until); day = day.AddDate(0, 0, 1) {
+        for _, weekday := range patternDays[schedule.Pattern] {
+            if day.Weekday() == weekday {
+                dates = append(dates, day.Format(dateLayout))
+            }
+        }
+    }
+    return dates, nil
+}
@@ -0,0 +1,383 @@
+package gateways
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestOccurrenceDates(t *testing.T) {
+    monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    sunday := time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name        string
+        schedule    models.DialysisSchedule
+        from, until time.Time
+        want        []string
+        wantErr     bool
+    }{
+        {
+            name:     "Monday, Wednesday, Friday",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01"},
+            from:     monday,
+            until:    sunday,
+            want:     []string{"2024-01-01", "2024-01-03", "2024-01-05"},
+        },
+        {
+            name:     "Tuesday, Thursday, Saturday",
+            schedule: models.DialysisSchedule{Pattern: models.PatternTTS, StartDate: "2023-12-01"},
+            from:     monday,
+            until:    sunday,
+            want:     []string{"2024-01-02", "2024-01-04", "2024-01-06"},
+        },
+        {
+            name:     "schedule starting mid-week",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2024-01-02"},
+            from:     monday,
+            until:    sunday,
+            want:     []string{"2024-01-03", "2024-01-05"},
+        },
+        {
+            name:     "schedule ending mid-week",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01", EndDate: "2024-01-03"},
+            from:     monday,
+            until:    sunday,
+            want:     []string{"2024-01-01", "2024-01-03"},
+        },
+        {
+            name:     "from part way through a day",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01"},
+            from:     monday.Add(15 * time.Hour),
+            until:    sunday,
+            want:     []string{"2024-01-01", "2024-01-03", "2024-01-05"},
+        },
+        {
+            name:     "until part way through a day",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01"},
+            from:     monday,
+            until:    monday.AddDate(0, 0, 4).Add(9 * time.Hour),
+            want:     []string{"2024-01-01", "2024-01-03", "2024-01-05"},
+        },
+        {
+            name:     "ended before the range",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01", EndDate: "2023-12-29"},
+            from:     monday,
+            until:    sunday,
+            want:     nil,
+        },
+        {
+            name:     "unknown pattern",
+            schedule: models.DialysisSchedule{Pattern: "daily", StartDate: "2023-12-01"},
+            from:     monday,
+            until:    sunday,
+            want:     nil,
+        },
+        {
+            name:     "invalid start date",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "01/12/2023"},
+            from:     monday,
+            until:    sunday,
+            wantErr:  true,
+        },
+        {
+            name:     "invalid end date",
+            schedule: models.DialysisSchedule{Pattern: models.PatternMWF, StartDate: "2023-12-01", EndDate: "soon"},
+            from:     monday,
+            until:    sunday,
+            wantErr:  true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := occurrenceDates(&tt.schedule, tt.from, tt.until)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("occurrenceDates() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+                t.Errorf("occurrenceDates() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestValidateSchedule(t *testing.T) {
+    valid := models.DialysisSchedule{Pattern: models.PatternMWF, Shift: "morning", StartDate: "2024-01-01"}
+
+    tests := []struct {
+        name    string
+        change  func(*models.DialysisSchedule)
+        wantErr bool
+    }{
+        {"valid", func(s *models.DialysisSchedule) {}, false},
+        {"open ended", func(s *models.DialysisSchedule) { s.EndDate = "" }, false},
+        {"unknown pattern", func(s *models.DialysisSchedule) { s.Pattern = "daily" }, true},
+        {"unknown shift", func(s *models.DialysisSchedule) { s.Shift = "night" }, true},
+        {"invalid start date", func(s *models.DialysisSchedule) { s.StartDate = "01/01/2024" }, true},
+        {"invalid end date", func(s *models.DialysisSchedule) { s.EndDate = "soon" }, true},
+        {"ends before it starts", func(s *models.DialysisSchedule) { s.EndDate = "2023-12-31" }, true},
+    }
+
+    for _, tt := range tests {
+        schedule := valid
+        tt.change(&schedule)
+        if err := validateSchedule(&schedule); (err != nil) != tt.wantErr {
+            t.Errorf("%s: validateSchedule() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+        }
+    }
+}
+
+func TestMaterializeSkipsExistingOccurrences(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("only missing dates are created", func(mt *mtest.T) {
+        today := time.Now().Format(dateLayout)
+        schedule := &models.DialysisSchedule{
+            ID: 3, PatientID: 7, Pattern: models.PatternMWF, Shift: "morning",
+            StartDate: today, EndDate: time.Now().AddDate(0, 0, 6).Format(dateLayout),
+        }
+        dates, _ := occurrenceDates(schedule, time.Now(), time.Now().Add(DefaultScheduleHorizon))
+
+        // The first date already exists, maybe as an edited or cancelled exception
+        mt.AddMockResponses(found("closures"), counted("dialysis_appointments", 1))
+        for range dates[1:] {
+            mt.AddMockResponses(counted("dialysis_appointments", 0))
+            mt.AddMockResponses(nextIDResponses(10)...)
+            // Booked under the patient's lock: lock, closure check, a clash lookup per appointment type, insert, commit
+            mt.AddMockResponses(mtest.CreateSuccessResponse(), counted("closures", 0))
+            mt.AddMockResponses(found("dialysis_appointments"), found("nephrologist_appointments"))
+            mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+        }
+
+        created, skipped, err := NewDialysisScheduleGateway(mt.DB).Materialize(schedule, time.Now().Add(DefaultScheduleHorizon))
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if len(skipped) != 0 {
+            mt.Errorf("skipped %v, want none", skipped)
+        }
+        if created != len(dates)-1 {
+            mt.Errorf("created %d occurrences, want %d", created, len(dates)-1)
+        }
+
+        inserted := sentDocuments(mt, "insert")
+        if len(inserted) != len(dates)-1 {
+            mt.Fatalf("inserted %d appointments, want %d", len(inserted), len(dates)-1)
+        }
+        for i, doc := range inserted {
+            if date := doc.Lookup("occurrence_date").StringValue(); date != dates[i+1] {
+                mt.Errorf("occurrence %d is on %s, want %s", i, date, dates[i+1])
+            }
+            if doc.Lookup("schedule_id").Int32() != 3 || doc.Lookup("time").StringValue() != "06:00" {
+                mt.Errorf("occurrence %v does not follow the schedule", doc)
+            }
+            if to := doc.Lookup("status_history", "0", "to").StringValue(); to != models.StatusConfirmed {
+                mt.Errorf("occurrence %d history starts at %q, want %q", i, to, models.StatusConfirmed)
+            }
+        }
+    })
+}
+
+func TestUpdateSeriesFrom(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    original := bson.D{
+        {Key: "schedule_id", Value: 3},
+        {Key: "patient_id", Value: 7},
+        {Key: "pattern", Value: models.PatternMWF},
+        {Key: "shift", Value: "morning"},
+        {Key: "start_date", Value: "2020-01-01"},
+    }
+    // Ending the changed series in the past keeps Materialize from creating anything
+    changes := &models.DialysisSchedule{PatientID: 99, Pattern: models.PatternTTS, Shift: "evening", StartDate: "2020-01-01", EndDate: "2020-06-30"}
+
+    upcoming := bson.D{
+        {Key: "appointment_id", Value: 20},
+        {Key: "schedule_id", Value: 3},
+        {Key: "date", Value: "2030-01-02"},
+        {Key: "time", Value: "06:00"},
+        {Key: "station_id", Value: 5},
+        {Key: "status", Value: models.StatusConfirmed},
+    }
+
+    mt.Run("a later date splits the series", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_schedules", original))
+        mt.AddMockResponses(nextIDResponses(4)...)
+        // In one transaction: end the original, insert the new series, remove its upcoming occurrences, commit
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), mtest.CreateSuccessResponse())
+        mt.AddMockResponses(found("dialysis_appointments", upcoming), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+        updated, freed, err := NewDialysisScheduleGateway(mt.DB).UpdateSeriesFrom(3, "2020-06-01", changes)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if updated.ID != 4 || updated.ParentID != 3 || updated.StartDate != "2020-06-01" || updated.PatientID != 7 {
+            mt.Errorf("new series = %+v, want ID 4 continuing schedule 3 for patient 7 from 2020-06-01", updated)
+        }
+
+        updates := sentUpdates(mt)
+        if len(updates) != 1 || updates[0].Lookup("$set", "end_date").StringValue() != "2020-05-31" {
+            mt.Errorf("original series updates = %v, want it to end on 2020-05-31", updates)
+        }
+
+        finds := sentFilters(mt, "find")
+        removable := finds[len(finds)-1]
+        // Occurrences before today are history, whatever the from date
+        if from := removable.Lookup("occurrence_date", "$gte").StringValue(); from != time.Now().Format(dateLayout) {
+            mt.Errorf("removed occurrences from %s, want from today", from)
+        }
+        if _, err := removable.LookupErr("is_exception", "$ne"); err != nil {
+            mt.Errorf("removal filter %v does not keep edited occurrences", removable)
+        }
+        if statuses := removable.Lookup("status", "$in").String(); strings.Contains(statuses, models.StatusCancelled) || strings.Contains(statuses, models.StatusCompleted) {
+            mt.Errorf("removal filter %v removes occurrences that are over", removable)
+        }
+        deletes := sentFilters(mt, "delete")
+        if len(deletes) != 1 || !strings.Contains(deletes[0].String(), `"$in": [{"$numberInt":"20"}]`) {
+            mt.Errorf("deletes = %v, want occurrence 20 removed", deletes)
+        }
+        if len(freed) != 1 || freed[0].FreedAppointmentID != 20 || freed[0].StationID != 5 {
+            mt.Errorf("freed = %+v, want the slot of occurrence 20 offered", freed)
+        }
+        if commits := commandCount(mt, "commitTransaction"); commits != 1 {
+            mt.Errorf("committed %d transactions, want the whole edit in 1", commits)
+        }
+    })
+
+    mt.Run("the start date changes the whole series", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_schedules", original))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), found("dialysis_appointments"), mtest.CreateSuccessResponse())
+
+        updated, freed, err := NewDialysisScheduleGateway(mt.DB).UpdateSeriesFrom(3, "2020-01-01", changes)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if updated.ID != 3 || updated.StartDate != "2020-01-01" || updated.Pattern != models.PatternTTS {
+            mt.Errorf("series = %+v, want schedule 3 replaced with the changes", updated)
+        }
+        if len(freed) != 0 {
+            mt.Errorf("freed = %+v, want none", freed)
+        }
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "insert" {
+                mt.Error("a new schedule was inserted for a whole-series change")
+            }
+        }
+    })
+
+    mt.Run("changes without a start date keep the series start", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_schedules", original))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), found("dialysis_appointments"), mtest.CreateSuccessResponse())
+
+        unstarted := &models.DialysisSchedule{Pattern: models.PatternTTS, Shift: "evening", EndDate: "2020-06-30"}
+        updated, _, err := NewDialysisScheduleGateway(mt.DB).UpdateSeriesFrom(3, "2020-01-01", unstarted)
+        if err != nil {
+            mt.Fatalf("UpdateSeriesFrom() error = %v", err)
+        }
+        if updated.StartDate != "2020-01-01" {
+            mt.Errorf("start date = %q, want the series start 2020-01-01", updated.StartDate)
+        }
+    })
+
+    mt.Run("invalid changes are refused before writing", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_schedules", original))
+
+        _, _, err := NewDialysisScheduleGateway(mt.DB).UpdateSeriesFrom(3, "2020-06-01", &models.DialysisSchedule{Pattern: "daily", Shift: "morning", StartDate: "2020-01-01"})
+        if err == nil {
+            mt.Fatal("UpdateSeriesFrom() accepted an unknown pattern")
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 1 {
+            mt.Errorf("sent %d commands, want only the schedule lookup", len(events))
+        }
+    })
+}
+
+func TestFreedSlots(t *testing.T) {
+    removed := []models.DialysisAppointment{
+        {ID: 20, Date: "2030-01-02", Time: "06:00", StationID: 5},
+        {ID: 21, Date: "2030-01-04", Time: "06:00", StationID: 5},
+    }
+    rebooked := []models.DialysisAppointment{{ID: 30, Date: "2030-01-02", Time: "06:00", StationID: 5}}
+
+    freed := freedSlots(removed, rebooked)
+    if len(freed) != 1 || freed[0].FreedAppointmentID != 21 {
+        t.Errorf("freedSlots() = %+v, want only the slot of appointment 21", freed)
+    }
+}
+
+func TestRefusedOccurrence(t *testing.T) {
+    schedule := &models.DialysisSchedule{ID: 3, PatientID: 7}
+    clash := &ConflictError{Conflicts: []models.AppointmentConflict{{AppointmentID: 12, Type: "dialysis"}}}
+
+    tests := []struct {
+        name          string
+        err           error
+        wantRefused   bool
+        wantConflicts int
+    }{
+        {"booked", nil, false, 0},
+        {"clashes with another appointment", clash, true, 1},
+        {"chair taken", ErrStationTaken, true, 0},
+        {"machine waiting for disinfection", fmt.Errorf("%w: station 4", ErrMachineNeedsDisinfection), true, 0},
+        {"clinic closed", ErrClinicClosed, true, 0},
+        {"database failure", errors.New("connection reset"), false, 0},
+    }
+
+    for _, tt := range tests {
+        skipped, refused := refusedOccurrence(schedule, "2030-03-04", tt.err)
+        if refused != tt.wantRefused {
+            t.Errorf("%s: refused = %v, want %v", tt.name, refused, tt.wantRefused)
+            continue
+        }
+        if !refused {
+            continue
+        }
+        if skipped.ScheduleID != 3 || skipped.PatientID != 7 || skipped.Date != "2030-03-04" || skipped.Reason == "" {
+            t.Errorf("%s: skipped = %+v, want schedule 3, patient 7 on 2030-03-04 with a reason", tt.name, skipped)
+        }
+        if len(skipped.Conflicts) != tt.wantConflicts {
+            t.Errorf("%s: %d conflicts reported, want %d", tt.name, len(skipped.Conflicts), tt.wantConflicts)
+        }
+    }
+}
+
+func TestUpdateOccurrenceRefusesMoves(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    startsAt, _ := models.ParseLocal("2030-03-04", "06:00")
+    occurrence := bson.D{
+        {Key: "appointment_id", Value: 12},
+        {Key: "schedule_id", Value: 3},
+        {Key: "date", Value: "2030-03-04"},
+        {Key: "time", Value: "06:00"},
+        {Key: "starts_at", Value: startsAt},
+    }
+
+    moves := []struct {
+        name   string
+        change models.DialysisAppointment
+    }{
+        {"another date", models.DialysisAppointment{ID: 12, Date: "2030-03-05", Time: "06:00"}},
+        {"another time", models.DialysisAppointment{ID: 12, Date: "2030-03-04", Time: "12:00"}},
+        {"another start", models.DialysisAppointment{ID: 12, StartsAt: startsAt.Add(time.Hour)}},
+    }
+    for _, tt := range moves {
+        mt.Run(tt.name, func(mt *mtest.T) {
+            mt.AddMockResponses(found("dialysis_appointments", occurrence))
+
+            change := tt.change
+            if err := NewDialysisScheduleGateway(mt.DB).UpdateOccurrence(&change); !errors.Is(err, ErrMoveNeedsReschedule) {
+                mt.Errorf("UpdateOccurrence() error = %v, want ErrMoveNeedsReschedule", err)
+            }
+            if updates := sentUpdates(mt); len(updates) != 0 {
+                mt.Errorf("sent updates %v, want none", updates)
+            }
+        })
+    }
+}
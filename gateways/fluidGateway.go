@@ -0,0 +1,349 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WeightGain holds the interdialytic weight gains that raise an alert, overridden from the environment at startup
+var WeightGain = models.WeightGainThresholds{
+    MaxKg:      3,
+    MaxPercent: 4,
+}
+
+// ErrInvalidDryWeight is returned when a dry weight is out of range or has no patient or date
+var ErrInvalidDryWeight = errors.New("invalid dry weight")
+
+// ErrDryWeightNotFound is returned when there is no dry weight with an ID
+var ErrDryWeightNotFound = errors.New("dry weight not found")
+
+// FluidGateway keeps the dry weights nephrologists set and the weight patients gain between sessions
+type FluidGateway struct {
+    db         *mongo.Database
+    dryWeights *mongo.Collection
+    records    *mongo.Collection
+    patients   *mongo.Collection
+}
+
+// NewFluidGateway creates a new instance of FluidGateway
+func NewFluidGateway(db *mongo.Database) *FluidGateway {
+    return &FluidGateway{
+        db:         db,
+        dryWeights: db.Collection("dry_weights"),
+        records:    db.Collection("treatment_records"),
+        patients:   db.Collection("patients"),
+    }
+}
+
+// EnsureIndexes keeps the dry weight in effect on a day quick to find
+func (fg *FluidGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := fg.dryWeights.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "effective_from", Value: -1}},
+    })
+    return err
+}
+
+// GetDryWeights returns a patient's dry weight history, the latest effective first
+func (fg *FluidGateway) GetDryWeights(patientID int) ([]models.DryWeight, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    return fg.history(ctx, patientID)
+}
+
+// SetDryWeight records a new dry weight for a patient, effective from its date or today. Sessions from then on
+// have their weight gain measured against it again; alerts are only raised as sessions are recorded.
+func (fg *FluidGateway) SetDryWeight(dryWeight *models.DryWeight, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if dryWeight.EffectiveFrom == "" {
+        dryWeight.EffectiveFrom = time.Now().In(models.ClinicLocation).Format(dateLayout)
+    }
+    if err := validateDryWeight(dryWeight); err != nil {
+        return err
+    }
+
+    var patient models.Patient
+    err := fg.patients.FindOne(ctx, bson.M{"patient_id": dryWeight.PatientID}).Decode(&patient)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: no patient with ID %d", ErrInvalidDryWeight, dryWeight.PatientID)
+    }
+    if err != nil {
+        return err
+    }
+
+    id, err := nextID(ctx, fg.db, "dry_weights", "dry_weight_id")
+    if err != nil {
+        return err
+    }
+    dryWeight.ID = id
+    dryWeight.PatientName = patient.Name
+    dryWeight.SetBy = by
+    dryWeight.CreatedAt = time.Now()
+    if _, err := fg.dryWeights.InsertOne(ctx, dryWeight); err != nil {
+        return err
+    }
+    return fg.remeasure(ctx, dryWeight.PatientID, dryWeight.EffectiveFrom)
+}
+
+// DeleteDryWeight removes a dry weight entered in error, so the one before it is back in effect
+func (fg *FluidGateway) DeleteDryWeight(id int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var dryWeight models.DryWeight
+    err := fg.dryWeights.FindOneAndDelete(ctx, bson.M{"dry_weight_id": id}).Decode(&dryWeight)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrDryWeightNotFound, id)
+    }
+    if err != nil {
+        return err
+    }
+    return fg.remeasure(ctx, dryWeight.PatientID, dryWeight.EffectiveFrom)
+}
+
+// Assess measures the weight a patient gained before the session in appointmentID and stores it on the
+// session's record. A gain above the thresholds alerts the care team and the patient, once per session.
+// The following session is measured again too, as its gain starts from this session's post weight.
+func (fg *FluidGateway) Assess(appointmentID int) (*models.WeightGain, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var record models.TreatmentRecord
+    err := fg.records.FindOne(ctx, bson.M{"appointment_id": appointmentID}).Decode(&record)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w for appointment %d", ErrRecordNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := fg.measure(ctx, &record, true); err != nil {
+        return nil, err
+    }
+
+    var next models.TreatmentRecord
+    err = fg.records.FindOne(ctx, bson.M{
+        "patient_id": record.PatientID,
+        "$or": []bson.M{
+            {"date": bson.M{"$gt": record.Date}},
+            {"date": record.Date, "appointment_id": bson.M{"$gt": record.AppointmentID}},
+        },
+    }, options.FindOne().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "appointment_id", Value: 1}})).Decode(&next)
+    if err == nil {
+        err = fg.measure(ctx, &next, false)
+    }
+    if err != nil && err != mongo.ErrNoDocuments {
+        return nil, err
+    }
+    return record.WeightGain, nil
+}
+
+// GetTrend returns a patient's dry weight history and their weight gain per session between two dates, either
+// of which may be left empty
+func (fg *FluidGateway) GetTrend(patientID int, from, to string) (*models.FluidTrend, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    trend := &models.FluidTrend{PatientID: patientID, Thresholds: WeightGain, Sessions: []models.WeightGainPoint{}}
+    history, err := fg.history(ctx, patientID)
+    if err != nil {
+        return nil, err
+    }
+    trend.DryWeights = history
+    trend.DryWeight = dryWeightOn(history, time.Now().In(models.ClinicLocation).Format(dateLayout))
+
+    filter := recordFilter(patientID, from, to)
+    filter["pre_weight_kg"] = bson.M{"$gt": 0}
+    cursor, err := fg.records.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "appointment_id", Value: 1}}))
+    if err != nil {
+        return nil, err
+    }
+    var records []models.TreatmentRecord
+    if err := cursor.All(ctx, &records); err != nil {
+        return nil, err
+    }
+
+    var total float64
+    var measured int
+    for _, record := range records {
+        trend.PatientName = record.PatientName
+        point := models.WeightGainPoint{
+            AppointmentID: record.AppointmentID,
+            Date:          record.Date,
+            PreWeightKg:   record.PreWeightKg,
+            PostWeightKg:  record.PostWeightKg,
+        }
+        if dryWeight := dryWeightOn(history, record.Date); dryWeight != nil {
+            point.DryWeightKg = dryWeight.WeightKg
+        }
+        if gain := record.WeightGain; gain != nil {
+            point.GainKg = gain.GainKg
+            point.Percent = gain.Percent
+            point.AboveThreshold = gain.AboveThreshold
+            total += gain.GainKg
+            measured++
+            if gain.AboveThreshold {
+                trend.SessionsAboveMax++
+            }
+        }
+        trend.Sessions = append(trend.Sessions, point)
+    }
+    if measured > 0 {
+        trend.AverageGainKg = math.Round(total/float64(measured)*10) / 10
+    }
+    if trend.PatientName == "" && len(history) > 0 {
+        trend.PatientName = history[0].PatientName
+    }
+    return trend, nil
+}
+
+// history returns a patient's dry weights, the latest effective first
+func (fg *FluidGateway) history(ctx context.Context, patientID int) ([]models.DryWeight, error) {
+    opts := options.Find().SetSort(bson.D{{Key: "effective_from", Value: -1}, {Key: "dry_weight_id", Value: -1}})
+    cursor, err := fg.dryWeights.Find(ctx, bson.M{"patient_id": patientID}, opts)
+    if err != nil {
+        return nil, err
+    }
+    dryWeights := []models.DryWeight{}
+    if err := cursor.All(ctx, &dryWeights); err != nil {
+        return nil, err
+    }
+    return dryWeights, nil
+}
+
+// remeasure measures again the weight gains of a patient's sessions on or after a date, after their dry
+// weight changed
+func (fg *FluidGateway) remeasure(ctx context.Context, patientID int, from string) error {
+    cursor, err := fg.records.Find(ctx, bson.M{"patient_id": patientID, "date": bson.M{"$gte": from}})
+    if err != nil {
+        return err
+    }
+    var records []models.TreatmentRecord
+    if err := cursor.All(ctx, &records); err != nil {
+        return err
+    }
+    for i := range records {
+        if err := fg.measure(ctx, &records[i], false); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// measure works out the weight gained since the patient's previous session with a post weight and saves it
+// on the record. A session without a pre weight, or with no session before it, has none. With alert set, a
+// gain above the thresholds that has not been alerted yet is sent to the care team and the patient.
+func (fg *FluidGateway) measure(ctx context.Context, record *models.TreatmentRecord, alert bool) error {
+    var gain *models.WeightGain
+    if record.PreWeightKg > 0 {
+        var previous models.TreatmentRecord
+        err := fg.records.FindOne(ctx, bson.M{
+            "patient_id":     record.PatientID,
+            "post_weight_kg": bson.M{"$gt": 0},
+            "$or": []bson.M{
+                {"date": bson.M{"$lt": record.Date}},
+                {"date": record.Date, "appointment_id": bson.M{"$lt": record.AppointmentID}},
+            },
+        }, options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}, {Key: "appointment_id", Value: -1}})).Decode(&previous)
+        if err != nil && err != mongo.ErrNoDocuments {
+            return err
+        }
+        if err == nil {
+            history, err := fg.history(ctx, record.PatientID)
+            if err != nil {
+                return err
+            }
+            gain = weightGain(record, &previous, dryWeightOn(history, record.Date))
+        }
+    }
+
+    if gain != nil && gain.AboveThreshold && record.WeightGain != nil {
+        gain.AlertedAt = record.WeightGain.AlertedAt
+    }
+    if gain != nil && gain.AboveThreshold && gain.AlertedAt == nil && alert {
+        if err := fg.alert(ctx, record, gain); err != nil {
+            return err
+        }
+        now := time.Now()
+        gain.AlertedAt = &now
+    }
+
+    record.WeightGain = gain
+    _, err := fg.records.UpdateOne(ctx, bson.M{"appointment_id": record.AppointmentID}, bson.M{"$set": bson.M{"weight_gain": gain}})
+    return err
+}
+
+// alert tells the care team and the patient about a weight gain above the thresholds
+func (fg *FluidGateway) alert(ctx context.Context, record *models.TreatmentRecord, gain *models.WeightGain) error {
+    detail := fmt.Sprintf("%.1f kg", gain.GainKg)
+    if gain.DryWeightKg > 0 {
+        detail += fmt.Sprintf(" (%.1f%% of dry weight %.1f kg)", gain.Percent, gain.DryWeightKg)
+    }
+    staffMessage := fmt.Sprintf("Interdialytic weight gain of %s for %s between %s and %s, above the limit of %.1f kg or %.1f%%. Please review their fluid management.",
+        detail, record.PatientName, gain.PreviousDate, record.Date, WeightGain.MaxKg, WeightGain.MaxPercent)
+    if err := notifyCareTeam(ctx, fg.db, record.PatientID, record.PatientName, staffMessage); err != nil {
+        return err
+    }
+
+    patientMessage := fmt.Sprintf("You gained %.1f kg of fluid between your dialysis sessions on %s and %s, more than is safe. Please keep to your fluid allowance and speak to your care team if you need help with it.",
+        gain.GainKg, gain.PreviousDate, record.Date)
+    return notifyPatient(ctx, fg.db, record.PatientID, record.PatientName, patientMessage)
+}
+
+// weightGain is the weight a patient came in to a session with less the weight they left the previous one
+// with, as a percent of their dry weight when there is one
+func weightGain(record, previous *models.TreatmentRecord, dryWeight *models.DryWeight) *models.WeightGain {
+    gain := &models.WeightGain{
+        PreviousAppointmentID: previous.AppointmentID,
+        PreviousDate:          previous.Date,
+        PreviousPostWeightKg:  previous.PostWeightKg,
+        GainKg:                math.Round((record.PreWeightKg-previous.PostWeightKg)*10) / 10,
+    }
+    from, errFrom := time.Parse(dateLayout, previous.Date)
+    to, errTo := time.Parse(dateLayout, record.Date)
+    if errFrom == nil && errTo == nil {
+        gain.IntervalDays = int(to.Sub(from).Hours() / 24)
+    }
+    if dryWeight != nil {
+        gain.DryWeightKg = dryWeight.WeightKg
+        gain.Percent = math.Round(gain.GainKg/dryWeight.WeightKg*1000) / 10
+    }
+    gain.AboveThreshold = (WeightGain.MaxKg > 0 && gain.GainKg > WeightGain.MaxKg) ||
+        (WeightGain.MaxPercent > 0 && gain.DryWeightKg > 0 && gain.Percent > WeightGain.MaxPercent)
+    return gain
+}
+
+// dryWeightOn returns the dry weight in effect on a day from a history with the latest effective first
+func dryWeightOn(history []models.DryWeight, date string) *models.DryWeight {
+    for i := range history {
+        if history[i].EffectiveFrom <= date {
+            return &history[i]
+        }
+    }
+    return nil
+}
+
+func validateDryWeight(dryWeight *models.DryWeight) error {
+    if dryWeight.PatientID == 0 {
+        return fmt.Errorf("%w: a patient_id is required", ErrInvalidDryWeight)
+    }
+    if dryWeight.WeightKg < 20 || dryWeight.WeightKg > 300 {
+        return fmt.Errorf("%w: %.1f kg is out of range", ErrInvalidDryWeight, dryWeight.WeightKg)
+    }
+    if _, err := time.Parse(dateLayout, dryWeight.EffectiveFrom); err != nil {
+        return fmt.Errorf("%w: invalid effective_from %q, expected YYYY-MM-DD", ErrInvalidDryWeight, dryWeight.EffectiveFrom)
+    }
+    return nil
+}
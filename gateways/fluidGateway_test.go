@@ -0,0 +1,103 @@
+package gateways
+
+import (
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+func TestWeightGain(t *testing.T) {
+    defer func(thresholds models.WeightGainThresholds) { WeightGain = thresholds }(WeightGain)
+    WeightGain = models.WeightGainThresholds{MaxKg: 3, MaxPercent: 4}
+
+    previous := &models.TreatmentRecord{AppointmentID: 5, Date: "2024-03-01", PostWeightKg: 70}
+    tests := []struct {
+        name      string
+        record    models.TreatmentRecord
+        previous  *models.TreatmentRecord
+        dryWeight *models.DryWeight
+        want      models.WeightGain
+    }{
+        {
+            name:      "within limits",
+            record:    models.TreatmentRecord{Date: "2024-03-04", PreWeightKg: 72.5},
+            previous:  previous,
+            dryWeight: &models.DryWeight{WeightKg: 70},
+            want:      models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, IntervalDays: 3, GainKg: 2.5, DryWeightKg: 70, Percent: 3.6},
+        },
+        {
+            name:      "above the kg limit",
+            record:    models.TreatmentRecord{Date: "2024-03-04", PreWeightKg: 73.4},
+            previous:  previous,
+            dryWeight: &models.DryWeight{WeightKg: 90},
+            want:      models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, IntervalDays: 3, GainKg: 3.4, DryWeightKg: 90, Percent: 3.8, AboveThreshold: true},
+        },
+        {
+            name:      "above the percent limit only",
+            record:    models.TreatmentRecord{Date: "2024-03-03", PreWeightKg: 72.5},
+            previous:  previous,
+            dryWeight: &models.DryWeight{WeightKg: 50},
+            want:      models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, IntervalDays: 2, GainKg: 2.5, DryWeightKg: 50, Percent: 5, AboveThreshold: true},
+        },
+        {
+            name:     "no dry weight leaves the percent out",
+            record:   models.TreatmentRecord{Date: "2024-03-03", PreWeightKg: 72.5},
+            previous: previous,
+            want:     models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, IntervalDays: 2, GainKg: 2.5},
+        },
+        {
+            name:     "weight lost between sessions",
+            record:   models.TreatmentRecord{Date: "2024-03-03", PreWeightKg: 69.2},
+            previous: previous,
+            want:     models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, IntervalDays: 2, GainKg: -0.8},
+        },
+        {
+            name:     "unreadable dates leave the interval out",
+            record:   models.TreatmentRecord{Date: "", PreWeightKg: 71},
+            previous: previous,
+            want:     models.WeightGain{PreviousAppointmentID: 5, PreviousDate: "2024-03-01", PreviousPostWeightKg: 70, GainKg: 1},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := weightGain(&tt.record, tt.previous, tt.dryWeight); *got != tt.want {
+                t.Errorf("weightGain() = %+v, want %+v", *got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDryWeightOn(t *testing.T) {
+    history := []models.DryWeight{
+        {ID: 3, WeightKg: 67.5, EffectiveFrom: "2024-03-01"},
+        {ID: 2, WeightKg: 68, EffectiveFrom: "2024-02-01"},
+        {ID: 1, WeightKg: 70, EffectiveFrom: "2024-01-01"},
+    }
+
+    tests := []struct {
+        name    string
+        history []models.DryWeight
+        date    string
+        want    int
+    }{
+        {"latest in effect", history, "2024-04-10", 3},
+        {"on the day it takes effect", history, "2024-03-01", 3},
+        {"day before a change", history, "2024-02-29", 2},
+        {"first dry weight", history, "2024-01-15", 1},
+        {"before any dry weight", history, "2023-12-31", 0},
+        {"no history", nil, "2024-03-01", 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := dryWeightOn(tt.history, tt.date)
+            switch {
+            case tt.want == 0 && got != nil:
+                t.Errorf("dryWeightOn(%q) = %+v, want none", tt.date, *got)
+            case tt.want != 0 && (got == nil || got.ID != tt.want):
+                t.Errorf("dryWeightOn(%q) = %+v, want dry weight %d", tt.date, got, tt.want)
+            }
+        })
+    }
+}
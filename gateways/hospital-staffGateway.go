@@ -13,12 +13,14 @@ import (
 )
 
 type HospitalStaffGateway struct {
-    collection *mongo.Collection
+    collection  *mongo.Collection
+    credentials *mongo.Collection
 }
 
 func NewHospitalStaffGateway(db *mongo.Database) *HospitalStaffGateway {
     return &HospitalStaffGateway{
-        collection: db.Collection("hospital_staff"),
+        collection:  db.Collection("hospital_staff"),
+        credentials: db.Collection("credentials"),
     }
 }
 
@@ -107,17 +109,19 @@ func (hsg *HospitalStaffGateway) UpdateHospitalStaff(staff *models.HospitalStaff
     defer cancel()
 
     filter := bson.M{"staff_id": staff.ID}
-    update := bson.M{
-        "$set": bson.M{
-            "name":             staff.Name,
-            "phone_number":     staff.PhoneNumber,
-            "gender":           staff.Gender,
-            "status":           staff.Status,
-            "specialization":   staff.Specialization,
-        },
+    set := bson.M{
+        "name":             staff.Name,
+        "phone_number":     staff.PhoneNumber,
+        "gender":           staff.Gender,
+        "status":           staff.Status,
+        "specialization":   staff.Specialization,
+    }
+    // The role is kept unless a new one is given
+    if staff.Role != "" {
+        set["role"] = staff.Role
     }
 
-    result, err := hsg.collection.UpdateOne(ctx, filter, update)
+    result, err := hsg.collection.UpdateOne(ctx, filter, bson.M{"$set": set})
     if err != nil {
         return err
     }
@@ -125,8 +129,16 @@ func (hsg *HospitalStaffGateway) UpdateHospitalStaff(staff *models.HospitalStaff
     if result.MatchedCount == 0 {
         return fmt.Errorf("no staff found with ID %d", staff.ID)
     }
+    if staff.Role == "" {
+        return nil
+    }
 
-    return nil
+    // The credential carries the role into access tokens, so it follows the staff record
+    _, err = hsg.credentials.UpdateOne(ctx,
+        bson.M{"account_type": models.AccountStaff, "account_id": staff.ID},
+        bson.M{"$set": bson.M{"role": staff.Role}},
+    )
+    return err
 }
 
 func (hsg *HospitalStaffGateway) DeleteHospitalStaff(staffID string) error {
@@ -0,0 +1,51 @@
+package gateways
+
+import (
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUpdateHospitalStaff(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("a new role is carried over to the credential", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+        err := NewHospitalStaffGateway(mt.DB).UpdateHospitalStaff(&models.HospitalStaff{ID: 7, Name: "Amina", Role: "nephrologist"})
+        if err != nil {
+            mt.Fatalf("UpdateHospitalStaff returned error: %v", err)
+        }
+
+        filters, updates := sentFilters(mt, "update"), sentUpdates(mt)
+        if len(updates) != 2 {
+            mt.Fatalf("sent %d updates, want the staff record and the credential", len(updates))
+        }
+        if filters[1].Lookup("account_type").StringValue() != models.AccountStaff || filters[1].Lookup("account_id").AsInt64() != 7 {
+            mt.Errorf("credential filter = %v, want staff account 7", filters[1])
+        }
+        if updates[1].Lookup("$set", "role").StringValue() != "nephrologist" {
+            mt.Errorf("credential update = %v, want the new role", updates[1])
+        }
+    })
+
+    mt.Run("the role is kept when none is given", func(mt *mtest.T) {
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        err := NewHospitalStaffGateway(mt.DB).UpdateHospitalStaff(&models.HospitalStaff{ID: 7, Name: "Amina"})
+        if err != nil {
+            mt.Fatalf("UpdateHospitalStaff returned error: %v", err)
+        }
+
+        updates := sentUpdates(mt)
+        if len(updates) != 1 {
+            mt.Fatalf("sent %d updates, want only the staff record", len(updates))
+        }
+        if _, err := updates[0].LookupErr("$set", "role"); err == nil {
+            mt.Errorf("update = %v clears the role", updates[0])
+        }
+    })
+}
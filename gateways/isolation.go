@@ -0,0 +1,62 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrIsolationMismatch is returned when a patient and a station are not in the same isolation group
+var ErrIsolationMismatch = errors.New("station does not match the patient's isolation needs")
+
+// patientIsolationGroup looks up the isolation group of a permanent or visiting patient, "" when they need none
+func patientIsolationGroup(ctx context.Context, db *mongo.Database, patientID int) (string, error) {
+    var patient models.Patient
+    err := db.Collection("patients").FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&patient)
+    if err == nil {
+        return patient.IsolationGroup(), nil
+    }
+    if err != mongo.ErrNoDocuments {
+        return "", err
+    }
+
+    var transient models.TransientPatient
+    err = db.Collection("transient_patients").FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&transient)
+    if err == mongo.ErrNoDocuments {
+        return "", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    return transient.IsolationGroup(), nil
+}
+
+// isolationProblem describes why a patient in group may not use station, "" when the pairing is allowed
+func isolationProblem(group string, station models.Station) string {
+    stationGroup := station.IsolationGroup()
+    switch {
+    case group == stationGroup:
+        return ""
+    case group == "":
+        return fmt.Sprintf("station %d is reserved for %s isolation", station.ID, stationGroup)
+    case stationGroup == "":
+        return fmt.Sprintf("patient needs a %s isolation station, station %d is not isolated", group, station.ID)
+    }
+    return fmt.Sprintf("patient needs a %s isolation station, station %d is isolated for %s", group, station.ID, stationGroup)
+}
+
+// checkIsolation refuses to put a patient on a station outside their isolation group
+func checkIsolation(ctx context.Context, db *mongo.Database, patientID int, station models.Station) error {
+    group, err := patientIsolationGroup(ctx, db, patientID)
+    if err != nil {
+        return err
+    }
+    if problem := isolationProblem(group, station); problem != "" {
+        return fmt.Errorf("%w: %s", ErrIsolationMismatch, problem)
+    }
+    return nil
+}
@@ -0,0 +1,55 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+func TestIsolationProblem(t *testing.T) {
+    standard := models.Station{ID: 1}
+    general := models.Station{ID: 2, Isolation: true}
+    hbv := models.Station{ID: 3, Isolation: true, IsolationFor: models.IsolationHBV}
+
+    tests := []struct {
+        group   string
+        station models.Station
+        allowed bool
+    }{
+        {"", standard, true},
+        {"", hbv, false},
+        {"", general, false},
+        {models.IsolationHBV, hbv, true},
+        {models.IsolationHBV, standard, false},
+        {models.IsolationHBV, general, false},
+        {models.IsolationCOVID, hbv, false},
+        {models.IsolationGeneral, general, true},
+    }
+
+    for _, tt := range tests {
+        if problem := isolationProblem(tt.group, tt.station); (problem == "") != tt.allowed {
+            t.Errorf("isolationProblem(%q, station %d) = %q, want allowed %v", tt.group, tt.station.ID, problem, tt.allowed)
+        }
+    }
+}
+
+func TestValidateStation(t *testing.T) {
+    tests := []struct {
+        station models.Station
+        valid   bool
+    }{
+        {models.Station{}, true},
+        {models.Station{Isolation: true}, true},
+        {models.Station{Isolation: true, IsolationFor: models.IsolationHBV}, true},
+        {models.Station{IsolationFor: models.IsolationHBV}, false},
+        {models.Station{Isolation: true, IsolationFor: "flu"}, false},
+    }
+
+    for _, tt := range tests {
+        err := validateStation(&tt.station)
+        if valid := err == nil; valid != tt.valid || (err != nil && !errors.Is(err, ErrInvalidStation)) {
+            t.Errorf("validateStation(%+v) error = %v, want valid %v", tt.station, err, tt.valid)
+        }
+    }
+}
@@ -0,0 +1,353 @@
+package gateways
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+// labLine is a result read from an import, with the line of the file or message it came from
+type labLine struct {
+    line   int
+    result models.LabResult
+}
+
+// labCSVColumns are the columns a lab CSV may have. patient_id, value, collected_at and one of loinc or test
+// (a LOINC code or panel short code such as "k") are required; unit may be left out for panel tests.
+var labCSVColumns = []string{"patient_id", "loinc", "test", "value", "unit", "collected_at", "range_low", "range_high", "flag", "accession"}
+
+// parseLabCSV reads lab results from a CSV with a header row naming its columns, in any order
+func parseLabCSV(r io.Reader) ([]labLine, []models.LabImportError, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+    reader.TrimLeadingSpace = true
+
+    header, err := reader.Read()
+    if err == io.EOF {
+        return nil, nil, fmt.Errorf("%w: the file is empty", ErrInvalidLabImport)
+    }
+    if err != nil {
+        return nil, nil, fmt.Errorf("%w: %v", ErrInvalidLabImport, err)
+    }
+    columns := map[string]int{}
+    for i, name := range header {
+        columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+    }
+    for _, required := range []string{"patient_id", "value", "collected_at"} {
+        if _, ok := columns[required]; !ok {
+            return nil, nil, fmt.Errorf("%w: the header has no %s column, expected columns are %s", ErrInvalidLabImport,
+                required, strings.Join(labCSVColumns, ", "))
+        }
+    }
+
+    var lines []labLine
+    var problems []models.LabImportError
+    for line := 2; ; line++ {
+        row, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            problems = append(problems, models.LabImportError{Line: line, Message: err.Error()})
+            continue
+        }
+        field := func(name string) string {
+            if i, ok := columns[name]; ok && i < len(row) {
+                return strings.TrimSpace(row[i])
+            }
+            return ""
+        }
+        if strings.Join(row, "") == "" {
+            continue
+        }
+
+        result, err := labCSVResult(field)
+        if err != nil {
+            problems = append(problems, models.LabImportError{Line: line, Message: err.Error()})
+            continue
+        }
+        lines = append(lines, labLine{line: line, result: result})
+    }
+    return lines, problems, nil
+}
+
+func labCSVResult(field func(string) string) (models.LabResult, error) {
+    result := models.LabResult{Source: models.LabSourceCSV, Unit: field("unit"), Flag: strings.ToUpper(field("flag")), Accession: field("accession")}
+
+    patientID, err := strconv.Atoi(field("patient_id"))
+    if err != nil || patientID <= 0 {
+        return result, fmt.Errorf("invalid patient_id %q", field("patient_id"))
+    }
+    result.PatientID = patientID
+
+    result.LOINC = field("loinc")
+    if test, ok := models.PanelTest(field("test")); ok && result.LOINC == "" {
+        result.LOINC = test.LOINC
+    }
+    if result.LOINC == "" {
+        return result, fmt.Errorf("unknown test %q, give its LOINC code in the loinc column", field("test"))
+    }
+    if test, ok := models.PanelTest(result.LOINC); ok && result.Unit == "" {
+        result.Unit = test.Unit
+    }
+
+    if result.Value, result.Comparator, err = parseLabValue(field("value")); err != nil {
+        return result, fmt.Errorf("value %q is not a number", field("value"))
+    }
+    if result.CollectedAt, err = parseCollectedAt(field("collected_at")); err != nil {
+        return result, err
+    }
+    for name, bound := range map[string]**float64{"range_low": &result.RangeLow, "range_high": &result.RangeHigh} {
+        if field(name) == "" {
+            continue
+        }
+        value, err := strconv.ParseFloat(field(name), 64)
+        if err != nil {
+            return result, fmt.Errorf("%s %q is not a number", name, field(name))
+        }
+        *bound = &value
+    }
+    return result, nil
+}
+
+// parseLabValue reads a result value, which may be reported beyond what the analyser measures as "<5" or ">1500"
+func parseLabValue(text string) (float64, string, error) {
+    text = strings.TrimSpace(text)
+    comparator := ""
+    for _, prefix := range []string{"<=", ">=", "<", ">"} {
+        if strings.HasPrefix(text, prefix) {
+            comparator, text = prefix, strings.TrimSpace(text[len(prefix):])
+            break
+        }
+    }
+    value, err := strconv.ParseFloat(text, 64)
+    return value, comparator, err
+}
+
+// parseCollectedAt reads a collection time given as a date, a date and time in clinic time or RFC 3339
+func parseCollectedAt(value string) (time.Time, error) {
+    if at, err := time.Parse(time.RFC3339, value); err == nil {
+        return at, nil
+    }
+    for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", dateLayout} {
+        if at, err := time.ParseInLocation(layout, value, models.ClinicLocation); err == nil {
+            return at, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid collected_at %q, expected YYYY-MM-DD or YYYY-MM-DD HH:MM", value)
+}
+
+// hl7Delimiters are the separators an HL7 v2 message declares in its MSH segment
+type hl7Delimiters struct {
+    field, component, repetition, escape, subcomponent string
+}
+
+// parseORU reads lab results from one or more HL7 v2 ORU^R01 messages. The patient is the first identifier in
+// PID-3, which must be their patient ID here; each OBX is one result, coded with LOINC in OBX-3 and collected
+// at OBX-14 or else OBR-7. Cancelled and deleted observations are skipped.
+func parseORU(body string) ([]labLine, []models.LabImportError, error) {
+    // Messages sent over MLLP arrive wrapped in start and end of block characters
+    body = strings.NewReplacer("\x0b", "", "\x1c", "").Replace(body)
+    segments := strings.FieldsFunc(body, func(r rune) bool { return r == '\r' || r == '\n' })
+    if len(segments) == 0 || !strings.HasPrefix(segments[0], "MSH") || len(segments[0]) < 8 {
+        return nil, nil, fmt.Errorf("%w: an HL7 message must start with an MSH segment", ErrInvalidLabImport)
+    }
+
+    var lines []labLine
+    var problems []models.LabImportError
+    var delimiters hl7Delimiters
+    var messageOK bool
+    var patientID int
+    var accession string
+    var observedAt time.Time
+    for i, segment := range segments {
+        line := i + 1
+        if strings.HasPrefix(segment, "MSH") {
+            delimiters, messageOK, patientID, accession, observedAt = hl7Delimiters{}, false, 0, "", time.Time{}
+            if len(segment) < 8 {
+                problems = append(problems, models.LabImportError{Line: line, Message: "MSH segment is too short to declare its delimiters"})
+                continue
+            }
+            encoding := segment[4:8]
+            delimiters = hl7Delimiters{
+                field:        segment[3:4],
+                component:    encoding[0:1],
+                repetition:   encoding[1:2],
+                escape:       encoding[2:3],
+                subcomponent: encoding[3:4],
+            }
+            // MSH-1 is the field separator itself, so MSH-n is at index n-1
+            fields := strings.Split(segment, delimiters.field)
+            messageType := delimiters.component0(hl7Field(fields, 8))
+            if messageType != "ORU" {
+                problems = append(problems, models.LabImportError{Line: line, Message: fmt.Sprintf("message type %q is not ORU, the message is skipped", messageType)})
+                continue
+            }
+            messageOK = true
+            continue
+        }
+        if !messageOK {
+            continue
+        }
+
+        fields := strings.Split(segment, delimiters.field)
+        switch fields[0] {
+        case "PID":
+            identifiers := strings.Split(hl7Field(fields, 3), delimiters.repetition)
+            patientID, _ = strconv.Atoi(delimiters.component0(identifiers[0]))
+            if patientID <= 0 {
+                problems = append(problems, models.LabImportError{Line: line, Message: fmt.Sprintf("PID-3 %q is not a patient ID", hl7Field(fields, 3))})
+            }
+        case "OBR":
+            accession = delimiters.component0(hl7Field(fields, 3))
+            observedAt, _ = parseHL7Time(hl7Field(fields, 7))
+        case "OBX":
+            result, err := delimiters.observation(fields, patientID, observedAt)
+            if err != nil {
+                problems = append(problems, models.LabImportError{Line: line, Message: err.Error()})
+                continue
+            }
+            if result == nil {
+                continue
+            }
+            result.Accession = accession
+            lines = append(lines, labLine{line: line, result: *result})
+        }
+    }
+    return lines, problems, nil
+}
+
+// observation reads the result in an OBX segment. Observations that are cancelled or deleted give none.
+func (d hl7Delimiters) observation(fields []string, patientID int, observedAt time.Time) (*models.LabResult, error) {
+    switch hl7Field(fields, 11) {
+    case "X", "D", "W":
+        return nil, nil
+    }
+    if patientID <= 0 {
+        return nil, fmt.Errorf("OBX without a patient, PID-3 must carry the patient ID")
+    }
+
+    result := &models.LabResult{PatientID: patientID, Source: models.LabSourceHL7}
+    identifier := strings.Split(hl7Field(fields, 3), d.component)
+    // The code may be the identifier or the alternate identifier, whichever has LN as its coding system
+    for i := 0; i+2 < len(identifier); i += 3 {
+        if identifier[i+2] == "LN" {
+            result.LOINC, result.Test = identifier[i], d.unescape(identifier[i+1])
+            break
+        }
+    }
+    if result.LOINC == "" {
+        if test, ok := models.PanelTest(identifier[0]); ok {
+            result.LOINC, result.Test = test.LOINC, test.Name
+        } else {
+            return nil, fmt.Errorf("OBX-3 %q is not coded with LOINC", hl7Field(fields, 3))
+        }
+    }
+
+    // A structured numeric (SN) value is comparator^number, such as >^1500
+    value := strings.TrimSpace(hl7Field(fields, 5))
+    if hl7Field(fields, 2) == "SN" {
+        parts := strings.Split(value, d.component)
+        if len(parts) > 1 && parts[1] != "" {
+            value = parts[0] + parts[1]
+        }
+    }
+    var err error
+    if result.Value, result.Comparator, err = parseLabValue(value); err != nil {
+        return nil, fmt.Errorf("OBX-5 %q for %s is not a number", value, result.LOINC)
+    }
+    result.Unit = d.unescape(d.component0(hl7Field(fields, 6)))
+    if result.Unit == "" {
+        if test, ok := models.PanelTest(result.LOINC); ok {
+            result.Unit = test.Unit
+        }
+    }
+    result.RangeLow, result.RangeHigh = parseHL7Range(hl7Field(fields, 7))
+    switch flag := strings.Split(hl7Field(fields, 8), d.repetition)[0]; flag {
+    case "L", "LL", "<":
+        result.Flag = models.LabFlagLow
+    case "H", "HH", ">":
+        result.Flag = models.LabFlagHigh
+    }
+
+    result.CollectedAt = observedAt
+    if at, err := parseHL7Time(hl7Field(fields, 14)); err == nil {
+        result.CollectedAt = at
+    }
+    if result.CollectedAt.IsZero() {
+        return nil, fmt.Errorf("no collection time for %s in OBX-14 or OBR-7", result.LOINC)
+    }
+    return result, nil
+}
+
+// component0 returns the first component of a field
+func (d hl7Delimiters) component0(field string) string {
+    return strings.Split(field, d.component)[0]
+}
+
+// unescape replaces the escape sequences HL7 uses for its delimiters in text
+func (d hl7Delimiters) unescape(text string) string {
+    if d.escape == "" || !strings.Contains(text, d.escape) {
+        return text
+    }
+    e := d.escape
+    return strings.NewReplacer(e+"F"+e, d.field, e+"S"+e, d.component, e+"R"+e, d.repetition,
+        e+"T"+e, d.subcomponent, e+"E"+e, d.escape).Replace(text)
+}
+
+// hl7Field returns field n of a segment other than MSH, or "" when the segment stops short of it
+func hl7Field(fields []string, n int) string {
+    if n < len(fields) {
+        return fields[n]
+    }
+    return ""
+}
+
+// parseHL7Time reads an HL7 timestamp, YYYYMMDD[HHMM[SS[.S]]][+/-ZZZZ], in clinic time unless it has an offset
+func parseHL7Time(value string) (time.Time, error) {
+    value = strings.TrimSpace(value)
+    offset := ""
+    if i := strings.IndexAny(value, "+-"); i > 0 {
+        value, offset = value[:i], value[i:]
+    }
+    if i := strings.Index(value, "."); i > 0 {
+        value = value[:i]
+    }
+    layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+    layout, ok := layouts[len(value)]
+    if !ok {
+        return time.Time{}, fmt.Errorf("invalid HL7 time %q", value)
+    }
+    if offset != "" {
+        return time.Parse(layout+"-0700", value+offset)
+    }
+    return time.ParseInLocation(layout, value, models.ClinicLocation)
+}
+
+// parseHL7Range reads a reference range such as "3.5-5.5", "<5" or ">200"
+func parseHL7Range(value string) (*float64, *float64) {
+    value = strings.ReplaceAll(value, " ", "")
+    bound := func(text string) *float64 {
+        if number, err := strconv.ParseFloat(text, 64); err == nil {
+            return &number
+        }
+        return nil
+    }
+    switch {
+    case value == "":
+        return nil, nil
+    case strings.HasPrefix(value, "<"):
+        return nil, bound(strings.TrimLeft(value, "<="))
+    case strings.HasPrefix(value, ">"):
+        return bound(strings.TrimLeft(value, ">=")), nil
+    }
+    if i := strings.Index(value[1:], "-"); i >= 0 {
+        return bound(value[:i+1]), bound(value[i+2:])
+    }
+    return nil, nil
+}
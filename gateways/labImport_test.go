@@ -0,0 +1,254 @@
+package gateways
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+func TestParseLabCSV(t *testing.T) {
+    tests := []struct {
+        name     string
+        csv      string
+        want     []models.LabResult
+        lines    []int
+        problems []int
+        wantErr  bool
+    }{
+        {
+            name: "panel short code fills in LOINC and unit",
+            csv:  "patient_id,test,value,collected_at\n42,k,6.1,2024-03-01 07:30\n",
+            want: []models.LabResult{{PatientID: 42, LOINC: "2823-3", Unit: "mmol/L", Value: 6.1,
+                CollectedAt: time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)}},
+            lines: []int{2},
+        },
+        {
+            name: "columns in any order and case, with a byte order mark",
+            csv:  "\ufeffCollected_At, Value ,LOINC,Patient_ID,Unit,Flag,Accession,Range_Low,Range_High\n2024-03-01,11.2,718-7,42,g/dL,h,ACC1,10,11.5\n",
+            want: []models.LabResult{{PatientID: 42, LOINC: "718-7", Unit: "g/dL", Value: 11.2, Flag: "H", Accession: "ACC1",
+                RangeLow: floatPtr(10), RangeHigh: floatPtr(11.5), CollectedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}},
+            lines: []int{2},
+        },
+        {
+            name: "value beyond the measurable range",
+            csv:  "patient_id,loinc,value,unit,collected_at\n42,1989-3,<5,ng/mL,2024-03-01T07:30:00Z\n",
+            want: []models.LabResult{{PatientID: 42, LOINC: "1989-3", Unit: "ng/mL", Value: 5, Comparator: "<",
+                CollectedAt: time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)}},
+            lines: []int{2},
+        },
+        {
+            name: "bad rows are reported by line and blank rows skipped",
+            csv: "patient_id,test,value,collected_at\n" +
+                "x,k,5,2024-03-01\n" +
+                ",,,\n" +
+                "42,unknown,5,2024-03-01\n" +
+                "42,k,high,2024-03-01\n" +
+                "42,k,5,yesterday\n" +
+                "42,k,4.2,2024-03-01\n",
+            want:     []models.LabResult{{PatientID: 42, LOINC: "2823-3", Unit: "mmol/L", Value: 4.2, CollectedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}},
+            lines:    []int{7},
+            problems: []int{2, 4, 5, 6},
+        },
+        {
+            name:    "required column missing",
+            csv:     "patient_id,test,value\n42,k,5\n",
+            wantErr: true,
+        },
+        {
+            name:    "empty file",
+            csv:     "",
+            wantErr: true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            lines, problems, err := parseLabCSV(strings.NewReader(tt.csv))
+            if tt.wantErr {
+                if !errors.Is(err, ErrInvalidLabImport) {
+                    t.Fatalf("parseLabCSV() error = %v, want %v", err, ErrInvalidLabImport)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseLabCSV() unexpected error: %v", err)
+            }
+            checkProblems(t, problems, tt.problems)
+            if len(lines) != len(tt.want) {
+                t.Fatalf("parseLabCSV() read %d results, want %d", len(lines), len(tt.want))
+            }
+            for i, line := range lines {
+                tt.want[i].Source = models.LabSourceCSV
+                checkLabResult(t, line, tt.lines[i], tt.want[i])
+            }
+        })
+    }
+}
+
+func TestParseORU(t *testing.T) {
+    message := strings.Join([]string{
+        "MSH|^~\\&|LAB|HOSP|DIAL|UNIT|20240301083000||ORU^R01|MSG1|P|2.5",
+        "PID|1||42^^^HOSP^MR||Doe^Jane",
+        "OBR|1||ACC123|CHEM^Chemistry|||20240301070000",
+        "OBX|1|NM|2823-3^Potassium^LN||6.1|mmol/L|3.5-5.5|H|||F",
+        "OBX|2|SN|718-7^Hemoglobin^LN||>^18|g/dL|<12||||F|||20240301071500+0300",
+        "OBX|3|NM|2160-0^Creatinine^LN||abc|mg/dL|||||F",
+        "OBX|4|NM|2823-3^Potassium^LN||5.0|mmol/L|||||X",
+        "OBX|5|NM|hb^^L||10.1|||||F",
+        "OBX|6|NM|XYZ^Unknown^L||1|||||F",
+        "MSH|^~\\&|LAB|HOSP|DIAL|UNIT|20240301083000||ADT^A01|MSG2|P|2.5",
+        "PID|1||43",
+        "OBX|1|NM|2823-3^Potassium^LN||4.0|mmol/L|||||F",
+        "MSH|^~\\&|LAB|HOSP|DIAL|UNIT|20240301083000||ORU^R01|MSG3|P|2.5",
+        "PID|1||MRN7",
+        "OBX|1|NM|2823-3^Potassium^LN||4.0|mmol/L|||||F|||20240301",
+    }, "\r")
+    collected := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name     string
+        body     string
+        want     []models.LabResult
+        lines    []int
+        problems []int
+        wantErr  bool
+    }{
+        {
+            name: "results, skipped observations and problems",
+            body: message,
+            want: []models.LabResult{
+                {PatientID: 42, LOINC: "2823-3", Test: "Potassium", Unit: "mmol/L", Value: 6.1, Flag: models.LabFlagHigh,
+                    RangeLow: floatPtr(3.5), RangeHigh: floatPtr(5.5), Accession: "ACC123", CollectedAt: collected},
+                {PatientID: 42, LOINC: "718-7", Test: "Hemoglobin", Unit: "g/dL", Value: 18, Comparator: ">",
+                    RangeHigh: floatPtr(12), Accession: "ACC123", CollectedAt: time.Date(2024, 3, 1, 4, 15, 0, 0, time.UTC)},
+                {PatientID: 42, LOINC: "718-7", Test: "Hemoglobin", Unit: "g/dL", Value: 10.1, Accession: "ACC123", CollectedAt: collected},
+            },
+            lines:    []int{4, 5, 8},
+            problems: []int{6, 9, 10, 14, 15},
+        },
+        {
+            name: "wrapped for MLLP with newlines between segments",
+            body: "\x0bMSH|^~\\&|LAB|HOSP|DIAL|UNIT|20240301083000||ORU^R01|MSG1|P|2.5\r\n" +
+                "PID|1||42\r\n" +
+                "OBX|1|NM|2823-3^Potassium^LN||4.4|mmol/L|||||F|||202403010700\x1c\r",
+            want:  []models.LabResult{{PatientID: 42, LOINC: "2823-3", Test: "Potassium", Unit: "mmol/L", Value: 4.4, CollectedAt: collected}},
+            lines: []int{3},
+        },
+        {
+            name: "escaped delimiters in text",
+            body: "MSH|^~\\&|LAB|HOSP|DIAL|UNIT|20240301083000||ORU^R01|MSG1|P|2.5\r" +
+                "PID|1||42\r" +
+                "OBX|1|NM|2823-3^K \\T\\ Na^LN||4.4|mmol\\S\\L|||||F|||20240301070000",
+            want:  []models.LabResult{{PatientID: 42, LOINC: "2823-3", Test: "K & Na", Unit: "mmol^L", Value: 4.4, CollectedAt: collected}},
+            lines: []int{3},
+        },
+        {
+            name:    "not an HL7 message",
+            body:    "patient_id,test,value\n42,k,5",
+            wantErr: true,
+        },
+        {
+            name:    "empty body",
+            body:    "",
+            wantErr: true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            lines, problems, err := parseORU(tt.body)
+            if tt.wantErr {
+                if !errors.Is(err, ErrInvalidLabImport) {
+                    t.Fatalf("parseORU() error = %v, want %v", err, ErrInvalidLabImport)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseORU() unexpected error: %v", err)
+            }
+            checkProblems(t, problems, tt.problems)
+            if len(lines) != len(tt.want) {
+                t.Fatalf("parseORU() read %d results, want %d: %+v", len(lines), len(tt.want), lines)
+            }
+            for i, line := range lines {
+                tt.want[i].Source = models.LabSourceHL7
+                checkLabResult(t, line, tt.lines[i], tt.want[i])
+            }
+        })
+    }
+}
+
+func TestParseHL7Range(t *testing.T) {
+    tests := []struct {
+        value     string
+        low, high *float64
+    }{
+        {"3.5-5.5", floatPtr(3.5), floatPtr(5.5)},
+        {"3.5 - 5.5", floatPtr(3.5), floatPtr(5.5)},
+        {"-2-2", floatPtr(-2), floatPtr(2)},
+        {"-5--1", floatPtr(-5), floatPtr(-1)},
+        {"<5", nil, floatPtr(5)},
+        {"<=5", nil, floatPtr(5)},
+        {">200", floatPtr(200), nil},
+        {">= 200", floatPtr(200), nil},
+        {"", nil, nil},
+        {"negative", nil, nil},
+        {"5", nil, nil},
+        {"a-b", nil, nil},
+    }
+
+    for _, tt := range tests {
+        low, high := parseHL7Range(tt.value)
+        if !sameBound(low, tt.low) || !sameBound(high, tt.high) {
+            t.Errorf("parseHL7Range(%q) = %s, %s, want %s, %s", tt.value, bound(low), bound(high), bound(tt.low), bound(tt.high))
+        }
+    }
+}
+
+func checkProblems(t *testing.T, problems []models.LabImportError, want []int) {
+    t.Helper()
+    if len(problems) != len(want) {
+        t.Fatalf("got %d problems, want %d: %+v", len(problems), len(want), problems)
+    }
+    for i, problem := range problems {
+        if problem.Line != want[i] || problem.Message == "" {
+            t.Errorf("problem %d = %+v, want one on line %d", i, problem, want[i])
+        }
+    }
+}
+
+func checkLabResult(t *testing.T, line labLine, wantLine int, want models.LabResult) {
+    t.Helper()
+    got := line.result
+    if line.line != wantLine {
+        t.Errorf("result for %s read from line %d, want %d", got.LOINC, line.line, wantLine)
+    }
+    if got.PatientID != want.PatientID || got.LOINC != want.LOINC || got.Test != want.Test || got.Unit != want.Unit ||
+        got.Value != want.Value || got.Comparator != want.Comparator || got.Flag != want.Flag ||
+        got.Accession != want.Accession || got.Source != want.Source || !got.CollectedAt.Equal(want.CollectedAt) {
+        t.Errorf("line %d result = %+v, want %+v", line.line, got, want)
+    }
+    if !sameBound(got.RangeLow, want.RangeLow) || !sameBound(got.RangeHigh, want.RangeHigh) {
+        t.Errorf("line %d range = %s to %s, want %s to %s", line.line,
+            bound(got.RangeLow), bound(got.RangeHigh), bound(want.RangeLow), bound(want.RangeHigh))
+    }
+}
+
+func floatPtr(value float64) *float64 {
+    return &value
+}
+
+func sameBound(a, b *float64) bool {
+    return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func bound(value *float64) string {
+    if value == nil {
+        return "none"
+    }
+    return fmt.Sprint(*value)
+}
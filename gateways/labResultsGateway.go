@@ -0,0 +1,289 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidLabImport is returned when an upload cannot be read as a lab CSV or HL7 message at all
+var ErrInvalidLabImport = errors.New("invalid lab import")
+
+// ErrLabResultNotFound is returned when there is no lab result with an ID
+var ErrLabResultNotFound = errors.New("lab result not found")
+
+// LabResultGateway handles the lab results reported for patients
+type LabResultGateway struct {
+    db         *mongo.Database
+    collection *mongo.Collection
+    patients   *mongo.Collection
+}
+
+// NewLabResultGateway creates a new instance of LabResultGateway
+func NewLabResultGateway(db *mongo.Database) *LabResultGateway {
+    return &LabResultGateway{
+        db:         db,
+        collection: db.Collection("lab_results"),
+        patients:   db.Collection("patients"),
+    }
+}
+
+// EnsureIndexes keeps one result per patient, test and collection time, so importing a file twice or a
+// corrected report replaces results rather than adding them again
+func (lg *LabResultGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := lg.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "patient_id", Value: 1}, {Key: "loinc", Value: 1}, {Key: "collected_at", Value: 1}},
+            Options: options.Index().SetUnique(true),
+        },
+        {
+            Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "collected_date", Value: -1}},
+        },
+    })
+    return err
+}
+
+// ImportCSV takes in the results in a lab CSV. Rows that cannot be read or are for unknown patients are
+// reported and the rest imported.
+func (lg *LabResultGateway) ImportCSV(r io.Reader, by int) (*models.LabImport, error) {
+    lines, problems, err := parseLabCSV(r)
+    if err != nil {
+        return nil, err
+    }
+    return lg.save(models.LabSourceCSV, lines, problems, by)
+}
+
+// ImportHL7 takes in the results in one or more HL7 v2 ORU^R01 messages
+func (lg *LabResultGateway) ImportHL7(message string, by int) (*models.LabImport, error) {
+    lines, problems, err := parseORU(message)
+    if err != nil {
+        return nil, err
+    }
+    return lg.save(models.LabSourceHL7, lines, problems, by)
+}
+
+// GetResults lists lab results newest first, only a patient's when patientID is not zero, only a test's when
+// loinc is given and only those collected between from and to when they are given
+func (lg *LabResultGateway) GetResults(patientID int, loinc, from, to string, limit, offset int) ([]models.LabResult, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset)).
+        SetSort(bson.D{{Key: "collected_at", Value: -1}, {Key: "loinc", Value: 1}})
+
+    cursor, err := lg.collection.Find(ctx, labFilter(patientID, loinc, from, to), opts)
+    if err != nil {
+        return nil, err
+    }
+    results := []models.LabResult{}
+    if err := cursor.All(ctx, &results); err != nil {
+        return nil, err
+    }
+    return results, nil
+}
+
+func (lg *LabResultGateway) CountResults(patientID int, loinc, from, to string) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := lg.collection.CountDocuments(ctx, labFilter(patientID, loinc, from, to))
+    return int(count), err
+}
+
+// GetPatientResults returns every lab result of a patient, newest first, for their history
+func (lg *LabResultGateway) GetPatientResults(patientID int) ([]models.LabResult, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    cursor, err := lg.collection.Find(ctx, bson.M{"patient_id": patientID}, options.Find().SetSort(bson.M{"collected_at": -1}))
+    if err != nil {
+        return nil, err
+    }
+    results := []models.LabResult{}
+    if err := cursor.All(ctx, &results); err != nil {
+        return nil, err
+    }
+    return results, nil
+}
+
+// GetTrend returns a patient's results per test between two dates, either of which may be left empty, with
+// the panel tests first in panel order and any others after them by LOINC code
+func (lg *LabResultGateway) GetTrend(patientID int, from, to string) (*models.LabTrend, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().SetSort(bson.D{{Key: "collected_at", Value: 1}})
+    cursor, err := lg.collection.Find(ctx, labFilter(patientID, "", from, to), opts)
+    if err != nil {
+        return nil, err
+    }
+    var results []models.LabResult
+    if err := cursor.All(ctx, &results); err != nil {
+        return nil, err
+    }
+
+    trend := &models.LabTrend{PatientID: patientID, Tests: []models.LabSeries{}, Flagged: []string{}}
+    series := map[string]*models.LabSeries{}
+    var order []string
+    for _, result := range results {
+        trend.PatientName = result.PatientName
+        s, ok := series[result.LOINC]
+        if !ok {
+            s = &models.LabSeries{LOINC: result.LOINC, Results: []models.LabPoint{}}
+            series[result.LOINC] = s
+            order = append(order, result.LOINC)
+        }
+        // The latest result names the test and gives its unit and range
+        s.Test, s.Unit, s.RangeLow, s.RangeHigh = result.Test, result.Unit, result.RangeLow, result.RangeHigh
+        point := models.LabPoint{
+            ResultID:      result.ID,
+            CollectedDate: result.CollectedDate,
+            Value:         result.Value,
+            Comparator:    result.Comparator,
+            Flag:          result.Flag,
+        }
+        s.Results = append(s.Results, point)
+        if result.Flag != "" {
+            s.OutOfRange++
+        }
+    }
+
+    sort.SliceStable(order, func(i, j int) bool {
+        return labOrder(order[i]) < labOrder(order[j]) || (labOrder(order[i]) == labOrder(order[j]) && order[i] < order[j])
+    })
+    for _, loinc := range order {
+        s := series[loinc]
+        latest := s.Results[len(s.Results)-1]
+        s.Latest = &latest
+        trend.Tests = append(trend.Tests, *s)
+        if s.Latest.Flag != "" {
+            trend.Flagged = append(trend.Flagged, s.Test)
+        }
+    }
+    return trend, nil
+}
+
+// DeleteResult removes a lab result entered against the wrong patient or in error
+func (lg *LabResultGateway) DeleteResult(id int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    result, err := lg.collection.DeleteOne(ctx, bson.M{"result_id": id})
+    if err != nil {
+        return err
+    }
+    if result.DeletedCount == 0 {
+        return fmt.Errorf("%w with ID %d", ErrLabResultNotFound, id)
+    }
+    return nil
+}
+
+// save stores the results read from an import, replacing any already held for the same patient, test and
+// collection time, and reports what was done
+func (lg *LabResultGateway) save(source string, lines []labLine, problems []models.LabImportError, by int) (*models.LabImport, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    report := &models.LabImport{Source: source, Errors: []models.LabImportError{}}
+    report.Errors = append(report.Errors, problems...)
+    names := map[int]string{}
+    now := time.Now()
+    for _, line := range lines {
+        result := line.result
+        name, ok := names[result.PatientID]
+        if !ok {
+            var patient models.Patient
+            err := lg.patients.FindOne(ctx, bson.M{"patient_id": result.PatientID}).Decode(&patient)
+            if err != nil && err != mongo.ErrNoDocuments {
+                return nil, err
+            }
+            name = patient.Name
+            names[result.PatientID] = name
+        }
+        if name == "" {
+            report.Errors = append(report.Errors, models.LabImportError{Line: line.line, Message: fmt.Sprintf("no patient with ID %d", result.PatientID)})
+            continue
+        }
+        if result.Unit == "" {
+            report.Errors = append(report.Errors, models.LabImportError{Line: line.line, Message: fmt.Sprintf("no unit given for %s", result.LOINC)})
+            continue
+        }
+
+        result.PatientName = name
+        result.CollectedDate = models.LocalDate(result.CollectedAt)
+        result.ImportedBy, result.ImportedAt = by, now
+        result.ApplyRange()
+        if result.Test == "" {
+            result.Test = result.LOINC
+        }
+
+        key := bson.M{"patient_id": result.PatientID, "loinc": result.LOINC, "collected_at": result.CollectedAt}
+        var existing models.LabResult
+        err := lg.collection.FindOne(ctx, key).Decode(&existing)
+        switch {
+        case err == nil:
+            result.ID = existing.ID
+            if _, err := lg.collection.ReplaceOne(ctx, key, result); err != nil {
+                return nil, err
+            }
+            report.Updated++
+        case err == mongo.ErrNoDocuments:
+            if result.ID, err = nextID(ctx, lg.db, "lab_results", "result_id"); err != nil {
+                return nil, err
+            }
+            if _, err := lg.collection.InsertOne(ctx, result); err != nil {
+                return nil, err
+            }
+            report.Imported++
+        default:
+            return nil, err
+        }
+    }
+    sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+    return report, nil
+}
+
+// labFilter narrows results to a patient, a test and a period, either end of which may be left open
+func labFilter(patientID int, loinc, from, to string) bson.M {
+    filter := scopeToPatient(bson.M{}, patientID)
+    if loinc != "" {
+        if test, ok := models.PanelTest(loinc); ok {
+            loinc = test.LOINC
+        }
+        filter["loinc"] = loinc
+    }
+    period := bson.M{}
+    if from != "" {
+        period["$gte"] = from
+    }
+    if to != "" {
+        period["$lte"] = to
+    }
+    if len(period) > 0 {
+        filter["collected_date"] = period
+    }
+    return filter
+}
+
+// labOrder places panel tests in panel order ahead of any other test
+func labOrder(loinc string) int {
+    for i, test := range models.LabPanel {
+        if test.LOINC == loinc {
+            return i
+        }
+    }
+    return len(models.LabPanel)
+}
@@ -0,0 +1,26 @@
+package gateways
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetPatientResults(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("filtered by patient ID, not name", func(mt *mtest.T) {
+        mt.AddMockResponses(found("lab_results"))
+
+        if _, err := NewLabResultGateway(mt.DB).GetPatientResults(3); err != nil {
+            mt.Fatalf("GetPatientResults() error = %v", err)
+        }
+        filter := sentFilters(mt, "find")[0]
+        if id := filter.Lookup("patient_id").AsInt64(); id != 3 {
+            mt.Errorf("filter patient_id = %d, want 3", id)
+        }
+        if _, err := filter.LookupErr("patient_name"); err == nil {
+            mt.Errorf("filter %v still matches on the patient's name", filter)
+        }
+    })
+}
@@ -0,0 +1,518 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrMachineUnavailable is returned when the machine at a station is out of service or overdue for maintenance
+var ErrMachineUnavailable = errors.New("machine is not available for dialysis")
+
+// ErrMachineNeedsDisinfection is returned when a session is started on a machine not disinfected since its last patient
+var ErrMachineNeedsDisinfection = errors.New("machine has not been disinfected since its last session")
+
+// ErrInvalidMachine is returned when a machine record is incomplete or refers to a station that does not exist
+var ErrInvalidMachine = errors.New("invalid machine")
+
+// ErrMachineNotFound is returned when no machine has the requested ID
+var ErrMachineNotFound = errors.New("machine not found")
+
+// MachineGateway handles the dialysis machines installed at stations and their upkeep
+type MachineGateway struct {
+    db           *mongo.Database
+    collection   *mongo.Collection
+    appointments *mongo.Collection
+}
+
+// NewMachineGateway creates a new instance of MachineGateway
+func NewMachineGateway(db *mongo.Database) *MachineGateway {
+    return &MachineGateway{
+        db:           db,
+        collection:   db.Collection("machines"),
+        appointments: db.Collection("dialysis_appointments"),
+    }
+}
+
+// EnsureIndexes keeps serial numbers unique and allows a single machine per station
+func (mg *MachineGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := mg.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "serial", Value: 1}},
+            Options: options.Index().SetUnique(true),
+        },
+        {
+            Keys:    bson.D{{Key: "station_id", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"station_id": bson.M{"$gt": 0}}),
+        },
+    })
+    return err
+}
+
+// GetMachines lists the machines, only the one at stationID when it is not zero. The log is left out.
+func (mg *MachineGateway) GetMachines(stationID, limit, offset int) ([]models.Machine, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset)).
+        SetSort(bson.M{"machine_id": 1}).
+        SetProjection(bson.M{"log": 0})
+
+    cursor, err := mg.collection.Find(ctx, machineFilter(stationID), opts)
+    if err != nil {
+        return nil, err
+    }
+    machines := []models.Machine{}
+    if err := cursor.All(ctx, &machines); err != nil {
+        return nil, err
+    }
+    return machines, nil
+}
+
+func (mg *MachineGateway) CountMachines(stationID int) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := mg.collection.CountDocuments(ctx, machineFilter(stationID))
+    return int(count), err
+}
+
+// GetMachine returns a machine with its full log
+func (mg *MachineGateway) GetMachine(machineID int) (*models.Machine, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var machine models.Machine
+    err := mg.collection.FindOne(ctx, bson.M{"machine_id": machineID}).Decode(&machine)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrMachineNotFound, machineID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &machine, nil
+}
+
+// CreateMachine registers a machine, in service unless a status is given. Its maintenance clock starts now
+// unless the last maintenance visit is given.
+func (mg *MachineGateway) CreateMachine(machine *models.Machine, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if machine.Status == "" {
+        machine.Status = models.MachineInService
+    }
+    if err := mg.validateMachine(ctx, machine); err != nil {
+        return err
+    }
+
+    id, err := nextID(ctx, mg.db, "machines", "machine_id")
+    if err != nil {
+        return err
+    }
+    machine.ID = id
+    machine.CreatedAt = time.Now()
+    if machine.LastMaintenanceAt == nil {
+        machine.LastMaintenanceHours = machine.Hours
+    }
+    machine.Log = []models.MachineLogEntry{{
+        Kind:   models.MachineStatusChange,
+        At:     machine.CreatedAt,
+        By:     by,
+        Hours:  machine.Hours,
+        Status: machine.Status,
+        Notes:  "registered",
+    }}
+
+    if _, err := mg.collection.InsertOne(ctx, machine); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            return fmt.Errorf("%w: serial %s or station %d already has a machine", ErrInvalidMachine, machine.Serial, machine.StationID)
+        }
+        return err
+    }
+    return mg.installAt(ctx, machine)
+}
+
+// UpdateMachine changes a machine's details, station, intervals and service state. A change of state is logged.
+// Hours, disinfection and maintenance are only changed by recording them.
+func (mg *MachineGateway) UpdateMachine(machine *models.Machine, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := mg.validateMachine(ctx, machine); err != nil {
+        return err
+    }
+    current, err := mg.GetMachine(machine.ID)
+    if err != nil {
+        return err
+    }
+
+    update := bson.M{
+        "$set": bson.M{
+            "serial":                     machine.Serial,
+            "model":                      machine.Model,
+            "station_id":                 machine.StationID,
+            "status":                     machine.Status,
+            "status_reason":              machine.StatusReason,
+            "maintenance_interval_days":  machine.MaintenanceIntervalDays,
+            "maintenance_interval_hours": machine.MaintenanceIntervalHours,
+        },
+    }
+    if machine.StationID == 0 {
+        delete(update["$set"].(bson.M), "station_id")
+        update["$unset"] = bson.M{"station_id": ""}
+    }
+    if machine.Status != current.Status {
+        update["$push"] = bson.M{"log": models.MachineLogEntry{
+            Kind:   models.MachineStatusChange,
+            At:     time.Now(),
+            By:     by,
+            Hours:  current.Hours,
+            Status: machine.Status,
+            Notes:  machine.StatusReason,
+        }}
+    }
+
+    if _, err := mg.collection.UpdateOne(ctx, bson.M{"machine_id": machine.ID}, update); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            return fmt.Errorf("%w: serial %s or station %d already has a machine", ErrInvalidMachine, machine.Serial, machine.StationID)
+        }
+        return err
+    }
+    return mg.installAt(ctx, machine)
+}
+
+func (mg *MachineGateway) DeleteMachine(machineID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := mg.collection.DeleteOne(ctx, bson.M{"machine_id": machineID})
+    return err
+}
+
+// RecordDisinfection clears a machine for its next patient
+func (mg *MachineGateway) RecordDisinfection(machineID int, service models.MachineService, by int) (*models.Machine, error) {
+    return mg.record(machineID, models.MachineDisinfection, service, by, bson.M{
+        "last_disinfected_at": time.Now(),
+        "needs_disinfection":  false,
+    })
+}
+
+// RecordMaintenance logs a preventive maintenance visit, which restarts the machine's maintenance clock
+func (mg *MachineGateway) RecordMaintenance(machineID int, service models.MachineService, by int) (*models.Machine, error) {
+    machine, err := mg.GetMachine(machineID)
+    if err != nil {
+        return nil, err
+    }
+    return mg.record(machineID, models.MachineMaintenance, service, by, bson.M{
+        "last_maintenance_at":    time.Now(),
+        "last_maintenance_hours": machine.Hours,
+    })
+}
+
+// record applies fields to a machine along with a log entry of kind, returning the updated machine
+func (mg *MachineGateway) record(machineID int, kind string, service models.MachineService, by int, fields bson.M) (*models.Machine, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    machine, err := mg.GetMachine(machineID)
+    if err != nil {
+        return nil, err
+    }
+    entry := models.MachineLogEntry{Kind: kind, At: time.Now(), By: by, Hours: machine.Hours, Notes: service.Notes}
+
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    var updated models.Machine
+    err = mg.collection.FindOneAndUpdate(ctx, bson.M{"machine_id": machineID}, bson.M{
+        "$set":  fields,
+        "$push": bson.M{"log": entry},
+    }, opts).Decode(&updated)
+    if err != nil {
+        return nil, err
+    }
+    return &updated, nil
+}
+
+// RecordSession adds a completed session's treatment time to the hours of the machine at its station and
+// marks the machine for disinfection. A session is only counted once.
+func (mg *MachineGateway) RecordSession(appointmentID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var appointment models.DialysisAppointment
+    if err := mg.appointments.FindOne(ctx, bson.M{"appointment_id": appointmentID}).Decode(&appointment); err != nil {
+        return err
+    }
+    if appointment.StationID == 0 {
+        return nil
+    }
+
+    completed := time.Now()
+    if appointment.CompletedAt != nil {
+        completed = *appointment.CompletedAt
+    }
+    minutes := appointment.DurationMinutes
+    if started := appointment.StartedAt; started != nil && completed.After(*started) {
+        minutes = int(completed.Sub(*started) / time.Minute)
+    } else if minutes == 0 {
+        minutes = models.DefaultDialysisMinutes
+    }
+
+    filter := bson.M{"station_id": appointment.StationID, "last_appointment_id": bson.M{"$ne": appointmentID}}
+    _, err := mg.collection.UpdateOne(ctx, filter, bson.M{
+        "$inc": bson.M{"hours": float64(minutes) / 60},
+        "$set": bson.M{
+            "needs_disinfection":  true,
+            "last_used_at":        completed,
+            "last_appointment_id": appointmentID,
+        },
+    })
+    return err
+}
+
+// GetWorkOrders lists what is due on the machines by the end of the week containing weekOf: repairs for machines
+// out of service, disinfections left from their last session and preventive maintenance falling due by date or by
+// the hours the week's bookings will put on the machine. Overdue jobs come first.
+func (mg *MachineGateway) GetWorkOrders(weekOf string) (*models.WorkOrderList, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    day, err := time.ParseInLocation(dateLayout, weekOf, models.ClinicLocation)
+    if err != nil {
+        return nil, fmt.Errorf("%w %q", ErrInvalidSlot, weekOf)
+    }
+    weekStart := mondayOf(day)
+    weekEnd := weekStart.AddDate(0, 0, 6).Format(dateLayout)
+    today := models.LocalDate(time.Now())
+
+    cursor, err := mg.collection.Find(ctx, bson.M{"status": bson.M{"$ne": models.MachineRetired}}, options.Find().SetProjection(bson.M{"log": 0}))
+    if err != nil {
+        return nil, err
+    }
+    var machines []models.Machine
+    if err := cursor.All(ctx, &machines); err != nil {
+        return nil, err
+    }
+
+    cursor, err = mg.db.Collection("stations").Find(ctx, bson.M{})
+    if err != nil {
+        return nil, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return nil, err
+    }
+    rooms := map[int]string{}
+    for _, station := range stations {
+        rooms[station.ID] = station.Room
+    }
+
+    // Sessions still to run this week, in order, to see when each machine will reach its maintenance hours
+    cursor, err = mg.appointments.Find(ctx, bson.M{
+        "station_id": bson.M{"$gt": 0},
+        "date":       bson.M{"$gte": today, "$lte": weekEnd},
+        "status":     bson.M{"$nin": append([]string{models.StatusCompleted}, releasedStatuses...)},
+    }, options.Find().SetSort(bson.M{"starts_at": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var upcoming []models.DialysisAppointment
+    if err := cursor.All(ctx, &upcoming); err != nil {
+        return nil, err
+    }
+    sessions := map[int][]models.DialysisAppointment{}
+    for _, appointment := range upcoming {
+        sessions[appointment.StationID] = append(sessions[appointment.StationID], appointment)
+    }
+
+    orders := []models.WorkOrder{}
+    for _, machine := range machines {
+        order := models.WorkOrder{
+            MachineID: machine.ID,
+            Serial:    machine.Serial,
+            StationID: machine.StationID,
+            Room:      rooms[machine.StationID],
+            Hours:     machine.Hours,
+        }
+
+        if machine.Status == models.MachineOutOfService {
+            repair := order
+            repair.Kind = models.MachineRepair
+            repair.DueDate = today
+            repair.Overdue = true
+            repair.Detail = "out of service"
+            if machine.StatusReason != "" {
+                repair.Detail += ": " + machine.StatusReason
+            }
+            orders = append(orders, repair)
+        }
+
+        if machine.NeedsDisinfection && machine.LastUsedAt != nil {
+            disinfection := order
+            disinfection.Kind = models.MachineDisinfection
+            disinfection.DueDate = models.LocalDate(*machine.LastUsedAt)
+            disinfection.Overdue = disinfection.DueDate < today
+            disinfection.Detail = fmt.Sprintf("not disinfected since appointment %d ended at %s",
+                machine.LastAppointmentID, machine.LastUsedAt.In(models.ClinicLocation).Format("2006-01-02 15:04"))
+            orders = append(orders, disinfection)
+        }
+
+        dueDate, dueHours := machine.MaintenanceDue()
+        maintenance := order
+        maintenance.Kind = models.MachineMaintenance
+        maintenance.DueDate = dueDate
+        maintenance.DueHours = dueHours
+        maintenance.Overdue = machine.MaintenanceOverdue(today)
+        switch {
+        case machine.Hours >= dueHours:
+            maintenance.DueDate = today
+            maintenance.Detail = fmt.Sprintf("%.0f machine hours reached", dueHours)
+        case dueDate <= weekEnd:
+            maintenance.Detail = fmt.Sprintf("preventive maintenance due by %s", dueDate)
+        default:
+            hours := machine.Hours
+            for _, session := range sessions[machine.StationID] {
+                minutes := session.DurationMinutes
+                if minutes == 0 {
+                    minutes = models.DefaultDialysisMinutes
+                }
+                if hours += float64(minutes) / 60; hours >= dueHours {
+                    maintenance.DueDate = session.Date
+                    maintenance.Detail = fmt.Sprintf("%.0f machine hours will be reached with the session of %s", dueHours, session.Date)
+                    break
+                }
+            }
+        }
+        if maintenance.Detail != "" {
+            orders = append(orders, maintenance)
+        }
+    }
+
+    sort.SliceStable(orders, func(i, j int) bool {
+        a, b := orders[i], orders[j]
+        if a.Overdue != b.Overdue {
+            return a.Overdue
+        }
+        if a.DueDate != b.DueDate {
+            return a.DueDate < b.DueDate
+        }
+        return a.MachineID < b.MachineID
+    })
+
+    return &models.WorkOrderList{
+        WeekStart:  weekStart.Format(dateLayout),
+        WeekEnd:    weekEnd,
+        WorkOrders: orders,
+    }, nil
+}
+
+// validateMachine checks a machine has a serial, a known status and, when installed, an existing station
+func (mg *MachineGateway) validateMachine(ctx context.Context, machine *models.Machine) error {
+    if machine.Serial == "" {
+        return fmt.Errorf("%w: a serial number is required", ErrInvalidMachine)
+    }
+    switch machine.Status {
+    case models.MachineInService, models.MachineOutOfService, models.MachineRetired:
+    default:
+        return fmt.Errorf("%w: unknown status %q", ErrInvalidMachine, machine.Status)
+    }
+    if machine.StationID == 0 {
+        return nil
+    }
+    if machine.Status == models.MachineRetired {
+        return fmt.Errorf("%w: a retired machine cannot be installed at a station", ErrInvalidMachine)
+    }
+    count, err := mg.db.Collection("stations").CountDocuments(ctx, bson.M{"station_id": machine.StationID})
+    if err != nil {
+        return err
+    }
+    if count == 0 {
+        return fmt.Errorf("%w: no station with ID %d", ErrInvalidMachine, machine.StationID)
+    }
+    return nil
+}
+
+// installAt keeps the serial shown on stations in line with the machine installed there, clearing it from
+// the station the machine was moved from
+func (mg *MachineGateway) installAt(ctx context.Context, machine *models.Machine) error {
+    stations := mg.db.Collection("stations")
+    _, err := stations.UpdateMany(ctx, bson.M{"machine_serial": machine.Serial, "station_id": bson.M{"$ne": machine.StationID}}, bson.M{
+        "$set": bson.M{"machine_serial": ""},
+    })
+    if err != nil || machine.StationID == 0 {
+        return err
+    }
+    _, err = stations.UpdateOne(ctx, bson.M{"station_id": machine.StationID}, bson.M{
+        "$set": bson.M{"machine_serial": machine.Serial},
+    })
+    return err
+}
+
+// machineFilter narrows machines to the one installed at a station, or none when stationID is zero
+func machineFilter(stationID int) bson.M {
+    if stationID == 0 {
+        return bson.M{}
+    }
+    return bson.M{"station_id": stationID}
+}
+
+// machineAt returns the machine installed at a station, or nil when the station has no registered machine
+func machineAt(ctx context.Context, db *mongo.Database, stationID int) (*models.Machine, error) {
+    var machine models.Machine
+    err := db.Collection("machines").FindOne(ctx, bson.M{"station_id": stationID}, options.FindOne().SetProjection(bson.M{"log": 0})).Decode(&machine)
+    if err == mongo.ErrNoDocuments {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &machine, nil
+}
+
+// checkMachine refuses bookings on a station whose machine is out of service, or will be overdue for maintenance
+// by date. Stations without a registered machine are not checked.
+func checkMachine(ctx context.Context, db *mongo.Database, stationID int, date string) error {
+    machine, err := machineAt(ctx, db, stationID)
+    if err != nil || machine == nil {
+        return err
+    }
+    if machine.Status != models.MachineInService {
+        return fmt.Errorf("%w: machine %s at station %d is %s", ErrMachineUnavailable, machine.Serial, stationID, machine.Status)
+    }
+    if machine.MaintenanceOverdue(date) {
+        return fmt.Errorf("%w: machine %s at station %d is overdue for maintenance by %s", ErrMachineUnavailable, machine.Serial, stationID, date)
+    }
+    return nil
+}
+
+// checkDisinfected refuses to start a session on a machine still waiting to be disinfected after its last patient
+func checkDisinfected(ctx context.Context, db *mongo.Database, stationID int) error {
+    if stationID == 0 {
+        return nil
+    }
+    machine, err := machineAt(ctx, db, stationID)
+    if err != nil || machine == nil {
+        return err
+    }
+    if machine.NeedsDisinfection {
+        return fmt.Errorf("%w: machine %s at station %d", ErrMachineNeedsDisinfection, machine.Serial, stationID)
+    }
+    return nil
+}
+
+// mondayOf returns the Monday of the week containing day
+func mondayOf(day time.Time) time.Time {
+    return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
@@ -0,0 +1,170 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckDisinfected(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("machine still waiting for disinfection", func(mt *mtest.T) {
+        mt.AddMockResponses(found("machines", bson.D{{Key: "serial", Value: "M-1"}, {Key: "needs_disinfection", Value: true}}))
+        if err := checkDisinfected(context.Background(), mt.DB, 4); !errors.Is(err, ErrMachineNeedsDisinfection) {
+            mt.Errorf("checkDisinfected() error = %v, want ErrMachineNeedsDisinfection", err)
+        }
+    })
+
+    mt.Run("station without a registered machine", func(mt *mtest.T) {
+        mt.AddMockResponses(found("machines"))
+        if err := checkDisinfected(context.Background(), mt.DB, 4); err != nil {
+            mt.Errorf("checkDisinfected() error = %v, want none", err)
+        }
+    })
+
+    mt.Run("session without a station", func(mt *mtest.T) {
+        if err := checkDisinfected(context.Background(), mt.DB, 0); err != nil {
+            mt.Errorf("checkDisinfected() error = %v, want none", err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+}
+
+func TestRecordSession(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("treatment time is added once and the machine marked for disinfection", func(mt *mtest.T) {
+        started := time.Date(2024, 3, 4, 3, 10, 0, 0, time.UTC)
+        mt.AddMockResponses(
+            found("dialysis_appointments", bson.D{
+                {Key: "appointment_id", Value: 12},
+                {Key: "station_id", Value: 4},
+                {Key: "duration_minutes", Value: 240},
+                {Key: "started_at", Value: started},
+                {Key: "completed_at", Value: started.Add(210 * time.Minute)},
+            }),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+        )
+
+        if err := NewMachineGateway(mt.DB).RecordSession(12); err != nil {
+            mt.Fatal(err)
+        }
+        filter, update := sentFilters(mt, "update")[0], sentUpdates(mt)[0]
+        if filter.Lookup("station_id").Int32() != 4 || filter.Lookup("last_appointment_id", "$ne").Int32() != 12 {
+            mt.Errorf("update filter = %v, want station 4 unless appointment 12 was already counted", filter)
+        }
+        if hours := update.Lookup("$inc", "hours").Double(); hours != 3.5 {
+            mt.Errorf("added %.2f hours, want the 3.5 the session ran", hours)
+        }
+        if !update.Lookup("$set", "needs_disinfection").Boolean() {
+            mt.Errorf("update = %v, want the machine marked for disinfection", update)
+        }
+    })
+
+    mt.Run("session without a station", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 12}}))
+
+        if err := NewMachineGateway(mt.DB).RecordSession(12); err != nil {
+            mt.Fatal(err)
+        }
+        if updates := sentUpdates(mt); len(updates) != 0 {
+            mt.Errorf("sent %d updates, want none", len(updates))
+        }
+    })
+}
+
+func TestGetWorkOrders(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    today := models.LocalDate(time.Now())
+    lastUsed := time.Now().AddDate(0, 0, -2)
+
+    mt.Run("repairs, disinfections and maintenance falling due", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("machines",
+                bson.D{{Key: "machine_id", Value: 1}, {Key: "serial", Value: "M-1"}, {Key: "station_id", Value: 1}, {Key: "status", Value: models.MachineOutOfService}, {Key: "status_reason", Value: "pump fault"}, {Key: "created_at", Value: time.Now()}},
+                bson.D{{Key: "machine_id", Value: 2}, {Key: "serial", Value: "M-2"}, {Key: "station_id", Value: 2}, {Key: "status", Value: models.MachineInService}, {Key: "needs_disinfection", Value: true}, {Key: "last_used_at", Value: lastUsed}, {Key: "last_appointment_id", Value: 30}, {Key: "created_at", Value: time.Now()}},
+                // 4 hours short of its maintenance hours, with a 4 hour session booked this week
+                bson.D{{Key: "machine_id", Value: 3}, {Key: "serial", Value: "M-3"}, {Key: "station_id", Value: 3}, {Key: "status", Value: models.MachineInService}, {Key: "hours", Value: 1996.0}, {Key: "created_at", Value: time.Now()}},
+            ),
+            found("stations", bson.D{{Key: "station_id", Value: 1}, {Key: "room", Value: "A"}}),
+            found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 40}, {Key: "station_id", Value: 3}, {Key: "date", Value: today}, {Key: "duration_minutes", Value: 240}}),
+        )
+
+        list, err := NewMachineGateway(mt.DB).GetWorkOrders(today)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        kinds := map[int]string{}
+        for _, order := range list.WorkOrders {
+            kinds[order.MachineID] = order.Kind
+        }
+        if len(list.WorkOrders) != 3 || kinds[1] != models.MachineRepair || kinds[2] != models.MachineDisinfection || kinds[3] != models.MachineMaintenance {
+            mt.Fatalf("work orders = %+v, want a repair, a disinfection and a maintenance", list.WorkOrders)
+        }
+        // Overdue jobs come first, the oldest before the others
+        if first, second := list.WorkOrders[0], list.WorkOrders[1]; first.MachineID != 2 || !first.Overdue || second.MachineID != 1 || second.Room != "A" {
+            mt.Errorf("work orders = %+v, want the disinfection left from two days ago then the repair in room A", list.WorkOrders)
+        }
+        if last := list.WorkOrders[2]; last.MachineID != 3 || last.DueDate != today {
+            mt.Errorf("last work order = %+v, want maintenance of machine 3 due with today's session", last)
+        }
+    })
+
+    mt.Run("unreadable week", func(mt *mtest.T) {
+        if _, err := NewMachineGateway(mt.DB).GetWorkOrders("this week"); !errors.Is(err, ErrInvalidSlot) {
+            mt.Errorf("GetWorkOrders() error = %v, want ErrInvalidSlot", err)
+        }
+    })
+}
+
+func TestValidateMachine(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    for name, machine := range map[string]models.Machine{
+        "no serial":                 {Status: models.MachineInService},
+        "unknown status":            {Serial: "M-1", Status: "broken"},
+        "retired machine installed": {Serial: "M-1", Status: models.MachineRetired, StationID: 4},
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            if err := NewMachineGateway(mt.DB).validateMachine(context.Background(), &machine); !errors.Is(err, ErrInvalidMachine) {
+                mt.Errorf("validateMachine() error = %v, want ErrInvalidMachine", err)
+            }
+        })
+    }
+
+    mt.Run("station that does not exist", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("stations", 0))
+        machine := models.Machine{Serial: "M-1", Status: models.MachineInService, StationID: 4}
+        if err := NewMachineGateway(mt.DB).validateMachine(context.Background(), &machine); !errors.Is(err, ErrInvalidMachine) {
+            mt.Errorf("validateMachine() error = %v, want ErrInvalidMachine", err)
+        }
+    })
+}
+
+func TestCheckMachineOnBookingDate(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    serviced := time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)
+    // Due for maintenance 30 days after its last service, on 2030-01-31
+    machine := bson.D{
+        {Key: "serial", Value: "M-1"}, {Key: "station_id", Value: 4}, {Key: "status", Value: models.MachineInService},
+        {Key: "maintenance_interval_days", Value: 30}, {Key: "last_maintenance_at", Value: serviced},
+    }
+
+    for date, wantErr := range map[string]bool{"2030-01-20": false, "2030-01-31": false, "2030-02-03": true} {
+        mt.Run("booking on "+date, func(mt *mtest.T) {
+            mt.AddMockResponses(found("machines", machine))
+            err := checkMachine(context.Background(), mt.DB, 4, date)
+            if (err != nil) != wantErr || (err != nil && !errors.Is(err, ErrMachineUnavailable)) {
+                mt.Errorf("checkMachine(%s) error = %v, wantErr %v", date, err, wantErr)
+            }
+        })
+    }
+}
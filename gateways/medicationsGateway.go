@@ -0,0 +1,373 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidMedication is returned when a medication order or a charted dose is incomplete or out of range
+var ErrInvalidMedication = errors.New("invalid medication")
+
+// ErrMedicationNotFound is returned when there is no medication order with an ID
+var ErrMedicationNotFound = errors.New("medication order not found")
+
+// ErrNoActiveOrder is returned when a dose is charted that no active order for the patient covers
+var ErrNoActiveOrder = errors.New("no active medication order")
+
+// MedicationGateway handles patients' medication lists and the doses charted at their sessions
+type MedicationGateway struct {
+    db              *mongo.Database
+    orders          *mongo.Collection
+    administrations *mongo.Collection
+    appointments    *mongo.Collection
+}
+
+// NewMedicationGateway creates a new instance of MedicationGateway
+func NewMedicationGateway(db *mongo.Database) *MedicationGateway {
+    return &MedicationGateway{
+        db:              db,
+        orders:          db.Collection("medication_orders"),
+        administrations: db.Collection("medication_administrations"),
+        appointments:    db.Collection("dialysis_appointments"),
+    }
+}
+
+// EnsureIndexes keeps medication lists quick to read and allows each order to be charted once per session
+func (mg *MedicationGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if _, err := mg.orders.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "status", Value: 1}},
+    }); err != nil {
+        return err
+    }
+    _, err := mg.administrations.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "appointment_id", Value: 1}, {Key: "order_id", Value: 1}},
+            Options: options.Index().SetUnique(true),
+        },
+        {
+            Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "date", Value: -1}},
+        },
+    })
+    return err
+}
+
+// GetOrders returns a patient's medication list, newest order first, only the orders active today when
+// activeOnly is set
+func (mg *MedicationGateway) GetOrders(patientID int, activeOnly bool) ([]models.MedicationOrder, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    orders, err := mg.patientOrders(ctx, patientID)
+    if err != nil {
+        return nil, err
+    }
+    if !activeOnly {
+        return orders, nil
+    }
+    today := models.LocalDate(time.Now())
+    active := []models.MedicationOrder{}
+    for _, order := range orders {
+        if order.ActiveOn(today) {
+            active = append(active, order)
+        }
+    }
+    return active, nil
+}
+
+// GetOrder returns a medication order, scoped to patientID when it is not zero
+func (mg *MedicationGateway) GetOrder(id, patientID int) (*models.MedicationOrder, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var order models.MedicationOrder
+    err := mg.orders.FindOne(ctx, scopeToPatient(bson.M{"order_id": id}, patientID)).Decode(&order)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrMedicationNotFound, id)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &order, nil
+}
+
+// CreateOrder adds a medication to a patient's list, starting today unless a start date is given. The
+// prescriber must be a member of hospital staff.
+func (mg *MedicationGateway) CreateOrder(order *models.MedicationOrder, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if order.StartDate == "" {
+        order.StartDate = models.LocalDate(time.Now())
+    }
+    if err := validateOrder(order); err != nil {
+        return err
+    }
+
+    var patient models.Patient
+    err := mg.db.Collection("patients").FindOne(ctx, bson.M{"patient_id": order.PatientID}).Decode(&patient)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: no patient with ID %d", ErrInvalidMedication, order.PatientID)
+    }
+    if err != nil {
+        return err
+    }
+    var prescriber models.HospitalStaff
+    err = mg.db.Collection("hospital_staff").FindOne(ctx, bson.M{"staff_id": order.PrescriberID}).Decode(&prescriber)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: no member of staff with ID %d to prescribe", ErrInvalidMedication, order.PrescriberID)
+    }
+    if err != nil {
+        return err
+    }
+
+    id, err := nextID(ctx, mg.db, "medication_orders", "order_id")
+    if err != nil {
+        return err
+    }
+    order.ID = id
+    order.PatientName = patient.Name
+    order.PrescriberName = prescriber.Name
+    order.Status = models.OrderActive
+    order.StopReason, order.StoppedBy, order.StoppedAt = "", 0, nil
+    order.CreatedBy = by
+    order.CreatedAt = time.Now()
+    _, err = mg.orders.InsertOne(ctx, order)
+    return err
+}
+
+// StopOrder takes a medication off a patient's list from now. A change of dose is a stopped order and a new one.
+func (mg *MedicationGateway) StopOrder(id int, reason string, by int) (*models.MedicationOrder, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    now := time.Now()
+    var order models.MedicationOrder
+    err := mg.orders.FindOneAndUpdate(ctx,
+        bson.M{"order_id": id, "status": models.OrderActive},
+        bson.M{"$set": bson.M{"status": models.OrderStopped, "stop_reason": reason, "stopped_by": by, "stopped_at": now}},
+        options.FindOneAndUpdate().SetReturnDocument(options.After),
+    ).Decode(&order)
+    if err == mongo.ErrNoDocuments {
+        if _, err := mg.GetOrder(id, 0); err != nil {
+            return nil, err
+        }
+        return nil, fmt.Errorf("%w: order %d is already stopped", ErrInvalidMedication, id)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &order, nil
+}
+
+// GetChart returns the medication administration record of a session: each order active on its day, and any
+// order charted at it since stopped, with what was charted. It is scoped to patientID when it is not zero.
+func (mg *MedicationGateway) GetChart(appointmentID, patientID int) (*models.MedicationChart, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var appointment models.DialysisAppointment
+    err := mg.appointments.FindOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    orders, err := mg.patientOrders(ctx, appointment.PatientID)
+    if err != nil {
+        return nil, err
+    }
+    cursor, err := mg.administrations.Find(ctx, bson.M{"appointment_id": appointmentID})
+    if err != nil {
+        return nil, err
+    }
+    var administrations []models.MedicationAdministration
+    if err := cursor.All(ctx, &administrations); err != nil {
+        return nil, err
+    }
+    charted := map[int]*models.MedicationAdministration{}
+    for i := range administrations {
+        charted[administrations[i].OrderID] = &administrations[i]
+    }
+
+    chart := &models.MedicationChart{
+        AppointmentID: appointment.ID,
+        PatientID:     appointment.PatientID,
+        PatientName:   appointment.PatientName,
+        Date:          appointment.Date,
+        Entries:       []models.MedicationChartEntry{},
+    }
+    for _, order := range orders {
+        administration := charted[order.ID]
+        if administration == nil && !order.ActiveOn(appointment.Date) {
+            continue
+        }
+        chart.Entries = append(chart.Entries, models.MedicationChartEntry{Order: order, Administration: administration})
+    }
+    return chart, nil
+}
+
+// ChartDose records a dose as given, held or refused at a session once the patient has checked in. The dose
+// must be covered by an order for the patient that is active on the day of the session, and a dose given must
+// be the dose ordered. Each order is charted once per session.
+func (mg *MedicationGateway) ChartDose(administration *models.MedicationAdministration, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := validateAdministration(administration); err != nil {
+        return err
+    }
+
+    var appointment models.DialysisAppointment
+    err := mg.appointments.FindOne(ctx, bson.M{"appointment_id": administration.AppointmentID}).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, administration.AppointmentID)
+    }
+    if err != nil {
+        return err
+    }
+    if !recordable(appointment.Status) {
+        return fmt.Errorf("%w: appointment %d is %s, doses are charted from check-in", ErrInvalidMedication,
+            appointment.ID, models.CurrentStatus(appointment.Status))
+    }
+
+    var order models.MedicationOrder
+    err = mg.orders.FindOne(ctx, bson.M{"order_id": administration.OrderID, "patient_id": appointment.PatientID}).Decode(&order)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w: %s has no order %d", ErrNoActiveOrder, appointment.PatientName, administration.OrderID)
+    }
+    if err != nil {
+        return err
+    }
+    if !order.ActiveOn(appointment.Date) {
+        return fmt.Errorf("%w: order %d for %s is not active on %s", ErrNoActiveOrder, order.ID, order.Drug, appointment.Date)
+    }
+    if administration.Outcome == models.DoseGiven && administration.Dose != 0 && administration.Dose != order.Dose {
+        return fmt.Errorf("%w: order %d is for %g %s of %s, not %g", ErrNoActiveOrder, order.ID, order.Dose, order.DoseUnit,
+            order.Drug, administration.Dose)
+    }
+
+    id, err := nextID(ctx, mg.db, "medication_administrations", "administration_id")
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    administration.ID = id
+    administration.PatientID = appointment.PatientID
+    administration.PatientName = appointment.PatientName
+    administration.Date = appointment.Date
+    administration.Drug, administration.Dose, administration.DoseUnit, administration.Route = order.Drug, order.Dose, order.DoseUnit, order.Route
+    if administration.At.IsZero() {
+        administration.At = now
+    }
+    administration.RecordedBy, administration.RecordedAt = by, now
+
+    _, err = mg.administrations.InsertOne(ctx, administration)
+    if mongo.IsDuplicateKeyError(err) {
+        return fmt.Errorf("%w: order %d is already charted for appointment %d", ErrInvalidMedication, order.ID, appointment.ID)
+    }
+    return err
+}
+
+// GetAdministrations lists charted doses newest first, only a patient's when patientID is not zero and only
+// between from and to when they are given
+func (mg *MedicationGateway) GetAdministrations(patientID int, from, to string, limit, offset int) ([]models.MedicationAdministration, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset)).
+        SetSort(bson.D{{Key: "date", Value: -1}, {Key: "at", Value: -1}})
+
+    cursor, err := mg.administrations.Find(ctx, recordFilter(patientID, from, to), opts)
+    if err != nil {
+        return nil, err
+    }
+    administrations := []models.MedicationAdministration{}
+    if err := cursor.All(ctx, &administrations); err != nil {
+        return nil, err
+    }
+    return administrations, nil
+}
+
+func (mg *MedicationGateway) CountAdministrations(patientID int, from, to string) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := mg.administrations.CountDocuments(ctx, recordFilter(patientID, from, to))
+    return int(count), err
+}
+
+func (mg *MedicationGateway) patientOrders(ctx context.Context, patientID int) ([]models.MedicationOrder, error) {
+    opts := options.Find().SetSort(bson.D{{Key: "start_date", Value: -1}, {Key: "order_id", Value: -1}})
+    cursor, err := mg.orders.Find(ctx, bson.M{"patient_id": patientID}, opts)
+    if err != nil {
+        return nil, err
+    }
+    orders := []models.MedicationOrder{}
+    if err := cursor.All(ctx, &orders); err != nil {
+        return nil, err
+    }
+    return orders, nil
+}
+
+func validateOrder(order *models.MedicationOrder) error {
+    order.Drug = strings.TrimSpace(order.Drug)
+    order.Route = strings.ToLower(strings.TrimSpace(order.Route))
+    switch {
+    case order.PatientID == 0 || order.PrescriberID == 0:
+        return fmt.Errorf("%w: a patient_id and prescriber_id are required", ErrInvalidMedication)
+    case order.Drug == "":
+        return fmt.Errorf("%w: a drug is required", ErrInvalidMedication)
+    case order.Dose <= 0 || order.DoseUnit == "":
+        return fmt.Errorf("%w: a dose and dose_unit are required", ErrInvalidMedication)
+    case strings.TrimSpace(order.Frequency) == "":
+        return fmt.Errorf("%w: a frequency is required", ErrInvalidMedication)
+    }
+    if !knownRoute(order.Route) {
+        return fmt.Errorf("%w: route %q is not one of %s", ErrInvalidMedication, order.Route, strings.Join(models.Routes, ", "))
+    }
+    if _, err := time.Parse(dateLayout, order.StartDate); err != nil {
+        return fmt.Errorf("%w: invalid start_date %q, expected YYYY-MM-DD", ErrInvalidMedication, order.StartDate)
+    }
+    if order.EndDate != "" {
+        if _, err := time.Parse(dateLayout, order.EndDate); err != nil || order.EndDate < order.StartDate {
+            return fmt.Errorf("%w: end_date %q must be a date on or after the start", ErrInvalidMedication, order.EndDate)
+        }
+    }
+    return nil
+}
+
+func knownRoute(route string) bool {
+    for _, known := range models.Routes {
+        if route == known {
+            return true
+        }
+    }
+    return false
+}
+
+func validateAdministration(administration *models.MedicationAdministration) error {
+    switch {
+    case administration.AppointmentID == 0 || administration.OrderID == 0:
+        return fmt.Errorf("%w: an appointment_id and order_id are required", ErrInvalidMedication)
+    case administration.Outcome != models.DoseGiven && administration.Outcome != models.DoseHeld && administration.Outcome != models.DoseRefused:
+        return fmt.Errorf("%w: outcome must be %s, %s or %s", ErrInvalidMedication, models.DoseGiven, models.DoseHeld, models.DoseRefused)
+    case administration.Outcome != models.DoseGiven && strings.TrimSpace(administration.Reason) == "":
+        return fmt.Errorf("%w: a reason is required when a dose is %s", ErrInvalidMedication, administration.Outcome)
+    }
+    return nil
+}
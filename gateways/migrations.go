@@ -0,0 +1,110 @@
+package gateways
+
+import (
+	"context"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MigrationResult counts what a migration did to one collection. Skipped lists the records found unparsable
+// on this run.
+type MigrationResult struct {
+    Converted  int                `json:"converted"`
+    Unparsable int                `json:"unparsable"`
+    Skipped    []UnparsableRecord `json:"skipped,omitempty"`
+}
+
+// UnparsableRecord is a record whose date and time strings could not be read
+type UnparsableRecord struct {
+    ID   interface{} `json:"id"`
+    Date string      `json:"date"`
+    Time string      `json:"time"`
+}
+
+// unparsableMark flags records a migration could not read, so later runs pass over them. Once their strings
+// are corrected, removing the flag lets the next run convert them.
+const unparsableMark = "unparsable_timestamp"
+
+// timestampFields names the string date and time fields of a collection and the timestamps derived from them
+type timestampFields struct {
+    collection string
+    date       string
+    clock      string
+    at         string
+    end        string
+    minutes    int
+}
+
+var timestampMigrations = []timestampFields{
+    {"dialysis_appointments", "date", "time", "starts_at", "ends_at", models.DefaultDialysisMinutes},
+    {"nephrologist_appointments", "date", "time", "starts_at", "ends_at", models.DefaultNephrologistMinutes},
+    {"notifications", "sent_date", "sent_time", "sent_at", "", 0},
+    {"posts", "post_date", "post_time", "posted_at", "", 0},
+}
+
+// MigrateTimestamps fills in the typed timestamps of records saved when dates and times were only
+// stored as strings, reading the strings as clinic time. Records that already have a timestamp are
+// left alone, so it can be run again safely. Records whose strings cannot be parsed are kept as they are, reported
+// and marked with unparsableMark.
+func MigrateTimestamps(db *mongo.Database) (map[string]MigrationResult, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+    defer cancel()
+
+    results := map[string]MigrationResult{}
+    for _, fields := range timestampMigrations {
+        collection := db.Collection(fields.collection)
+        cursor, err := collection.Find(ctx, bson.M{fields.at: bson.M{"$exists": false}, unparsableMark: bson.M{"$ne": true}})
+        if err != nil {
+            return results, err
+        }
+
+        result := MigrationResult{}
+        for cursor.Next(ctx) {
+            var record bson.M
+            if err := cursor.Decode(&record); err != nil {
+                cursor.Close(ctx)
+                return results, err
+            }
+
+            date, _ := record[fields.date].(string)
+            clock, _ := record[fields.clock].(string)
+            at, err := models.ParseLocal(date, clock)
+            if err != nil {
+                if _, err := collection.UpdateOne(ctx, bson.M{"_id": record["_id"]}, bson.M{"$set": bson.M{unparsableMark: true}}); err != nil {
+                    cursor.Close(ctx)
+                    return results, err
+                }
+                result.Unparsable++
+                result.Skipped = append(result.Skipped, UnparsableRecord{ID: record["_id"], Date: date, Time: clock})
+                continue
+            }
+
+            set := bson.M{fields.at: at.UTC()}
+            if fields.end != "" {
+                minutes := fields.minutes
+                switch stored := record["duration_minutes"].(type) {
+                case int32:
+                    minutes = int(stored)
+                case int64:
+                    minutes = int(stored)
+                }
+                set[fields.end] = at.Add(time.Duration(minutes) * time.Minute).UTC()
+            }
+
+            if _, err := collection.UpdateOne(ctx, bson.M{"_id": record["_id"]}, bson.M{"$set": set}); err != nil {
+                cursor.Close(ctx)
+                return results, err
+            }
+            result.Converted++
+        }
+        cursor.Close(ctx)
+        if err := cursor.Err(); err != nil {
+            return results, err
+        }
+        results[fields.collection] = result
+    }
+    return results, nil
+}
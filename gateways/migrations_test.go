@@ -0,0 +1,71 @@
+package gateways
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMigrateTimestamps(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("string times become timestamps", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("dialysis_appointments",
+                bson.D{{Key: "_id", Value: 1}, {Key: "date", Value: "2024-03-04"}, {Key: "time", Value: "06:00"}, {Key: "duration_minutes", Value: 300}},
+                bson.D{{Key: "_id", Value: 2}, {Key: "date", Value: "04/03/2024"}, {Key: "time", Value: "6am"}},
+            ),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("nephrologist_appointments", bson.D{{Key: "_id", Value: 3}, {Key: "date", Value: "2024-03-04"}, {Key: "time", Value: "09:30:00"}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            found("notifications"),
+            found("posts"),
+        )
+
+        results, err := MigrateTimestamps(mt.DB)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if got := results["dialysis_appointments"]; got.Converted != 1 || got.Unparsable != 1 {
+            mt.Errorf("dialysis result = %+v, want 1 converted and 1 unparsable", got)
+        }
+        if got := results["nephrologist_appointments"]; got.Converted != 1 || got.Unparsable != 0 {
+            mt.Errorf("nephrologist result = %+v, want 1 converted", got)
+        }
+
+        if skipped := results["dialysis_appointments"].Skipped; len(skipped) != 1 || skipped[0].ID != int32(2) || skipped[0].Date != "04/03/2024" {
+            mt.Errorf("skipped = %+v, want record 2 with its date", skipped)
+        }
+
+        updates := sentUpdates(mt)
+        if len(updates) != 3 {
+            mt.Fatalf("sent %d updates, want 3", len(updates))
+        }
+        // The unparsable record is marked so it is not read again
+        if marked := updates[1].Lookup("$set", "unparsable_timestamp"); !marked.Boolean() {
+            mt.Errorf("second update = %v, want the unparsable record marked", updates[1])
+        }
+        // The stored duration wins over the default session length
+        dialysis := updates[0].Lookup("$set")
+        start := time.Date(2024, 3, 4, 6, 0, 0, 0, time.UTC)
+        if !dialysis.Document().Lookup("starts_at").Time().Equal(start) || !dialysis.Document().Lookup("ends_at").Time().Equal(start.Add(300*time.Minute)) {
+            mt.Errorf("dialysis update = %v, want 06:00 to 11:00", dialysis)
+        }
+        nephrologist := updates[2].Lookup("$set").Document()
+        if !nephrologist.Lookup("ends_at").Time().Equal(time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)) {
+            mt.Errorf("nephrologist update = %v, want the default 30 minutes", nephrologist)
+        }
+
+        // Only records still missing their timestamp are read, so running it again is safe
+        filter := sentFilters(mt, "find")[0]
+        if _, err := filter.LookupErr("starts_at", "$exists"); err != nil {
+            mt.Error("migration rereads records that already have a timestamp")
+        }
+        if _, err := filter.LookupErr("unparsable_timestamp", "$ne"); err != nil {
+            mt.Error("migration rereads records already found unparsable")
+        }
+    })
+}
@@ -0,0 +1,74 @@
+package gateways
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// found is the reply of a find or findOne that returns docs
+func found(collection string, docs ...bson.D) bson.D {
+    return mtest.CreateCursorResponse(0, "dialysis."+collection, mtest.FirstBatch, docs...)
+}
+
+// counted is the reply of a CountDocuments, which the driver sends as an aggregate
+func counted(collection string, n int) bson.D {
+    return found(collection, bson.D{{Key: "n", Value: n}})
+}
+
+// nextIDResponses are the replies nextID needs when the counter already exists
+func nextIDResponses(id int) []bson.D {
+    return []bson.D{
+        found("counters", bson.D{{Key: "_id", Value: "counter"}, {Key: "seq", Value: id - 1}}),
+        mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "seq", Value: id}}}),
+    }
+}
+
+// sentDocuments returns every document inserted with a command of the given name
+func sentDocuments(mt *mtest.T, commandName string) []bson.Raw {
+    mt.Helper()
+    var docs []bson.Raw
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName != commandName {
+            continue
+        }
+        values, _ := event.Command.Lookup("documents").Array().Values()
+        for _, value := range values {
+            docs = append(docs, value.Document())
+        }
+    }
+    return docs
+}
+
+// sentUpdates returns the update document of every update command, in order
+func sentUpdates(mt *mtest.T) []bson.Raw {
+    mt.Helper()
+    var updates []bson.Raw
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName == "update" {
+            updates = append(updates, event.Command.Lookup("updates", "0", "u").Document())
+        }
+    }
+    return updates
+}
+
+// sentFilters returns the filter of every command of the given name, in order
+func sentFilters(mt *mtest.T, commandName string) []bson.Raw {
+    mt.Helper()
+    var filters []bson.Raw
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName != commandName {
+            continue
+        }
+        switch commandName {
+        case "find":
+            filters = append(filters, event.Command.Lookup("filter").Document())
+        case "update":
+            filters = append(filters, event.Command.Lookup("updates", "0", "q").Document())
+        case "delete":
+            filters = append(filters, event.Command.Lookup("deletes", "0", "q").Document())
+        case "aggregate":
+            filters = append(filters, event.Command.Lookup("pipeline", "0", "$match").Document())
+        }
+    }
+    return filters
+}
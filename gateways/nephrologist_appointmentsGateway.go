@@ -2,20 +2,17 @@ package gateways
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"time"
 
 	"github.com/BrianKasina/dialysis-scheduling/models"
-	"github.com/BrianKasina/dialysis-scheduling/utils"
-	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type NephrologistAppointmentGateway struct {
+    db *mongo.Database
     collection *mongo.Collection
     collection2 *mongo.Collection
 }
@@ -23,39 +20,73 @@ type NephrologistAppointmentGateway struct {
 // Initialize Nephrologist Gateway
 func NewNephrologistAppointmentGateway(db *mongo.Database) *NephrologistAppointmentGateway {
     return &NephrologistAppointmentGateway{
+        db: db,
         collection: db.Collection("nephrologist_appointments"),
         collection2: db.Collection("patients"),
     }
 }
 
-// Retrieve nephrologist appointments with joined patient and staff data
-func (ng *NephrologistAppointmentGateway) GetAppointments(limit, offset int) ([]models.NephrologistAppointment, error) {
+// EnsureIndexes creates the indexes the appointment filters and clash checks rely on
+func (ng *NephrologistAppointmentGateway) EnsureIndexes() error {
+    return ensureAppointmentIndexes(ng.collection)
+}
+
+// GetAppointments retrieves the nephrologist appointments matching filter, one page at a time
+func (ng *NephrologistAppointmentGateway) GetAppointments(filter AppointmentFilter, limit, offset int) ([]models.NephrologistAppointment, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    opts := options.Find()
-    opts.SetLimit(int64(limit))
-    opts.SetSkip(int64(offset))
-
-    cursor, err := ng.collection.Find(ctx, bson.M{}, opts)
+    query, err := filter.query(false)
+    if err != nil {
+        return nil, err
+    }
+    opts, err := filter.findOptions(limit, offset)
     if err != nil {
         return nil, err
     }
-    defer cursor.Close(ctx)
 
-    var appointments []models.NephrologistAppointment
-    for cursor.Next(ctx) {
-        var appointment models.NephrologistAppointment
-        if err := cursor.Decode(&appointment); err != nil {
-            return nil, err
-        }
-        appointments = append(appointments, appointment)
+    cursor, err := ng.collection.Find(ctx, query, opts)
+    if err != nil {
+        return nil, err
+    }
+    appointments := []models.NephrologistAppointment{}
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
     }
     return appointments, nil
 }
 
+// GetAppointment retrieves one appointment, a non-zero patientID limits it to that patient's appointments
+func (ng *NephrologistAppointmentGateway) GetAppointment(appointmentID, patientID int) (*models.NephrologistAppointment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var appointment models.NephrologistAppointment
+    err := ng.collection.FindOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &appointment, nil
+}
+
+// CountAppointments counts the nephrologist appointments matching filter
+func (ng *NephrologistAppointmentGateway) CountAppointments(filter AppointmentFilter) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    query, err := filter.query(false)
+    if err != nil {
+        return 0, err
+    }
+    count, err := ng.collection.CountDocuments(ctx, query)
+    return int(count), err
+}
+
 // SearchAppointments searches for nephrologist appointments based on a query
-func (ng *NephrologistAppointmentGateway) SearchAppointments(query string, limit, offset int ) ([]models.NephrologistAppointment, error) {
+func (ng *NephrologistAppointmentGateway) SearchAppointments(query string, patientID, limit, offset int) ([]models.NephrologistAppointment, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -71,8 +102,9 @@ func (ng *NephrologistAppointmentGateway) SearchAppointments(query string, limit
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"starts_at": 1})
 
-    cursor, err := ng.collection.Find(ctx, filter, opts)
+    cursor, err := ng.collection.Find(ctx, scopeToPatient(filter, patientID), opts)
     if err != nil {
         return nil, err
     }
@@ -89,7 +121,7 @@ func (ng *NephrologistAppointmentGateway) SearchAppointments(query string, limit
     return appointments, nil
 }
 
-func (ng *NephrologistAppointmentGateway) GetTotalNephrologistAppointmentCount(query string) (int, error) {
+func (ng *NephrologistAppointmentGateway) GetTotalNephrologistAppointmentCount(query string, patientID int) (int, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
@@ -103,82 +135,177 @@ func (ng *NephrologistAppointmentGateway) GetTotalNephrologistAppointmentCount(q
         },
     }
 
-    count, err := ng.collection.CountDocuments(ctx, filter)
+    count, err := ng.collection.CountDocuments(ctx, scopeToPatient(filter, patientID))
     if err != nil {
         return 0, err
     }
     return int(count), nil
 }
 
-// Create new nephrologist appointment
-func (ng *NephrologistAppointmentGateway) CreateAppointment(w http.ResponseWriter, r *http.Request) {
+// Create new nephrologist appointment. The booking is refused with a ConflictError
+// when the patient or nephrologist is already booked at that time.
+func (ng *NephrologistAppointmentGateway) CreateAppointment(appointment *models.NephrologistAppointment) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    var appointment models.NephrologistAppointment
-    err := json.NewDecoder(r.Body).Decode(&appointment)
+    // IDs are always handed out here, so a booking cannot take over or collide with an existing appointment
+    id, err := nextID(ctx, ng.db, "nephrologist_appointments", "appointment_id")
     if err != nil {
-        utils.ErrorHandler(w, http.StatusBadRequest, err, "Invalid request payload")
-        return
+        return err
     }
-
-    _, err = ng.collection.InsertOne(ctx, appointment)
-    if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to create nephrologist appointment")
-        return
+    appointment.ID = id
+    if err := appointment.ResolveTimes(); err != nil {
+        return fmt.Errorf("%w: %v", ErrInvalidSlot, err)
     }
 
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(appointment)
-
+    return withBookingLock(ng.db, nephrologistSlot(appointment), func(ctx context.Context) error {
+        _, err := ng.collection.InsertOne(ctx, appointment)
+        return err
+    })
 }
 
-// Update or cancel nephrologist appointment
-func (ng *NephrologistAppointmentGateway) UpdateAppointment(appointment *models.NephrologistAppointment) error {
+// UpdateAppointment corrects the names on a nephrologist appointment, a non-zero patientID limits the update to that
+// patient's appointments. Moving it to another date or time goes through Reschedule so the original is kept,
+// and the status only changes through TransitionStatus.
+func (ng *NephrologistAppointmentGateway) UpdateAppointment(appointment *models.NephrologistAppointment, patientID int) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    filter := bson.M{"appointment_id": appointment.ID}
+    filter := scopeToPatient(bson.M{"appointment_id": appointment.ID}, patientID)
+
+    var existing models.NephrologistAppointment
+    err := ng.collection.FindOne(ctx, filter).Decode(&existing)
+    if err == mongo.ErrNoDocuments {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointment.ID)
+    }
+    if err != nil {
+        return err
+    }
+    if movesAppointment(appointment.Date, appointment.Time, appointment.StartsAt, existing.StartsAt) {
+        return ErrMoveNeedsReschedule
+    }
+
     update := bson.M{
         "$set": bson.M{
-            "date":         appointment.Date,
-            "time":         appointment.Time,
-            "status":       appointment.Status,
             "patient_name": appointment.PatientName,
             "staff_name":   appointment.StaffName,
         },
     }
+    _, err = ng.collection.UpdateOne(ctx, filter, update)
+    return err
+}
+
+// TransitionStatus moves a nephrologist appointment to change.To and records change in its history,
+// a non-zero patientID limits it to that patient's appointments
+func (ng *NephrologistAppointmentGateway) TransitionStatus(appointmentID, patientID int, change *models.StatusChange) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    return transitionStatus(ctx, ng.collection, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID), change, nil)
+}
+
+// Reschedule moves a nephrologist appointment to the date and time in request, keeping the original as
+// rescheduled and linked to the new appointment, which takes over its status. The new time must be an open
+// slot in the nephrologist's working hours, and the patient is told of the move.
+func (ng *NephrologistAppointmentGateway) Reschedule(appointmentID, patientID int, request models.RescheduleRequest, change models.StatusChange) (*models.NephrologistAppointment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
 
-    result, err := ng.collection.UpdateOne(ctx, filter, update)
+    filter := scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)
+    var original models.NephrologistAppointment
+    err := ng.collection.FindOne(ctx, filter).Decode(&original)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
     if err != nil {
-        return err
+        return nil, err
+    }
+    if !models.CanTransition(original.Status, models.StatusRescheduled) {
+        return nil, fmt.Errorf("%w from %q to %q", ErrIllegalTransition, models.CurrentStatus(original.Status), models.StatusRescheduled)
+    }
+
+    id, err := nextID(ctx, ng.db, "nephrologist_appointments", "appointment_id")
+    if err != nil {
+        return nil, err
     }
 
-    if result.MatchedCount == 0 {
-        return fmt.Errorf("no appointment found with ID %d", appointment.ID)
+    moved := original
+    moved.ID = id
+    moved.Date, moved.Time = request.Date, request.Time
+    moved.StartsAt, moved.EndsAt = time.Time{}, time.Time{}
+    moved.Status = models.CurrentStatus(original.Status)
+    moved.StatusHistory = rescheduledHistory(moved.Status, original.ID, change)
+    moved.RescheduledFrom, moved.RescheduledTo = original.ID, 0
+    if err := moved.ResolveTimes(); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrInvalidSlot, err)
     }
 
-    return nil
+    availability := NewAvailabilityGateway(ng.db)
+    slot := nephrologistSlot(&moved)
+    slot.AppointmentID = original.ID
+    err = withBookingLock(ng.db, slot, func(ctx context.Context) error {
+        // Free the original first so moving within the same afternoon does not count it against the new slot
+        change.To = models.StatusRescheduled
+        if err := transitionStatus(ctx, ng.collection, filter, &change, bson.M{"rescheduled_to": moved.ID}); err != nil {
+            return err
+        }
+        // Nephrologists without working hours are booked freely, as CreateAppointment does
+        hours, err := availability.findWorkingHours(ctx, moved.StaffID)
+        if err != nil {
+            return err
+        }
+        if len(hours) > 0 {
+            if err := availability.checkOpenSlot(ctx, &moved); err != nil {
+                return err
+            }
+        }
+        if _, err := ng.collection.InsertOne(ctx, moved); err != nil {
+            return err
+        }
+        message := rescheduleMessage("nephrologist", original.Date, original.Time, moved.Date, moved.Time, change.Reason)
+        return notifyPatient(ctx, ng.db, moved.PatientID, moved.PatientName, message)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &moved, nil
 }
 
-// Delete nephrologist appointment
-func (ng *NephrologistAppointmentGateway) DeleteAppointment(w http.ResponseWriter, r *http.Request) {
+// GetRescheduleReport counts the nephrologist appointments rescheduled between from and to, per account
+func (ng *NephrologistAppointmentGateway) GetRescheduleReport(from, to time.Time) (*models.RescheduleReport, error) {
+    return rescheduleReport(ng.collection, "nephrologist", from, to)
+}
+
+// nephrologistSlot describes the time and resources a nephrologist appointment holds
+func nephrologistSlot(appointment *models.NephrologistAppointment) bookingSlot {
+    minutes := appointment.DurationMinutes
+    if minutes == 0 {
+        minutes = models.DefaultNephrologistMinutes
+    }
+    return bookingSlot{
+        Type:          "nephrologist",
+        AppointmentID: appointment.ID,
+        Date:          appointment.Date,
+        Time:          appointment.Time,
+        Minutes:       minutes,
+        PatientID:     appointment.PatientID,
+        StaffID:       appointment.StaffID,
+    }
+}
+
+// Delete nephrologist appointment, a non-zero patientID limits it to that patient's appointments
+func (ng *NephrologistAppointmentGateway) DeleteAppointment(appointmentID, patientID int) error {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    vars := mux.Vars(r)
-    appointmentID := vars["id"]
-    if appointmentID == "" {
-        utils.ErrorHandler(w, http.StatusBadRequest, nil, "Missing appointment ID")
-        return
+    result, err := ng.collection.DeleteOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID))
+    if err != nil {
+        return err
     }
 
-    _, err := ng.collection.DeleteOne(ctx, bson.M{"appointment_id": appointmentID})
-    if err != nil {
-        utils.ErrorHandler(w, http.StatusInternalServerError, err, "Failed to delete nephrologist appointment")
-        return
+    if result.DeletedCount == 0 {
+        return fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
     }
 
-    w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]string{"message": "Nephrologist appointment deleted successfully"})
-}
\ No newline at end of file
+    return nil
+}
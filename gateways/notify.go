@@ -0,0 +1,41 @@
+package gateways
+
+import (
+	"context"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// notifyPatient leaves a notification for a patient, as the system rather than an admin
+func notifyPatient(ctx context.Context, db *mongo.Database, patientID int, patientName, message string) error {
+    return notify(ctx, db, models.Notification{Message: message, PatientID: patientID, PatientName: patientName})
+}
+
+// notifyCareTeam leaves a notification about a patient for the staff looking after them, which the patient
+// does not see
+func notifyCareTeam(ctx context.Context, db *mongo.Database, patientID int, patientName, message string) error {
+    return notify(ctx, db, models.Notification{
+        Message:     message,
+        PatientID:   patientID,
+        PatientName: patientName,
+        Audience:    models.AudienceCareTeam,
+    })
+}
+
+func notify(ctx context.Context, db *mongo.Database, notification models.Notification) error {
+    id, err := nextID(ctx, db, "notifications", "notification_id")
+    if err != nil {
+        return err
+    }
+
+    notification.ID = id
+    notification.SentAt = time.Now()
+    if err := notification.ResolveTimes(); err != nil {
+        return err
+    }
+
+    _, err = db.Collection("notifications").InsertOne(ctx, notification)
+    return err
+}
@@ -6,18 +6,30 @@ import (
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/mongo/options"
     "context"
+    "errors"
     "fmt"
     "time"
 )
 
+// ErrInvalidPatient is returned when a patient's details cannot be stored as given
+var ErrInvalidPatient = errors.New("invalid patient")
+
+// ErrPatientIDTaken is returned when a new patient is given the ID of an existing or visiting patient
+var ErrPatientIDTaken = errors.New("patient ID is already in use")
+
+// ErrAmbiguousPatientName is returned when a name looked up is shared by several patients
+var ErrAmbiguousPatientName = errors.New("several patients have that name")
+
 
 type PatientGateway struct {
     collection *mongo.Collection
+    transients *mongo.Collection
 }
 
 func NewPatientGateway(db *mongo.Database) *PatientGateway {
     return &PatientGateway{
         collection: db.Collection("patients"),
+        transients: db.Collection("transient_patients"),
     }
 }
 
@@ -121,32 +133,114 @@ func (pg *PatientGateway) GetTotalPatientCount(query string) (int, error) {
     return int(count), err
 }
 
+// GetPatientByID retrieves a single patient record
+func (pg *PatientGateway) GetPatientByID(patientID int) (*models.Patient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var patient models.Patient
+    err := pg.collection.FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&patient)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("no patient found with ID %d", patientID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &patient, nil
+}
+
+// GetPatientByName retrieves the only patient with a name, failing with ErrAmbiguousPatientName when the name
+// is shared so callers never mix up two patients' records
+func (pg *PatientGateway) GetPatientByName(name string) (*models.Patient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    cursor, err := pg.collection.Find(ctx, bson.M{"name": name}, options.Find().SetLimit(2))
+    if err != nil {
+        return nil, err
+    }
+    var patients []models.Patient
+    if err := cursor.All(ctx, &patients); err != nil {
+        return nil, err
+    }
+    switch len(patients) {
+    case 0:
+        return nil, fmt.Errorf("no patient found named %q", name)
+    case 1:
+        return &patients[0], nil
+    default:
+        return nil, fmt.Errorf("%w: %q, give patient_id instead", ErrAmbiguousPatientName, name)
+    }
+}
+
 func (pg *PatientGateway) CreatePatient(patient *models.Patient) error {
+    if err := normalizeSerology(patient.Serology); err != nil {
+        return err
+    }
+
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
+    // Visiting patients share the ID space, and an ID reused here would hand over their appointments
+    for _, collection := range []*mongo.Collection{pg.collection, pg.transients} {
+        taken, err := collection.CountDocuments(ctx, bson.M{"patient_id": patient.ID})
+        if err != nil {
+            return err
+        }
+        if taken > 0 {
+            return fmt.Errorf("%w: %d", ErrPatientIDTaken, patient.ID)
+        }
+    }
+
     _, err := pg.collection.InsertOne(ctx, patient)
     return err
 }
 
+// clearablePatientFields are the optional details an update leaves alone when they are not given, and removes
+// when they are named in the patient's clear list
+var clearablePatientFields = map[string]bool{"dialysis_needs": true, "serology": true}
+
 func (pg *PatientGateway) UpdatePatient(patient *models.Patient) error {
+    if err := normalizeSerology(patient.Serology); err != nil {
+        return err
+    }
+
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
     filter := bson.M{"patient_id": patient.ID}
-    update := bson.M{
-        "$set": bson.M{
-            "name":             patient.Name,
-            "address":          patient.Address,
-            "phone_number":     patient.PhoneNumber,
-            "date_of_birth":    patient.DateOfBirth,
-            "gender":           patient.Gender,
-            "emergency_contact": patient.EmergencyContact,
-            "payment_details_id": patient.PaymentDetailsID,
-            "payment_name":     patient.PaymentName,
-            "status":           patient.Status,
-            "history_file":     patient.HistoryFile,
-        },
+    set := bson.M{
+        "name":             patient.Name,
+        "address":          patient.Address,
+        "phone_number":     patient.PhoneNumber,
+        "date_of_birth":    patient.DateOfBirth,
+        "gender":           patient.Gender,
+        "emergency_contact": patient.EmergencyContact,
+        "payment_details_id": patient.PaymentDetailsID,
+        "payment_name":     patient.PaymentName,
+        "status":           patient.Status,
+        "history_file":     patient.HistoryFile,
+    }
+    if patient.DialysisNeeds != nil {
+        set["dialysis_needs"] = patient.DialysisNeeds
+    }
+    if patient.Serology != nil {
+        set["serology"] = patient.Serology
+    }
+    update := bson.M{"$set": set}
+
+    unset := bson.M{}
+    for _, field := range patient.Clear {
+        if !clearablePatientFields[field] {
+            return fmt.Errorf("%w: %q cannot be cleared", ErrInvalidPatient, field)
+        }
+        if _, given := set[field]; given {
+            return fmt.Errorf("%w: %q is both given and cleared", ErrInvalidPatient, field)
+        }
+        unset[field] = ""
+    }
+    if len(unset) > 0 {
+        update["$unset"] = unset
     }
 
     result, err := pg.collection.UpdateOne(ctx, filter, update)
@@ -168,4 +262,16 @@ func (pg *PatientGateway) DeletePatient(patientID string) error {
     filter := bson.M{"patient_id": patientID}
     _, err := pg.collection.DeleteOne(ctx, filter)
     return err
-}
\ No newline at end of file
+}
+
+// normalizeSerology checks the serology results given with a patient, since a misspelt positive result
+// would put them on a standard station
+func normalizeSerology(serology *models.Serology) error {
+    if serology == nil {
+        return nil
+    }
+    if err := serology.Normalize(); err != nil {
+        return fmt.Errorf("%w: %v", ErrInvalidPatient, err)
+    }
+    return nil
+}
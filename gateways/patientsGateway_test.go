@@ -0,0 +1,158 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCreatePatient(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("new ID is stored", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("patients", 0), counted("transient_patients", 0), mtest.CreateSuccessResponse())
+
+        if err := NewPatientGateway(mt.DB).CreatePatient(&models.Patient{ID: 3, Name: "Jane Doe"}); err != nil {
+            mt.Fatalf("CreatePatient() error = %v", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 1 {
+            mt.Errorf("inserted %d patients, want 1", len(inserted))
+        }
+    })
+
+    mt.Run("ID held by a visiting patient", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("patients", 0), counted("transient_patients", 1))
+
+        err := NewPatientGateway(mt.DB).CreatePatient(&models.Patient{ID: 3, Name: "Jane Doe"})
+        if !errors.Is(err, ErrPatientIDTaken) {
+            mt.Fatalf("CreatePatient() error = %v, want ErrPatientIDTaken", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d patients, want none", len(inserted))
+        }
+    })
+
+    mt.Run("misspelt serology", func(mt *mtest.T) {
+        patient := &models.Patient{ID: 3, Serology: &models.Serology{HBsAg: "postive"}}
+        if err := NewPatientGateway(mt.DB).CreatePatient(patient); !errors.Is(err, ErrInvalidPatient) {
+            mt.Errorf("CreatePatient() error = %v, want ErrInvalidPatient", err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+}
+
+func TestGetPatientByName(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    patient := func(id int) bson.D {
+        return bson.D{{Key: "patient_id", Value: id}, {Key: "name", Value: "Jane Doe"}}
+    }
+
+    mt.Run("only patient with the name", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients", patient(3)))
+
+        got, err := NewPatientGateway(mt.DB).GetPatientByName("Jane Doe")
+        if err != nil {
+            mt.Fatalf("GetPatientByName() error = %v", err)
+        }
+        if got.ID != 3 {
+            mt.Errorf("patient ID = %d, want 3", got.ID)
+        }
+    })
+
+    mt.Run("name shared by two patients", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients", patient(3), patient(8)))
+
+        if _, err := NewPatientGateway(mt.DB).GetPatientByName("Jane Doe"); !errors.Is(err, ErrAmbiguousPatientName) {
+            mt.Errorf("GetPatientByName() error = %v, want ErrAmbiguousPatientName", err)
+        }
+    })
+
+    mt.Run("unknown name", func(mt *mtest.T) {
+        mt.AddMockResponses(found("patients"))
+
+        if _, err := NewPatientGateway(mt.DB).GetPatientByName("Jane Doe"); err == nil {
+            mt.Errorf("GetPatientByName() error = nil, want not found")
+        }
+    })
+}
+
+func TestUpdatePatientOptionalDetails(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    matched := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})
+
+    mt.Run("needs left out are kept", func(mt *mtest.T) {
+        mt.AddMockResponses(matched)
+
+        if err := NewPatientGateway(mt.DB).UpdatePatient(&models.Patient{ID: 3, Name: "Jane Doe"}); err != nil {
+            mt.Fatalf("UpdatePatient() error = %v", err)
+        }
+        update := sentUpdates(mt)[0]
+        if _, err := update.LookupErr("$set", "dialysis_needs"); err == nil {
+            mt.Errorf("update %v overwrites the dialysis needs", update)
+        }
+        if _, err := update.LookupErr("$set", "serology"); err == nil {
+            mt.Errorf("update %v overwrites the serology", update)
+        }
+        if _, err := update.LookupErr("$unset"); err == nil {
+            mt.Errorf("update %v removes details", update)
+        }
+    })
+
+    mt.Run("needs given are set", func(mt *mtest.T) {
+        mt.AddMockResponses(matched)
+
+        patient := &models.Patient{ID: 3, DialysisNeeds: &models.DialysisNeeds{SessionsPerWeek: 3}}
+        if err := NewPatientGateway(mt.DB).UpdatePatient(patient); err != nil {
+            mt.Fatalf("UpdatePatient() error = %v", err)
+        }
+        if sessions := sentUpdates(mt)[0].Lookup("$set", "dialysis_needs", "sessions_per_week").AsInt64(); sessions != 3 {
+            mt.Errorf("sessions_per_week = %d, want 3", sessions)
+        }
+    })
+
+    mt.Run("needs cleared are removed", func(mt *mtest.T) {
+        mt.AddMockResponses(matched)
+
+        if err := NewPatientGateway(mt.DB).UpdatePatient(&models.Patient{ID: 3, Clear: []string{"dialysis_needs"}}); err != nil {
+            mt.Fatalf("UpdatePatient() error = %v", err)
+        }
+        if _, err := sentUpdates(mt)[0].LookupErr("$unset", "dialysis_needs"); err != nil {
+            mt.Errorf("update %v does not remove the dialysis needs", sentUpdates(mt)[0])
+        }
+    })
+
+    mt.Run("serology cleared is removed", func(mt *mtest.T) {
+        mt.AddMockResponses(matched)
+
+        if err := NewPatientGateway(mt.DB).UpdatePatient(&models.Patient{ID: 3, Clear: []string{"serology"}}); err != nil {
+            mt.Fatalf("UpdatePatient() error = %v", err)
+        }
+        if _, err := sentUpdates(mt)[0].LookupErr("$unset", "serology"); err != nil {
+            mt.Errorf("update %v does not remove the serology", sentUpdates(mt)[0])
+        }
+    })
+
+    invalid := []struct {
+        name    string
+        patient *models.Patient
+    }{
+        {"needs both given and cleared", &models.Patient{ID: 3, DialysisNeeds: &models.DialysisNeeds{SessionsPerWeek: 3}, Clear: []string{"dialysis_needs"}}},
+        {"serology both given and cleared", &models.Patient{ID: 3, Serology: &models.Serology{HBsAg: "negative"}, Clear: []string{"serology"}}},
+        {"required detail cleared", &models.Patient{ID: 3, Clear: []string{"name"}}},
+    }
+    for _, tt := range invalid {
+        mt.Run(tt.name, func(mt *mtest.T) {
+            if err := NewPatientGateway(mt.DB).UpdatePatient(tt.patient); !errors.Is(err, ErrInvalidPatient) {
+                mt.Errorf("UpdatePatient() error = %v, want ErrInvalidPatient", err)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+}
@@ -76,6 +76,22 @@ func (pg *PaymentDetailsGateway) SearchPaymentDetails(query string, limit, offse
     return paymentDetails, nil
 }
 
+// GetPaymentDetailByID retrieves a single payment detail record
+func (pg *PaymentDetailsGateway) GetPaymentDetailByID(paymentDetailID int) (*models.PaymentDetails, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var paymentDetail models.PaymentDetails
+    err := pg.collection.FindOne(ctx, bson.M{"payment_details_id": paymentDetailID}).Decode(&paymentDetail)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("no payment detail found with ID %d", paymentDetailID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &paymentDetail, nil
+}
+
 func (pg *PaymentDetailsGateway) GetTotalPaymentDetailsCount(query string) (int, error) {
     return 0, nil
 }
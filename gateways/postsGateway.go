@@ -28,6 +28,7 @@ func (pg *PostGateway) GetPosts(limit, offset int) ([]models.Post, error) {
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"posted_at": -1})
 
     cursor, err := pg.collection.Find(ctx, bson.M{}, opts)
     if err != nil {
@@ -59,6 +60,7 @@ func (pg *PostGateway) SearchPosts(query string, limit, offset int) ([]models.Po
     opts := options.Find()
     opts.SetLimit(int64(limit))
     opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"posted_at": -1})
 
     cursor, err := pg.collection.Find(ctx, filter, opts)
     if err != nil {
@@ -82,12 +84,16 @@ func (pg *PostGateway) GetTotalPostCount(query string) (int, error) {
 }
 
 func (pg *PostGateway) CreatePost(post *models.Post) error {
+    if err := post.ResolveTimes(); err != nil {
+        return err
+    }
     _, err := pg.collection.InsertOne(context.Background(),
         bson.M{
             "title": post.Title,
             "content": post.Content,
             "post_date": post.PostDate,
             "post_time": post.PostTime,
+            "posted_at": post.PostedAt,
             "admin_name": post.AdminName,
         })
     return err
@@ -98,15 +104,21 @@ func (pg *PostGateway) UpdatePost(post *models.Post) error {
     defer cancel()
 
     filter := bson.M{"post_id": post.ID}
-    update := bson.M{
-        "$set": bson.M{
-            "title":      post.Title,
-            "content":    post.Content,
-            "post_date":  post.PostDate,
-            "post_time":  post.PostTime,
-            "admin_name": post.AdminName,
-        },
+    fields := bson.M{
+        "title":      post.Title,
+        "content":    post.Content,
+        "admin_name": post.AdminName,
+    }
+    // The posting time only changes when a new one is given
+    if post.PostDate != "" || !post.PostedAt.IsZero() {
+        if err := post.ResolveTimes(); err != nil {
+            return err
+        }
+        fields["post_date"] = post.PostDate
+        fields["post_time"] = post.PostTime
+        fields["posted_at"] = post.PostedAt
     }
+    update := bson.M{"$set": fields}
 
     result, err := pg.collection.UpdateOne(ctx, filter, update)
     if err != nil {
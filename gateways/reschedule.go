@@ -0,0 +1,103 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrMoveNeedsReschedule is returned when an update tries to change an appointment's date or time directly
+var ErrMoveNeedsReschedule = errors.New("appointments are moved by rescheduling them")
+
+// movesAppointment reports whether an update asks for a different start than the stored one.
+// Leaving the date and time out keeps the current start.
+func movesAppointment(date, clock string, startsAt, current time.Time) bool {
+    switch {
+    case date != "" || clock != "":
+        requested, err := models.ParseLocal(date, clock)
+        return err != nil || !requested.Equal(current)
+    case !startsAt.IsZero():
+        return !startsAt.Equal(current)
+    }
+    return false
+}
+
+// rescheduledHistory starts the history of the appointment that replaces a rescheduled one
+func rescheduledHistory(status string, originalID int, change models.StatusChange) []models.StatusChange {
+    change.From = ""
+    change.To = status
+    change.Reason = fmt.Sprintf("rescheduled from appointment %d: %s", originalID, change.Reason)
+    change.ChangedAt = time.Now()
+    return []models.StatusChange{change}
+}
+
+// rescheduleMessage tells a patient where their appointment moved to
+func rescheduleMessage(kind, fromDate, fromTime, toDate, toTime, reason string) string {
+    return fmt.Sprintf("Your %s appointment on %s at %s has been moved to %s at %s. Reason: %s",
+        kind, fromDate, fromTime, toDate, toTime, reason)
+}
+
+// rescheduleReport counts the reschedules recorded in the status histories of a collection between
+// from and to, per account that made them. Zero times leave that end of the period open.
+func rescheduleReport(collection *mongo.Collection, appointmentType string, from, to time.Time) (*models.RescheduleReport, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    change := bson.M{"to": models.StatusRescheduled}
+    period := bson.M{}
+    if !from.IsZero() {
+        period["$gte"] = from
+    }
+    if !to.IsZero() {
+        period["$lt"] = to
+    }
+    if len(period) > 0 {
+        change["changed_at"] = period
+    }
+    unwound := bson.M{}
+    for field, value := range change {
+        unwound["status_history."+field] = value
+    }
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{"status_history": bson.M{"$elemMatch": change}}}},
+        {{Key: "$unwind", Value: "$status_history"}},
+        {{Key: "$match", Value: unwound}},
+        {{Key: "$group", Value: bson.M{
+            "_id":   bson.M{"changed_by": "$status_history.changed_by", "role": "$status_history.role"},
+            "count": bson.M{"$sum": 1},
+        }}},
+        {{Key: "$sort", Value: bson.M{"count": -1}}},
+    }
+
+    cursor, err := collection.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    var groups []struct {
+        ID struct {
+            ChangedBy int    `bson:"changed_by"`
+            Role      string `bson:"role"`
+        } `bson:"_id"`
+        Count int `bson:"count"`
+    }
+    if err := cursor.All(ctx, &groups); err != nil {
+        return nil, err
+    }
+
+    report := &models.RescheduleReport{Type: appointmentType, From: from, To: to, ByActor: []models.RescheduleCount{}}
+    for _, group := range groups {
+        report.Total += group.Count
+        report.ByActor = append(report.ByActor, models.RescheduleCount{
+            ChangedBy: group.ID.ChangedBy,
+            Role:      group.ID.Role,
+            Count:     group.Count,
+        })
+    }
+    return report, nil
+}
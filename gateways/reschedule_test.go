@@ -0,0 +1,132 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMovesAppointment(t *testing.T) {
+    current, _ := models.ParseLocal("2024-03-04", "06:00")
+    tests := []struct {
+        date, clock string
+        startsAt    time.Time
+        want        bool
+    }{
+        {"", "", time.Time{}, false},
+        {"2024-03-04", "06:00", time.Time{}, false},
+        {"2024-03-04", "10:00", time.Time{}, true},
+        {"2024-03-05", "", time.Time{}, true},
+        {"", "", current, false},
+        {"", "", current.Add(time.Hour), true},
+        // An unreadable start cannot be compared, so it is treated as a move
+        {"next monday", "06:00", time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        if got := movesAppointment(tt.date, tt.clock, tt.startsAt, current); got != tt.want {
+            t.Errorf("movesAppointment(%q, %q, %v) = %v, want %v", tt.date, tt.clock, tt.startsAt, got, tt.want)
+        }
+    }
+}
+
+func TestReschedule(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    tomorrow := time.Now().AddDate(0, 0, 1).Format(dateLayout)
+    original := func(status string) bson.D {
+        return bson.D{
+            {Key: "appointment_id", Value: 12},
+            {Key: "patient_id", Value: 7},
+            {Key: "patient_name", Value: "Jane"},
+            {Key: "date", Value: tomorrow},
+            {Key: "time", Value: "06:00"},
+            {Key: "duration_minutes", Value: 240},
+            {Key: "schedule_id", Value: 3},
+            {Key: "status", Value: status},
+        }
+    }
+    request := models.RescheduleRequest{Date: tomorrow, Time: "14:00", Reason: "transport"}
+    change := models.StatusChange{ChangedBy: 2, Role: "front_desk", Reason: "transport"}
+    ok := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})
+
+    mt.Run("original is kept and linked to the new appointment", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", original(models.StatusConfirmed)))
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(ok, counted("closures", 0), found("dialysis_appointments"), found("nephrologist_appointments"))
+        mt.AddMockResponses(found("dialysis_appointments", original(models.StatusConfirmed)), ok, mtest.CreateSuccessResponse())
+        mt.AddMockResponses(nextIDResponses(50)...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+
+        moved, err := NewDialysisGateway(mt.DB).Reschedule(12, 0, request, change)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if moved.ID != 40 || moved.RescheduledFrom != 12 || moved.Time != "14:00" || moved.Status != models.StatusConfirmed {
+            mt.Errorf("moved = %+v, want confirmed appointment 40 at 14:00 from 12", moved)
+        }
+        if moved.ScheduleID != 0 {
+            mt.Errorf("moved appointment still belongs to schedule %d", moved.ScheduleID)
+        }
+
+        // The original gives up its slot in the same transaction, so it is left out of the clash checks
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName != "find" || event.Command.Lookup("find").StringValue() != "dialysis_appointments" {
+                continue
+            }
+            if filter := event.Command.Lookup("filter").Document(); filter.Lookup("$or").Type != 0 {
+                if excluded, ok := filter.Lookup("appointment_id", "$ne").AsInt64OK(); !ok || excluded != 12 {
+                    mt.Errorf("conflict filter %v does not leave out appointment 12", filter)
+                }
+            }
+        }
+        updates := sentUpdates(mt)
+        closed := updates[len(updates)-1]
+        if closed.Lookup("$set", "status").StringValue() != models.StatusRescheduled || closed.Lookup("$set", "rescheduled_to").Int32() != 40 {
+            mt.Errorf("original update = %v, want it rescheduled to 40", closed)
+        }
+        inserted := sentDocuments(mt, "insert")
+        if len(inserted) != 2 || inserted[0].Lookup("rescheduled_from").Int32() != 12 || inserted[1].Lookup("patient_id").Int32() != 7 {
+            mt.Errorf("inserted %v, want the new appointment and a notice to patient 7", inserted)
+        }
+    })
+
+    mt.Run("final appointment cannot be moved", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", original(models.StatusCompleted)))
+
+        _, err := NewDialysisGateway(mt.DB).Reschedule(12, 0, request, change)
+        if !errors.Is(err, ErrIllegalTransition) {
+            mt.Errorf("Reschedule() error = %v, want ErrIllegalTransition", err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 1 {
+            mt.Errorf("sent %d commands, want only the lookup", len(events))
+        }
+    })
+
+    mt.Run("new slot clashes", func(mt *mtest.T) {
+        clash := bson.D{
+            {Key: "appointment_id", Value: 30},
+            {Key: "patient_id", Value: 7},
+            {Key: "starts_at", Value: time.Now().AddDate(0, 0, -1)},
+            {Key: "ends_at", Value: time.Now().AddDate(0, 0, 3)},
+        }
+        mt.AddMockResponses(found("dialysis_appointments", original(models.StatusConfirmed)))
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(ok, counted("closures", 0), found("dialysis_appointments", clash), found("nephrologist_appointments", clash), mtest.CreateSuccessResponse())
+
+        _, err := NewDialysisGateway(mt.DB).Reschedule(12, 0, request, change)
+        var conflict *ConflictError
+        if !errors.As(err, &conflict) {
+            mt.Fatalf("Reschedule() error = %v, want a ConflictError", err)
+        }
+        if updates := sentUpdates(mt); len(updates) != 1 {
+            mt.Errorf("sent %d updates, want only the booking lock", len(updates))
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d documents, want none", len(inserted))
+        }
+    })
+}
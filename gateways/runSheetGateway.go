@@ -0,0 +1,164 @@
+package gateways
+
+import (
+	"context"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunSheetGateway builds the daily run-sheet from appointments, stations, staff and patients
+type RunSheetGateway struct {
+    appointments *mongo.Collection
+    stations     *mongo.Collection
+    staff        *mongo.Collection
+    patients     *mongo.Collection
+}
+
+// NewRunSheetGateway creates a new instance of RunSheetGateway
+func NewRunSheetGateway(db *mongo.Database) *RunSheetGateway {
+    return &RunSheetGateway{
+        appointments: db.Collection("dialysis_appointments"),
+        stations:     db.Collection("stations"),
+        staff:        db.Collection("hospital_staff"),
+        patients:     db.Collection("patients"),
+    }
+}
+
+// GetRunSheet lays out every active chair for each shift of a date with the session booked on it.
+// Cancelled sessions are left off; names come from the current patient and staff records.
+func (rg *RunSheetGateway) GetRunSheet(date string) (*models.RunSheet, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    cursor, err := rg.stations.Find(ctx, bson.M{"active": true}, options.Find().SetSort(bson.M{"station_id": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return nil, err
+    }
+
+    filter := bson.M{"date": date, "status": bson.M{"$ne": models.StatusCancelled}}
+    cursor, err = rg.appointments.Find(ctx, filter, options.Find().SetSort(bson.M{"starts_at": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var appointments []models.DialysisAppointment
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
+    }
+
+    patientIDs, staffIDs := []int{}, []int{}
+    for _, appointment := range appointments {
+        patientIDs = append(patientIDs, appointment.PatientID)
+        staffIDs = append(staffIDs, appointment.StaffID)
+    }
+    patientNames, err := namesByID(ctx, rg.patients, "patient_id", patientIDs)
+    if err != nil {
+        return nil, err
+    }
+    staffNames, err := namesByID(ctx, rg.staff, "staff_id", staffIDs)
+    if err != nil {
+        return nil, err
+    }
+
+    byShift := map[string][]models.DialysisAppointment{}
+    for _, appointment := range appointments {
+        shift := appointmentShift(&appointment)
+        byShift[shift] = append(byShift[shift], appointment)
+    }
+
+    sheet := &models.RunSheet{Date: date, GeneratedAt: time.Now(), Shifts: []models.RunSheetShift{}}
+    for _, shift := range models.ShiftOrder {
+        seated := map[int]models.DialysisAppointment{}
+        unseated := []models.DialysisAppointment{}
+        for _, appointment := range byShift[shift] {
+            if _, taken := seated[appointment.StationID]; appointment.StationID == 0 || taken {
+                unseated = append(unseated, appointment)
+                continue
+            }
+            seated[appointment.StationID] = appointment
+        }
+
+        rows := []models.RunSheetRow{}
+        for _, station := range stations {
+            row := models.RunSheetRow{StationID: station.ID, Room: station.Room, Isolation: station.Isolation, IsolationFor: station.IsolationGroup()}
+            if appointment, ok := seated[station.ID]; ok {
+                fillRunSheetRow(&row, appointment, patientNames, staffNames)
+                delete(seated, station.ID)
+            }
+            rows = append(rows, row)
+        }
+        // Sessions on a chair that has since been deactivated are listed with the unseated ones
+        for _, appointment := range seated {
+            unseated = append(unseated, appointment)
+        }
+        for _, appointment := range unseated {
+            row := models.RunSheetRow{StationID: appointment.StationID}
+            fillRunSheetRow(&row, appointment, patientNames, staffNames)
+            rows = append(rows, row)
+        }
+
+        sheet.Shifts = append(sheet.Shifts, models.RunSheetShift{
+            Shift:     shift,
+            StartTime: models.ShiftStartTimes[shift],
+            Rows:      rows,
+        })
+    }
+    return sheet, nil
+}
+
+// fillRunSheetRow copies a session onto a run-sheet row, preferring the current names of the patient and nurse
+func fillRunSheetRow(row *models.RunSheetRow, appointment models.DialysisAppointment, patientNames, staffNames map[int]string) {
+    row.AppointmentID = appointment.ID
+    row.Time = appointment.Time
+    row.PatientID = appointment.PatientID
+    row.PatientName = appointment.PatientName
+    if name, ok := patientNames[appointment.PatientID]; ok {
+        row.PatientName = name
+    }
+    row.StaffID = appointment.StaffID
+    row.NurseName = appointment.StaffName
+    if name, ok := staffNames[appointment.StaffID]; ok {
+        row.NurseName = name
+    }
+    row.Status = models.CurrentStatus(appointment.Status)
+    for _, change := range appointment.StatusHistory {
+        if change.To == models.StatusCheckedIn {
+            checkedIn := change.ChangedAt
+            row.CheckedInAt = &checkedIn
+        }
+    }
+}
+
+// namesByID looks up the name field of the records whose idField is one of ids
+func namesByID(ctx context.Context, collection *mongo.Collection, idField string, ids []int) (map[int]string, error) {
+    names := map[int]string{}
+    if len(ids) == 0 {
+        return names, nil
+    }
+
+    cursor, err := collection.Find(ctx, bson.M{idField: bson.M{"$in": ids}})
+    if err != nil {
+        return nil, err
+    }
+    var records []bson.M
+    if err := cursor.All(ctx, &records); err != nil {
+        return nil, err
+    }
+    for _, record := range records {
+        name, _ := record["name"].(string)
+        switch id := record[idField].(type) {
+        case int32:
+            names[int(id)] = name
+        case int64:
+            names[int(id)] = name
+        }
+    }
+    return names, nil
+}
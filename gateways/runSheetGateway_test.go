@@ -0,0 +1,84 @@
+package gateways
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetRunSheet(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("chairs, double bookings and unseated sessions", func(mt *mtest.T) {
+        checkedIn := time.Date(2024, 3, 4, 5, 50, 0, 0, time.UTC)
+        session := func(id, station int, clock, shift, status string, extra ...bson.E) bson.D {
+            return append(bson.D{
+                {Key: "appointment_id", Value: id},
+                {Key: "date", Value: "2024-03-04"},
+                {Key: "time", Value: clock},
+                {Key: "shift", Value: shift},
+                {Key: "station_id", Value: station},
+                {Key: "patient_id", Value: 100 + id},
+                {Key: "patient_name", Value: "stored name"},
+                {Key: "staff_id", Value: 3},
+                {Key: "status", Value: status},
+            }, extra...)
+        }
+
+        mt.AddMockResponses(
+            found("stations",
+                bson.D{{Key: "station_id", Value: 1}, {Key: "room", Value: "A"}},
+                bson.D{{Key: "station_id", Value: 2}, {Key: "room", Value: "B"}, {Key: "isolation", Value: true}},
+            ),
+            found("dialysis_appointments",
+                session(1, 1, "06:00", "morning", models.StatusCheckedIn,
+                    bson.E{Key: "status_history", Value: bson.A{bson.D{{Key: "to", Value: models.StatusCheckedIn}, {Key: "changed_at", Value: checkedIn}}}},
+                ),
+                session(2, 1, "06:00", "morning", models.StatusConfirmed),
+                session(3, 0, "16:00", "evening", models.StatusConfirmed),
+                session(4, 9, "11:00", "afternoon", models.StatusConfirmed),
+            ),
+            found("patients", bson.D{{Key: "patient_id", Value: 101}, {Key: "name", Value: "Jane Wanjiru"}}),
+            found("hospital_staff", bson.D{{Key: "staff_id", Value: 3}, {Key: "name", Value: "Nurse Otieno"}}),
+        )
+
+        sheet, err := NewRunSheetGateway(mt.DB).GetRunSheet("2024-03-04")
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if len(sheet.Shifts) != len(models.ShiftOrder) {
+            mt.Fatalf("sheet has %d shifts, want %d", len(sheet.Shifts), len(models.ShiftOrder))
+        }
+
+        rows := map[string][]models.RunSheetRow{}
+        for _, shift := range sheet.Shifts {
+            rows[shift.Shift] = shift.Rows
+        }
+
+        morning := rows["morning"]
+        if len(morning) != 3 {
+            mt.Fatalf("morning has %d rows, want both chairs and the double booking", len(morning))
+        }
+        first := morning[0]
+        if first.AppointmentID != 1 || first.PatientName != "Jane Wanjiru" || first.NurseName != "Nurse Otieno" || first.CheckedInAt == nil || !first.CheckedInAt.Equal(checkedIn) {
+            mt.Errorf("chair 1 = %+v, want session 1 with current names and its check-in time", first)
+        }
+        if morning[1].StationID != 2 || morning[1].AppointmentID != 0 || !morning[1].Isolation {
+            mt.Errorf("chair 2 = %+v, want the empty isolation chair", morning[1])
+        }
+        if morning[2].AppointmentID != 2 || morning[2].PatientName != "stored name" {
+            mt.Errorf("last morning row = %+v, want the double-booked session 2 with its stored name", morning[2])
+        }
+
+        // A session on a chair that is no longer active is still listed
+        if afternoon := rows["afternoon"]; len(afternoon) != 3 || afternoon[2].AppointmentID != 4 || afternoon[2].StationID != 9 {
+            mt.Errorf("afternoon rows = %+v, want session 4 after the chairs", afternoon)
+        }
+        if evening := rows["evening"]; len(evening) != 3 || evening[2].AppointmentID != 3 || evening[2].StationID != 0 {
+            mt.Errorf("evening rows = %+v, want unassigned session 3 after the chairs", evening)
+        }
+    })
+}
@@ -0,0 +1,15 @@
+package gateways
+
+import "go.mongodb.org/mongo-driver/bson"
+
+// scopeToPatient restricts a filter to the records of one patient.
+// A patientID of 0 means the caller is staff and the filter is left unrestricted.
+func scopeToPatient(filter bson.M, patientID int) bson.M {
+    if patientID == 0 {
+        return filter
+    }
+    if len(filter) == 0 {
+        return bson.M{"patient_id": patientID}
+    }
+    return bson.M{"$and": []bson.M{filter, {"patient_id": patientID}}}
+}
@@ -0,0 +1,31 @@
+package gateways
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestScopeToPatient(t *testing.T) {
+    byName := bson.M{"patient_name": "Jane"}
+
+    tests := []struct {
+        name      string
+        filter    bson.M
+        patientID int
+        want      bson.M
+    }{
+        {"staff keep the filter", byName, 0, byName},
+        {"patient with no filter", bson.M{}, 7, bson.M{"patient_id": 7}},
+        {"patient with a filter", byName, 7, bson.M{"$and": []bson.M{byName, {"patient_id": 7}}}},
+        // A patient_id in the filter cannot widen the scope, both have to match
+        {"patient naming another patient", bson.M{"patient_id": 99}, 7, bson.M{"$and": []bson.M{{"patient_id": 99}, {"patient_id": 7}}}},
+    }
+
+    for _, tt := range tests {
+        if got := scopeToPatient(tt.filter, tt.patientID); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: scopeToPatient() = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
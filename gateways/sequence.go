@@ -0,0 +1,47 @@
+package gateways
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// nextID returns the next numeric ID for a collection from the shared counters collection.
+// The first call for a collection starts counting after the highest ID already stored in idField.
+func nextID(ctx context.Context, db *mongo.Database, collection, idField string) (int, error) {
+    counters := db.Collection("counters")
+
+    err := counters.FindOne(ctx, bson.M{"_id": collection}).Err()
+    if err == mongo.ErrNoDocuments {
+        var highest bson.M
+        opts := options.FindOne().SetSort(bson.M{idField: -1}).SetProjection(bson.M{idField: 1})
+        err = db.Collection(collection).FindOne(ctx, bson.M{}, opts).Decode(&highest)
+        if err != nil && err != mongo.ErrNoDocuments {
+            return 0, err
+        }
+
+        seed := 0
+        if id, ok := highest[idField].(int32); ok {
+            seed = int(id)
+        } else if id, ok := highest[idField].(int64); ok {
+            seed = int(id)
+        }
+
+        _, err = counters.UpdateOne(ctx, bson.M{"_id": collection}, bson.M{"$max": bson.M{"seq": seed}}, options.Update().SetUpsert(true))
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    var counter struct {
+        Seq int `bson:"seq"`
+    }
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err = counters.FindOneAndUpdate(ctx, bson.M{"_id": collection}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+    if err != nil {
+        return 0, err
+    }
+    return counter.Seq, nil
+}
@@ -0,0 +1,358 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrStationTaken is returned when a station is already booked for the requested shift
+var ErrStationTaken = errors.New("station is already booked for this shift")
+
+// ErrStationUnavailable is returned when a station does not exist or is not active
+var ErrStationUnavailable = errors.New("station is not available for booking")
+
+// ErrInvalidStation is returned when a station's isolation settings do not make sense
+var ErrInvalidStation = errors.New("invalid station")
+
+// ErrStationInUse is returned when a station still has sessions or schedules booked on it
+var ErrStationInUse = errors.New("station still has bookings")
+
+// StationGateway handles database operations for dialysis stations
+type StationGateway struct {
+    db           *mongo.Database
+    collection   *mongo.Collection
+    appointments *mongo.Collection
+}
+
+// NewStationGateway creates a new instance of StationGateway
+func NewStationGateway(db *mongo.Database) *StationGateway {
+    return &StationGateway{
+        db:           db,
+        collection:   db.Collection("stations"),
+        appointments: db.Collection("dialysis_appointments"),
+    }
+}
+
+func (sg *StationGateway) GetStations(limit, offset int) ([]models.Station, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find()
+    opts.SetLimit(int64(limit))
+    opts.SetSkip(int64(offset))
+    opts.SetSort(bson.M{"station_id": 1})
+
+    cursor, err := sg.collection.Find(ctx, bson.M{}, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    var stations []models.Station
+    for cursor.Next(ctx) {
+        var station models.Station
+        if err := cursor.Decode(&station); err != nil {
+            return nil, err
+        }
+        stations = append(stations, station)
+    }
+    return stations, nil
+}
+
+func (sg *StationGateway) GetTotalStationCount() (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := sg.collection.CountDocuments(ctx, bson.M{})
+    return int(count), err
+}
+
+func (sg *StationGateway) CreateStation(station *models.Station) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := validateStation(station); err != nil {
+        return err
+    }
+    if station.ID == 0 {
+        id, err := nextID(ctx, sg.db, "stations", "station_id")
+        if err != nil {
+            return err
+        }
+        station.ID = id
+    }
+
+    _, err := sg.collection.InsertOne(ctx, station)
+    return err
+}
+
+func (sg *StationGateway) UpdateStation(station *models.Station) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := validateStation(station); err != nil {
+        return err
+    }
+
+    filter := bson.M{"station_id": station.ID}
+    update := bson.M{
+        "$set": bson.M{
+            "room":           station.Room,
+            "machine_serial": station.MachineSerial,
+            "isolation":      station.Isolation,
+            "isolation_for":  station.IsolationFor,
+            "active":         station.Active,
+        },
+    }
+
+    result, err := sg.collection.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return err
+    }
+
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("no station found with ID %d", station.ID)
+    }
+
+    return nil
+}
+
+// DeleteStation removes a station that nothing is booked on any more. While sessions that have not finished or
+// schedules that have not ended use it, it is refused with ErrStationInUse, the station can be deactivated instead.
+func (sg *StationGateway) DeleteStation(stationID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    // Sessions stored before timestamps were introduced only have their date
+    upcoming, err := sg.appointments.CountDocuments(ctx, bson.M{
+        "station_id": stationID,
+        "status":     bson.M{"$nin": releasedStatuses},
+        "$or": []bson.M{
+            {"ends_at": bson.M{"$gt": time.Now()}},
+            {"ends_at": bson.M{"$exists": false}, "date": bson.M{"$gte": models.LocalDate(time.Now())}},
+        },
+    })
+    if err != nil {
+        return err
+    }
+    schedules, err := sg.db.Collection("dialysis_schedules").CountDocuments(ctx, bson.M{
+        "station_id": stationID,
+        "$or": []bson.M{
+            {"end_date": bson.M{"$exists": false}},
+            {"end_date": ""},
+            {"end_date": bson.M{"$gte": models.LocalDate(time.Now())}},
+        },
+    })
+    if err != nil {
+        return err
+    }
+    if upcoming > 0 || schedules > 0 {
+        return fmt.Errorf("%w: %d upcoming session(s) and %d schedule(s), deactivate it instead", ErrStationInUse, upcoming, schedules)
+    }
+
+    _, err = sg.collection.DeleteOne(ctx, bson.M{"station_id": stationID})
+    return err
+}
+
+// GetOccupancy lists every active station for each shift of a date, with the appointment booked there if any
+func (sg *StationGateway) GetOccupancy(date string) (map[string][]models.StationOccupancy, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    cursor, err := sg.collection.Find(ctx, bson.M{"active": true}, options.Find().SetSort(bson.M{"station_id": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return nil, err
+    }
+
+    filter := bson.M{
+        "date":       date,
+        "station_id": bson.M{"$exists": true},
+        "status":     bson.M{"$nin": releasedStatuses},
+    }
+    cursor, err = sg.appointments.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    var appointments []models.DialysisAppointment
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
+    }
+
+    booked := map[string]map[int]models.DialysisAppointment{}
+    for _, appointment := range appointments {
+        shift := appointmentShift(&appointment)
+        if booked[shift] == nil {
+            booked[shift] = map[int]models.DialysisAppointment{}
+        }
+        booked[shift][appointment.StationID] = appointment
+    }
+
+    occupancy := map[string][]models.StationOccupancy{}
+    for shift := range models.ShiftStartTimes {
+        occupancy[shift] = []models.StationOccupancy{}
+        for _, station := range stations {
+            entry := models.StationOccupancy{Station: station}
+            if appointment, ok := booked[shift][station.ID]; ok {
+                entry.Appointment = &appointment
+            }
+            occupancy[shift] = append(occupancy[shift], entry)
+        }
+    }
+    return occupancy, nil
+}
+
+// GetIsolationViolations lists the dialysis sessions booked from one date to another, inclusive, whose station
+// does not match the patient's isolation group. Either date may be left empty.
+func (sg *StationGateway) GetIsolationViolations(from, to string) ([]models.IsolationViolation, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    cursor, err := sg.collection.Find(ctx, bson.M{})
+    if err != nil {
+        return nil, err
+    }
+    var stations []models.Station
+    if err := cursor.All(ctx, &stations); err != nil {
+        return nil, err
+    }
+    stationsByID := map[int]models.Station{}
+    for _, station := range stations {
+        stationsByID[station.ID] = station
+    }
+
+    filter := bson.M{
+        "station_id": bson.M{"$gt": 0},
+        "status":     bson.M{"$nin": releasedStatuses},
+    }
+    period := bson.M{}
+    if from != "" {
+        period["$gte"] = from
+    }
+    if to != "" {
+        period["$lte"] = to
+    }
+    if len(period) > 0 {
+        filter["date"] = period
+    }
+    cursor, err = sg.appointments.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "starts_at", Value: 1}, {Key: "station_id", Value: 1}}))
+    if err != nil {
+        return nil, err
+    }
+    var appointments []models.DialysisAppointment
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
+    }
+
+    groups := map[int]string{}
+    violations := []models.IsolationViolation{}
+    for _, appointment := range appointments {
+        station, ok := stationsByID[appointment.StationID]
+        if !ok {
+            continue
+        }
+        group, known := groups[appointment.PatientID]
+        if !known {
+            if group, err = patientIsolationGroup(ctx, sg.db, appointment.PatientID); err != nil {
+                return nil, err
+            }
+            groups[appointment.PatientID] = group
+        }
+
+        problem := isolationProblem(group, station)
+        if problem == "" {
+            continue
+        }
+        violations = append(violations, models.IsolationViolation{
+            AppointmentID: appointment.ID,
+            Date:          appointment.Date,
+            Shift:         appointmentShift(&appointment),
+            Status:        models.CurrentStatus(appointment.Status),
+            PatientID:     appointment.PatientID,
+            PatientName:   appointment.PatientName,
+            PatientGroup:  group,
+            StationID:     station.ID,
+            StationGroup:  station.IsolationGroup(),
+            Problem:       problem,
+        })
+    }
+    return violations, nil
+}
+
+// validateStation checks an isolation group is only set on an isolation station and is one that is known
+func validateStation(station *models.Station) error {
+    switch station.IsolationFor {
+    case "":
+        return nil
+    case models.IsolationHBV, models.IsolationHCV, models.IsolationHIV, models.IsolationCOVID, models.IsolationGeneral:
+        if !station.Isolation {
+            return fmt.Errorf("%w: only an isolation station can be isolated for %s", ErrInvalidStation, station.IsolationFor)
+        }
+        return nil
+    }
+    return fmt.Errorf("%w: unknown isolation group %q", ErrInvalidStation, station.IsolationFor)
+}
+
+// releasedStatuses are appointment statuses that no longer hold a station, nurse or patient
+var releasedStatuses = models.ReleasedStatuses
+
+// appointmentShift returns the shift of an appointment, working it out from the start time when it was not stored
+func appointmentShift(appointment *models.DialysisAppointment) string {
+    if appointment.Shift != "" {
+        return appointment.Shift
+    }
+    return models.ShiftForTime(appointment.Time)
+}
+
+// checkStationFree makes sure the appointment's station is active, its machine is fit for use, it suits the patient's
+// isolation group and it is not booked by another appointment in the same shift on the same date. It fills in the
+// shift when only a time was given.
+func checkStationFree(ctx context.Context, db *mongo.Database, appointment *models.DialysisAppointment) error {
+    if appointment.StationID == 0 {
+        return nil
+    }
+
+    var station models.Station
+    err := db.Collection("stations").FindOne(ctx, bson.M{"station_id": appointment.StationID, "active": true}).Decode(&station)
+    if err == mongo.ErrNoDocuments {
+        return ErrStationUnavailable
+    }
+    if err != nil {
+        return err
+    }
+    if err := checkMachine(ctx, db, station.ID, appointment.Date); err != nil {
+        return err
+    }
+    if err := checkIsolation(ctx, db, appointment.PatientID, station); err != nil {
+        return err
+    }
+
+    // Station bookings are new, so every booked appointment has its shift stored
+    appointment.Shift = appointmentShift(appointment)
+    filter := bson.M{
+        "appointment_id": bson.M{"$ne": appointment.ID},
+        "date":           appointment.Date,
+        "shift":          appointment.Shift,
+        "station_id":     appointment.StationID,
+        "status":         bson.M{"$nin": releasedStatuses},
+    }
+
+    count, err := db.Collection("dialysis_appointments").CountDocuments(ctx, filter)
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return ErrStationTaken
+    }
+    return nil
+}
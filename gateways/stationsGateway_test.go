@@ -0,0 +1,156 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckStationFree(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    station := bson.D{{Key: "station_id", Value: 4}, {Key: "active", Value: true}}
+
+    mt.Run("no station requested", func(mt *mtest.T) {
+        appointment := &models.DialysisAppointment{ID: 1, Date: "2024-03-04", Time: "06:00"}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); err != nil {
+            mt.Fatal(err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+
+    mt.Run("inactive or unknown station", func(mt *mtest.T) {
+        mt.AddMockResponses(found("stations"))
+        appointment := &models.DialysisAppointment{ID: 1, Date: "2024-03-04", Time: "06:00", StationID: 4}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); !errors.Is(err, ErrStationUnavailable) {
+            mt.Errorf("checkStationFree() error = %v, want ErrStationUnavailable", err)
+        }
+    })
+
+    mt.Run("machine out of service", func(mt *mtest.T) {
+        mt.AddMockResponses(found("stations", station), found("machines", bson.D{{Key: "serial", Value: "M-1"}, {Key: "status", Value: models.MachineOutOfService}}))
+        appointment := &models.DialysisAppointment{ID: 1, Date: "2024-03-04", Time: "06:00", StationID: 4}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); !errors.Is(err, ErrMachineUnavailable) {
+            mt.Errorf("checkStationFree() error = %v, want ErrMachineUnavailable", err)
+        }
+    })
+
+    mt.Run("patient outside the station's isolation group", func(mt *mtest.T) {
+        positive := bson.D{{Key: "patient_id", Value: 7}, {Key: "serology", Value: bson.D{{Key: "hbsag", Value: models.SerologyPositive}}}}
+        mt.AddMockResponses(found("stations", station), found("machines"), found("patients", positive))
+        appointment := &models.DialysisAppointment{ID: 1, PatientID: 7, Date: "2024-03-04", Time: "06:00", StationID: 4}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); !errors.Is(err, ErrIsolationMismatch) {
+            mt.Errorf("checkStationFree() error = %v, want ErrIsolationMismatch", err)
+        }
+    })
+
+    mt.Run("booked by another appointment in the shift", func(mt *mtest.T) {
+        mt.AddMockResponses(found("stations", station), found("machines"), found("patients"), found("transient_patients"), counted("dialysis_appointments", 1))
+        appointment := &models.DialysisAppointment{ID: 1, Date: "2024-03-04", Time: "13:30", StationID: 4}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); !errors.Is(err, ErrStationTaken) {
+            mt.Fatalf("checkStationFree() error = %v, want ErrStationTaken", err)
+        }
+
+        filter := sentFilters(mt, "aggregate")[0]
+        if filter.Lookup("shift").StringValue() != "afternoon" || filter.Lookup("date").StringValue() != "2024-03-04" {
+            mt.Errorf("conflict filter %v does not match the afternoon shift of the date", filter)
+        }
+        // Moving an appointment must not conflict with itself
+        if filter.Lookup("appointment_id", "$ne").Int32() != 1 {
+            mt.Errorf("conflict filter %v does not exclude the appointment itself", filter)
+        }
+    })
+
+    mt.Run("free station fills in the shift", func(mt *mtest.T) {
+        mt.AddMockResponses(found("stations", station), found("machines"), found("patients"), found("transient_patients"), counted("dialysis_appointments", 0))
+        appointment := &models.DialysisAppointment{ID: 1, Date: "2024-03-04", Time: "16:00", StationID: 4}
+        if err := checkStationFree(context.Background(), mt.DB, appointment); err != nil {
+            mt.Fatal(err)
+        }
+        if appointment.Shift != "evening" {
+            mt.Errorf("shift = %q, want evening", appointment.Shift)
+        }
+    })
+}
+
+func TestGetOccupancy(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("each shift lists every active station", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("stations", bson.D{{Key: "station_id", Value: 1}}, bson.D{{Key: "station_id", Value: 2}}),
+            found("dialysis_appointments",
+                bson.D{{Key: "appointment_id", Value: 9}, {Key: "station_id", Value: 2}, {Key: "shift", Value: "evening"}},
+                // Rows from before shifts were stored are placed by their start time
+                bson.D{{Key: "appointment_id", Value: 10}, {Key: "station_id", Value: 1}, {Key: "time", Value: "06:30"}},
+            ),
+        )
+
+        occupancy, err := NewStationGateway(mt.DB).GetOccupancy("2024-03-04")
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if len(occupancy) != len(models.ShiftStartTimes) {
+            mt.Fatalf("occupancy has %d shifts, want %d", len(occupancy), len(models.ShiftStartTimes))
+        }
+
+        booked := map[string]int{}
+        for shift, stations := range occupancy {
+            if len(stations) != 2 {
+                mt.Errorf("%s lists %d stations, want 2", shift, len(stations))
+            }
+            for _, entry := range stations {
+                if entry.Appointment != nil {
+                    booked[fmt.Sprintf("%s/%d", shift, entry.Station.ID)] = entry.Appointment.ID
+                }
+            }
+        }
+        if len(booked) != 2 || booked["evening/2"] != 9 || booked["morning/1"] != 10 {
+            mt.Errorf("booked stations = %v, want evening/2 by 9 and morning/1 by 10", booked)
+        }
+
+        filter := sentFilters(mt, "find")[1]
+        if _, err := filter.LookupErr("status", "$nin"); err != nil {
+            mt.Errorf("appointment filter %v does not leave out released appointments", filter)
+        }
+    })
+}
+
+func TestDeleteStation(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    for name, counts := range map[string][2]int{
+        "upcoming sessions":  {2, 0},
+        "a running schedule": {0, 1},
+    } {
+        mt.Run(name+" keep the station", func(mt *mtest.T) {
+            mt.AddMockResponses(counted("dialysis_appointments", counts[0]), counted("dialysis_schedules", counts[1]))
+            if err := NewStationGateway(mt.DB).DeleteStation(4); !errors.Is(err, ErrStationInUse) {
+                mt.Errorf("err = %v, want ErrStationInUse", err)
+            }
+            if deletes := sentFilters(mt, "delete"); len(deletes) != 0 {
+                mt.Errorf("sent %d deletes, want none", len(deletes))
+            }
+        })
+    }
+
+    mt.Run("unused station is deleted", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("dialysis_appointments", 0), counted("dialysis_schedules", 0), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        if err := NewStationGateway(mt.DB).DeleteStation(4); err != nil {
+            mt.Fatalf("DeleteStation returned error: %v", err)
+        }
+        upcoming := sentFilters(mt, "aggregate")[0]
+        if upcoming.Lookup("station_id").AsInt64() != 4 || upcoming.Lookup("$or", "0", "ends_at", "$gt").Type != bson.TypeDateTime {
+            mt.Errorf("upcoming filter = %v, want sessions at station 4 not yet over", upcoming)
+        }
+        if deletes := sentFilters(mt, "delete"); len(deletes) != 1 {
+            mt.Errorf("sent %d deletes, want 1", len(deletes))
+        }
+    })
+}
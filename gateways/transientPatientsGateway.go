@@ -0,0 +1,313 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoSpareChair is returned when no free station suits a visiting patient on the requested shift
+var ErrNoSpareChair = errors.New("no spare chair suits the patient on that shift")
+
+// ErrInvalidTransient is returned when a visiting patient lacks a home centre, a valid visit or a prescription
+var ErrInvalidTransient = errors.New("invalid visiting patient")
+
+// ErrOutsideVisit is returned when a visiting patient is booked outside their visit or beyond their prescription
+var ErrOutsideVisit = errors.New("booking falls outside the patient's visit or prescription")
+
+// TransientPatientGateway handles patients visiting from other centres and their bookings into spare chairs
+type TransientPatientGateway struct {
+    db         *mongo.Database
+    collection *mongo.Collection
+    stations   *StationGateway
+    dialysis   *DialysisGateway
+}
+
+// NewTransientPatientGateway creates a new instance of TransientPatientGateway
+func NewTransientPatientGateway(db *mongo.Database) *TransientPatientGateway {
+    return &TransientPatientGateway{
+        db:         db,
+        collection: db.Collection("transient_patients"),
+        stations:   NewStationGateway(db),
+        dialysis:   NewDialysisGateway(db),
+    }
+}
+
+// GetTransients lists visiting patients, only those visiting on a date when on is set
+func (tg *TransientPatientGateway) GetTransients(on string, limit, offset int) ([]models.TransientPatient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().SetSort(bson.M{"visit_from": -1}).SetLimit(int64(limit)).SetSkip(int64(offset))
+    cursor, err := tg.collection.Find(ctx, visitingOn(on), opts)
+    if err != nil {
+        return nil, err
+    }
+    transients := []models.TransientPatient{}
+    if err := cursor.All(ctx, &transients); err != nil {
+        return nil, err
+    }
+    return transients, nil
+}
+
+func (tg *TransientPatientGateway) CountTransients(on string) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := tg.collection.CountDocuments(ctx, visitingOn(on))
+    return int(count), err
+}
+
+// GetTransient retrieves a single visiting patient
+func (tg *TransientPatientGateway) GetTransient(patientID int) (*models.TransientPatient, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return tg.findTransient(ctx, patientID)
+}
+
+func (tg *TransientPatientGateway) findTransient(ctx context.Context, patientID int) (*models.TransientPatient, error) {
+    var transient models.TransientPatient
+    err := tg.collection.FindOne(ctx, bson.M{"patient_id": patientID}).Decode(&transient)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("no visiting patient found with ID %d", patientID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &transient, nil
+}
+
+// CreateTransient records a visiting patient. The ID comes from the patients counter so it never
+// matches a permanent patient's.
+func (tg *TransientPatientGateway) CreateTransient(transient *models.TransientPatient) error {
+    if err := validateTransient(transient); err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    for {
+        id, err := nextID(ctx, tg.db, "patients", "patient_id")
+        if err != nil {
+            return err
+        }
+        // Permanent patients are still created with IDs picked by the client, so skip any already taken
+        taken, err := tg.db.Collection("patients").CountDocuments(ctx, bson.M{"patient_id": id})
+        if err != nil {
+            return err
+        }
+        if taken == 0 {
+            transient.ID = id
+            break
+        }
+    }
+    transient.ReferralFolder = fmt.Sprintf("transient-%d", transient.ID)
+    transient.ReferralFiles = nil
+    transient.CreatedAt = time.Now()
+
+    _, err := tg.collection.InsertOne(ctx, transient)
+    return err
+}
+
+// UpdateTransient changes a visiting patient's details, visit and prescription. Referral files are kept.
+func (tg *TransientPatientGateway) UpdateTransient(transient *models.TransientPatient) error {
+    if err := validateTransient(transient); err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    update := bson.M{
+        "$set": bson.M{
+            "name":                transient.Name,
+            "phone_number":        transient.PhoneNumber,
+            "date_of_birth":       transient.DateOfBirth,
+            "gender":              transient.Gender,
+            "home_centre":         transient.HomeCentre,
+            "home_centre_contact": transient.HomeCentreContact,
+            "visit_from":          transient.VisitFrom,
+            "visit_to":            transient.VisitTo,
+            "prescription":        transient.Prescription,
+            "isolation":           transient.Isolation,
+            "serology":            transient.Serology,
+        },
+    }
+    result, err := tg.collection.UpdateOne(ctx, bson.M{"patient_id": transient.ID}, update)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("no visiting patient found with ID %d", transient.ID)
+    }
+    return nil
+}
+
+// AddReferralFiles records referral documents saved in the patient's referral folder
+func (tg *TransientPatientGateway) AddReferralFiles(patientID int, files []string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    update := bson.M{"$addToSet": bson.M{"referral_files": bson.M{"$each": files}}}
+    _, err := tg.collection.UpdateOne(ctx, bson.M{"patient_id": patientID}, update)
+    return err
+}
+
+// DeleteTransient removes a visiting patient. Their past appointments stay on record.
+func (tg *TransientPatientGateway) DeleteTransient(patientID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := tg.collection.DeleteOne(ctx, bson.M{"patient_id": patientID})
+    return err
+}
+
+// GetSpareChairs lists the stations free on each shift of a date
+func (tg *TransientPatientGateway) GetSpareChairs(date string) ([]models.SpareChair, error) {
+    occupancy, err := tg.stations.GetOccupancy(date)
+    if err != nil {
+        return nil, err
+    }
+
+    spare := []models.SpareChair{}
+    for _, shift := range models.ShiftOrder {
+        for _, entry := range occupancy[shift] {
+            if entry.Appointment == nil {
+                spare = append(spare, models.SpareChair{Date: date, Shift: shift, Station: entry.Station})
+            }
+        }
+    }
+    return spare, nil
+}
+
+// Book puts a visiting patient into a spare chair for a shift within their visit, for the length of their
+// prescribed session. Only stations of the patient's isolation group are considered.
+// A week is refused once it holds as many sessions as the prescription asks for.
+func (tg *TransientPatientGateway) Book(patientID int, booking models.TransientBooking, change models.StatusChange) (*models.DialysisAppointment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    transient, err := tg.findTransient(ctx, patientID)
+    if err != nil {
+        return nil, err
+    }
+    day, err := time.Parse(dateLayout, booking.Date)
+    if err != nil {
+        return nil, fmt.Errorf("%w %q", ErrInvalidSlot, booking.Date)
+    }
+    if _, ok := models.ShiftStartTimes[booking.Shift]; !ok {
+        return nil, fmt.Errorf("%w: unknown shift %q", ErrInvalidSlot, booking.Shift)
+    }
+    if booking.Date < transient.VisitFrom || booking.Date > transient.VisitTo {
+        return nil, fmt.Errorf("%w: the visit runs from %s to %s", ErrOutsideVisit, transient.VisitFrom, transient.VisitTo)
+    }
+
+    weekStart := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+    sessions, err := tg.dialysis.collection.CountDocuments(ctx, bson.M{
+        "patient_id": patientID,
+        "date":       bson.M{"$gte": weekStart.Format(dateLayout), "$lt": weekStart.AddDate(0, 0, 7).Format(dateLayout)},
+        "status":     bson.M{"$nin": releasedStatuses},
+    })
+    if err != nil {
+        return nil, err
+    }
+    if int(sessions) >= transient.Prescription.SessionsPerWeek {
+        return nil, fmt.Errorf("%w: %d sessions are already booked that week", ErrOutsideVisit, sessions)
+    }
+
+    spare, err := tg.GetSpareChairs(booking.Date)
+    if err != nil {
+        return nil, err
+    }
+
+    change.To = models.StatusConfirmed
+    group := transient.IsolationGroup()
+    for _, chair := range spare {
+        if chair.Shift != booking.Shift || chair.Station.IsolationGroup() != group {
+            continue
+        }
+        if booking.StationID != 0 && chair.Station.ID != booking.StationID {
+            continue
+        }
+
+        appointment := models.DialysisAppointment{
+            Date:            booking.Date,
+            Time:            models.ShiftStartTimes[booking.Shift],
+            DurationMinutes: transient.Prescription.DurationMinutes,
+            Status:          models.StatusConfirmed,
+            PatientID:       transient.ID,
+            PatientName:     transient.Name,
+            Shift:           booking.Shift,
+            StationID:       chair.Station.ID,
+            StatusHistory:   []models.StatusChange{change},
+            Transient:       true,
+        }
+        err := tg.dialysis.CreateAppointment(&appointment)
+        // Someone took the chair since it was listed as spare or its machine is down, try the next one
+        if errors.Is(err, ErrStationTaken) || errors.Is(err, ErrMachineUnavailable) || errors.Is(err, ErrMachineNeedsDisinfection) || onlyStationClashes(err) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        return &appointment, nil
+    }
+    return nil, ErrNoSpareChair
+}
+
+// onlyStationClashes reports whether a booking was refused only because its station is held, so another
+// station may still be free. A clash on the patient would follow them to every chair.
+func onlyStationClashes(err error) bool {
+    var conflict *ConflictError
+    if !errors.As(err, &conflict) || len(conflict.Conflicts) == 0 {
+        return false
+    }
+    for _, clash := range conflict.Conflicts {
+        if clash.Resource != "station" {
+            return false
+        }
+    }
+    return true
+}
+
+// visitingOn filters visiting patients to those whose visit covers a date, or all of them when date is empty
+func visitingOn(date string) bson.M {
+    if date == "" {
+        return bson.M{}
+    }
+    return bson.M{"visit_from": bson.M{"$lte": date}, "visit_to": bson.M{"$gte": date}}
+}
+
+// validateTransient checks a visiting patient has a home centre, a visit and a usable prescription
+func validateTransient(transient *models.TransientPatient) error {
+    if transient.Name == "" || transient.HomeCentre == "" {
+        return fmt.Errorf("%w: a name and a home centre are required", ErrInvalidTransient)
+    }
+    from, err := time.Parse(dateLayout, transient.VisitFrom)
+    if err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidTransient, transient.VisitFrom)
+    }
+    to, err := time.Parse(dateLayout, transient.VisitTo)
+    if err != nil {
+        return fmt.Errorf("%w %q", ErrInvalidTransient, transient.VisitTo)
+    }
+    if to.Before(from) {
+        return fmt.Errorf("%w: the visit must end after it starts", ErrInvalidTransient)
+    }
+    if transient.Prescription.SessionsPerWeek <= 0 || transient.Prescription.DurationMinutes <= 0 {
+        return fmt.Errorf("%w: a prescription with sessions per week and session length is required", ErrInvalidTransient)
+    }
+    if transient.Serology != nil {
+        if err := transient.Serology.Normalize(); err != nil {
+            return fmt.Errorf("%w: %v", ErrInvalidTransient, err)
+        }
+    }
+    return nil
+}
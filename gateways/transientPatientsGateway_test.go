@@ -0,0 +1,115 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestValidateTransient(t *testing.T) {
+    valid := models.TransientPatient{
+        Name:         "Jane",
+        HomeCentre:   "Mombasa Renal Unit",
+        VisitFrom:    "2024-03-04",
+        VisitTo:      "2024-03-17",
+        Prescription: models.DialysisPrescription{SessionsPerWeek: 3, DurationMinutes: 240},
+    }
+    if err := validateTransient(&valid); err != nil {
+        t.Fatalf("validateTransient() error = %v for a complete visit", err)
+    }
+
+    for name, change := range map[string]func(*models.TransientPatient){
+        "no home centre":          func(p *models.TransientPatient) { p.HomeCentre = "" },
+        "unreadable visit start":  func(p *models.TransientPatient) { p.VisitFrom = "monday" },
+        "visit ending too soon":   func(p *models.TransientPatient) { p.VisitTo = "2024-03-01" },
+        "no sessions prescribed":  func(p *models.TransientPatient) { p.Prescription.SessionsPerWeek = 0 },
+        "no session length given": func(p *models.TransientPatient) { p.Prescription.DurationMinutes = 0 },
+    } {
+        transient := valid
+        change(&transient)
+        if err := validateTransient(&transient); !errors.Is(err, ErrInvalidTransient) {
+            t.Errorf("%s: validateTransient() error = %v, want ErrInvalidTransient", name, err)
+        }
+    }
+}
+
+func TestBookTransient(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    visitor := func(isolation bool) bson.D {
+        return bson.D{
+            {Key: "patient_id", Value: 70},
+            {Key: "name", Value: "Jane"},
+            {Key: "visit_from", Value: "2024-03-04"},
+            {Key: "visit_to", Value: "2024-03-17"},
+            {Key: "prescription", Value: bson.D{{Key: "sessions_per_week", Value: 3}, {Key: "duration_minutes", Value: 240}}},
+            {Key: "isolation", Value: isolation},
+        }
+    }
+    book := func(mt *mtest.T, date string) error {
+        _, err := NewTransientPatientGateway(mt.DB).Book(70, models.TransientBooking{Date: date, Shift: "morning"}, models.StatusChange{})
+        return err
+    }
+
+    mt.Run("day outside the visit", func(mt *mtest.T) {
+        mt.AddMockResponses(found("transient_patients", visitor(false)))
+
+        if err := book(mt, "2024-03-18"); !errors.Is(err, ErrOutsideVisit) {
+            mt.Errorf("Book() error = %v, want ErrOutsideVisit", err)
+        }
+    })
+
+    mt.Run("prescribed sessions for the week already booked", func(mt *mtest.T) {
+        mt.AddMockResponses(found("transient_patients", visitor(false)), counted("dialysis_appointments", 3))
+
+        if err := book(mt, "2024-03-06"); !errors.Is(err, ErrOutsideVisit) {
+            mt.Errorf("Book() error = %v, want ErrOutsideVisit", err)
+        }
+        // The week is counted from its Monday
+        week := sentFilters(mt, "aggregate")[0].Lookup("date")
+        if week.Document().Lookup("$gte").StringValue() != "2024-03-04" || week.Document().Lookup("$lt").StringValue() != "2024-03-11" {
+            mt.Errorf("sessions counted over %v, want the week of 2024-03-04", week)
+        }
+    })
+
+    mt.Run("isolation patient is kept off shared chairs", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("transient_patients", visitor(true)),
+            counted("dialysis_appointments", 0),
+            found("stations", bson.D{{Key: "station_id", Value: 1}, {Key: "active", Value: true}}),
+            found("dialysis_appointments"),
+        )
+
+        if err := book(mt, "2024-03-06"); !errors.Is(err, ErrNoSpareChair) {
+            mt.Errorf("Book() error = %v, want ErrNoSpareChair", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d appointments, want none", len(inserted))
+        }
+    })
+}
+
+func TestOnlyStationClashes(t *testing.T) {
+    station := models.AppointmentConflict{AppointmentID: 12, Type: "dialysis", Resource: "station"}
+    patient := models.AppointmentConflict{AppointmentID: 13, Type: "nephrologist", Resource: "patient"}
+
+    tests := []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {"station held", &ConflictError{Conflicts: []models.AppointmentConflict{station, station}}, true},
+        {"patient busy as well", &ConflictError{Conflicts: []models.AppointmentConflict{station, patient}}, false},
+        {"patient busy", &ConflictError{Conflicts: []models.AppointmentConflict{patient}}, false},
+        {"other error", ErrStationTaken, false},
+        {"booked", nil, false},
+    }
+
+    for _, tt := range tests {
+        if got := onlyStationClashes(tt.err); got != tt.want {
+            t.Errorf("%s: onlyStationClashes() = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,414 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidRecord is returned when a treatment record has impossible readings or its session cannot take one
+var ErrInvalidRecord = errors.New("invalid treatment record")
+
+// ErrRecordNotFound is returned when a session has no treatment record
+var ErrRecordNotFound = errors.New("treatment record not found")
+
+// recordableStatuses are the session statuses a treatment record can be kept for: from check-in onwards
+var recordableStatuses = []string{models.StatusCheckedIn, models.StatusInProgress, models.StatusCompleted}
+
+// TreatmentRecordGateway handles the flowsheets nurses keep for each dialysis session
+type TreatmentRecordGateway struct {
+    db           *mongo.Database
+    collection   *mongo.Collection
+    appointments *mongo.Collection
+}
+
+// NewTreatmentRecordGateway creates a new instance of TreatmentRecordGateway
+func NewTreatmentRecordGateway(db *mongo.Database) *TreatmentRecordGateway {
+    return &TreatmentRecordGateway{
+        db:           db,
+        collection:   db.Collection("treatment_records"),
+        appointments: db.Collection("dialysis_appointments"),
+    }
+}
+
+// EnsureIndexes allows a single record per session and keeps a patient's records quick to list
+func (tg *TreatmentRecordGateway) EnsureIndexes() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    _, err := tg.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "appointment_id", Value: 1}},
+            Options: options.Index().SetUnique(true),
+        },
+        {
+            Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "date", Value: -1}},
+        },
+    })
+    return err
+}
+
+// GetRecords lists treatment records newest first, only a patient's when patientID is not zero and only
+// between from and to when they are given
+func (tg *TreatmentRecordGateway) GetRecords(patientID int, from, to string, limit, offset int) ([]models.TreatmentRecord, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset)).
+        SetSort(bson.D{{Key: "date", Value: -1}, {Key: "appointment_id", Value: -1}})
+
+    cursor, err := tg.collection.Find(ctx, recordFilter(patientID, from, to), opts)
+    if err != nil {
+        return nil, err
+    }
+    records := []models.TreatmentRecord{}
+    if err := cursor.All(ctx, &records); err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+func (tg *TreatmentRecordGateway) CountRecords(patientID int, from, to string) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    count, err := tg.collection.CountDocuments(ctx, recordFilter(patientID, from, to))
+    return int(count), err
+}
+
+// GetPatientRecords returns every treatment record of a patient, newest first, for their history
+func (tg *TreatmentRecordGateway) GetPatientRecords(patientID int) ([]models.TreatmentRecord, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    cursor, err := tg.collection.Find(ctx, bson.M{"patient_id": patientID}, options.Find().SetSort(bson.M{"date": -1}))
+    if err != nil {
+        return nil, err
+    }
+    records := []models.TreatmentRecord{}
+    if err := cursor.All(ctx, &records); err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+// GetRecord returns the treatment record of a session, scoped to patientID when it is not zero
+func (tg *TreatmentRecordGateway) GetRecord(appointmentID, patientID int) (*models.TreatmentRecord, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var record models.TreatmentRecord
+    err := tg.collection.FindOne(ctx, scopeToPatient(bson.M{"appointment_id": appointmentID}, patientID)).Decode(&record)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w for appointment %d", ErrRecordNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &record, nil
+}
+
+// CreateRecord opens the treatment record of a session once the patient has checked in. The patient, date
+// and station are taken from the appointment.
+func (tg *TreatmentRecordGateway) CreateRecord(record *models.TreatmentRecord, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := validateRecord(record); err != nil {
+        return err
+    }
+
+    appointment, err := tg.session(ctx, record.AppointmentID)
+    if err != nil {
+        return err
+    }
+
+    id, err := nextID(ctx, tg.db, "treatment_records", "record_id")
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    record.ID = id
+    record.PatientID = appointment.PatientID
+    record.PatientName = appointment.PatientName
+    record.Date = appointment.Date
+    record.StationID = appointment.StationID
+    record.CreatedBy, record.CreatedAt = by, now
+    record.UpdatedBy, record.UpdatedAt = by, now
+    stampReadings(record, by, now)
+    assessAdequacy(record, appointment, now)
+
+    _, err = tg.collection.InsertOne(ctx, record)
+    if mongo.IsDuplicateKeyError(err) {
+        return fmt.Errorf("%w: appointment %d already has a record", ErrInvalidRecord, record.AppointmentID)
+    }
+    return err
+}
+
+// UpdateRecord replaces the entries of a session's record and works out its adequacy again. The session it
+// belongs to does not change, and must still be one a record is kept for; a change once it is completed is
+// recorded as an amendment.
+func (tg *TreatmentRecordGateway) UpdateRecord(record *models.TreatmentRecord, by int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err := validateRecord(record); err != nil {
+        return err
+    }
+    appointment, err := tg.session(ctx, record.AppointmentID)
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    record.PatientID = appointment.PatientID
+    record.PatientName = appointment.PatientName
+    record.Date = appointment.Date
+    record.StationID = appointment.StationID
+    record.UpdatedBy, record.UpdatedAt = by, now
+    stampReadings(record, by, now)
+    assessAdequacy(record, appointment, now)
+
+    set := bson.M{
+        "pre_weight_kg":        record.PreWeightKg,
+        "post_weight_kg":       record.PostWeightKg,
+        "pre_vitals":           record.PreVitals,
+        "post_vitals":          record.PostVitals,
+        "observations":         record.Observations,
+        "uf_goal_ml":           record.UFGoalMl,
+        "uf_achieved_ml":       record.UFAchievedMl,
+        "dialyzer":             record.Dialyzer,
+        "heparin_bolus_units":  record.HeparinBolusUnits,
+        "heparin_hourly_units": record.HeparinHourlyUnits,
+        "complications":        record.Complications,
+        "notes":                record.Notes,
+        "pre_urea":             record.PreUrea,
+        "post_urea":            record.PostUrea,
+        "treatment_minutes":    record.TreatmentMinutes,
+        "updated_by":           by,
+        "updated_at":           now,
+    }
+    if models.CurrentStatus(appointment.Status) == models.StatusCompleted {
+        set["amended_at"] = now
+    }
+    update := bson.M{"$set": set}
+    // A record that can no longer be assessed loses its adequacy rather than keeping a null one
+    if record.Adequacy != nil {
+        set["adequacy"] = record.Adequacy
+    } else {
+        update["$unset"] = bson.M{"adequacy": ""}
+    }
+    result, err := tg.collection.UpdateOne(ctx, bson.M{"appointment_id": record.AppointmentID}, update)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("%w for appointment %d", ErrRecordNotFound, record.AppointmentID)
+    }
+    return nil
+}
+
+// AddObservation appends a set of readings taken during a session, timed now unless a time is given. Readings
+// added once the session is completed are marked as late entries.
+func (tg *TreatmentRecordGateway) AddObservation(appointmentID int, observation models.Observation, by int) (*models.TreatmentRecord, error) {
+    if err := validateObservation(&observation); err != nil {
+        return nil, err
+    }
+    if observation.At.IsZero() {
+        observation.At = time.Now()
+    }
+    observation.RecordedBy = by
+    return tg.push(appointmentID, "observations", by, func(late bool) interface{} {
+        observation.LateEntry = late
+        return observation
+    })
+}
+
+// AddComplication appends a complication to a session's record, timed now unless a time is given. Complications
+// added once the session is completed are marked as late entries.
+func (tg *TreatmentRecordGateway) AddComplication(appointmentID int, complication models.Complication, by int) (*models.TreatmentRecord, error) {
+    if err := validateComplication(&complication); err != nil {
+        return nil, err
+    }
+    if complication.At.IsZero() {
+        complication.At = time.Now()
+    }
+    complication.RecordedBy = by
+    return tg.push(appointmentID, "complications", by, func(late bool) interface{} {
+        complication.LateEntry = late
+        return complication
+    })
+}
+
+// push appends the entry made by entry to one of a record's lists and returns the updated record. The session
+// must still be one a record is kept for, and entry is told whether it has already been completed.
+func (tg *TreatmentRecordGateway) push(appointmentID int, field string, by int, entry func(late bool) interface{}) (*models.TreatmentRecord, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    appointment, err := tg.session(ctx, appointmentID)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    late := models.CurrentStatus(appointment.Status) == models.StatusCompleted
+    set := bson.M{"updated_by": by, "updated_at": now}
+    if late {
+        set["amended_at"] = now
+    }
+
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    var record models.TreatmentRecord
+    err = tg.collection.FindOneAndUpdate(ctx, bson.M{"appointment_id": appointmentID}, bson.M{
+        "$push": bson.M{field: entry(late)},
+        "$set":  set,
+    }, opts).Decode(&record)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w for appointment %d", ErrRecordNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &record, nil
+}
+
+// recordFilter narrows records to a patient and a period, either end of which may be left open
+func recordFilter(patientID int, from, to string) bson.M {
+    filter := scopeToPatient(bson.M{}, patientID)
+    period := bson.M{}
+    if from != "" {
+        period["$gte"] = from
+    }
+    if to != "" {
+        period["$lte"] = to
+    }
+    if len(period) > 0 {
+        filter["date"] = period
+    }
+    return filter
+}
+
+// session returns the appointment a record belongs to, refusing one that has not been checked in or was
+// cancelled or missed
+func (tg *TreatmentRecordGateway) session(ctx context.Context, appointmentID int) (*models.DialysisAppointment, error) {
+    var appointment models.DialysisAppointment
+    err := tg.appointments.FindOne(ctx, bson.M{"appointment_id": appointmentID}).Decode(&appointment)
+    if err == mongo.ErrNoDocuments {
+        return nil, fmt.Errorf("%w with ID %d", ErrAppointmentNotFound, appointmentID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !recordable(appointment.Status) {
+        return nil, fmt.Errorf("%w: appointment %d is %s, records are kept from check-in", ErrInvalidRecord,
+            appointment.ID, models.CurrentStatus(appointment.Status))
+    }
+    return &appointment, nil
+}
+
+func recordable(status string) bool {
+    current := models.CurrentStatus(status)
+    for _, allowed := range recordableStatuses {
+        if current == allowed {
+            return true
+        }
+    }
+    return false
+}
+
+// stampReadings fills in who took readings and complications entered without it, and when
+func stampReadings(record *models.TreatmentRecord, by int, at time.Time) {
+    if record.Observations == nil {
+        record.Observations = []models.Observation{}
+    }
+    if record.Complications == nil {
+        record.Complications = []models.Complication{}
+    }
+    for _, observation := range []*models.Observation{record.PreVitals, record.PostVitals} {
+        if observation != nil && observation.At.IsZero() {
+            observation.At = at
+        }
+    }
+    for i := range record.Observations {
+        if record.Observations[i].RecordedBy == 0 {
+            record.Observations[i].RecordedBy = by
+        }
+    }
+    for i := range record.Complications {
+        if record.Complications[i].RecordedBy == 0 {
+            record.Complications[i].RecordedBy = by
+        }
+    }
+}
+
+// validateRecord rejects readings that cannot be right, so a slip of the keyboard is caught at the chair
+func validateRecord(record *models.TreatmentRecord) error {
+    if record.AppointmentID == 0 {
+        return fmt.Errorf("%w: an appointment_id is required", ErrInvalidRecord)
+    }
+    for name, weight := range map[string]float64{"pre_weight_kg": record.PreWeightKg, "post_weight_kg": record.PostWeightKg} {
+        if weight < 0 || weight > 400 {
+            return fmt.Errorf("%w: %s of %.1f is out of range", ErrInvalidRecord, name, weight)
+        }
+    }
+    if record.UFGoalMl < 0 || record.UFAchievedMl < 0 || record.HeparinBolusUnits < 0 || record.HeparinHourlyUnits < 0 {
+        return fmt.Errorf("%w: ultrafiltration and heparin cannot be negative", ErrInvalidRecord)
+    }
+    if record.PreUrea < 0 || record.PostUrea < 0 || record.TreatmentMinutes < 0 {
+        return fmt.Errorf("%w: urea and treatment time cannot be negative", ErrInvalidRecord)
+    }
+    if record.PreUrea > 0 && record.PostUrea >= record.PreUrea {
+        return fmt.Errorf("%w: %v", ErrInvalidRecord, models.ErrImpossibleUrea)
+    }
+    for _, observation := range []*models.Observation{record.PreVitals, record.PostVitals} {
+        if observation == nil {
+            continue
+        }
+        if err := validateObservation(observation); err != nil {
+            return err
+        }
+    }
+    for i := range record.Observations {
+        if err := validateObservation(&record.Observations[i]); err != nil {
+            return err
+        }
+    }
+    for i := range record.Complications {
+        if err := validateComplication(&record.Complications[i]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func validateObservation(observation *models.Observation) error {
+    if observation.SystolicBP < 0 || observation.SystolicBP > 300 || observation.DiastolicBP < 0 || observation.DiastolicBP > 200 {
+        return fmt.Errorf("%w: blood pressure %d/%d is out of range", ErrInvalidRecord, observation.SystolicBP, observation.DiastolicBP)
+    }
+    if observation.SystolicBP != 0 && observation.DiastolicBP >= observation.SystolicBP {
+        return fmt.Errorf("%w: diastolic pressure must be below systolic", ErrInvalidRecord)
+    }
+    if observation.Pulse < 0 || observation.Pulse > 250 {
+        return fmt.Errorf("%w: pulse %d is out of range", ErrInvalidRecord, observation.Pulse)
+    }
+    if observation.BloodFlowRate < 0 || observation.BloodFlowRate > 600 || observation.DialysateFlowRate < 0 || observation.DialysateFlowRate > 1000 {
+        return fmt.Errorf("%w: flow rates are out of range", ErrInvalidRecord)
+    }
+    return nil
+}
+
+func validateComplication(complication *models.Complication) error {
+    for _, kind := range models.Complications {
+        if complication.Kind == kind {
+            return nil
+        }
+    }
+    return fmt.Errorf("%w: unknown complication %q", ErrInvalidRecord, complication.Kind)
+}
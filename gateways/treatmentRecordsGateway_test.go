@@ -0,0 +1,271 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestValidateRecord(t *testing.T) {
+    tests := []struct {
+        name    string
+        record  models.TreatmentRecord
+        wantErr bool
+    }{
+        {"plausible record", models.TreatmentRecord{AppointmentID: 1, PreWeightKg: 72.4, PostWeightKg: 70.1, UFGoalMl: 2500,
+            PreVitals: &models.Observation{SystolicBP: 150, DiastolicBP: 90, Pulse: 80}}, false},
+        {"no appointment", models.TreatmentRecord{PreWeightKg: 72}, true},
+        {"impossible weight", models.TreatmentRecord{AppointmentID: 1, PostWeightKg: 720}, true},
+        {"negative heparin", models.TreatmentRecord{AppointmentID: 1, HeparinBolusUnits: -1000}, true},
+        {"diastolic above systolic", models.TreatmentRecord{AppointmentID: 1,
+            PostVitals: &models.Observation{SystolicBP: 80, DiastolicBP: 120}}, true},
+        {"blood flow out of range", models.TreatmentRecord{AppointmentID: 1,
+            Observations: []models.Observation{{BloodFlowRate: 900}}}, true},
+        {"unknown complication", models.TreatmentRecord{AppointmentID: 1,
+            Complications: []models.Complication{{Kind: "fainting"}}}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := validateRecord(&tt.record)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("validateRecord() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if err != nil && !errors.Is(err, ErrInvalidRecord) {
+                t.Errorf("validateRecord() error = %v, want ErrInvalidRecord", err)
+            }
+        })
+    }
+}
+
+func TestCreateRecord(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    appointment := func(status string) bson.D {
+        return bson.D{
+            {Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 3}, {Key: "patient_name", Value: "Jane Doe"},
+            {Key: "date", Value: "2030-03-04"}, {Key: "station_id", Value: 5}, {Key: "status", Value: status},
+        }
+    }
+
+    mt.Run("session details come from the appointment", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", appointment(models.StatusCheckedIn)))
+        mt.AddMockResponses(nextIDResponses(7)...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+        record := &models.TreatmentRecord{AppointmentID: 12, PatientID: 99, Date: "1999-01-01",
+            PreVitals: &models.Observation{SystolicBP: 140, DiastolicBP: 85}}
+        if err := NewTreatmentRecordGateway(mt.DB).CreateRecord(record, 21); err != nil {
+            mt.Fatalf("CreateRecord() error = %v", err)
+        }
+        inserted := sentDocuments(mt, "insert")
+        if len(inserted) != 1 {
+            mt.Fatalf("inserted %d documents, want 1", len(inserted))
+        }
+        doc := inserted[0]
+        if got := doc.Lookup("record_id").AsInt64(); got != 7 {
+            mt.Errorf("record_id = %d, want 7", got)
+        }
+        if got := doc.Lookup("patient_id").AsInt64(); got != 3 {
+            mt.Errorf("patient_id = %d, want the appointment's 3", got)
+        }
+        if got := doc.Lookup("date").StringValue(); got != "2030-03-04" {
+            mt.Errorf("date = %q, want the appointment's", got)
+        }
+        if got := doc.Lookup("station_id").AsInt64(); got != 5 {
+            mt.Errorf("station_id = %d, want 5", got)
+        }
+        if got := doc.Lookup("created_by").AsInt64(); got != 21 {
+            mt.Errorf("created_by = %d, want 21", got)
+        }
+        if record.PreVitals.At.IsZero() {
+            mt.Error("pre-dialysis vitals were not timed")
+        }
+    })
+
+    mt.Run("session not checked in", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", appointment(models.StatusConfirmed)))
+
+        err := NewTreatmentRecordGateway(mt.DB).CreateRecord(&models.TreatmentRecord{AppointmentID: 12}, 21)
+        if !errors.Is(err, ErrInvalidRecord) {
+            mt.Fatalf("CreateRecord() error = %v, want ErrInvalidRecord", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d documents, want none", len(inserted))
+        }
+    })
+
+    mt.Run("unknown appointment", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments"))
+
+        err := NewTreatmentRecordGateway(mt.DB).CreateRecord(&models.TreatmentRecord{AppointmentID: 12}, 21)
+        if !errors.Is(err, ErrAppointmentNotFound) {
+            mt.Errorf("CreateRecord() error = %v, want ErrAppointmentNotFound", err)
+        }
+    })
+
+    mt.Run("second record for a session", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", appointment(models.StatusCompleted)))
+        mt.AddMockResponses(nextIDResponses(8)...)
+        mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"}))
+
+        err := NewTreatmentRecordGateway(mt.DB).CreateRecord(&models.TreatmentRecord{AppointmentID: 12}, 21)
+        if !errors.Is(err, ErrInvalidRecord) {
+            mt.Errorf("CreateRecord() error = %v, want ErrInvalidRecord", err)
+        }
+    })
+}
+
+func TestAddObservation(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    session := func(status string) bson.D {
+        return found("dialysis_appointments", bson.D{{Key: "appointment_id", Value: 12}, {Key: "status", Value: status}})
+    }
+    pushed := func(mt *mtest.T) bson.Raw {
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "findAndModify" {
+                return event.Command.Lookup("update").Document()
+            }
+        }
+        mt.Fatal("no findAndModify was sent")
+        return nil
+    }
+
+    mt.Run("appends a timed reading", func(mt *mtest.T) {
+        mt.AddMockResponses(session(models.StatusInProgress))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "appointment_id", Value: 12}}}))
+
+        _, err := NewTreatmentRecordGateway(mt.DB).AddObservation(12, models.Observation{SystolicBP: 120, DiastolicBP: 70}, 21)
+        if err != nil {
+            mt.Fatalf("AddObservation() error = %v", err)
+        }
+        update := pushed(mt)
+        observation := update.Lookup("$push", "observations").Document()
+        if _, err := observation.LookupErr("at"); err != nil {
+            mt.Error("observation was pushed without a time")
+        }
+        if got := observation.Lookup("recorded_by").AsInt64(); got != 21 {
+            mt.Errorf("recorded_by = %d, want 21", got)
+        }
+        if _, err := observation.LookupErr("late_entry"); err == nil {
+            mt.Error("reading during the session was marked as a late entry")
+        }
+        if _, err := update.LookupErr("$set", "amended_at"); err == nil {
+            mt.Error("record was marked amended during the session")
+        }
+    })
+
+    mt.Run("reading after completion is a late entry", func(mt *mtest.T) {
+        mt.AddMockResponses(session(models.StatusCompleted))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "appointment_id", Value: 12}}}))
+
+        if _, err := NewTreatmentRecordGateway(mt.DB).AddObservation(12, models.Observation{Pulse: 70}, 21); err != nil {
+            mt.Fatalf("AddObservation() error = %v", err)
+        }
+        update := pushed(mt)
+        if !update.Lookup("$push", "observations", "late_entry").Boolean() {
+            mt.Error("reading after completion was not marked as a late entry")
+        }
+        if _, err := update.LookupErr("$set", "amended_at"); err != nil {
+            mt.Error("record was not marked amended")
+        }
+    })
+
+    mt.Run("cancelled session takes no readings", func(mt *mtest.T) {
+        mt.AddMockResponses(session(models.StatusCancelled))
+
+        _, err := NewTreatmentRecordGateway(mt.DB).AddObservation(12, models.Observation{Pulse: 70}, 21)
+        if !errors.Is(err, ErrInvalidRecord) {
+            mt.Fatalf("AddObservation() error = %v, want ErrInvalidRecord", err)
+        }
+        if commandCount(mt, "findAndModify") != 0 {
+            mt.Error("reading was added to a cancelled session")
+        }
+    })
+
+    mt.Run("no record for the session", func(mt *mtest.T) {
+        mt.AddMockResponses(session(models.StatusInProgress))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+
+        _, err := NewTreatmentRecordGateway(mt.DB).AddObservation(12, models.Observation{Pulse: 70}, 21)
+        if !errors.Is(err, ErrRecordNotFound) {
+            mt.Errorf("AddObservation() error = %v, want ErrRecordNotFound", err)
+        }
+    })
+
+    mt.Run("implausible reading is refused before writing", func(mt *mtest.T) {
+        _, err := NewTreatmentRecordGateway(mt.DB).AddObservation(12, models.Observation{Pulse: 400}, 21)
+        if !errors.Is(err, ErrInvalidRecord) {
+            mt.Errorf("AddObservation() error = %v, want ErrInvalidRecord", err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+}
+
+func TestUpdateRecordAdequacy(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    appointment := bson.D{
+        {Key: "appointment_id", Value: 12}, {Key: "patient_id", Value: 3}, {Key: "date", Value: "2030-03-04"},
+        {Key: "status", Value: models.StatusCompleted}, {Key: "duration_minutes", Value: 240},
+    }
+
+    mt.Run("both urea samples give an adequacy", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", appointment), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        record := &models.TreatmentRecord{AppointmentID: 12, PreUrea: 25, PostUrea: 7, PostWeightKg: 70}
+        if err := NewTreatmentRecordGateway(mt.DB).UpdateRecord(record, 21); err != nil {
+            mt.Fatalf("UpdateRecord() error = %v", err)
+        }
+        update := sentUpdates(mt)[0]
+        if _, err := update.LookupErr("$set", "adequacy", "ktv"); err != nil {
+            mt.Errorf("update %v does not set the adequacy", update)
+        }
+        if _, err := update.LookupErr("$unset"); err == nil {
+            mt.Errorf("update %v unsets fields, want none", update)
+        }
+    })
+
+    mt.Run("removing a urea sample unsets the adequacy", func(mt *mtest.T) {
+        mt.AddMockResponses(found("dialysis_appointments", appointment), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        record := &models.TreatmentRecord{AppointmentID: 12, PreUrea: 25, PostWeightKg: 70}
+        if err := NewTreatmentRecordGateway(mt.DB).UpdateRecord(record, 21); err != nil {
+            mt.Fatalf("UpdateRecord() error = %v", err)
+        }
+        update := sentUpdates(mt)[0]
+        if _, err := update.LookupErr("$unset", "adequacy"); err != nil {
+            mt.Errorf("update %v does not unset the adequacy", update)
+        }
+        if _, err := update.LookupErr("$set", "adequacy"); err == nil {
+            mt.Errorf("update %v sets a null adequacy", update)
+        }
+    })
+}
+
+func TestGetPatientRecords(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+    mt.Run("filtered by patient ID, not name", func(mt *mtest.T) {
+        mt.AddMockResponses(found("treatment_records", bson.D{{Key: "appointment_id", Value: 9}, {Key: "patient_id", Value: 3}}))
+
+        records, err := NewTreatmentRecordGateway(mt.DB).GetPatientRecords(3)
+        if err != nil {
+            mt.Fatalf("GetPatientRecords() error = %v", err)
+        }
+        if len(records) != 1 {
+            mt.Errorf("got %d records, want 1", len(records))
+        }
+        filter := sentFilters(mt, "find")[0]
+        if id := filter.Lookup("patient_id").AsInt64(); id != 3 {
+            mt.Errorf("filter patient_id = %d, want 3", id)
+        }
+        if _, err := filter.LookupErr("patient_name"); err == nil {
+            mt.Errorf("filter %v still matches on the patient's name", filter)
+        }
+    })
+}
@@ -0,0 +1,402 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrOfferNotOpen is returned when an offer has already been answered, has expired or does not exist
+var ErrOfferNotOpen = errors.New("slot offer is no longer open")
+
+// ErrInvalidWaitlistEntry is returned when a waitlist entry cannot be stored as given
+var ErrInvalidWaitlistEntry = errors.New("invalid waitlist entry")
+
+// OfferTTL is how long a waitlisted patient has to accept an offered slot before it moves to the next patient
+var OfferTTL = 2 * time.Hour
+
+// WaitlistGateway handles the waitlist and the offers of freed slots made from it
+type WaitlistGateway struct {
+    db           *mongo.Database
+    entries      *mongo.Collection
+    offers       *mongo.Collection
+    dialysis     *DialysisGateway
+    nephrologist *NephrologistAppointmentGateway
+}
+
+// NewWaitlistGateway creates a new instance of WaitlistGateway
+func NewWaitlistGateway(db *mongo.Database) *WaitlistGateway {
+    return &WaitlistGateway{
+        db:           db,
+        entries:      db.Collection("waitlist"),
+        offers:       db.Collection("slot_offers"),
+        dialysis:     NewDialysisGateway(db),
+        nephrologist: NewNephrologistAppointmentGateway(db),
+    }
+}
+
+// GetEntries retrieves waitlist entries, highest priority first. A non-zero patientID limits them to that patient
+// and a status narrows them to entries in that status.
+func (wg *WaitlistGateway) GetEntries(patientID int, status string, limit, offset int) ([]models.WaitlistEntry, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := bson.M{}
+    if status != "" {
+        filter["status"] = status
+    }
+    opts := options.Find().
+        SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}}).
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset))
+
+    cursor, err := wg.entries.Find(ctx, scopeToPatient(filter, patientID), opts)
+    if err != nil {
+        return nil, err
+    }
+    entries := []models.WaitlistEntry{}
+    if err := cursor.All(ctx, &entries); err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
+
+// CreateEntry puts a patient on the waitlist for a slot type and date window
+func (wg *WaitlistGateway) CreateEntry(entry *models.WaitlistEntry) error {
+    if _, ok := appointmentCollections[entry.Type]; !ok {
+        return fmt.Errorf("%w: type %q, expected dialysis or nephrologist", ErrInvalidWaitlistEntry, entry.Type)
+    }
+    if entry.PatientID == 0 {
+        return fmt.Errorf("%w: a patient ID is required", ErrInvalidWaitlistEntry)
+    }
+    for _, date := range []string{entry.From, entry.To} {
+        if _, err := time.Parse(dateLayout, date); err != nil {
+            return fmt.Errorf("%w: date %q, expected YYYY-MM-DD", ErrInvalidWaitlistEntry, date)
+        }
+    }
+    if entry.To < entry.From {
+        return fmt.Errorf("%w: the window ends before it starts", ErrInvalidWaitlistEntry)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    id, err := nextID(ctx, wg.db, "waitlist", "waitlist_id")
+    if err != nil {
+        return err
+    }
+    entry.ID = id
+    entry.Status = models.WaitlistWaiting
+    entry.CreatedAt = time.Now()
+
+    _, err = wg.entries.InsertOne(ctx, entry)
+    return err
+}
+
+// WithdrawEntry takes a patient off the waitlist, a non-zero patientID limits it to that patient's entries
+func (wg *WaitlistGateway) WithdrawEntry(entryID, patientID int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    filter := scopeToPatient(bson.M{"waitlist_id": entryID, "status": bson.M{"$in": []string{models.WaitlistWaiting, models.WaitlistOffered}}}, patientID)
+    result, err := wg.entries.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": models.WaitlistWithdrawn}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("no open waitlist entry found with ID %d", entryID)
+    }
+    return nil
+}
+
+// GetOffers retrieves slot offers, newest first, a non-zero patientID limits them to that patient
+func (wg *WaitlistGateway) GetOffers(patientID, limit, offset int) ([]models.SlotOffer, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    opts := options.Find().SetSort(bson.M{"offered_at": -1}).SetLimit(int64(limit)).SetSkip(int64(offset))
+    cursor, err := wg.offers.Find(ctx, scopeToPatient(bson.M{}, patientID), opts)
+    if err != nil {
+        return nil, err
+    }
+    offers := []models.SlotOffer{}
+    if err := cursor.All(ctx, &offers); err != nil {
+        return nil, err
+    }
+    return offers, nil
+}
+
+// OfferFreedSlot offers the slot described by slot to the highest-priority waiting patient whose window,
+// preferred nephrologist and shift fit it. Patients already offered the same freed slot are skipped.
+// It returns nil without error when nobody on the waitlist fits, the slot has already started or the clinic
+// is closed that day.
+func (wg *WaitlistGateway) OfferFreedSlot(slot models.SlotOffer) (*models.SlotOffer, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return wg.offerFreedSlot(ctx, slot)
+}
+
+func (wg *WaitlistGateway) offerFreedSlot(ctx context.Context, slot models.SlotOffer) (*models.SlotOffer, error) {
+    start, _, err := slotRange(slot.Date, slot.Time, 0)
+    if err != nil {
+        return nil, err
+    }
+    if !start.After(time.Now()) {
+        return nil, nil
+    }
+    if err := checkNotClosed(ctx, wg.db, slot.Date); err == ErrClinicClosed {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    excluded, err := wg.offers.Distinct(ctx, "patient_id", bson.M{"type": slot.Type, "freed_appointment_id": slot.FreedAppointmentID})
+    if err != nil {
+        return nil, err
+    }
+    excluded = append(excluded, slot.PatientID)
+
+    filter := bson.M{
+        "status":     models.WaitlistWaiting,
+        "type":       slot.Type,
+        "from":       bson.M{"$lte": slot.Date},
+        "to":         bson.M{"$gte": slot.Date},
+        "patient_id": bson.M{"$nin": excluded},
+        "$and": []bson.M{
+            {"$or": []bson.M{{"staff_id": bson.M{"$exists": false}}, {"staff_id": slot.StaffID}}},
+            {"$or": []bson.M{{"shift": bson.M{"$exists": false}}, {"shift": slot.Shift}}},
+        },
+    }
+    opts := options.FindOneAndUpdate().
+        SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}}).
+        SetReturnDocument(options.After)
+
+    // Claiming the entry and marking it offered in one step keeps two freed slots from going to the same patient
+    var entry models.WaitlistEntry
+    err = wg.entries.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"status": models.WaitlistOffered}}, opts).Decode(&entry)
+    if err == mongo.ErrNoDocuments {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    id, err := nextID(ctx, wg.db, "slot_offers", "offer_id")
+    if err != nil {
+        return nil, wg.releaseEntry(ctx, entry.ID, err)
+    }
+    offer := slot
+    offer.ID = id
+    offer.WaitlistID = entry.ID
+    offer.PatientID = entry.PatientID
+    offer.PatientName = entry.PatientName
+    offer.Status = models.OfferOpen
+    offer.OfferedAt = time.Now()
+    offer.ExpiresAt = offer.OfferedAt.Add(OfferTTL)
+    offer.RespondedAt = nil
+    offer.AppointmentID = 0
+
+    if _, err := wg.offers.InsertOne(ctx, offer); err != nil {
+        return nil, wg.releaseEntry(ctx, entry.ID, err)
+    }
+
+    message := fmt.Sprintf("A %s slot on %s at %s is available for you. Accept it before %s %s.",
+        offer.Type, offer.Date, offer.Time, models.LocalDate(offer.ExpiresAt), models.LocalClock(offer.ExpiresAt))
+    if err := notifyPatient(ctx, wg.db, offer.PatientID, offer.PatientName, message); err != nil {
+        return &offer, err
+    }
+    return &offer, nil
+}
+
+// releaseEntry puts an entry claimed for an offer that could not be made back to waiting, so the patient is
+// not left marked as offered with no offer to answer, and returns the error that stopped the offer
+func (wg *WaitlistGateway) releaseEntry(ctx context.Context, entryID int, cause error) error {
+    _, err := wg.entries.UpdateOne(ctx,
+        bson.M{"waitlist_id": entryID, "status": models.WaitlistOffered},
+        bson.M{"$set": bson.M{"status": models.WaitlistWaiting}})
+    if err != nil {
+        return fmt.Errorf("%v, and waitlist entry %d could not be released: %w", cause, entryID, err)
+    }
+    return cause
+}
+
+// AcceptOffer books the offered slot for the patient. The booking goes through the usual clash checks,
+// so a slot that was taken in the meantime is refused with a ConflictError. A refused offer is released at
+// once, the patient going back to waiting. The slot moves on to the next patient in line only when it was
+// refused because of the accepting patient, e.g. a clash with their own appointments, since a slot that is
+// taken or whose station cannot be used would only be refused again. change records who accepted.
+func (wg *WaitlistGateway) AcceptOffer(offerID, patientID int, change models.StatusChange) (*models.SlotOffer, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    offer, err := wg.openOffer(ctx, offerID, patientID)
+    if err != nil {
+        return nil, err
+    }
+
+    change.To = models.StatusConfirmed
+    history := []models.StatusChange{change}
+    switch offer.Type {
+    case "dialysis":
+        appointment := models.DialysisAppointment{
+            Date:            offer.Date,
+            Time:            offer.Time,
+            DurationMinutes: offer.DurationMinutes,
+            Status:          models.StatusConfirmed,
+            PatientID:       offer.PatientID,
+            PatientName:     offer.PatientName,
+            StaffID:         offer.StaffID,
+            StaffName:       offer.StaffName,
+            Shift:           offer.Shift,
+            StationID:       offer.StationID,
+            StatusHistory:   history,
+        }
+        err = wg.dialysis.CreateAppointment(&appointment)
+        offer.AppointmentID = appointment.ID
+    case "nephrologist":
+        appointment := models.NephrologistAppointment{
+            Date:            offer.Date,
+            Time:            offer.Time,
+            DurationMinutes: offer.DurationMinutes,
+            Status:          models.StatusConfirmed,
+            PatientID:       offer.PatientID,
+            PatientName:     offer.PatientName,
+            StaffID:         offer.StaffID,
+            StaffName:       offer.StaffName,
+            StatusHistory:   history,
+        }
+        err = wg.nephrologist.CreateAppointment(&appointment)
+        offer.AppointmentID = appointment.ID
+    }
+    if bookingRefused(err) {
+        offer.AppointmentID = 0
+        if err := wg.closeOffer(ctx, offer, models.OfferUnavailable, models.WaitlistWaiting); err != nil {
+            return nil, err
+        }
+        if refusedForPatient(err) {
+            if _, err := wg.offerFreedSlot(ctx, *offer); err != nil {
+                return nil, err
+            }
+        }
+        return nil, err
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err := wg.closeOffer(ctx, offer, models.OfferAccepted, models.WaitlistBooked); err != nil {
+        return nil, err
+    }
+    return offer, nil
+}
+
+// refusedForPatient reports whether a booking was refused because of the patient it was for, their isolation
+// needs or a clash with their own appointments, leaving the slot free for someone else
+func refusedForPatient(err error) bool {
+    if errors.Is(err, ErrIsolationMismatch) {
+        return true
+    }
+    var conflict *ConflictError
+    if !errors.As(err, &conflict) {
+        return false
+    }
+    for _, clash := range conflict.Conflicts {
+        if clash.Resource != "patient" {
+            return false
+        }
+    }
+    return true
+}
+
+// DeclineOffer turns an offer down. The patient stays on the waitlist and the slot moves to the next patient.
+func (wg *WaitlistGateway) DeclineOffer(offerID, patientID int) (*models.SlotOffer, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    offer, err := wg.openOffer(ctx, offerID, patientID)
+    if err != nil {
+        return nil, err
+    }
+    if err := wg.closeOffer(ctx, offer, models.OfferDeclined, models.WaitlistWaiting); err != nil {
+        return nil, err
+    }
+    _, err = wg.offerFreedSlot(ctx, *offer)
+    return offer, err
+}
+
+// ExpireOffers closes the open offers that were not answered in time, puts their patients back on
+// the waitlist and offers each slot to the next patient in line. It returns how many offers expired.
+func (wg *WaitlistGateway) ExpireOffers() (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    cursor, err := wg.offers.Find(ctx, bson.M{"status": models.OfferOpen, "expires_at": bson.M{"$lte": time.Now()}})
+    if err != nil {
+        return 0, err
+    }
+    var offers []models.SlotOffer
+    if err := cursor.All(ctx, &offers); err != nil {
+        return 0, err
+    }
+
+    expired := 0
+    for i := range offers {
+        if err := wg.closeOffer(ctx, &offers[i], models.OfferExpired, models.WaitlistWaiting); err == ErrOfferNotOpen {
+            continue
+        } else if err != nil {
+            return expired, err
+        }
+        expired++
+        if _, err := wg.offerFreedSlot(ctx, offers[i]); err != nil {
+            return expired, err
+        }
+    }
+    return expired, nil
+}
+
+// openOffer loads an offer that can still be answered, a non-zero patientID limits it to that patient's offers
+func (wg *WaitlistGateway) openOffer(ctx context.Context, offerID, patientID int) (*models.SlotOffer, error) {
+    var offer models.SlotOffer
+    filter := scopeToPatient(bson.M{"offer_id": offerID, "status": models.OfferOpen}, patientID)
+    err := wg.offers.FindOne(ctx, filter).Decode(&offer)
+    if err == mongo.ErrNoDocuments {
+        return nil, ErrOfferNotOpen
+    }
+    if err != nil {
+        return nil, err
+    }
+    if time.Now().After(offer.ExpiresAt) {
+        return nil, ErrOfferNotOpen
+    }
+    return &offer, nil
+}
+
+// closeOffer records the answer to an open offer and moves its waitlist entry on
+func (wg *WaitlistGateway) closeOffer(ctx context.Context, offer *models.SlotOffer, status, entryStatus string) error {
+    now := time.Now()
+    set := bson.M{"status": status, "responded_at": now}
+    if offer.AppointmentID != 0 {
+        set["appointment_id"] = offer.AppointmentID
+    }
+
+    result, err := wg.offers.UpdateOne(ctx, bson.M{"offer_id": offer.ID, "status": models.OfferOpen}, bson.M{"$set": set})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return ErrOfferNotOpen
+    }
+    offer.Status = status
+    offer.RespondedAt = &now
+
+    _, err = wg.entries.UpdateOne(ctx,
+        bson.M{"waitlist_id": offer.WaitlistID, "status": models.WaitlistOffered},
+        bson.M{"$set": bson.M{"status": entryStatus}})
+    return err
+}
@@ -0,0 +1,336 @@
+package gateways
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCreateEntryValidation(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    valid := models.WaitlistEntry{Type: "dialysis", PatientID: 7, From: "2024-03-04", To: "2024-03-10"}
+
+    for name, change := range map[string]func(*models.WaitlistEntry){
+        "unknown type":               func(e *models.WaitlistEntry) { e.Type = "surgery" },
+        "no patient":                 func(e *models.WaitlistEntry) { e.PatientID = 0 },
+        "unreadable window":          func(e *models.WaitlistEntry) { e.From = "next week" },
+        "window ending before start": func(e *models.WaitlistEntry) { e.To = "2024-03-01" },
+    } {
+        mt.Run(name, func(mt *mtest.T) {
+            entry := valid
+            change(&entry)
+            if err := NewWaitlistGateway(mt.DB).CreateEntry(&entry); !errors.Is(err, ErrInvalidWaitlistEntry) {
+                mt.Errorf("CreateEntry() error = %v, want ErrInvalidWaitlistEntry", err)
+            }
+            if events := mt.GetAllStartedEvents(); len(events) != 0 {
+                mt.Errorf("sent %d commands, want none", len(events))
+            }
+        })
+    }
+}
+
+func TestOfferFreedSlot(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    tomorrow := time.Now().AddDate(0, 0, 1).Format(dateLayout)
+    freed := models.SlotOffer{Type: "dialysis", Date: tomorrow, Time: "06:00", Shift: "morning", StationID: 4, PatientID: 9, FreedAppointmentID: 30}
+    claimed := bson.D{{Key: "waitlist_id", Value: 5}, {Key: "patient_id", Value: 7}, {Key: "patient_name", Value: "Jane"}, {Key: "status", Value: models.WaitlistOffered}}
+
+    mt.Run("slot that has started is not offered", func(mt *mtest.T) {
+        started := freed
+        started.Date = time.Now().AddDate(0, 0, -1).Format(dateLayout)
+        offer, err := NewWaitlistGateway(mt.DB).OfferFreedSlot(started)
+        if offer != nil || err != nil {
+            mt.Errorf("OfferFreedSlot() = %v, %v, want nothing offered", offer, err)
+        }
+        if events := mt.GetAllStartedEvents(); len(events) != 0 {
+            mt.Errorf("sent %d commands, want none", len(events))
+        }
+    })
+
+    mt.Run("next waiting patient is claimed, offered and notified", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("closures", 0))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{8}}))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: claimed}))
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+        mt.AddMockResponses(nextIDResponses(50)...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+        offer, err := NewWaitlistGateway(mt.DB).OfferFreedSlot(freed)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if offer.ID != 40 || offer.WaitlistID != 5 || offer.PatientID != 7 || offer.Status != models.OfferOpen {
+            mt.Errorf("offer = %+v, want open offer 40 to patient 7 from entry 5", offer)
+        }
+        if got := offer.ExpiresAt.Sub(offer.OfferedAt); got != OfferTTL {
+            mt.Errorf("offer is open for %v, want %v", got, OfferTTL)
+        }
+
+        var claim bson.Raw
+        for _, event := range mt.GetAllStartedEvents() {
+            if event.CommandName == "findAndModify" && event.Command.Lookup("findAndModify").StringValue() == "waitlist" {
+                claim = event.Command
+            }
+        }
+        if claim == nil {
+            mt.Fatal("no waitlist entry was claimed")
+        }
+        if claim.Lookup("query", "status").StringValue() != models.WaitlistWaiting || claim.Lookup("update", "$set", "status").StringValue() != models.WaitlistOffered {
+            mt.Errorf("claim = %v, want a waiting entry moved to offered in one step", claim)
+        }
+        // Patients already offered this slot and the patient who gave it up are skipped
+        excluded, _ := claim.Lookup("query", "patient_id", "$nin").Array().Values()
+        if len(excluded) != 2 || excluded[0].Int32() != 8 || excluded[1].Int32() != 9 {
+            mt.Errorf("excluded patients = %v, want 8 and 9", excluded)
+        }
+
+        inserted := sentDocuments(mt, "insert")
+        if len(inserted) != 2 || inserted[1].Lookup("patient_id").Int32() != 7 {
+            mt.Errorf("inserted %v, want the offer and a notification for patient 7", inserted)
+        }
+    })
+
+    mt.Run("entry goes back to waiting when the offer cannot be stored", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("closures", 0))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{}}))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: claimed}))
+        mt.AddMockResponses(nextIDResponses(40)...)
+        mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down"}))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        offer, err := NewWaitlistGateway(mt.DB).OfferFreedSlot(freed)
+        if offer != nil || err == nil {
+            mt.Fatalf("OfferFreedSlot() = %v, %v, want the insert error", offer, err)
+        }
+        filters, updates := sentFilters(mt, "update"), sentUpdates(mt)
+        if len(updates) != 1 || filters[0].Lookup("waitlist_id").Int32() != 5 || updates[0].Lookup("$set", "status").StringValue() != models.WaitlistWaiting {
+            mt.Errorf("updates = %v, want entry 5 waiting again", updates)
+        }
+    })
+
+    mt.Run("nobody on the waitlist fits", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            counted("closures", 0),
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+        )
+        offer, err := NewWaitlistGateway(mt.DB).OfferFreedSlot(freed)
+        if offer != nil || err != nil {
+            mt.Errorf("OfferFreedSlot() = %v, %v, want nothing offered", offer, err)
+        }
+    })
+
+    mt.Run("slot on a closed day is not offered", func(mt *mtest.T) {
+        mt.AddMockResponses(counted("closures", 1))
+        offer, err := NewWaitlistGateway(mt.DB).OfferFreedSlot(freed)
+        if offer != nil || err != nil {
+            mt.Errorf("OfferFreedSlot() = %v, %v, want nothing offered", offer, err)
+        }
+        if claims := commandCount(mt, "findAndModify"); claims != 0 {
+            mt.Errorf("claimed %d waitlist entries, want none", claims)
+        }
+    })
+}
+
+func TestAnswerOffer(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    tomorrow := time.Now().AddDate(0, 0, 1).Format(dateLayout)
+    open := func(expiresAt time.Time) bson.D {
+        return bson.D{
+            {Key: "offer_id", Value: 40},
+            {Key: "waitlist_id", Value: 5},
+            {Key: "patient_id", Value: 7},
+            {Key: "type", Value: "dialysis"},
+            {Key: "date", Value: tomorrow},
+            {Key: "time", Value: "06:00"},
+            {Key: "freed_appointment_id", Value: 30},
+            {Key: "status", Value: models.OfferOpen},
+            {Key: "expires_at", Value: expiresAt},
+        }
+    }
+
+    mt.Run("declining puts the patient back and moves the slot on", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("slot_offers", open(time.Now().Add(time.Hour))),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{7}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+        )
+
+        offer, err := NewWaitlistGateway(mt.DB).DeclineOffer(40, 7)
+        if err != nil {
+            mt.Fatal(err)
+        }
+        if offer.Status != models.OfferDeclined || offer.RespondedAt == nil {
+            mt.Errorf("offer = %+v, want it declined with a response time", offer)
+        }
+
+        filters, updates := sentFilters(mt, "update"), sentUpdates(mt)
+        if filters[0].Lookup("status").StringValue() != models.OfferOpen {
+            mt.Errorf("offer update filter = %v, want it guarded on the open status", filters[0])
+        }
+        if updates[1].Lookup("$set", "status").StringValue() != models.WaitlistWaiting {
+            mt.Errorf("entry update = %v, want the patient waiting again", updates[1])
+        }
+        if claims := commandCount(mt, "findAndModify"); claims != 1 {
+            mt.Errorf("the declined slot was offered %d times, want once", claims)
+        }
+    })
+
+    startsAt, _ := models.ParseLocal(tomorrow, "06:00")
+    clash := func(patientID, stationID int) bson.D {
+        return bson.D{
+            {Key: "appointment_id", Value: 31},
+            {Key: "date", Value: tomorrow},
+            {Key: "time", Value: "06:00"},
+            {Key: "shift", Value: "morning"},
+            {Key: "starts_at", Value: startsAt},
+            {Key: "ends_at", Value: startsAt.Add(4 * time.Hour)},
+            {Key: "patient_id", Value: patientID},
+            {Key: "station_id", Value: stationID},
+        }
+    }
+    // Booking the offer: an appointment ID, then under the lock the patient and station locks, the closure
+    // check and a clash lookup per appointment type, which fails and aborts
+    refusedBooking := func(mt *mtest.T, clashing bson.D) {
+        mt.AddMockResponses(nextIDResponses(60)...)
+        mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse(), counted("closures", 0))
+        mt.AddMockResponses(found("dialysis_appointments", clashing), found("nephrologist_appointments", clashing))
+        mt.AddMockResponses(mtest.CreateSuccessResponse())
+    }
+    atStation := func(doc bson.D) bson.D {
+        return append(doc, bson.E{Key: "station_id", Value: 4}, bson.E{Key: "shift", Value: "morning"})
+    }
+
+    mt.Run("slot taken in the meantime is not offered again", func(mt *mtest.T) {
+        mt.AddMockResponses(found("slot_offers", atStation(open(time.Now().Add(time.Hour)))))
+        refusedBooking(mt, clash(9, 4))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+        _, err := NewWaitlistGateway(mt.DB).AcceptOffer(40, 7, models.StatusChange{})
+        var conflict *ConflictError
+        if !errors.As(err, &conflict) {
+            mt.Fatalf("AcceptOffer() error = %v, want a ConflictError", err)
+        }
+        if updates := sentUpdates(mt); updates[len(updates)-1].Lookup("$set", "status").StringValue() != models.WaitlistWaiting {
+            mt.Errorf("entry update = %v, want the patient waiting again", updates[len(updates)-1])
+        }
+        if lookups := commandCount(mt, "distinct"); lookups != 0 {
+            mt.Errorf("the taken slot was offered again %d times, want none", lookups)
+        }
+    })
+
+    mt.Run("slot refused for the patient's own clash moves on", func(mt *mtest.T) {
+        mt.AddMockResponses(found("slot_offers", atStation(open(time.Now().Add(time.Hour)))))
+        refusedBooking(mt, clash(7, 2))
+        mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+        mt.AddMockResponses(
+            counted("closures", 0),
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{7}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+        )
+
+        _, err := NewWaitlistGateway(mt.DB).AcceptOffer(40, 7, models.StatusChange{})
+        var conflict *ConflictError
+        if !errors.As(err, &conflict) {
+            mt.Fatalf("AcceptOffer() error = %v, want a ConflictError", err)
+        }
+        if lookups := commandCount(mt, "distinct"); lookups != 1 {
+            mt.Errorf("the slot was offered %d times, want once more", lookups)
+        }
+    })
+
+    mt.Run("expired offer cannot be accepted", func(mt *mtest.T) {
+        mt.AddMockResponses(found("slot_offers", open(time.Now().Add(-time.Minute))))
+
+        _, err := NewWaitlistGateway(mt.DB).AcceptOffer(40, 7, models.StatusChange{})
+        if !errors.Is(err, ErrOfferNotOpen) {
+            mt.Errorf("AcceptOffer() error = %v, want ErrOfferNotOpen", err)
+        }
+        if inserted := sentDocuments(mt, "insert"); len(inserted) != 0 {
+            mt.Errorf("inserted %d documents, want none", len(inserted))
+        }
+    })
+
+    mt.Run("another patient's offer", func(mt *mtest.T) {
+        mt.AddMockResponses(found("slot_offers"))
+
+        _, err := NewWaitlistGateway(mt.DB).DeclineOffer(40, 8)
+        if !errors.Is(err, ErrOfferNotOpen) {
+            mt.Errorf("DeclineOffer() error = %v, want ErrOfferNotOpen", err)
+        }
+        if !scopedFilter(sentFilters(mt, "find")[0], 8) {
+            mt.Error("offer lookup is not limited to the patient")
+        }
+    })
+}
+
+func TestExpireOffers(t *testing.T) {
+    mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+    tomorrow := time.Now().AddDate(0, 0, 1).Format(dateLayout)
+    expired := func(id int) bson.D {
+        return bson.D{
+            {Key: "offer_id", Value: id},
+            {Key: "waitlist_id", Value: id + 100},
+            {Key: "type", Value: "dialysis"},
+            {Key: "date", Value: tomorrow},
+            {Key: "time", Value: "06:00"},
+            {Key: "status", Value: models.OfferOpen},
+        }
+    }
+
+    mt.Run("lapsed offers close and move on, answered ones are skipped", func(mt *mtest.T) {
+        mt.AddMockResponses(
+            found("slot_offers", expired(40), expired(41)),
+            // Offer 40 was answered just before it expired
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+            counted("closures", 0),
+            mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{}}),
+            mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+        )
+
+        count, err := NewWaitlistGateway(mt.DB).ExpireOffers()
+        if err != nil || count != 1 {
+            mt.Errorf("ExpireOffers() = %d, %v, want 1 expired", count, err)
+        }
+        updates := sentUpdates(mt)
+        if len(updates) != 3 || updates[1].Lookup("$set", "status").StringValue() != models.OfferExpired {
+            mt.Errorf("updates = %v, want offer 41 expired and its entry waiting again", updates)
+        }
+    })
+}
+
+// scopedFilter reports whether a filter can only match records of the given patient
+func scopedFilter(filter bson.Raw, patientID int) bool {
+    clauses, err := filter.LookupErr("$and")
+    if err != nil {
+        id, ok := filter.Lookup("patient_id").AsInt64OK()
+        return ok && int(id) == patientID
+    }
+    values, _ := clauses.Array().Values()
+    for _, clause := range values {
+        if scopedFilter(clause.Document(), patientID) {
+            return true
+        }
+    }
+    return false
+}
+
+func commandCount(mt *mtest.T, commandName string) int {
+    count := 0
+    for _, event := range mt.GetAllStartedEvents() {
+        if event.CommandName == commandName {
+            count++
+        }
+    }
+    return count
+}
@@ -2,14 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-    "strconv"
 	"os"
+	"strconv"
+	"time"
+	_ "time/tzdata" // the clinic time zone must load even in images without a zoneinfo database
+
 	"github.com/BrianKasina/dialysis-scheduling/controllers"
+	"github.com/BrianKasina/dialysis-scheduling/gateways"
+	"github.com/BrianKasina/dialysis-scheduling/models"
 	"github.com/BrianKasina/dialysis-scheduling/utils"
-	"github.com/gorilla/mux")
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
 
 // Middleware to extract pagination parameters
 func paginationMiddleware(next http.Handler) http.Handler {
@@ -48,6 +58,11 @@ func setJSONContentType(next http.Handler) http.Handler {
 }
 
 func main() {
+	migrateTimestamps := flag.Bool("migrate-timestamps", false, "convert date and time strings stored before timestamps were introduced, report and exit (also done at startup)")
+	planWeek := flag.String("plan-week", "", "plan dialysis chairs for the week containing this date (YYYY-MM-DD), print the plan and exit")
+	commitPlan := flag.String("commit-plan", "", "with -plan-week, book the plan with this version, as printed by the preview")
+	flag.Parse()
+
 	// // Load environment variables from .env file
 	// err := godotenv.Load()
 	// if err != nil {
@@ -60,9 +75,27 @@ func main() {
 	dbName := os.Getenv("MONGO_DATABASE")
 	dbUser := os.Getenv("MONGO_USER")
 	dbPass := os.Getenv("MONGO_PASSWORD")
+	dbReplicaSet := os.Getenv("MONGO_REPLICA_SET")
+	if dbReplicaSet == "" {
+		dbReplicaSet = "rs0"
+	}
+	jwtSecret := os.Getenv("JWT_SECRET_KEY")
+	if jwtSecret == "" {
+		log.Fatal("JWT_SECRET_KEY must be set")
+	}
+	jwtUtil := utils.NewJWTUtil(jwtSecret)
+	adminUser := os.Getenv("ADMIN_USERNAME")
+	adminPass := os.Getenv("ADMIN_PASSWORD")
+	clinicTimezone := os.Getenv("CLINIC_TIMEZONE")
+	if clinicTimezone == "" {
+		clinicTimezone = "Africa/Nairobi"
+	}
+	if err := models.SetClinicTimezone(clinicTimezone); err != nil {
+		log.Fatal(err)
+	}
 
 	// Initialize database connection
-	database, err := utils.NewDatabase(dbHost, dbPort, dbName, dbUser, dbPass)
+	database, err := utils.NewDatabase(dbHost, dbPort, dbName, dbUser, dbPass, dbReplicaSet)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -76,16 +109,117 @@ func main() {
 		}
 	}()
 
+	// Records without timestamps are invisible to clash checks, open slots and the run sheet, so they are
+	// converted before anything is served. Converted records are skipped, so this is quick once done.
+	results, err := gateways.MigrateTimestamps(db)
+	for collection, result := range results {
+		if result.Converted > 0 || result.Unparsable > 0 || *migrateTimestamps {
+			log.Printf("%s: %d converted, %d could not be parsed", collection, result.Converted, result.Unparsable)
+		}
+		for _, skipped := range result.Skipped {
+			log.Printf("%s %v: date %q and time %q could not be parsed, correct them and unset unparsable_timestamp to migrate it",
+				collection, skipped.ID, skipped.Date, skipped.Time)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *migrateTimestamps {
+		return
+	}
+
+	if *planWeek != "" {
+		if err := runChairPlan(db, *planWeek, *commitPlan); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Initialize controllers
+	authController := controllers.NewAuthController(db, jwtUtil)
+	if err := authController.AuthGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := authController.AuthGateway.EnsureBootstrapAdmin(adminUser, adminPass); err != nil {
+		log.Fatal(err)
+	}
+	scheduleController := controllers.NewDialysisScheduleController(db)
+	if err := scheduleController.ScheduleGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	go materializeSchedules(scheduleController)
+	if minutes, err := strconv.Atoi(os.Getenv("WAITLIST_OFFER_MINUTES")); err == nil && minutes > 0 {
+		gateways.OfferTTL = time.Duration(minutes) * time.Minute
+	}
+	waitlistController := controllers.NewWaitlistController(db)
+	go expireWaitlistOffers(waitlistController)
+	closuresController := controllers.NewClosuresController(db)
+	if err := closuresController.ClosuresGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	machinesController := controllers.NewMachineController(db)
+	if err := machinesController.MachineGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	treatmentRecordsController := controllers.NewTreatmentRecordController(db)
+	if err := treatmentRecordsController.TreatmentRecordGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	fluidController := controllers.NewFluidController(db)
+	if err := fluidController.FluidGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	labResultsController := controllers.NewLabResultController(db)
+	if err := labResultsController.LabResultGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	medicationsController := controllers.NewMedicationController(db)
+	if err := medicationsController.MedicationGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAdherenceThresholds(); err != nil {
+		log.Fatal(err)
+	}
+	loadAdequacyTargets()
+	loadWeightGainThresholds()
+	if infections, ok := os.LookupEnv("ISOLATE_INFECTIONS"); ok {
+		models.SetIsolatedInfections(infections)
+	}
+	adherenceController := controllers.NewAdherenceController(db)
+	go refreshAdherenceFlags(adherenceController)
+	appointmentController := controllers.NewAppointmentController(db)
+	if err := appointmentController.DialysisGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := appointmentController.NephrologistGateway.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+
 	controllersMap := map[string]interface{}{
-		"patients":        controllers.NewPatientController(db),
-		"appointments":    controllers.NewAppointmentController(db),
-		"hospital_staff":  controllers.NewHospitalStaffController(db),
-		"system_admins":   controllers.NewAdminController(db),
-		"notifications":   controllers.NewNotificationController(db),
-		"posts":           controllers.NewPostController(db),
-		"payment_details": controllers.NewPaymentDetailsController(db),
-		"patient_history": controllers.NewPatientHistoryController(db),
+		"patients":           controllers.NewPatientController(db),
+		"appointments":       appointmentController,
+		"hospital_staff":     controllers.NewHospitalStaffController(db),
+		"system_admins":      controllers.NewAdminController(db),
+		"notifications":      controllers.NewNotificationController(db),
+		"posts":              controllers.NewPostController(db),
+		"payment_details":    controllers.NewPaymentDetailsController(db),
+		"patient_history":    controllers.NewPatientHistoryController(db),
+		"credentials":        authController,
+		"dialysis_schedules": scheduleController,
+		"stations":           controllers.NewStationController(db),
+		"availability":       controllers.NewAvailabilityController(db),
+		"run_sheet":          controllers.NewRunSheetController(db),
+		"waitlist":           waitlistController,
+		"adherence":          adherenceController,
+		"chair_plan":         controllers.NewChairPlanController(db),
+		"closures":           closuresController,
+		"transient_patients": controllers.NewTransientPatientController(db),
+		"machines":           machinesController,
+		"treatment_records":  treatmentRecordsController,
+		"adequacy":           controllers.NewAdequacyController(db),
+		"fluid":              fluidController,
+		"lab_results":        labResultsController,
+		"medications":        medicationsController,
 	}
 
 	// Initialize router
@@ -96,25 +230,56 @@ func main() {
 	router.Use(setJSONContentType)
 	router.Use(paginationMiddleware)
 
+	// Authentication routes are the only ones reachable without a token
+	router.HandleFunc("/auth/login", authController.Login).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/auth/refresh", authController.Refresh).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/auth/reset", authController.ResetPassword).Methods(http.MethodPost, http.MethodOptions)
+
+	// Every other route requires a valid access token
+	api := router.PathPrefix("/").Subrouter()
+	api.Use(jwtUtil.AuthMiddleware)
+
 	allowedEndpoints := map[string]bool{
-		"patients":        true,
-		"hospital_staff":  true,
-		"appointments":    true,
-		"posts":           true,
-		"system_admins":   true,
-		"notifications":   true,
-		"patient_history": true,
-		"payment_details": true,
+		"patients":           true,
+		"hospital_staff":     true,
+		"appointments":       true,
+		"posts":              true,
+		"system_admins":      true,
+		"notifications":      true,
+		"patient_history":    true,
+		"payment_details":    true,
+		"credentials":        true,
+		"dialysis_schedules": true,
+		"stations":           true,
+		"availability":       true,
+		"run_sheet":          true,
+		"waitlist":           true,
+		"adherence":          true,
+		"chair_plan":         true,
+		"closures":           true,
+		"transient_patients": true,
+		"machines":           true,
+		"treatment_records":  true,
+		"adequacy":           true,
+		"fluid":              true,
+		"lab_results":        true,
+		"medications":        true,
 	}
 
 	// Define routes
-	router.HandleFunc("/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+	api.HandleFunc("/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		endpoint := vars["endpoint"]
 
 		// Check if the endpoint is valid and allowed
 		if _, ok := allowedEndpoints[endpoint]; !ok {
-			utils.ErrorHandler(w, http.StatusNotFound, err, "Endpoint not found")
+			utils.ErrorHandler(w, http.StatusNotFound, errors.New("unknown endpoint"), "Endpoint not found")
+			return
+		}
+
+		// Check the caller's role before anything reaches a controller
+		if !utils.Authorize(utils.GetRole(r), permissionResource(r, endpoint), r.Method) {
+			utils.ErrorHandler(w, http.StatusForbidden, errors.New("forbidden"), "You do not have permission to perform this action")
 			return
 		}
 
@@ -137,6 +302,151 @@ func main() {
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
 
+// materializeSchedules keeps recurring dialysis schedules materialized up to the default horizon
+func materializeSchedules(sc *controllers.DialysisScheduleController) {
+	for {
+		_, skipped, err := sc.ScheduleGateway.MaterializeAll(time.Now().Add(gateways.DefaultScheduleHorizon))
+		if err != nil {
+			log.Printf("failed to materialize dialysis schedules: %v", err)
+		}
+		for _, occurrence := range skipped {
+			log.Printf("schedule %d: session on %s not booked: %s", occurrence.ScheduleID, occurrence.Date, occurrence.Reason)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// expireWaitlistOffers closes unanswered slot offers every minute so their slots move down the waitlist
+func expireWaitlistOffers(wc *controllers.WaitlistController) {
+	for {
+		if _, err := wc.WaitlistGateway.ExpireOffers(); err != nil {
+			log.Printf("failed to expire waitlist offers: %v", err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// runChairPlan plans a week of dialysis chairs from the command line and prints the plan as JSON,
+// booking it when version is that of the plan
+func runChairPlan(db *mongo.Database, week, version string) error {
+	planner := gateways.NewChairPlanGateway(db)
+	var result interface{}
+	if version != "" {
+		change := models.StatusChange{Role: utils.RoleSystemAdmin, ChangedAt: time.Now()}
+		plan, booked, err := planner.CommitWeek(week, version, change)
+		if errors.Is(err, gateways.ErrPlanChanged) {
+			return fmt.Errorf("%w, preview it again: its version is now %s", err, plan.Version)
+		}
+		if err != nil {
+			return err
+		}
+		result = map[string]interface{}{"plan": plan, "appointments": booked}
+	} else {
+		plan, err := planner.PreviewWeek(week)
+		if err != nil {
+			return err
+		}
+		result = plan
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// loadAdequacyTargets overrides the default adequacy targets with any set in the environment
+func loadAdequacyTargets() {
+	for name, target := range map[string]*float64{
+		"ADEQUACY_MIN_KTV": &gateways.Adequacy.MinKtV,
+		"ADEQUACY_MIN_URR": &gateways.Adequacy.MinURR,
+	} {
+		if value, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && value >= 0 {
+			*target = value
+		}
+	}
+}
+
+// loadWeightGainThresholds overrides the default interdialytic weight gain alert thresholds with any set in the environment
+func loadWeightGainThresholds() {
+	for name, target := range map[string]*float64{
+		"IDWG_MAX_KG":      &gateways.WeightGain.MaxKg,
+		"IDWG_MAX_PERCENT": &gateways.WeightGain.MaxPercent,
+	} {
+		if value, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && value >= 0 {
+			*target = value
+		}
+	}
+}
+
+// loadAdherenceThresholds overrides the default adherence thresholds with any set in the environment.
+// It fails when the window flags are judged on is not one the summaries cover, since nobody would ever be
+// flagged against the window that was asked for.
+func loadAdherenceThresholds() error {
+	for name, target := range map[string]*int{
+		"ADHERENCE_WINDOW_DAYS":           &gateways.Adherence.WindowDays,
+		"ADHERENCE_MAX_NO_SHOWS":          &gateways.Adherence.MaxNoShows,
+		"ADHERENCE_MAX_SHORTENED_MINUTES": &gateways.Adherence.MaxShortenedMinutes,
+		"ADHERENCE_LATE_GRACE_MINUTES":    &gateways.Adherence.LateGraceMinutes,
+	} {
+		if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value >= 0 {
+			*target = value
+		}
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("ADHERENCE_MIN_ATTENDED_PERCENT"), 64); err == nil && value >= 0 {
+		gateways.Adherence.MinAttendedPercent = value
+	}
+
+	window := os.Getenv("ADHERENCE_WINDOW_DAYS")
+	if window == "" {
+		return nil
+	}
+	for _, days := range models.AdherenceWindows {
+		if window == strconv.Itoa(days) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ADHERENCE_WINDOW_DAYS=%q is not supported, expected one of %v", window, models.AdherenceWindows)
+}
+
+// refreshAdherenceFlags recomputes adherence flags every hour, so patients drop off or onto the list as the windows move
+func refreshAdherenceFlags(ac *controllers.AdherenceController) {
+	for {
+		if _, err := ac.AdherenceGateway.RefreshAll(); err != nil {
+			log.Printf("failed to refresh adherence flags: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// permissionResource names the resource checked against the role permissions,
+// appointments are qualified by their type, and cancelling one further still, and availability by what is being
+// read or changed.
+// Recording a disinfection is kept apart from the rest of machine upkeep so nurses can do it.
+func permissionResource(r *http.Request, endpoint string) string {
+	switch endpoint {
+	case "appointments":
+		if r.URL.Query().Get("identifier") == "cancel" {
+			return endpoint + ":" + r.URL.Query().Get("type") + ":cancel"
+		}
+		return endpoint + ":" + r.URL.Query().Get("type")
+	case "availability":
+		identifier := r.URL.Query().Get("identifier")
+		if identifier == "" {
+			identifier = "slots"
+		}
+		return endpoint + ":" + identifier
+	case "machines":
+		if r.URL.Query().Get("identifier") == "disinfect" {
+			return endpoint + ":disinfect"
+		}
+	case "medications":
+		if r.URL.Query().Get("identifier") == "doses" {
+			return endpoint + ":doses"
+		}
+	}
+	return endpoint
+}
+
 // Handle GET requests
 func handleGetRequest(w http.ResponseWriter, r *http.Request, endpoint string, controllersMap map[string]interface{}) {
 	switch endpoint {
@@ -156,6 +466,36 @@ func handleGetRequest(w http.ResponseWriter, r *http.Request, endpoint string, c
 		controllersMap["payment_details"].(*controllers.PaymentDetailsController).GetPaymentDetails(w, r)
 	case "patient_history":
 		controllersMap["patient_history"].(*controllers.PatientHistoryController).HandlePatientHistory(w, r)
+	case "dialysis_schedules":
+		controllersMap["dialysis_schedules"].(*controllers.DialysisScheduleController).GetSchedules(w, r)
+	case "stations":
+		controllersMap["stations"].(*controllers.StationController).GetStations(w, r)
+	case "availability":
+		controllersMap["availability"].(*controllers.AvailabilityController).GetAvailability(w, r)
+	case "run_sheet":
+		controllersMap["run_sheet"].(*controllers.RunSheetController).GetRunSheet(w, r)
+	case "waitlist":
+		controllersMap["waitlist"].(*controllers.WaitlistController).GetWaitlist(w, r)
+	case "adherence":
+		controllersMap["adherence"].(*controllers.AdherenceController).GetAdherence(w, r)
+	case "chair_plan":
+		controllersMap["chair_plan"].(*controllers.ChairPlanController).PreviewPlan(w, r)
+	case "closures":
+		controllersMap["closures"].(*controllers.ClosuresController).GetClosures(w, r)
+	case "transient_patients":
+		controllersMap["transient_patients"].(*controllers.TransientPatientController).GetTransients(w, r)
+	case "machines":
+		controllersMap["machines"].(*controllers.MachineController).GetMachines(w, r)
+	case "treatment_records":
+		controllersMap["treatment_records"].(*controllers.TreatmentRecordController).GetRecords(w, r)
+	case "adequacy":
+		controllersMap["adequacy"].(*controllers.AdequacyController).GetAdequacy(w, r)
+	case "fluid":
+		controllersMap["fluid"].(*controllers.FluidController).GetFluid(w, r)
+	case "lab_results":
+		controllersMap["lab_results"].(*controllers.LabResultController).GetResults(w, r)
+	case "medications":
+		controllersMap["medications"].(*controllers.MedicationController).GetMedications(w, r)
 	default:
 		http.Error(w, "Invalid endpoint", http.StatusNotFound)
 	}
@@ -180,6 +520,32 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request, endpoint string,
 		controllersMap["payment_details"].(*controllers.PaymentDetailsController).CreatePaymentDetail(w, r)
 	case "patient_history":
 		controllersMap["patient_history"].(*controllers.PatientHistoryController).UploadPatientHistory(w, r)
+	case "credentials":
+		controllersMap["credentials"].(*controllers.AuthController).CreateCredential(w, r)
+	case "dialysis_schedules":
+		controllersMap["dialysis_schedules"].(*controllers.DialysisScheduleController).CreateSchedule(w, r)
+	case "stations":
+		controllersMap["stations"].(*controllers.StationController).CreateStation(w, r)
+	case "availability":
+		controllersMap["availability"].(*controllers.AvailabilityController).CreateAvailability(w, r)
+	case "waitlist":
+		controllersMap["waitlist"].(*controllers.WaitlistController).CreateWaitlist(w, r)
+	case "chair_plan":
+		controllersMap["chair_plan"].(*controllers.ChairPlanController).CommitPlan(w, r)
+	case "closures":
+		controllersMap["closures"].(*controllers.ClosuresController).CreateClosure(w, r)
+	case "transient_patients":
+		controllersMap["transient_patients"].(*controllers.TransientPatientController).CreateTransient(w, r)
+	case "machines":
+		controllersMap["machines"].(*controllers.MachineController).CreateMachine(w, r)
+	case "treatment_records":
+		controllersMap["treatment_records"].(*controllers.TreatmentRecordController).CreateRecord(w, r)
+	case "fluid":
+		controllersMap["fluid"].(*controllers.FluidController).SetDryWeight(w, r)
+	case "lab_results":
+		controllersMap["lab_results"].(*controllers.LabResultController).ImportResults(w, r)
+	case "medications":
+		controllersMap["medications"].(*controllers.MedicationController).CreateMedication(w, r)
 	default:
 		http.Error(w, "Invalid endpoint", http.StatusNotFound)
 	}
@@ -202,6 +568,18 @@ func handlePutRequest(w http.ResponseWriter, r *http.Request, endpoint string, c
 		controllersMap["posts"].(*controllers.PostController).UpdatePost(w, r)
 	case "payment_details":
 		controllersMap["payment_details"].(*controllers.PaymentDetailsController).UpdatePaymentDetail(w, r)
+	case "credentials":
+		controllersMap["credentials"].(*controllers.AuthController).ChangePassword(w, r)
+	case "dialysis_schedules":
+		controllersMap["dialysis_schedules"].(*controllers.DialysisScheduleController).UpdateSchedule(w, r)
+	case "stations":
+		controllersMap["stations"].(*controllers.StationController).UpdateStation(w, r)
+	case "transient_patients":
+		controllersMap["transient_patients"].(*controllers.TransientPatientController).UpdateTransient(w, r)
+	case "machines":
+		controllersMap["machines"].(*controllers.MachineController).UpdateMachine(w, r)
+	case "treatment_records":
+		controllersMap["treatment_records"].(*controllers.TreatmentRecordController).UpdateRecord(w, r)
 	default:
 		http.Error(w, "Invalid endpoint", http.StatusNotFound)
 	}
@@ -224,6 +602,24 @@ func handleDeleteRequest(w http.ResponseWriter, r *http.Request, endpoint string
 		controllersMap["posts"].(*controllers.PostController).DeletePost(w, r)
 	case "payment_details":
 		controllersMap["payment_details"].(*controllers.PaymentDetailsController).DeletePaymentDetail(w, r)
+	case "dialysis_schedules":
+		controllersMap["dialysis_schedules"].(*controllers.DialysisScheduleController).DeleteSchedule(w, r)
+	case "stations":
+		controllersMap["stations"].(*controllers.StationController).DeleteStation(w, r)
+	case "availability":
+		controllersMap["availability"].(*controllers.AvailabilityController).DeleteAvailability(w, r)
+	case "waitlist":
+		controllersMap["waitlist"].(*controllers.WaitlistController).DeleteWaitlist(w, r)
+	case "closures":
+		controllersMap["closures"].(*controllers.ClosuresController).DeleteClosure(w, r)
+	case "transient_patients":
+		controllersMap["transient_patients"].(*controllers.TransientPatientController).DeleteTransient(w, r)
+	case "machines":
+		controllersMap["machines"].(*controllers.MachineController).DeleteMachine(w, r)
+	case "fluid":
+		controllersMap["fluid"].(*controllers.FluidController).DeleteDryWeight(w, r)
+	case "lab_results":
+		controllersMap["lab_results"].(*controllers.LabResultController).DeleteResult(w, r)
 	default:
 		http.Error(w, "Invalid endpoint", http.StatusNotFound)
 	}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/BrianKasina/dialysis-scheduling/gateways"
+)
+
+func TestPermissionResource(t *testing.T) {
+	tests := []struct {
+		endpoint, url, want string
+	}{
+		{"patients", "/patients", "patients"},
+		{"appointments", "/appointments?type=dialysis", "appointments:dialysis"},
+		{"appointments", "/appointments?type=nephrologist&id=4", "appointments:nephrologist"},
+		{"appointments", "/appointments", "appointments:"},
+		{"appointments", "/appointments?type=dialysis&identifier=cancel&id=4", "appointments:dialysis:cancel"},
+		{"appointments", "/appointments?type=nephrologist&identifier=confirm&id=4", "appointments:nephrologist"},
+		{"posts", "/posts?type=dialysis", "posts"},
+		{"availability", "/availability", "availability:slots"},
+		{"availability", "/availability?identifier=hours&staff_id=3", "availability:hours"},
+		{"availability", "/availability?identifier=book", "availability:book"},
+		{"machines", "/machines?identifier=disinfect&id=2", "machines:disinfect"},
+		{"machines", "/machines?identifier=maintenance&id=2", "machines"},
+		{"medications", "/medications?identifier=doses&appointment_id=4", "medications:doses"},
+		{"medications", "/medications?patient_id=3", "medications"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if got := permissionResource(r, tt.endpoint); got != tt.want {
+			t.Errorf("permissionResource(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLoadAdherenceThresholds(t *testing.T) {
+	defaults := gateways.Adherence
+	t.Cleanup(func() { gateways.Adherence = defaults })
+
+	tests := []struct {
+		window  string
+		wantErr bool
+	}{
+		{"", false},
+		{"30", false},
+		{"90", false},
+		{"60", true},
+		{"a month", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("ADHERENCE_WINDOW_DAYS", tt.window)
+		if err := loadAdherenceThresholds(); (err != nil) != tt.wantErr {
+			t.Errorf("loadAdherenceThresholds() with ADHERENCE_WINDOW_DAYS=%q error = %v, want error %v", tt.window, err, tt.wantErr)
+		}
+	}
+}
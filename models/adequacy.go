@@ -0,0 +1,79 @@
+package models
+
+import (
+    "errors"
+    "math"
+    "time"
+)
+
+// AdequacyTargets are the minimum single-pool Kt/V and urea reduction ratio (percent) a session should reach.
+// A zero target is not checked.
+type AdequacyTargets struct {
+    MinKtV float64 `json:"min_ktv"`
+    MinURR float64 `json:"min_urr"`
+}
+
+// Adequacy is the dose of dialysis a session delivered, worked out from its urea samples and treatment parameters
+type Adequacy struct {
+    URR            float64   `json:"urr" bson:"urr"`
+    KtV            float64   `json:"ktv" bson:"ktv"`
+    TreatmentHours float64   `json:"treatment_hours" bson:"treatment_hours"`
+    UFLitres       float64   `json:"uf_litres" bson:"uf_litres"`
+    PostWeightKg   float64   `json:"post_weight_kg" bson:"post_weight_kg"`
+    BelowTarget    bool      `json:"below_target" bson:"below_target"`
+    ComputedAt     time.Time `json:"computed_at" bson:"computed_at"`
+}
+
+// AdequacyPoint is one session on a patient's adequacy trend
+type AdequacyPoint struct {
+    AppointmentID int     `json:"appointment_id"`
+    Date          string  `json:"date"`
+    URR           float64 `json:"urr"`
+    KtV           float64 `json:"ktv"`
+    BelowTarget   bool    `json:"below_target"`
+}
+
+// AdequacyTrend is a patient's adequacy over time, oldest session first, with the review it led to if any
+type AdequacyTrend struct {
+    PatientID           int             `json:"patient_id"`
+    PatientName         string          `json:"patient_name,omitempty"`
+    Targets             AdequacyTargets `json:"targets"`
+    Sessions            []AdequacyPoint `json:"sessions"`
+    AverageKtV          float64         `json:"average_ktv,omitempty"`
+    AverageURR          float64         `json:"average_urr,omitempty"`
+    Flagged             bool            `json:"flagged"`
+    ReviewAppointmentID int             `json:"review_appointment_id,omitempty"`
+}
+
+// Urea samples and treatment parameters that cannot give an adequacy figure
+var (
+    ErrNoUreaSamples   = errors.New("pre and post dialysis urea are both needed")
+    ErrImpossibleUrea  = errors.New("post dialysis urea must be below pre dialysis urea")
+    ErrNoPostWeight    = errors.New("a post dialysis weight is needed")
+    ErrNoTreatmentTime = errors.New("the treatment time is needed")
+)
+
+// ComputeAdequacy returns the urea reduction ratio, as a percent, and the single-pool Kt/V by the second
+// generation Daugirdas formula, spKt/V = -ln(R - 0.008t) + (4 - 3.5R) x UF/W, where R is post over pre urea,
+// t the treatment time in hours, UF the litres removed and W the post dialysis weight in kg.
+// The urea samples may be in any unit as long as both use the same one.
+func ComputeAdequacy(preUrea, postUrea, hours, ufLitres, postWeightKg float64) (float64, float64, error) {
+    switch {
+    case preUrea <= 0 || postUrea <= 0:
+        return 0, 0, ErrNoUreaSamples
+    case postUrea >= preUrea:
+        return 0, 0, ErrImpossibleUrea
+    case postWeightKg <= 0:
+        return 0, 0, ErrNoPostWeight
+    case hours <= 0:
+        return 0, 0, ErrNoTreatmentTime
+    }
+
+    ratio := postUrea / preUrea
+    if ratio-0.008*hours <= 0 {
+        return 0, 0, ErrImpossibleUrea
+    }
+    ktv := -math.Log(ratio-0.008*hours) + (4-3.5*ratio)*ufLitres/postWeightKg
+    urr := (1 - ratio) * 100
+    return math.Round(urr*10) / 10, math.Round(ktv*100) / 100, nil
+}
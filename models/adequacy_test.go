@@ -0,0 +1,39 @@
+package models
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestComputeAdequacy(t *testing.T) {
+    tests := []struct {
+        name                                     string
+        preUrea, postUrea, hours, uf, postWeight float64
+        wantURR, wantKtV                         float64
+        wantErr                                  error
+    }{
+        {"typical session", 70, 21, 4, 2, 70, 70, 1.4, nil},
+        {"no fluid removed", 70, 21, 4, 0, 70, 70, 1.32, nil},
+        {"short session", 60, 30, 2.5, 1.5, 60, 50, 0.79, nil},
+        {"urea in mg/dL", 150, 45, 4, 3, 80, 70, 1.43, nil},
+        {"below target", 20, 10, 3, 0.5, 65, 50, 0.76, nil},
+        {"missing pre urea", 0, 21, 4, 2, 70, 0, 0, ErrNoUreaSamples},
+        {"missing post urea", 70, 0, 4, 2, 70, 0, 0, ErrNoUreaSamples},
+        {"post urea not below pre", 21, 21, 4, 2, 70, 0, 0, ErrImpossibleUrea},
+        {"session too long for the ratio", 70, 1, 200, 2, 70, 0, 0, ErrImpossibleUrea},
+        {"no post weight", 70, 21, 4, 2, 0, 0, 0, ErrNoPostWeight},
+        {"no treatment time", 70, 21, 0, 2, 70, 0, 0, ErrNoTreatmentTime},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            urr, ktv, err := ComputeAdequacy(tt.preUrea, tt.postUrea, tt.hours, tt.uf, tt.postWeight)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("ComputeAdequacy() error = %v, want %v", err, tt.wantErr)
+            }
+            if urr != tt.wantURR || ktv != tt.wantKtV {
+                t.Errorf("ComputeAdequacy() = URR %v, Kt/V %v, want URR %v, Kt/V %v", urr, ktv, tt.wantURR, tt.wantKtV)
+            }
+        })
+    }
+}
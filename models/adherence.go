@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// AdherenceWindows are the look-back periods, in days, an adherence summary covers
+var AdherenceWindows = []int{30, 90}
+
+// AdherenceThresholds decide when a patient is flagged for missing or cutting short dialysis sessions.
+// A zero threshold is not checked.
+type AdherenceThresholds struct {
+    WindowDays          int     `json:"window_days"`
+    MinAttendedPercent  float64 `json:"min_attended_percent"`
+    MaxNoShows          int     `json:"max_no_shows"`
+    MaxShortenedMinutes int     `json:"max_shortened_minutes"`
+    LateGraceMinutes    int     `json:"late_grace_minutes"`
+}
+
+// AdherenceWindow sums up a patient's dialysis sessions that were due over the last Days days.
+// Cancelled and rescheduled sessions were never due. Past sessions nobody recorded are due but not attended,
+// and are also counted apart so staff can catch up on them.
+type AdherenceWindow struct {
+    Days             int     `json:"days"`
+    Due              int     `json:"due"`
+    Attended         int     `json:"attended"`
+    NoShows          int     `json:"no_shows"`
+    LateArrivals     int     `json:"late_arrivals"`
+    LateMinutes      int     `json:"late_minutes"`
+    ShortenedMinutes int     `json:"shortened_minutes"`
+    Unrecorded       int     `json:"unrecorded"`
+    AttendedPercent  float64 `json:"attended_percent"`
+}
+
+// AdherenceSummary is a patient's attendance over each of the AdherenceWindows, with the thresholds they crossed
+type AdherenceSummary struct {
+    PatientID   int               `json:"patient_id"`
+    PatientName string            `json:"patient_name,omitempty"`
+    Windows     []AdherenceWindow `json:"windows"`
+    Flagged     bool              `json:"flagged"`
+    Flags       []string          `json:"flags"`
+    ComputedAt  time.Time         `json:"computed_at"`
+}
@@ -0,0 +1,19 @@
+package models
+
+// Default session lengths used when an appointment does not give its own duration
+const (
+    DefaultDialysisMinutes     = 240
+    DefaultNephrologistMinutes = 30
+)
+
+// AppointmentConflict describes an existing appointment that clashes with a requested booking
+type AppointmentConflict struct {
+    AppointmentID int    `json:"appointment_id"`
+    Type          string `json:"type"`
+    Resource      string `json:"resource"`
+    Date          string `json:"date"`
+    Time          string `json:"time"`
+    PatientID     int    `json:"patient_id,omitempty"`
+    StaffID       int    `json:"staff_id,omitempty"`
+    StationID     int    `json:"station_id,omitempty"`
+}
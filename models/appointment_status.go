@@ -0,0 +1,75 @@
+package models
+
+import "time"
+
+// Appointment statuses, shared by dialysis and nephrologist appointments
+const (
+    StatusRequested   = "requested"
+    StatusConfirmed   = "confirmed"
+    StatusCheckedIn   = "checked-in"
+    StatusInProgress  = "in-progress"
+    StatusCompleted   = "completed"
+    StatusCancelled   = "cancelled"
+    StatusNoShow      = "no-show"
+    StatusRescheduled = "rescheduled"
+)
+
+// statusTransitions lists the statuses an appointment may move to from each status.
+// Completed, cancelled, no-show and rescheduled appointments are final.
+var statusTransitions = map[string][]string{
+    StatusRequested:  {StatusConfirmed, StatusCancelled, StatusRescheduled},
+    StatusConfirmed:  {StatusCheckedIn, StatusCancelled, StatusNoShow, StatusRescheduled},
+    StatusCheckedIn:  {StatusInProgress, StatusCancelled},
+    StatusInProgress: {StatusCompleted},
+}
+
+// ReleasedStatuses are the statuses of appointments that no longer hold their slot
+var ReleasedStatuses = []string{StatusCancelled, StatusNoShow, StatusRescheduled}
+
+// HoldsSlot reports whether an appointment in status still occupies its time, staff member and station
+func HoldsSlot(status string) bool {
+    for _, released := range ReleasedStatuses {
+        if CurrentStatus(status) == released {
+            return false
+        }
+    }
+    return true
+}
+
+// StatusChange records who moved an appointment from one status to another, when and why
+type StatusChange struct {
+    From      string    `json:"from" bson:"from"`
+    To        string    `json:"to" bson:"to"`
+    ChangedBy int       `json:"changed_by" bson:"changed_by"`
+    Role      string    `json:"role" bson:"role"`
+    Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+    ChangedAt time.Time `json:"changed_at" bson:"changed_at"`
+    // OccurredAt is when the change really happened, when it is recorded afterwards, e.g. a check-in
+    // entered once the patient is already on the machine
+    OccurredAt *time.Time `json:"occurred_at,omitempty" bson:"occurred_at,omitempty"`
+}
+
+// CurrentStatus maps the free-form statuses of appointments saved before the state machine
+// existed onto a defined status. Sessions generated from a schedule used to be "scheduled".
+func CurrentStatus(status string) string {
+    if _, ok := statusTransitions[status]; ok {
+        return status
+    }
+    switch status {
+    case StatusCompleted, StatusCancelled, StatusNoShow, StatusRescheduled:
+        return status
+    case "scheduled":
+        return StatusConfirmed
+    }
+    return StatusRequested
+}
+
+// CanTransition reports whether an appointment in status from may move to status to
+func CanTransition(from, to string) bool {
+    for _, next := range statusTransitions[CurrentStatus(from)] {
+        if next == to {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,65 @@
+package models
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+    tests := []struct {
+        from, to string
+        want     bool
+    }{
+        {StatusRequested, StatusConfirmed, true},
+        {StatusRequested, StatusCancelled, true},
+        {StatusRequested, StatusCheckedIn, false},
+        {StatusRequested, StatusNoShow, false},
+        {StatusConfirmed, StatusCheckedIn, true},
+        {StatusConfirmed, StatusNoShow, true},
+        {StatusConfirmed, StatusCompleted, false},
+        {StatusRequested, StatusRescheduled, true},
+        {StatusConfirmed, StatusRescheduled, true},
+        {StatusCheckedIn, StatusRescheduled, false},
+        {StatusRescheduled, StatusConfirmed, false},
+        {StatusCheckedIn, StatusInProgress, true},
+        {StatusCheckedIn, StatusCancelled, true},
+        {StatusCheckedIn, StatusNoShow, false},
+        {StatusInProgress, StatusCompleted, true},
+        {StatusInProgress, StatusCancelled, false},
+        {StatusCompleted, StatusConfirmed, false},
+        {StatusCancelled, StatusConfirmed, false},
+        {StatusNoShow, StatusCheckedIn, false},
+        {StatusConfirmed, StatusConfirmed, false},
+        // Statuses saved before the state machine existed
+        {"scheduled", StatusCheckedIn, true},
+        {"scheduled", StatusConfirmed, false},
+        {"", StatusConfirmed, true},
+        {"pending", StatusCheckedIn, false},
+        {StatusConfirmed, "unknown", false},
+    }
+
+    for _, tt := range tests {
+        if got := CanTransition(tt.from, tt.to); got != tt.want {
+            t.Errorf("CanTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+        }
+    }
+}
+
+func TestHoldsSlot(t *testing.T) {
+    tests := []struct {
+        status string
+        want   bool
+    }{
+        {StatusRequested, true},
+        {StatusConfirmed, true},
+        {StatusInProgress, true},
+        {StatusCompleted, true},
+        {"scheduled", true},
+        {StatusCancelled, false},
+        {StatusNoShow, false},
+        {StatusRescheduled, false},
+    }
+
+    for _, tt := range tests {
+        if got := HoldsSlot(tt.status); got != tt.want {
+            t.Errorf("HoldsSlot(%q) = %v, want %v", tt.status, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,30 @@
+package models
+
+// WorkingHours is a weekly template of when a nephrologist sees patients
+type WorkingHours struct {
+    ID          int    `json:"id" bson:"working_hours_id"`
+    StaffID     int    `json:"staff_id" bson:"staff_id"`
+    Weekday     int    `json:"weekday" bson:"weekday"`
+    StartTime   string `json:"start_time" bson:"start_time"`
+    EndTime     string `json:"end_time" bson:"end_time"`
+    SlotMinutes int    `json:"slot_minutes,omitempty" bson:"slot_minutes,omitempty"`
+}
+
+// AvailabilityException takes time out of a nephrologist's working hours, such as leave or a clinic.
+// An exception without start and end times covers the whole day.
+type AvailabilityException struct {
+    ID        int    `json:"id" bson:"exception_id"`
+    StaffID   int    `json:"staff_id" bson:"staff_id"`
+    Date      string `json:"date" bson:"date"`
+    StartTime string `json:"start_time,omitempty" bson:"start_time,omitempty"`
+    EndTime   string `json:"end_time,omitempty" bson:"end_time,omitempty"`
+    Reason    string `json:"reason" bson:"reason"`
+}
+
+// Slot is an open period in a nephrologist's schedule that a patient can book
+type Slot struct {
+    StaffID         int    `json:"staff_id"`
+    Date            string `json:"date"`
+    Time            string `json:"time"`
+    DurationMinutes int    `json:"duration_minutes"`
+}
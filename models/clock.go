@@ -0,0 +1,77 @@
+package models
+
+import (
+    "fmt"
+    "time"
+)
+
+// DateLayout and ClockLayout are the formats of the date and time strings the API accepts and returns
+const (
+    DateLayout  = "2006-01-02"
+    ClockLayout = "15:04"
+)
+
+// ClinicLocation is the time zone dates and times are entered and shown in, set from CLINIC_TIMEZONE at startup.
+// Timestamps are stored in UTC.
+var ClinicLocation = time.UTC
+
+// SetClinicTimezone sets ClinicLocation from an IANA zone name such as "Africa/Nairobi"
+func SetClinicTimezone(name string) error {
+    location, err := time.LoadLocation(name)
+    if err != nil {
+        return fmt.Errorf("invalid clinic time zone %q: %w", name, err)
+    }
+    ClinicLocation = location
+    return nil
+}
+
+// ParseLocal turns a clinic date and time of day into a timestamp, seconds in the time are optional
+func ParseLocal(date, clock string) (time.Time, error) {
+    for _, layout := range []string{ClockLayout, "15:04:05"} {
+        if t, err := time.ParseInLocation(DateLayout+" "+layout, date+" "+clock, ClinicLocation); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid date or time %q %q, expected YYYY-MM-DD and HH:MM", date, clock)
+}
+
+// LocalDate formats a timestamp as a date in clinic time
+func LocalDate(t time.Time) string {
+    return t.In(ClinicLocation).Format(DateLayout)
+}
+
+// LocalClock formats a timestamp as a time of day in clinic time
+func LocalClock(t time.Time) string {
+    return t.In(ClinicLocation).Format(ClockLayout)
+}
+
+// resolveTimes keeps the date and time strings and the start timestamp of a record in step.
+// Clients may send either; the strings win when both are given. The end is the start plus minutes.
+func resolveTimes(date, clock *string, startsAt, endsAt *time.Time, minutes int) error {
+    switch {
+    case *date != "" && *clock != "":
+        start, err := ParseLocal(*date, *clock)
+        if err != nil {
+            return err
+        }
+        *startsAt = start
+    case startsAt.IsZero():
+        return fmt.Errorf("a date and time, or a start timestamp, is required")
+    }
+
+    *startsAt = startsAt.UTC()
+    *date = LocalDate(*startsAt)
+    *clock = LocalClock(*startsAt)
+    if endsAt != nil {
+        *endsAt = startsAt.Add(time.Duration(minutes) * time.Minute)
+    }
+    return nil
+}
+
+// stampNow fills in a missing date and time with the current time, then keeps them in step with the timestamp
+func stampNow(date, clock *string, at *time.Time) error {
+    if *date == "" && *clock == "" && at.IsZero() {
+        *at = time.Now()
+    }
+    return resolveTimes(date, clock, at, nil, 0)
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLocal(t *testing.T) {
+    nairobi := time.FixedZone("EAT", 3*60*60)
+    defer func(location *time.Location) { ClinicLocation = location }(ClinicLocation)
+    ClinicLocation = nairobi
+
+    tests := []struct {
+        name        string
+        date, clock string
+        want        time.Time
+        wantErr     bool
+    }{
+        {"hours and minutes", "2024-03-05", "06:00", time.Date(2024, 3, 5, 6, 0, 0, 0, nairobi), false},
+        {"with seconds", "2024-03-05", "13:45:30", time.Date(2024, 3, 5, 13, 45, 30, 0, nairobi), false},
+        {"late evening is still the same clinic day", "2024-03-05", "23:30", time.Date(2024, 3, 5, 20, 30, 0, 0, time.UTC), false},
+        {"missing time", "2024-03-05", "", time.Time{}, true},
+        {"missing date", "", "06:00", time.Time{}, true},
+        {"wrong date format", "05/03/2024", "06:00", time.Time{}, true},
+        {"impossible date", "2024-02-30", "06:00", time.Time{}, true},
+        {"impossible time", "2024-03-05", "25:00", time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := ParseLocal(tt.date, tt.clock)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("ParseLocal(%q, %q) error = %v, wantErr %v", tt.date, tt.clock, err, tt.wantErr)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("ParseLocal(%q, %q) = %v, want %v", tt.date, tt.clock, got, tt.want)
+            }
+            if err == nil && (LocalDate(got) != tt.date || LocalClock(got) != tt.clock[:5]) {
+                t.Errorf("LocalDate/LocalClock(%v) = %s %s, want %s %s", got, LocalDate(got), LocalClock(got), tt.date, tt.clock[:5])
+            }
+        })
+    }
+}
+
+func TestResolveTimes(t *testing.T) {
+    nairobi := time.FixedZone("EAT", 3*60*60)
+    defer func(location *time.Location) { ClinicLocation = location }(ClinicLocation)
+    ClinicLocation = nairobi
+    stored := time.Date(2024, 3, 5, 3, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name               string
+        date, clock        string
+        startsAt           time.Time
+        wantDate, wantTime string
+        wantStart          time.Time
+        wantErr            bool
+    }{
+        {"strings only", "2024-03-05", "06:00", time.Time{}, "2024-03-05", "06:00", stored, false},
+        {"timestamp only", "", "", stored, "2024-03-05", "06:00", stored, false},
+        {"strings win over the timestamp", "2024-03-05", "07:00", stored, "2024-03-05", "07:00", stored.Add(time.Hour), false},
+        {"neither", "", "", time.Time{}, "", "", time.Time{}, true},
+        {"unreadable strings", "2024-03-05", "7am", stored, "", "", time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        date, clock, startsAt := tt.date, tt.clock, tt.startsAt
+        var endsAt time.Time
+        err := resolveTimes(&date, &clock, &startsAt, &endsAt, 240)
+        if (err != nil) != tt.wantErr {
+            t.Fatalf("%s: resolveTimes() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+        }
+        if err != nil {
+            continue
+        }
+        if date != tt.wantDate || clock != tt.wantTime || !startsAt.Equal(tt.wantStart) || startsAt.Location() != time.UTC {
+            t.Errorf("%s: resolveTimes() = %s %s %v, want %s %s %v in UTC", tt.name, date, clock, startsAt, tt.wantDate, tt.wantTime, tt.wantStart)
+        }
+        if !endsAt.Equal(startsAt.Add(240 * time.Minute)) {
+            t.Errorf("%s: ends at %v, want 240 minutes after %v", tt.name, endsAt, startsAt)
+        }
+    }
+}
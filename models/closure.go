@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// Kinds of clinic closure
+const (
+    ClosureHoliday     = "holiday"
+    ClosureMaintenance = "maintenance"
+    ClosureWater       = "water_treatment"
+    ClosureOther       = "other"
+)
+
+// Closure is a day the unit is shut and takes no bookings
+type Closure struct {
+    ID        int       `json:"id" bson:"closure_id"`
+    Date      string    `json:"date" bson:"date"`
+    Kind      string    `json:"kind" bson:"kind"`
+    Reason    string    `json:"reason" bson:"reason"`
+    CreatedBy int       `json:"created_by,omitempty" bson:"created_by,omitempty"`
+    CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// RelocateRequest lists the days sessions on a closed day may move to, in order of preference.
+// Without dates the following clinic days are tried.
+type RelocateRequest struct {
+    Dates []string `json:"dates,omitempty"`
+}
+
+// Relocation reports where one appointment on a closed day went, or why it could not be moved
+type Relocation struct {
+    Type             string `json:"type"`
+    AppointmentID    int    `json:"appointment_id"`
+    PatientID        int    `json:"patient_id"`
+    PatientName      string `json:"patient_name,omitempty"`
+    Time             string `json:"time"`
+    Moved            bool   `json:"moved"`
+    NewAppointmentID int    `json:"new_appointment_id,omitempty"`
+    NewDate          string `json:"new_date,omitempty"`
+    StationID        int    `json:"station_id,omitempty"`
+    Reason           string `json:"reason,omitempty"`
+}
+
+// RelocationReport sums up a bulk relocation off a closed day
+type RelocationReport struct {
+    ClosedDate  string       `json:"closed_date"`
+    Moved       int          `json:"moved"`
+    NotMoved    int          `json:"not_moved"`
+    Relocations []Relocation `json:"relocations"`
+}
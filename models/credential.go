@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Account types a credential can belong to
+const (
+    AccountAdmin   = "admin"
+    AccountStaff   = "staff"
+    AccountPatient = "patient"
+)
+
+// Credential holds the login details for a system admin, hospital staff or patient account
+type Credential struct {
+    Username          string    `json:"username" bson:"username"`
+    PasswordHash      string    `json:"-" bson:"password_hash"`
+    AccountType       string    `json:"account_type" bson:"account_type"`
+    AccountID         int       `json:"account_id" bson:"account_id"`
+    Role              string    `json:"role" bson:"role"`
+    ResetTokenHash    string    `json:"-" bson:"reset_token_hash,omitempty"`
+    ResetTokenExpires time.Time `json:"-" bson:"reset_token_expires,omitempty"`
+    // TokenVersion goes up with every password change and is carried in refresh tokens, so tokens issued
+    // before the change can no longer be refreshed
+    TokenVersion int `json:"-" bson:"token_version,omitempty"`
+}
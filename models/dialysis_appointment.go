@@ -1,12 +1,69 @@
 package models
 
+import "time"
+
 type DialysisAppointment struct {
-    ID          int    `json:"id" bson:"appointment_id"`
-    Date        string `json:"date" bson:"date"`
-    Time        string `json:"time" bson:"time"`
-    Status      string `json:"status" bson:"status"`
-    PatientID   int    `json:"patient_id,omitempty" bson:"patient_id"`
-    StaffID     int    `json:"staff_id,omitempty" bson:"staff_id"`
-    StaffName   string `json:"staff_name,omitempty" bson:"staff_name"`
-    PatientName string `json:"patient_name,omitempty" bson:"patient_name"`
-}
\ No newline at end of file
+    ID               int            `json:"id" bson:"appointment_id"`
+    Date             string         `json:"date" bson:"date"`
+    Time             string         `json:"time" bson:"time"`
+    StartsAt         time.Time      `json:"starts_at" bson:"starts_at"`
+    EndsAt           time.Time      `json:"ends_at" bson:"ends_at"`
+    DurationMinutes  int            `json:"duration_minutes,omitempty" bson:"duration_minutes,omitempty"`
+    Status           string         `json:"status" bson:"status"`
+    PatientID        int            `json:"patient_id,omitempty" bson:"patient_id"`
+    StaffID          int            `json:"staff_id,omitempty" bson:"staff_id"`
+    StaffName        string         `json:"staff_name,omitempty" bson:"staff_name"`
+    PatientName      string         `json:"patient_name,omitempty" bson:"patient_name"`
+    Shift            string         `json:"shift,omitempty" bson:"shift,omitempty"`
+    StationID        int            `json:"station_id,omitempty" bson:"station_id,omitempty"`
+    ScheduleID       int            `json:"schedule_id,omitempty" bson:"schedule_id,omitempty"`
+    OccurrenceDate   string         `json:"occurrence_date,omitempty" bson:"occurrence_date,omitempty"`
+    IsException      bool           `json:"is_exception,omitempty" bson:"is_exception,omitempty"`
+    StatusHistory    []StatusChange `json:"status_history,omitempty" bson:"status_history,omitempty"`
+    RescheduledFrom  int            `json:"rescheduled_from,omitempty" bson:"rescheduled_from,omitempty"`
+    RescheduledTo    int            `json:"rescheduled_to,omitempty" bson:"rescheduled_to,omitempty"`
+    CheckedInAt      *time.Time     `json:"checked_in_at,omitempty" bson:"checked_in_at,omitempty"`
+    LateMinutes      int            `json:"late_minutes,omitempty" bson:"late_minutes,omitempty"`
+    StartedAt        *time.Time     `json:"started_at,omitempty" bson:"started_at,omitempty"`
+    CompletedAt      *time.Time     `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+    ShortenedMinutes int            `json:"shortened_minutes,omitempty" bson:"shortened_minutes,omitempty"`
+    Transient        bool           `json:"transient,omitempty" bson:"transient,omitempty"`
+}
+
+// ResolveTimes sets the start and end timestamps from the date, time and duration, or the date
+// and time from the start timestamp when only that was given
+func (a *DialysisAppointment) ResolveTimes() error {
+    minutes := a.DurationMinutes
+    if minutes == 0 {
+        minutes = DefaultDialysisMinutes
+    }
+    return resolveTimes(&a.Date, &a.Time, &a.StartsAt, &a.EndsAt, minutes)
+}
+
+// FreedSlot describes the slot the appointment holds, to offer to the waitlist once it is given up
+func (a *DialysisAppointment) FreedSlot() SlotOffer {
+    return SlotOffer{
+        Type:               "dialysis",
+        Date:               a.Date,
+        Time:               a.Time,
+        DurationMinutes:    a.DurationMinutes,
+        StaffID:            a.StaffID,
+        StaffName:          a.StaffName,
+        StationID:          a.StationID,
+        Shift:              a.Shift,
+        PatientID:          a.PatientID,
+        FreedAppointmentID: a.ID,
+    }
+}
+
+// ClearServerFields drops the fields only the server sets, so a new appointment cannot arrive already
+// checked in, attended, rescheduled, part of a schedule or marked as a visiting patient's
+func (a *DialysisAppointment) ClearServerFields() {
+    a.ID = 0
+    a.ScheduleID, a.OccurrenceDate, a.IsException = 0, "", false
+    a.StatusHistory = nil
+    a.RescheduledFrom, a.RescheduledTo = 0, 0
+    a.CheckedInAt, a.LateMinutes = nil, 0
+    a.StartedAt, a.CompletedAt, a.ShortenedMinutes = nil, nil, 0
+    a.Transient = false
+}
@@ -0,0 +1,57 @@
+package models
+
+// DialysisSchedule is a recurring dialysis series that is materialized into dialysis appointments
+type DialysisSchedule struct {
+    ID          int    `json:"id" bson:"schedule_id"`
+    PatientID   int    `json:"patient_id" bson:"patient_id"`
+    PatientName string `json:"patient_name,omitempty" bson:"patient_name"`
+    StaffID     int    `json:"staff_id,omitempty" bson:"staff_id"`
+    StaffName   string `json:"staff_name,omitempty" bson:"staff_name"`
+    Pattern     string `json:"pattern" bson:"pattern"`
+    Shift       string `json:"shift" bson:"shift"`
+    StartDate   string `json:"start_date" bson:"start_date"`
+    EndDate     string `json:"end_date,omitempty" bson:"end_date,omitempty"`
+    StationID   int    `json:"station_id" bson:"station_id"`
+    ParentID    int    `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+
+    // Skipped lists the occurrences that could not be booked the last time the schedule was materialized
+    Skipped []SkippedOccurrence `json:"skipped,omitempty" bson:"-"`
+}
+
+// SkippedOccurrence is a date of a schedule that was not materialized because the booking was refused
+type SkippedOccurrence struct {
+    ScheduleID int                   `json:"schedule_id"`
+    PatientID  int                   `json:"patient_id"`
+    Date       string                `json:"date"`
+    Reason     string                `json:"reason"`
+    Conflicts  []AppointmentConflict `json:"conflicts,omitempty"`
+}
+
+// Weekly patterns for in-centre haemodialysis
+const (
+    PatternMWF = "MWF"
+    PatternTTS = "TTS"
+)
+
+// Shift start times for each dialysis shift
+var ShiftStartTimes = map[string]string{
+    "morning":   "06:00",
+    "afternoon": "11:00",
+    "evening":   "16:00",
+}
+
+// ShiftOrder lists the shifts in the order they run during the day
+var ShiftOrder = []string{"morning", "afternoon", "evening"}
+
+// ShiftForTime returns the dialysis shift a start time such as "13:30" falls in
+func ShiftForTime(clock string) string {
+    switch {
+    case clock == "":
+        return ""
+    case clock < ShiftStartTimes["afternoon"]:
+        return "morning"
+    case clock < ShiftStartTimes["evening"]:
+        return "afternoon"
+    }
+    return "evening"
+}
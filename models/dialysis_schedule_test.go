@@ -0,0 +1,23 @@
+package models
+
+import "testing"
+
+func TestShiftForTime(t *testing.T) {
+    tests := []struct {
+        clock, want string
+    }{
+        {"", ""},
+        {"06:00", "morning"},
+        {"10:59", "morning"},
+        {"11:00", "afternoon"},
+        {"15:30", "afternoon"},
+        {"16:00", "evening"},
+        {"22:15", "evening"},
+    }
+
+    for _, tt := range tests {
+        if got := ShiftForTime(tt.clock); got != tt.want {
+            t.Errorf("ShiftForTime(%q) = %q, want %q", tt.clock, got, tt.want)
+        }
+    }
+}
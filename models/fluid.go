@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// DryWeight is the target weight a nephrologist sets for a patient, the weight they should leave dialysis at
+// with no excess fluid. A patient's dry weight on a day is the one with the latest EffectiveFrom on or before it.
+type DryWeight struct {
+    ID            int       `json:"id" bson:"dry_weight_id"`
+    PatientID     int       `json:"patient_id" bson:"patient_id"`
+    PatientName   string    `json:"patient_name" bson:"patient_name"`
+    WeightKg      float64   `json:"weight_kg" bson:"weight_kg"`
+    EffectiveFrom string    `json:"effective_from" bson:"effective_from"`
+    Reason        string    `json:"reason,omitempty" bson:"reason,omitempty"`
+    SetBy         int       `json:"set_by" bson:"set_by"`
+    CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+}
+
+// WeightGainThresholds are the interdialytic weight gains that raise an alert: a gain in kg, or a gain as a
+// percent of dry weight. A zero threshold is not checked.
+type WeightGainThresholds struct {
+    MaxKg      float64 `json:"max_kg"`
+    MaxPercent float64 `json:"max_percent"`
+}
+
+// WeightGain is the fluid a patient put on between two sessions: their weight coming in to a session less
+// their weight leaving the one before. Percent is of the dry weight in effect on the day, when there is one.
+type WeightGain struct {
+    PreviousAppointmentID int        `json:"previous_appointment_id" bson:"previous_appointment_id"`
+    PreviousDate          string     `json:"previous_date" bson:"previous_date"`
+    PreviousPostWeightKg  float64    `json:"previous_post_weight_kg" bson:"previous_post_weight_kg"`
+    IntervalDays          int        `json:"interval_days" bson:"interval_days"`
+    GainKg                float64    `json:"gain_kg" bson:"gain_kg"`
+    DryWeightKg           float64    `json:"dry_weight_kg,omitempty" bson:"dry_weight_kg,omitempty"`
+    Percent               float64    `json:"percent,omitempty" bson:"percent,omitempty"`
+    AboveThreshold        bool       `json:"above_threshold" bson:"above_threshold"`
+    AlertedAt             *time.Time `json:"alerted_at,omitempty" bson:"alerted_at,omitempty"`
+}
+
+// WeightGainPoint is one session on a patient's fluid trend
+type WeightGainPoint struct {
+    AppointmentID  int     `json:"appointment_id"`
+    Date           string  `json:"date"`
+    PreWeightKg    float64 `json:"pre_weight_kg,omitempty"`
+    PostWeightKg   float64 `json:"post_weight_kg,omitempty"`
+    DryWeightKg    float64 `json:"dry_weight_kg,omitempty"`
+    GainKg         float64 `json:"gain_kg"`
+    Percent        float64 `json:"percent,omitempty"`
+    AboveThreshold bool    `json:"above_threshold"`
+}
+
+// FluidTrend is a patient's dry weight history, newest first, and their weight gains between sessions,
+// oldest first
+type FluidTrend struct {
+    PatientID        int                  `json:"patient_id"`
+    PatientName      string               `json:"patient_name,omitempty"`
+    Thresholds       WeightGainThresholds `json:"thresholds"`
+    DryWeight        *DryWeight           `json:"dry_weight,omitempty"`
+    DryWeights       []DryWeight          `json:"dry_weights"`
+    Sessions         []WeightGainPoint    `json:"sessions"`
+    AverageGainKg    float64              `json:"average_gain_kg,omitempty"`
+    SessionsAboveMax int                  `json:"sessions_above_max"`
+}
@@ -7,4 +7,6 @@ type HospitalStaff struct {
     Specialization string `json:"specialization" bson:"specialization"`
     PhoneNumber    string `json:"phone_number" bson:"phone_number"`
     Status         string `json:"status" bson:"status"`
+    // Role is the access role the staff member's credential carries
+    Role           string `json:"role" bson:"role,omitempty"`
 }
\ No newline at end of file
@@ -0,0 +1,145 @@
+package models
+
+import (
+    "strings"
+    "time"
+)
+
+// Abnormal flags a lab result can carry, as in HL7 table 0078
+const (
+    LabFlagLow  = "L"
+    LabFlagHigh = "H"
+)
+
+// Where a lab result came from
+const (
+    LabSourceCSV = "csv"
+    LabSourceHL7 = "hl7"
+)
+
+// LabTest is a test the unit tracks, identified by its LOINC code, with the unit it is reported in and the
+// range the unit aims to keep dialysis patients in
+type LabTest struct {
+    Code  string  `json:"code"`
+    LOINC string  `json:"loinc"`
+    Name  string  `json:"name"`
+    Unit  string  `json:"unit"`
+    Low   float64 `json:"low"`
+    High  float64 `json:"high"`
+}
+
+// LabPanel is the monthly dialysis panel. A result for a test in it that comes without a reference range, in
+// the same unit, is judged against the panel's range.
+var LabPanel = []LabTest{
+    {Code: "hb", LOINC: "718-7", Name: "Hemoglobin", Unit: "g/dL", Low: 10, High: 11.5},
+    {Code: "k", LOINC: "2823-3", Name: "Potassium", Unit: "mmol/L", Low: 3.5, High: 5.5},
+    {Code: "ca", LOINC: "17861-6", Name: "Calcium", Unit: "mg/dL", Low: 8.4, High: 10.2},
+    {Code: "po4", LOINC: "2777-1", Name: "Phosphate", Unit: "mg/dL", Low: 3.5, High: 5.5},
+    {Code: "pth", LOINC: "2731-8", Name: "Parathyroid hormone, intact", Unit: "pg/mL", Low: 130, High: 585},
+    {Code: "albumin", LOINC: "1751-7", Name: "Albumin", Unit: "g/dL", Low: 3.5, High: 5},
+    {Code: "ferritin", LOINC: "2276-4", Name: "Ferritin", Unit: "ng/mL", Low: 200, High: 500},
+}
+
+// PanelTest returns the panel test with a LOINC code or short code such as "k", if there is one
+func PanelTest(code string) (LabTest, bool) {
+    for _, test := range LabPanel {
+        if test.LOINC == code || strings.EqualFold(test.Code, code) {
+            return test, true
+        }
+    }
+    return LabTest{}, false
+}
+
+// LabResult is one value reported for a patient by the laboratory. There is one result per patient, LOINC code
+// and collection time; importing it again replaces it, so corrected results overwrite the first report.
+// Comparator is set for a value beyond what the laboratory could measure, "<" or ">" it. RangeLow and RangeHigh
+// are the reference range the result is flagged against.
+type LabResult struct {
+    ID            int       `json:"id" bson:"result_id"`
+    PatientID     int       `json:"patient_id" bson:"patient_id"`
+    PatientName   string    `json:"patient_name" bson:"patient_name"`
+    LOINC         string    `json:"loinc" bson:"loinc"`
+    Test          string    `json:"test" bson:"test"`
+    Value         float64   `json:"value" bson:"value"`
+    Comparator    string    `json:"comparator,omitempty" bson:"comparator,omitempty"`
+    Unit          string    `json:"unit" bson:"unit"`
+    RangeLow      *float64  `json:"range_low,omitempty" bson:"range_low,omitempty"`
+    RangeHigh     *float64  `json:"range_high,omitempty" bson:"range_high,omitempty"`
+    Flag          string    `json:"flag,omitempty" bson:"flag,omitempty"`
+    CollectedAt   time.Time `json:"collected_at" bson:"collected_at"`
+    CollectedDate string    `json:"collected_date" bson:"collected_date"`
+    Accession     string    `json:"accession,omitempty" bson:"accession,omitempty"`
+    Source        string    `json:"source" bson:"source"`
+    ImportedBy    int       `json:"imported_by,omitempty" bson:"imported_by,omitempty"`
+    ImportedAt    time.Time `json:"imported_at" bson:"imported_at"`
+}
+
+// ApplyRange fills in the panel's reference range when the result has none and is in the panel's unit, then
+// flags the value low or high against the range. A flag sent with a result that has no range is kept.
+func (l *LabResult) ApplyRange() {
+    if test, ok := PanelTest(l.LOINC); ok {
+        if l.Test == "" {
+            l.Test = test.Name
+        }
+        if l.RangeLow == nil && l.RangeHigh == nil && strings.EqualFold(l.Unit, test.Unit) {
+            low, high := test.Low, test.High
+            l.RangeLow, l.RangeHigh = &low, &high
+        }
+    }
+    if l.RangeLow == nil && l.RangeHigh == nil {
+        return
+    }
+
+    l.Flag = ""
+    if l.RangeLow != nil && l.Value < *l.RangeLow {
+        l.Flag = LabFlagLow
+    }
+    if l.RangeHigh != nil && l.Value > *l.RangeHigh {
+        l.Flag = LabFlagHigh
+    }
+}
+
+// LabImportError is a row or segment of an import that could not be taken in
+type LabImportError struct {
+    Line    int    `json:"line"`
+    Message string `json:"message"`
+}
+
+// LabImport reports what an import did: results new to the unit, results that replaced an earlier report
+// and the lines that were rejected
+type LabImport struct {
+    Source   string           `json:"source"`
+    Imported int              `json:"imported"`
+    Updated  int              `json:"updated"`
+    Errors   []LabImportError `json:"errors"`
+}
+
+// LabPoint is one result on a lab trend
+type LabPoint struct {
+    ResultID      int     `json:"result_id"`
+    CollectedDate string  `json:"collected_date"`
+    Value         float64 `json:"value"`
+    Comparator    string  `json:"comparator,omitempty"`
+    Flag          string  `json:"flag,omitempty"`
+}
+
+// LabSeries is the trend of one test, oldest result first
+type LabSeries struct {
+    LOINC      string     `json:"loinc"`
+    Test       string     `json:"test"`
+    Unit       string     `json:"unit"`
+    RangeLow   *float64   `json:"range_low,omitempty"`
+    RangeHigh  *float64   `json:"range_high,omitempty"`
+    Latest     *LabPoint  `json:"latest,omitempty"`
+    OutOfRange int        `json:"out_of_range"`
+    Results    []LabPoint `json:"results"`
+}
+
+// LabTrend is a patient's results per test, panel tests first. Flagged lists the tests whose latest result is
+// out of range.
+type LabTrend struct {
+    PatientID   int         `json:"patient_id"`
+    PatientName string      `json:"patient_name,omitempty"`
+    Tests       []LabSeries `json:"tests"`
+    Flagged     []string    `json:"flagged"`
+}
@@ -0,0 +1,106 @@
+package models
+
+import "time"
+
+// Service states of a dialysis machine
+const (
+    MachineInService    = "in_service"
+    MachineOutOfService = "out_of_service"
+    MachineRetired      = "retired"
+)
+
+// Kinds of machine log entry and work order
+const (
+    MachineDisinfection = "disinfection"
+    MachineMaintenance  = "maintenance"
+    MachineRepair       = "repair"
+    MachineStatusChange = "status"
+)
+
+// Preventive maintenance intervals used when a machine does not set its own
+const (
+    DefaultMaintenanceIntervalDays  = 180
+    DefaultMaintenanceIntervalHours = 2000
+)
+
+// Machine is a dialysis machine, installed at a station or in store. Hours are the treatment hours it has run,
+// counted up as sessions on its station complete. A machine used for a session must be disinfected before the next.
+type Machine struct {
+    ID                       int               `json:"id" bson:"machine_id"`
+    Serial                   string            `json:"serial" bson:"serial"`
+    Model                    string            `json:"model,omitempty" bson:"model,omitempty"`
+    StationID                int               `json:"station_id,omitempty" bson:"station_id,omitempty"`
+    Status                   string            `json:"status" bson:"status"`
+    StatusReason             string            `json:"status_reason,omitempty" bson:"status_reason,omitempty"`
+    Hours                    float64           `json:"hours" bson:"hours"`
+    MaintenanceIntervalDays  int               `json:"maintenance_interval_days,omitempty" bson:"maintenance_interval_days,omitempty"`
+    MaintenanceIntervalHours float64           `json:"maintenance_interval_hours,omitempty" bson:"maintenance_interval_hours,omitempty"`
+    LastMaintenanceAt        *time.Time        `json:"last_maintenance_at,omitempty" bson:"last_maintenance_at,omitempty"`
+    LastMaintenanceHours     float64           `json:"last_maintenance_hours" bson:"last_maintenance_hours"`
+    LastDisinfectedAt        *time.Time        `json:"last_disinfected_at,omitempty" bson:"last_disinfected_at,omitempty"`
+    NeedsDisinfection        bool              `json:"needs_disinfection" bson:"needs_disinfection"`
+    LastUsedAt               *time.Time        `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+    LastAppointmentID        int               `json:"last_appointment_id,omitempty" bson:"last_appointment_id,omitempty"`
+    Log                      []MachineLogEntry `json:"log,omitempty" bson:"log,omitempty"`
+    CreatedAt                time.Time         `json:"created_at" bson:"created_at"`
+}
+
+// MachineLogEntry records a disinfection, maintenance visit, repair or change of service state
+type MachineLogEntry struct {
+    Kind   string    `json:"kind" bson:"kind"`
+    At     time.Time `json:"at" bson:"at"`
+    By     int       `json:"by,omitempty" bson:"by,omitempty"`
+    Hours  float64   `json:"hours" bson:"hours"`
+    Status string    `json:"status,omitempty" bson:"status,omitempty"`
+    Notes  string    `json:"notes,omitempty" bson:"notes,omitempty"`
+}
+
+// MachineService is what a technician or nurse records against a machine
+type MachineService struct {
+    Notes string `json:"notes,omitempty"`
+}
+
+// MaintenanceDue returns the date and the machine hours at which preventive maintenance next falls due.
+// The clock starts at the last maintenance visit, or when the machine was registered.
+func (m *Machine) MaintenanceDue() (string, float64) {
+    days, hours := m.MaintenanceIntervalDays, m.MaintenanceIntervalHours
+    if days <= 0 {
+        days = DefaultMaintenanceIntervalDays
+    }
+    if hours <= 0 {
+        hours = DefaultMaintenanceIntervalHours
+    }
+    since := m.CreatedAt
+    if m.LastMaintenanceAt != nil {
+        since = *m.LastMaintenanceAt
+    }
+    return LocalDate(since.AddDate(0, 0, days)), m.LastMaintenanceHours + hours
+}
+
+// MaintenanceOverdue reports whether preventive maintenance was due before today or the machine has run its hours
+func (m *Machine) MaintenanceOverdue(today string) bool {
+    date, hours := m.MaintenanceDue()
+    return date < today || m.Hours >= hours
+}
+
+// WorkOrder is a job due on a machine: preventive maintenance, a repair to bring it back into service,
+// or a disinfection after its last session
+type WorkOrder struct {
+    MachineID int     `json:"machine_id"`
+    Serial    string  `json:"serial"`
+    StationID int     `json:"station_id,omitempty"`
+    Room      string  `json:"room,omitempty"`
+    Kind      string  `json:"kind"`
+    DueDate   string  `json:"due_date"`
+    DueHours  float64 `json:"due_hours,omitempty"`
+    Hours     float64 `json:"hours"`
+    Overdue   bool    `json:"overdue"`
+    Detail    string  `json:"detail"`
+}
+
+// WorkOrderList is the jobs due on the machines by the end of a week
+type WorkOrderList struct {
+    WeekStart  string      `json:"week_start"`
+    WeekEnd    string      `json:"week_end"`
+    WorkOrders []WorkOrder `json:"work_orders"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceDue(t *testing.T) {
+    registered := time.Date(2024, 1, 10, 9, 0, 0, 0, ClinicLocation)
+    serviced := time.Date(2024, 3, 1, 9, 0, 0, 0, ClinicLocation)
+
+    tests := []struct {
+        name      string
+        machine   Machine
+        wantDate  string
+        wantHours float64
+    }{
+        {"defaults from registration", Machine{CreatedAt: registered}, "2024-07-08", DefaultMaintenanceIntervalHours},
+        {"own intervals", Machine{CreatedAt: registered, MaintenanceIntervalDays: 30, MaintenanceIntervalHours: 500}, "2024-02-09", 500},
+        {"clock restarts at the last visit", Machine{CreatedAt: registered, LastMaintenanceAt: &serviced, LastMaintenanceHours: 1200, MaintenanceIntervalDays: 90}, "2024-05-30", 3200},
+    }
+
+    for _, tt := range tests {
+        date, hours := tt.machine.MaintenanceDue()
+        if date != tt.wantDate || hours != tt.wantHours {
+            t.Errorf("%s: MaintenanceDue() = %s, %.0f, want %s, %.0f", tt.name, date, hours, tt.wantDate, tt.wantHours)
+        }
+    }
+}
+
+func TestMaintenanceOverdue(t *testing.T) {
+    registered := time.Date(2024, 1, 10, 9, 0, 0, 0, ClinicLocation)
+    machine := Machine{CreatedAt: registered, MaintenanceIntervalDays: 30, MaintenanceIntervalHours: 500}
+
+    if machine.MaintenanceOverdue("2024-02-09") {
+        t.Error("maintenance due today is reported overdue")
+    }
+    if !machine.MaintenanceOverdue("2024-02-10") {
+        t.Error("maintenance due yesterday is not reported overdue")
+    }
+    machine.Hours = 500
+    if !machine.MaintenanceOverdue("2024-01-20") {
+        t.Error("machine that has run its hours is not reported overdue")
+    }
+}
@@ -0,0 +1,92 @@
+package models
+
+import "time"
+
+// Routes a medication order may give
+const (
+    RouteIV   = "iv"
+    RouteSC   = "sc"
+    RouteOral = "oral"
+)
+
+// Routes lists the routes a medication order accepts
+var Routes = []string{RouteIV, RouteSC, RouteOral}
+
+// Medication order statuses. An order is stopped rather than deleted, so doses charted against it keep it.
+const (
+    OrderActive  = "active"
+    OrderStopped = "stopped"
+)
+
+// What became of a dose at a session. A dose held or refused needs a reason.
+const (
+    DoseGiven   = "given"
+    DoseHeld    = "held"
+    DoseRefused = "refused"
+)
+
+// MedicationOrder is a medication on a patient's list, prescribed by a member of staff. Dose is in DoseUnit,
+// e.g. 4000 units of epoetin alfa or 100 mg of iron sucrose, and Frequency says how often it is given, e.g.
+// "three times a week" or "every other session". The order runs from StartDate until EndDate, when set, or
+// until it is stopped.
+type MedicationOrder struct {
+    ID             int        `json:"id" bson:"order_id"`
+    PatientID      int        `json:"patient_id" bson:"patient_id"`
+    PatientName    string     `json:"patient_name" bson:"patient_name"`
+    Drug           string     `json:"drug" bson:"drug"`
+    Dose           float64    `json:"dose" bson:"dose"`
+    DoseUnit       string     `json:"dose_unit" bson:"dose_unit"`
+    Route          string     `json:"route" bson:"route"`
+    Frequency      string     `json:"frequency" bson:"frequency"`
+    PrescriberID   int        `json:"prescriber_id" bson:"prescriber_id"`
+    PrescriberName string     `json:"prescriber_name" bson:"prescriber_name"`
+    StartDate      string     `json:"start_date" bson:"start_date"`
+    EndDate        string     `json:"end_date,omitempty" bson:"end_date,omitempty"`
+    Status         string     `json:"status" bson:"status"`
+    Notes          string     `json:"notes,omitempty" bson:"notes,omitempty"`
+    StopReason     string     `json:"stop_reason,omitempty" bson:"stop_reason,omitempty"`
+    StoppedBy      int        `json:"stopped_by,omitempty" bson:"stopped_by,omitempty"`
+    StoppedAt      *time.Time `json:"stopped_at,omitempty" bson:"stopped_at,omitempty"`
+    CreatedBy      int        `json:"created_by,omitempty" bson:"created_by,omitempty"`
+    CreatedAt      time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// ActiveOn reports whether the order may be given on a date
+func (o *MedicationOrder) ActiveOn(date string) bool {
+    return o.Status == OrderActive && o.StartDate <= date && (o.EndDate == "" || date <= o.EndDate)
+}
+
+// MedicationAdministration is a dose charted at a dialysis session against a medication order: given, held
+// or refused. The drug, dose and route are copied from the order so the chart reads on its own.
+type MedicationAdministration struct {
+    ID            int       `json:"id" bson:"administration_id"`
+    AppointmentID int       `json:"appointment_id" bson:"appointment_id"`
+    OrderID       int       `json:"order_id" bson:"order_id"`
+    PatientID     int       `json:"patient_id" bson:"patient_id"`
+    PatientName   string    `json:"patient_name" bson:"patient_name"`
+    Date          string    `json:"date" bson:"date"`
+    Drug          string    `json:"drug" bson:"drug"`
+    Dose          float64   `json:"dose" bson:"dose"`
+    DoseUnit      string    `json:"dose_unit" bson:"dose_unit"`
+    Route         string    `json:"route" bson:"route"`
+    Outcome       string    `json:"outcome" bson:"outcome"`
+    Reason        string    `json:"reason,omitempty" bson:"reason,omitempty"`
+    At            time.Time `json:"at" bson:"at"`
+    RecordedBy    int       `json:"recorded_by,omitempty" bson:"recorded_by,omitempty"`
+    RecordedAt    time.Time `json:"recorded_at" bson:"recorded_at"`
+}
+
+// MedicationChartEntry is an order active on the day of a session and what was charted against it, if anything
+type MedicationChartEntry struct {
+    Order          MedicationOrder           `json:"order"`
+    Administration *MedicationAdministration `json:"administration,omitempty"`
+}
+
+// MedicationChart is the medication administration record of one session
+type MedicationChart struct {
+    AppointmentID int                    `json:"appointment_id"`
+    PatientID     int                    `json:"patient_id"`
+    PatientName   string                 `json:"patient_name"`
+    Date          string                 `json:"date"`
+    Entries       []MedicationChartEntry `json:"entries"`
+}
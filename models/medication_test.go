@@ -0,0 +1,29 @@
+package models
+
+import "testing"
+
+func TestMedicationOrderActiveOn(t *testing.T) {
+    tests := []struct {
+        name  string
+        order MedicationOrder
+        date  string
+        want  bool
+    }{
+        {"open ended, after start", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01"}, "2024-06-01", true},
+        {"on the start date", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01"}, "2024-03-01", true},
+        {"before the start date", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01"}, "2024-02-29", false},
+        {"within a course", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01", EndDate: "2024-03-31"}, "2024-03-15", true},
+        {"on the end date", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01", EndDate: "2024-03-31"}, "2024-03-31", true},
+        {"after the end date", MedicationOrder{Status: OrderActive, StartDate: "2024-03-01", EndDate: "2024-03-31"}, "2024-04-01", false},
+        {"stopped", MedicationOrder{Status: OrderStopped, StartDate: "2024-03-01"}, "2024-03-15", false},
+        {"no status", MedicationOrder{StartDate: "2024-03-01"}, "2024-03-15", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.order.ActiveOn(tt.date); got != tt.want {
+                t.Errorf("ActiveOn(%q) = %v, want %v", tt.date, got, tt.want)
+            }
+        })
+    }
+}
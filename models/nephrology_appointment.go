@@ -1,12 +1,38 @@
 package models
 
+import "time"
+
 type NephrologistAppointment struct {
-    ID        int    `json:"id" bson:"appointment_id"`
-    Date      string `json:"date" bson:"date"`
-    Time      string `json:"time" bson:"time"`
-    Status    string `json:"status" bson:"status"`
-    PatientID int    `json:"patient_id,omitempty" bson:"patient_id"`
-    StaffID   int    `json:"staff_id,omitempty" bson:"staff_id"`
-    StaffName string `json:"staff_name,omitempty" bson:"staff_name"`
-    PatientName string `json:"patient_name,omitempty" bson:"patient_name"`
-}
\ No newline at end of file
+    ID              int            `json:"id" bson:"appointment_id"`
+    Date            string         `json:"date" bson:"date"`
+    Time            string         `json:"time" bson:"time"`
+    StartsAt        time.Time      `json:"starts_at" bson:"starts_at"`
+    EndsAt          time.Time      `json:"ends_at" bson:"ends_at"`
+    DurationMinutes int            `json:"duration_minutes,omitempty" bson:"duration_minutes,omitempty"`
+    Status          string         `json:"status" bson:"status"`
+    PatientID       int            `json:"patient_id,omitempty" bson:"patient_id"`
+    StaffID         int            `json:"staff_id,omitempty" bson:"staff_id"`
+    StaffName       string         `json:"staff_name,omitempty" bson:"staff_name"`
+    PatientName     string         `json:"patient_name,omitempty" bson:"patient_name"`
+    StatusHistory   []StatusChange `json:"status_history,omitempty" bson:"status_history,omitempty"`
+    RescheduledFrom int            `json:"rescheduled_from,omitempty" bson:"rescheduled_from,omitempty"`
+    RescheduledTo   int            `json:"rescheduled_to,omitempty" bson:"rescheduled_to,omitempty"`
+}
+
+// ResolveTimes sets the start and end timestamps from the date, time and duration, or the date
+// and time from the start timestamp when only that was given
+func (a *NephrologistAppointment) ResolveTimes() error {
+    minutes := a.DurationMinutes
+    if minutes == 0 {
+        minutes = DefaultNephrologistMinutes
+    }
+    return resolveTimes(&a.Date, &a.Time, &a.StartsAt, &a.EndsAt, minutes)
+}
+
+// ClearServerFields drops the fields only the server sets, so a new appointment cannot arrive already
+// rescheduled or with a made-up history
+func (a *NephrologistAppointment) ClearServerFields() {
+    a.ID = 0
+    a.StatusHistory = nil
+    a.RescheduledFrom, a.RescheduledTo = 0, 0
+}
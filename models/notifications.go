@@ -1,12 +1,24 @@
 package models
 
+import "time"
+
+// AudienceCareTeam marks a notification meant for the staff looking after a patient rather than the patient
+const AudienceCareTeam = "care_team"
+
 type Notification struct {
-    ID          int    `json:"id" bson:"notification_id"`
-    Message     string `json:"message" bson:"message"`
-    SentDate    string `json:"sent_date" bson:"sent_date"`
-    SentTime    string `json:"sent_time" bson:"sent_time"`
-    AdminID     int    `json:"admin_id,omitempty" bson:"admin_id"`
-    AdminName   string `json:"admin_name,omitempty" bson:"admin_name"`
-    PatientID   int    `json:"patient_id,omitempty" bson:"patient_id"`
-    PatientName string `json:"patient_name,omitempty" bson:"patient_name"`
-}
\ No newline at end of file
+    ID          int       `json:"id" bson:"notification_id"`
+    Message     string    `json:"message" bson:"message"`
+    SentDate    string    `json:"sent_date" bson:"sent_date"`
+    SentTime    string    `json:"sent_time" bson:"sent_time"`
+    SentAt      time.Time `json:"sent_at" bson:"sent_at"`
+    AdminID     int       `json:"admin_id,omitempty" bson:"admin_id"`
+    AdminName   string    `json:"admin_name,omitempty" bson:"admin_name"`
+    PatientID   int       `json:"patient_id,omitempty" bson:"patient_id"`
+    PatientName string    `json:"patient_name,omitempty" bson:"patient_name"`
+    Audience    string    `json:"audience,omitempty" bson:"audience,omitempty"`
+}
+
+// ResolveTimes sets SentAt from the sent date and time, or the other way round, defaulting to now
+func (n *Notification) ResolveTimes() error {
+    return stampNow(&n.SentDate, &n.SentTime, &n.SentAt)
+}
@@ -1,15 +1,39 @@
 package models
 
 type Patient struct {
-    ID               int    `json:"id" bson:"patient_id"`
-    Name             string `json:"name" bson:"name"`
-    Address          string `json:"address" bson:"address"`
-    PhoneNumber      string `json:"phone_number" bson:"phone_number"`
-    DateOfBirth      string `json:"date_of_birth" bson:"date_of_birth"`
-    Gender           string `json:"gender" bson:"gender"`
-    EmergencyContact string `json:"emergency_contact" bson:"emergency_contact"`
-    PaymentDetailsID int    `json:"payment_details_id,omitempty" bson:"payment_details_id"`
-    PaymentName      string `json:"payment_name,omitempty" bson:"payment_name"`
-    Status           string `json:"status,omitempty" bson:"status"`
-    HistoryFile      string `json:"history_file,omitempty" bson:"history_file"`
-}
\ No newline at end of file
+    ID               int            `json:"id" bson:"patient_id"`
+    Name             string         `json:"name" bson:"name"`
+    Address          string         `json:"address" bson:"address"`
+    PhoneNumber      string         `json:"phone_number" bson:"phone_number"`
+    DateOfBirth      string         `json:"date_of_birth" bson:"date_of_birth"`
+    Gender           string         `json:"gender" bson:"gender"`
+    EmergencyContact string         `json:"emergency_contact" bson:"emergency_contact"`
+    PaymentDetailsID int            `json:"payment_details_id,omitempty" bson:"payment_details_id"`
+    PaymentName      string         `json:"payment_name,omitempty" bson:"payment_name"`
+    Status           string         `json:"status,omitempty" bson:"status"`
+    HistoryFile      string         `json:"history_file,omitempty" bson:"history_file"`
+    AdherenceFlagged bool           `json:"adherence_flagged,omitempty" bson:"adherence_flagged,omitempty"`
+    AdherenceFlags   []string       `json:"adherence_flags,omitempty" bson:"adherence_flags,omitempty"`
+    AdequacyFlagged  bool           `json:"adequacy_flagged,omitempty" bson:"adequacy_flagged,omitempty"`
+    AdequacyReviewID int            `json:"adequacy_review_id,omitempty" bson:"adequacy_review_id,omitempty"`
+    DialysisNeeds    *DialysisNeeds `json:"dialysis_needs,omitempty" bson:"dialysis_needs,omitempty"`
+    Serology         *Serology      `json:"serology,omitempty" bson:"serology,omitempty"`
+    // Clear names optional details an update should remove, since leaving them out keeps them as they are
+    Clear            []string       `json:"clear,omitempty" bson:"-"`
+}
+
+// IsolationGroup returns the isolation group the patient must dialyse in, "" for a standard station
+func (p *Patient) IsolationGroup() string {
+    return IsolationGroup(p.Serology, p.DialysisNeeds != nil && p.DialysisNeeds.Isolation)
+}
+
+// DialysisNeeds are what the chair planner needs to know to place a patient: how many sessions a week,
+// the shifts they prefer in order, whether they must dialyse in isolation and the hours their transport
+// can bring them in and take them home (HH:MM, empty for no limit)
+type DialysisNeeds struct {
+    SessionsPerWeek int      `json:"sessions_per_week" bson:"sessions_per_week"`
+    PreferredShifts []string `json:"preferred_shifts,omitempty" bson:"preferred_shifts,omitempty"`
+    Isolation       bool     `json:"isolation,omitempty" bson:"isolation,omitempty"`
+    ArriveFrom      string   `json:"arrive_from,omitempty" bson:"arrive_from,omitempty"`
+    LeaveBy         string   `json:"leave_by,omitempty" bson:"leave_by,omitempty"`
+}
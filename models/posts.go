@@ -1,11 +1,19 @@
 package models
 
+import "time"
+
 type Post struct {
-    ID       int    `json:"id" bson:"post_id"`
-    Title    string `json:"title" bson:"title"`
-    Content  string `json:"content" bson:"content"`
-    AdminID  int    `json:"admin_id,omitempty" bson:"admin_id"`
-    AdminName string `json:"admin_name,omitempty" bson:"admin_name"`
-    PostDate string `json:"post_date" bson:"post_date"`
-    PostTime string `json:"post_time" bson:"post_time"`
-}
\ No newline at end of file
+    ID        int       `json:"id" bson:"post_id"`
+    Title     string    `json:"title" bson:"title"`
+    Content   string    `json:"content" bson:"content"`
+    AdminID   int       `json:"admin_id,omitempty" bson:"admin_id"`
+    AdminName string    `json:"admin_name,omitempty" bson:"admin_name"`
+    PostDate  string    `json:"post_date" bson:"post_date"`
+    PostTime  string    `json:"post_time" bson:"post_time"`
+    PostedAt  time.Time `json:"posted_at" bson:"posted_at"`
+}
+
+// ResolveTimes sets PostedAt from the post date and time, or the other way round, defaulting to now
+func (p *Post) ResolveTimes() error {
+    return stampNow(&p.PostDate, &p.PostTime, &p.PostedAt)
+}
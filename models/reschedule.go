@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// RescheduleRequest moves an appointment to a new slot; a zero StationID keeps the current station
+type RescheduleRequest struct {
+    Date      string `json:"date"`
+    Time      string `json:"time"`
+    StationID int    `json:"station_id,omitempty"`
+    Reason    string `json:"reason"`
+}
+
+// RescheduleCount is how many appointments one account rescheduled
+type RescheduleCount struct {
+    ChangedBy int    `json:"changed_by"`
+    Role      string `json:"role"`
+    Count     int    `json:"count"`
+}
+
+// RescheduleReport counts the reschedules of one appointment type over a period, per account
+type RescheduleReport struct {
+    Type    string            `json:"type"`
+    From    time.Time         `json:"from,omitempty"`
+    To      time.Time         `json:"to,omitempty"`
+    Total   int               `json:"total"`
+    ByActor []RescheduleCount `json:"by_actor"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// RunSheet is the printed plan of the dialysis floor for one day, shift by shift and chair by chair
+type RunSheet struct {
+    Date        string          `json:"date"`
+    GeneratedAt time.Time       `json:"generated_at"`
+    Shifts      []RunSheetShift `json:"shifts"`
+}
+
+// RunSheetShift lists the chairs of one shift. Sessions without a chair come last with a zero StationID.
+type RunSheetShift struct {
+    Shift     string        `json:"shift"`
+    StartTime string        `json:"start_time"`
+    Rows      []RunSheetRow `json:"rows"`
+}
+
+// RunSheetRow is one chair in a shift and the session booked on it, if any
+type RunSheetRow struct {
+    StationID     int        `json:"station_id"`
+    Room          string     `json:"room,omitempty"`
+    Isolation     bool       `json:"isolation,omitempty"`
+    IsolationFor  string     `json:"isolation_for,omitempty"`
+    AppointmentID int        `json:"appointment_id,omitempty"`
+    Time          string     `json:"time,omitempty"`
+    PatientID     int        `json:"patient_id,omitempty"`
+    PatientName   string     `json:"patient_name,omitempty"`
+    StaffID       int        `json:"staff_id,omitempty"`
+    NurseName     string     `json:"nurse_name,omitempty"`
+    Status        string     `json:"status,omitempty"`
+    CheckedInAt   *time.Time `json:"checked_in_at,omitempty"`
+}
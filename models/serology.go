@@ -0,0 +1,110 @@
+package models
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Serology results
+const (
+    SerologyPositive = "positive"
+    SerologyNegative = "negative"
+    SerologyUnknown  = "unknown"
+)
+
+// Isolation groups. A patient in a group may only dialyse on a station isolated for that group, and
+// isolated stations are not used for anyone outside it. IsolationGeneral covers isolation stations with
+// no group set and patients flagged for isolation without a positive result.
+const (
+    IsolationHBV     = "hbv"
+    IsolationHCV     = "hcv"
+    IsolationHIV     = "hiv"
+    IsolationCOVID   = "covid"
+    IsolationGeneral = "isolation"
+)
+
+// IsolatedInfections are the infections that need a dedicated station, in the order they take precedence.
+// HCV and HIV are managed with standard precautions unless the unit isolates them too (ISOLATE_INFECTIONS).
+var IsolatedInfections = []string{IsolationHBV, IsolationCOVID}
+
+// SetIsolatedInfections sets IsolatedInfections from a comma separated list such as "hbv,covid,hcv"
+func SetIsolatedInfections(list string) {
+    infections := []string{}
+    for _, infection := range []string{IsolationHBV, IsolationCOVID, IsolationHCV, IsolationHIV} {
+        for _, listed := range strings.Split(list, ",") {
+            if strings.TrimSpace(strings.ToLower(listed)) == infection {
+                infections = append(infections, infection)
+            }
+        }
+    }
+    IsolatedInfections = infections
+}
+
+// Serology holds a patient's blood-borne virus and COVID-19 results and when they were last tested
+type Serology struct {
+    HBsAg    string `json:"hbsag,omitempty" bson:"hbsag,omitempty"`
+    AntiHCV  string `json:"anti_hcv,omitempty" bson:"anti_hcv,omitempty"`
+    HIV      string `json:"hiv,omitempty" bson:"hiv,omitempty"`
+    COVID19  string `json:"covid19,omitempty" bson:"covid19,omitempty"`
+    TestedOn string `json:"tested_on,omitempty" bson:"tested_on,omitempty"`
+}
+
+// Normalize lower-cases the results so "Positive" is read as positive, and rejects any result that is not
+// positive, negative or unknown. Results left out stay empty.
+func (s *Serology) Normalize() error {
+    for _, result := range []struct {
+        test  string
+        value *string
+    }{
+        {"hbsag", &s.HBsAg},
+        {"anti_hcv", &s.AntiHCV},
+        {"hiv", &s.HIV},
+        {"covid19", &s.COVID19},
+    } {
+        value := strings.ToLower(strings.TrimSpace(*result.value))
+        switch value {
+        case "", SerologyPositive, SerologyNegative, SerologyUnknown:
+            *result.value = value
+        default:
+            return fmt.Errorf("invalid %s result %q, expected %s, %s or %s", result.test, *result.value, SerologyPositive, SerologyNegative, SerologyUnknown)
+        }
+    }
+    return nil
+}
+
+// IsolationGroup returns the isolation group a patient's results put them in, or "" when they
+// dialyse on a standard station. flagged isolates a patient without a positive result.
+func IsolationGroup(serology *Serology, flagged bool) string {
+    if serology != nil {
+        results := map[string]string{
+            IsolationHBV:   serology.HBsAg,
+            IsolationHCV:   serology.AntiHCV,
+            IsolationHIV:   serology.HIV,
+            IsolationCOVID: serology.COVID19,
+        }
+        for _, infection := range IsolatedInfections {
+            // Results are normalized on every write, EqualFold covers those stored before they were
+            if strings.EqualFold(results[infection], SerologyPositive) {
+                return infection
+            }
+        }
+    }
+    if flagged {
+        return IsolationGeneral
+    }
+    return ""
+}
+
+// IsolationViolation is a booked dialysis session whose station does not match the patient's isolation group
+type IsolationViolation struct {
+    AppointmentID int    `json:"appointment_id"`
+    Date          string `json:"date"`
+    Shift         string `json:"shift"`
+    Status        string `json:"status"`
+    PatientID     int    `json:"patient_id"`
+    PatientName   string `json:"patient_name,omitempty"`
+    PatientGroup  string `json:"patient_group"`
+    StationID     int    `json:"station_id"`
+    StationGroup  string `json:"station_group"`
+    Problem       string `json:"problem"`
+}
@@ -0,0 +1,56 @@
+package models
+
+import "testing"
+
+func TestIsolationGroup(t *testing.T) {
+    defer SetIsolatedInfections("hbv,covid")
+
+    tests := []struct {
+        name     string
+        isolated string
+        serology *Serology
+        flagged  bool
+        want     string
+    }{
+        {"no results", "hbv,covid", nil, false, ""},
+        {"flagged without results", "hbv,covid", nil, true, IsolationGeneral},
+        {"all negative", "hbv,covid", &Serology{HBsAg: SerologyNegative, COVID19: SerologyNegative}, false, ""},
+        {"hepatitis B", "hbv,covid", &Serology{HBsAg: SerologyPositive}, true, IsolationHBV},
+        {"hepatitis B before COVID-19", "hbv,covid", &Serology{HBsAg: SerologyPositive, COVID19: SerologyPositive}, false, IsolationHBV},
+        {"hepatitis C under standard precautions", "hbv,covid", &Serology{AntiHCV: SerologyPositive}, false, ""},
+        {"hepatitis C isolated by the unit", "HBV, hcv", &Serology{AntiHCV: SerologyPositive}, false, IsolationHCV},
+        {"unknown result", "hbv,covid", &Serology{HBsAg: SerologyUnknown}, false, ""},
+    }
+
+    for _, tt := range tests {
+        SetIsolatedInfections(tt.isolated)
+        if got := IsolationGroup(tt.serology, tt.flagged); got != tt.want {
+            t.Errorf("%s: IsolationGroup() = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestSerologyNormalize(t *testing.T) {
+    tests := []struct {
+        name     string
+        serology Serology
+        want     Serology
+        wantErr  bool
+    }{
+        {"mixed case and spaces", Serology{HBsAg: " Positive", AntiHCV: "NEGATIVE"}, Serology{HBsAg: SerologyPositive, AntiHCV: SerologyNegative}, false},
+        {"results left out", Serology{HIV: "unknown"}, Serology{HIV: SerologyUnknown}, false},
+        {"misspelt result", Serology{HBsAg: "postive"}, Serology{}, true},
+        {"free text", Serology{COVID19: "reactive"}, Serology{}, true},
+    }
+
+    for _, tt := range tests {
+        err := tt.serology.Normalize()
+        if (err != nil) != tt.wantErr {
+            t.Errorf("%s: Normalize() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+            continue
+        }
+        if !tt.wantErr && tt.serology != tt.want {
+            t.Errorf("%s: Normalize() = %+v, want %+v", tt.name, tt.serology, tt.want)
+        }
+    }
+}
@@ -0,0 +1,29 @@
+package models
+
+// Station is a dialysis chair and the machine installed at it. An isolation station is dedicated to
+// the patients of one isolation group, IsolationFor, such as hbv.
+type Station struct {
+    ID            int    `json:"id" bson:"station_id"`
+    Room          string `json:"room" bson:"room"`
+    MachineSerial string `json:"machine_serial" bson:"machine_serial"`
+    Isolation     bool   `json:"isolation" bson:"isolation"`
+    IsolationFor  string `json:"isolation_for,omitempty" bson:"isolation_for,omitempty"`
+    Active        bool   `json:"active" bson:"active"`
+}
+
+// IsolationGroup returns the isolation group a station is dedicated to, "" for a standard station
+func (s Station) IsolationGroup() string {
+    switch {
+    case !s.Isolation:
+        return ""
+    case s.IsolationFor == "":
+        return IsolationGeneral
+    }
+    return s.IsolationFor
+}
+
+// StationOccupancy shows whether a station is booked for a shift and by which appointment
+type StationOccupancy struct {
+    Station     Station              `json:"station"`
+    Appointment *DialysisAppointment `json:"appointment,omitempty"`
+}
@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// DialysisPrescription is the treatment a visiting patient's home unit prescribed
+type DialysisPrescription struct {
+    SessionsPerWeek   int     `json:"sessions_per_week" bson:"sessions_per_week"`
+    DurationMinutes   int     `json:"duration_minutes" bson:"duration_minutes"`
+    Dialyzer          string  `json:"dialyzer,omitempty" bson:"dialyzer,omitempty"`
+    BloodFlowRate     int     `json:"blood_flow_rate,omitempty" bson:"blood_flow_rate,omitempty"`
+    DialysateFlowRate int     `json:"dialysate_flow_rate,omitempty" bson:"dialysate_flow_rate,omitempty"`
+    Anticoagulation   string  `json:"anticoagulation,omitempty" bson:"anticoagulation,omitempty"`
+    DryWeightKg       float64 `json:"dry_weight_kg,omitempty" bson:"dry_weight_kg,omitempty"`
+    Notes             string  `json:"notes,omitempty" bson:"notes,omitempty"`
+}
+
+// TransientPatient is a patient from another centre dialysing here for a visit. They share the ID space of
+// permanent patients so their appointments can be told apart, but are kept out of the patients collection.
+type TransientPatient struct {
+    ID                int                  `json:"id" bson:"patient_id"`
+    Name              string               `json:"name" bson:"name"`
+    PhoneNumber       string               `json:"phone_number" bson:"phone_number"`
+    DateOfBirth       string               `json:"date_of_birth,omitempty" bson:"date_of_birth,omitempty"`
+    Gender            string               `json:"gender,omitempty" bson:"gender,omitempty"`
+    HomeCentre        string               `json:"home_centre" bson:"home_centre"`
+    HomeCentreContact string               `json:"home_centre_contact,omitempty" bson:"home_centre_contact,omitempty"`
+    VisitFrom         string               `json:"visit_from" bson:"visit_from"`
+    VisitTo           string               `json:"visit_to" bson:"visit_to"`
+    Prescription      DialysisPrescription `json:"prescription" bson:"prescription"`
+    Isolation         bool                 `json:"isolation,omitempty" bson:"isolation,omitempty"`
+    Serology          *Serology            `json:"serology,omitempty" bson:"serology,omitempty"`
+    ReferralFolder    string               `json:"referral_folder,omitempty" bson:"referral_folder,omitempty"`
+    ReferralFiles     []string             `json:"referral_files,omitempty" bson:"referral_files,omitempty"`
+    CreatedAt         time.Time            `json:"created_at" bson:"created_at"`
+}
+
+// IsolationGroup returns the isolation group the visiting patient must dialyse in, "" for a standard station
+func (t *TransientPatient) IsolationGroup() string {
+    return IsolationGroup(t.Serology, t.Isolation)
+}
+
+// TransientBooking asks for a spare chair for a visiting patient on a date and shift.
+// A zero StationID takes the first spare station that suits them.
+type TransientBooking struct {
+    Date      string `json:"date"`
+    Shift     string `json:"shift"`
+    StationID int    `json:"station_id,omitempty"`
+}
+
+// SpareChair is a station free for a shift on a date
+type SpareChair struct {
+    Date    string  `json:"date"`
+    Shift   string  `json:"shift"`
+    Station Station `json:"station"`
+}
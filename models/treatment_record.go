@@ -0,0 +1,82 @@
+package models
+
+import "time"
+
+// Complications commonly recorded during haemodialysis
+const (
+    ComplicationHypotension = "hypotension"
+    ComplicationCramps      = "cramps"
+    ComplicationNausea      = "nausea"
+    ComplicationHeadache    = "headache"
+    ComplicationChestPain   = "chest_pain"
+    ComplicationClotting    = "clotting"
+    ComplicationAccess      = "access_problem"
+    ComplicationOther       = "other"
+)
+
+// Complications lists the complication kinds a treatment record accepts
+var Complications = []string{
+    ComplicationHypotension, ComplicationCramps, ComplicationNausea, ComplicationHeadache,
+    ComplicationChestPain, ComplicationClotting, ComplicationAccess, ComplicationOther,
+}
+
+// Observation is a set of readings taken at one point of a session. Flow rates are in ml/min.
+type Observation struct {
+    At                time.Time `json:"at" bson:"at"`
+    SystolicBP        int       `json:"systolic_bp,omitempty" bson:"systolic_bp,omitempty"`
+    DiastolicBP       int       `json:"diastolic_bp,omitempty" bson:"diastolic_bp,omitempty"`
+    Pulse             int       `json:"pulse,omitempty" bson:"pulse,omitempty"`
+    BloodFlowRate     int       `json:"blood_flow_rate,omitempty" bson:"blood_flow_rate,omitempty"`
+    DialysateFlowRate int       `json:"dialysate_flow_rate,omitempty" bson:"dialysate_flow_rate,omitempty"`
+    RecordedBy        int       `json:"recorded_by,omitempty" bson:"recorded_by,omitempty"`
+    Notes             string    `json:"notes,omitempty" bson:"notes,omitempty"`
+    LateEntry         bool      `json:"late_entry,omitempty" bson:"late_entry,omitempty"`
+}
+
+// Complication is something that went wrong during a session and what was done about it
+type Complication struct {
+    At          time.Time `json:"at" bson:"at"`
+    Kind        string    `json:"kind" bson:"kind"`
+    Description string    `json:"description,omitempty" bson:"description,omitempty"`
+    Action      string    `json:"action,omitempty" bson:"action,omitempty"`
+    RecordedBy  int       `json:"recorded_by,omitempty" bson:"recorded_by,omitempty"`
+    LateEntry   bool      `json:"late_entry,omitempty" bson:"late_entry,omitempty"`
+}
+
+// TreatmentRecord is the flowsheet of one dialysis session: weights and vitals before and after, the readings
+// taken during it, the ultrafiltration goal and what was achieved (ml), the dialyzer, the heparin given
+// (units) and any complications. There is at most one per appointment. Once pre and post dialysis urea are
+// in, the adequacy of the session is worked out from them; TreatmentMinutes is the time actually dialysed.
+// WeightGain is the fluid put on since the patient's previous session. Readings and complications added once
+// the session was completed are marked as late entries, and AmendedAt records the last change to the record
+// made after then.
+type TreatmentRecord struct {
+    ID                 int            `json:"id" bson:"record_id"`
+    AppointmentID      int            `json:"appointment_id" bson:"appointment_id"`
+    PatientID          int            `json:"patient_id" bson:"patient_id"`
+    PatientName        string         `json:"patient_name" bson:"patient_name"`
+    Date               string         `json:"date" bson:"date"`
+    StationID          int            `json:"station_id,omitempty" bson:"station_id,omitempty"`
+    PreWeightKg        float64        `json:"pre_weight_kg,omitempty" bson:"pre_weight_kg,omitempty"`
+    PostWeightKg       float64        `json:"post_weight_kg,omitempty" bson:"post_weight_kg,omitempty"`
+    PreVitals          *Observation   `json:"pre_vitals,omitempty" bson:"pre_vitals,omitempty"`
+    PostVitals         *Observation   `json:"post_vitals,omitempty" bson:"post_vitals,omitempty"`
+    Observations       []Observation  `json:"observations" bson:"observations"`
+    UFGoalMl           float64        `json:"uf_goal_ml,omitempty" bson:"uf_goal_ml,omitempty"`
+    UFAchievedMl       float64        `json:"uf_achieved_ml,omitempty" bson:"uf_achieved_ml,omitempty"`
+    Dialyzer           string         `json:"dialyzer,omitempty" bson:"dialyzer,omitempty"`
+    HeparinBolusUnits  float64        `json:"heparin_bolus_units,omitempty" bson:"heparin_bolus_units,omitempty"`
+    HeparinHourlyUnits float64        `json:"heparin_hourly_units,omitempty" bson:"heparin_hourly_units,omitempty"`
+    Complications      []Complication `json:"complications" bson:"complications"`
+    PreUrea            float64        `json:"pre_urea,omitempty" bson:"pre_urea,omitempty"`
+    PostUrea           float64        `json:"post_urea,omitempty" bson:"post_urea,omitempty"`
+    TreatmentMinutes   int            `json:"treatment_minutes,omitempty" bson:"treatment_minutes,omitempty"`
+    Adequacy           *Adequacy      `json:"adequacy,omitempty" bson:"adequacy,omitempty"`
+    WeightGain         *WeightGain    `json:"weight_gain,omitempty" bson:"weight_gain,omitempty"`
+    Notes              string         `json:"notes,omitempty" bson:"notes,omitempty"`
+    CreatedBy          int            `json:"created_by,omitempty" bson:"created_by,omitempty"`
+    CreatedAt          time.Time      `json:"created_at" bson:"created_at"`
+    UpdatedBy          int            `json:"updated_by,omitempty" bson:"updated_by,omitempty"`
+    UpdatedAt          time.Time      `json:"updated_at" bson:"updated_at"`
+    AmendedAt          *time.Time     `json:"amended_at,omitempty" bson:"amended_at,omitempty"`
+}
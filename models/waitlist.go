@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// Waitlist entry statuses
+const (
+    WaitlistWaiting   = "waiting"
+    WaitlistOffered   = "offered"
+    WaitlistBooked    = "booked"
+    WaitlistWithdrawn = "withdrawn"
+)
+
+// Slot offer statuses. An offer is unavailable when it was accepted but the slot could no longer be booked.
+const (
+    OfferOpen        = "open"
+    OfferAccepted    = "accepted"
+    OfferDeclined    = "declined"
+    OfferExpired     = "expired"
+    OfferUnavailable = "unavailable"
+)
+
+// WaitlistEntry queues a patient for an earlier slot of a type within a date window.
+// Higher priorities are offered first, ties go to whoever joined first.
+type WaitlistEntry struct {
+    ID          int       `json:"id" bson:"waitlist_id"`
+    PatientID   int       `json:"patient_id" bson:"patient_id"`
+    PatientName string    `json:"patient_name,omitempty" bson:"patient_name"`
+    Type        string    `json:"type" bson:"type"`
+    StaffID     int       `json:"staff_id,omitempty" bson:"staff_id,omitempty"`
+    Shift       string    `json:"shift,omitempty" bson:"shift,omitempty"`
+    From        string    `json:"from" bson:"from"`
+    To          string    `json:"to" bson:"to"`
+    Priority    int       `json:"priority" bson:"priority"`
+    Status      string    `json:"status" bson:"status"`
+    CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+// SlotOffer is a freed slot offered to a waitlisted patient until it expires
+type SlotOffer struct {
+    ID                 int        `json:"id" bson:"offer_id"`
+    WaitlistID         int        `json:"waitlist_id" bson:"waitlist_id"`
+    PatientID          int        `json:"patient_id" bson:"patient_id"`
+    PatientName        string     `json:"patient_name,omitempty" bson:"patient_name"`
+    Type               string     `json:"type" bson:"type"`
+    Date               string     `json:"date" bson:"date"`
+    Time               string     `json:"time" bson:"time"`
+    DurationMinutes    int        `json:"duration_minutes,omitempty" bson:"duration_minutes,omitempty"`
+    StaffID            int        `json:"staff_id,omitempty" bson:"staff_id,omitempty"`
+    StaffName          string     `json:"staff_name,omitempty" bson:"staff_name,omitempty"`
+    StationID          int        `json:"station_id,omitempty" bson:"station_id,omitempty"`
+    Shift              string     `json:"shift,omitempty" bson:"shift,omitempty"`
+    FreedAppointmentID int        `json:"freed_appointment_id" bson:"freed_appointment_id"`
+    Status             string     `json:"status" bson:"status"`
+    OfferedAt          time.Time  `json:"offered_at" bson:"offered_at"`
+    ExpiresAt          time.Time  `json:"expires_at" bson:"expires_at"`
+    RespondedAt        *time.Time `json:"responded_at,omitempty" bson:"responded_at,omitempty"`
+    AppointmentID      int        `json:"appointment_id,omitempty" bson:"appointment_id,omitempty"`
+}
@@ -0,0 +1,434 @@
+// Package scheduler builds a weekly dialysis chair plan from patients' needs and the stations available.
+// It works on plain values and never touches the database, so a plan can be built and looked over
+// offline before any of it is booked through the DialysisGateway.
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+// ClinicDays are the weekdays the unit dialyses on
+var ClinicDays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+
+// Patient is someone to place in the plan. BookedDates are the days they already have a session
+// booked that week; those sessions stay and count towards the weekly total. Group is the patient's
+// isolation group, empty when they need none.
+type Patient struct {
+    ID          int
+    Name        string
+    Needs       models.DialysisNeeds
+    Group       string
+    BookedDates []string
+}
+
+// Station is a chair that can be planned, Group being the isolation group it is kept for
+type Station struct {
+    ID    int
+    Group string
+}
+
+// Booking is a station already taken for a shift on a date
+type Booking struct {
+    Date      string
+    Shift     string
+    StationID int
+}
+
+// Input is everything a plan is built from. WeekStart is the Monday of the week to plan,
+// nothing is planned on the Closed dates.
+type Input struct {
+    WeekStart      time.Time
+    SessionMinutes int
+    Patients       []Patient
+    Stations       []Station
+    Taken          []Booking
+    Closed         []string
+}
+
+// Session is one planned dialysis session
+type Session struct {
+    Date      string `json:"date"`
+    StationID int    `json:"station_id"`
+}
+
+// Assignment places a patient on a shift for the week. Preferred is false when none of the
+// patient's preferred shifts had room.
+type Assignment struct {
+    PatientID   int       `json:"patient_id"`
+    PatientName string    `json:"patient_name,omitempty"`
+    Shift       string    `json:"shift"`
+    Sessions    []Session `json:"sessions"`
+    Preferred   bool      `json:"preferred"`
+}
+
+// Unplaced is a patient the plan has no room for, and why
+type Unplaced struct {
+    PatientID   int    `json:"patient_id"`
+    PatientName string `json:"patient_name,omitempty"`
+    Reason      string `json:"reason"`
+}
+
+// Plan is a conflict-free weekly assignment of patients to shifts and stations. Version identifies the
+// sessions it books, so booking a plan can make sure it is still the one that was previewed.
+type Plan struct {
+    WeekStart        string       `json:"week_start"`
+    Version          string       `json:"version"`
+    SessionMinutes   int          `json:"session_minutes"`
+    Assignments      []Assignment `json:"assignments"`
+    Unplaced         []Unplaced   `json:"unplaced"`
+    AlreadyScheduled []int        `json:"already_scheduled"`
+}
+
+// Appointments turns the plan into the dialysis appointments that book it
+func (p *Plan) Appointments() []models.DialysisAppointment {
+    appointments := []models.DialysisAppointment{}
+    for _, assignment := range p.Assignments {
+        for _, session := range assignment.Sessions {
+            appointments = append(appointments, models.DialysisAppointment{
+                Date:            session.Date,
+                Time:            models.ShiftStartTimes[assignment.Shift],
+                DurationMinutes: p.SessionMinutes,
+                PatientID:       assignment.PatientID,
+                PatientName:     assignment.PatientName,
+                Shift:           assignment.Shift,
+                StationID:       session.StationID,
+            })
+        }
+    }
+    return appointments
+}
+
+// candidate is a patient with what the planner worked out about them
+type candidate struct {
+    Patient
+    needed   int
+    shifts   []string
+    stations []Station
+    booked   map[time.Weekday]bool
+    closed   map[time.Weekday]bool
+    reason   string
+}
+
+// Build places the patients who are hardest to fit first: those needing isolation, then those whose
+// transport leaves the fewest shifts, then those needing the most sessions. Each patient gets the most
+// evenly spaced days on their most preferred shift that has room, on one station for the whole week
+// where possible. The same input always gives the same plan.
+func Build(input Input) *Plan {
+    if input.SessionMinutes <= 0 {
+        input.SessionMinutes = models.DefaultDialysisMinutes
+    }
+    plan := &Plan{
+        WeekStart:        input.WeekStart.Format(models.DateLayout),
+        SessionMinutes:   input.SessionMinutes,
+        Assignments:      []Assignment{},
+        Unplaced:         []Unplaced{},
+        AlreadyScheduled: []int{},
+    }
+
+    taken := map[string]bool{}
+    for _, booking := range input.Taken {
+        taken[slotKey(booking.Date, booking.Shift, booking.StationID)] = true
+    }
+    closed := map[time.Weekday]bool{}
+    for _, date := range input.Closed {
+        if day, err := time.Parse(models.DateLayout, date); err == nil {
+            closed[day.Weekday()] = true
+        }
+    }
+
+    candidates := []candidate{}
+    for _, patient := range input.Patients {
+        c := prepare(patient, input, closed)
+        switch {
+        case c.reason != "":
+            plan.Unplaced = append(plan.Unplaced, Unplaced{PatientID: patient.ID, PatientName: patient.Name, Reason: c.reason})
+        case c.needed <= 0:
+            plan.AlreadyScheduled = append(plan.AlreadyScheduled, patient.ID)
+        default:
+            candidates = append(candidates, c)
+        }
+    }
+
+    sort.SliceStable(candidates, func(i, j int) bool {
+        a, b := candidates[i], candidates[j]
+        if (a.Group != "") != (b.Group != "") {
+            return a.Group != ""
+        }
+        if len(a.shifts) != len(b.shifts) {
+            return len(a.shifts) < len(b.shifts)
+        }
+        if a.needed != b.needed {
+            return a.needed > b.needed
+        }
+        return a.ID < b.ID
+    })
+
+    for _, c := range candidates {
+        assignment, ok := place(c, input.WeekStart, taken)
+        if !ok {
+            plan.Unplaced = append(plan.Unplaced, Unplaced{PatientID: c.ID, PatientName: c.Name, Reason: noRoomReason(c)})
+            continue
+        }
+        for _, session := range assignment.Sessions {
+            taken[slotKey(session.Date, assignment.Shift, session.StationID)] = true
+        }
+        plan.Assignments = append(plan.Assignments, assignment)
+    }
+    plan.Version = plan.version()
+    return plan
+}
+
+// version hashes every session the plan books, in order
+func (p *Plan) version() string {
+    hash := sha256.New()
+    fmt.Fprintf(hash, "%s %d\n", p.WeekStart, p.SessionMinutes)
+    for _, assignment := range p.Assignments {
+        for _, session := range assignment.Sessions {
+            fmt.Fprintf(hash, "%d %s %s %d\n", assignment.PatientID, assignment.Shift, session.Date, session.StationID)
+        }
+    }
+    return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// prepare works out how many sessions a patient still needs and which days, shifts and stations can take them,
+// or the reason they cannot be planned at all
+func prepare(patient Patient, input Input, closed map[time.Weekday]bool) candidate {
+    c := candidate{Patient: patient, booked: map[time.Weekday]bool{}, closed: closed}
+    for _, date := range patient.BookedDates {
+        if day, err := time.Parse(models.DateLayout, date); err == nil {
+            c.booked[day.Weekday()] = true
+        }
+    }
+
+    if patient.Needs.SessionsPerWeek <= 0 {
+        c.reason = "no sessions per week are set on the patient"
+        return c
+    }
+    c.needed = patient.Needs.SessionsPerWeek - len(c.booked)
+    if c.needed <= 0 {
+        return c
+    }
+    free := 0
+    for _, day := range ClinicDays {
+        if !c.booked[day] && !closed[day] {
+            free++
+        }
+    }
+    if c.needed > free {
+        c.reason = fmt.Sprintf("needs %d more sessions but only %d clinic days are free this week", c.needed, free)
+        return c
+    }
+
+    c.shifts = feasibleShifts(patient.Needs, input.SessionMinutes)
+    if len(c.shifts) == 0 {
+        c.reason = fmt.Sprintf("no shift fits the transport window %s", transportWindow(patient.Needs))
+        return c
+    }
+
+    for _, station := range input.Stations {
+        if station.Group == patient.Group {
+            c.stations = append(c.stations, station)
+        }
+    }
+    if len(c.stations) == 0 {
+        c.reason = "there is no active station " + stationKind(patient.Group)
+    }
+    return c
+}
+
+// place finds room for a candidate, trying shifts in order of preference. On each shift one station
+// for the whole week is preferred over moving the patient between stations.
+func place(c candidate, weekStart time.Time, taken map[string]bool) (Assignment, bool) {
+    daySets := daySets(c.needed, c.booked, c.closed)
+    preferred := map[string]bool{}
+    for _, shift := range c.Needs.PreferredShifts {
+        preferred[shift] = true
+    }
+
+    for _, shift := range c.shifts {
+        for _, sameStation := range []bool{true, false} {
+            for _, days := range daySets {
+                dates := make([]string, len(days))
+                for i, day := range days {
+                    dates[i] = weekStart.AddDate(0, 0, int(day-time.Monday)).Format(models.DateLayout)
+                }
+                if sessions, ok := seat(c.stations, dates, shift, sameStation, taken); ok {
+                    return Assignment{
+                        PatientID:   c.ID,
+                        PatientName: c.Name,
+                        Shift:       shift,
+                        Sessions:    sessions,
+                        Preferred:   len(preferred) == 0 || preferred[shift],
+                    }, true
+                }
+            }
+        }
+    }
+    return Assignment{}, false
+}
+
+// seat picks a free station on each date, the same one on every date when sameStation is set
+func seat(stations []Station, dates []string, shift string, sameStation bool, taken map[string]bool) ([]Session, bool) {
+    if sameStation {
+        for _, station := range stations {
+            free := true
+            for _, date := range dates {
+                if taken[slotKey(date, shift, station.ID)] {
+                    free = false
+                    break
+                }
+            }
+            if free {
+                sessions := make([]Session, len(dates))
+                for i, date := range dates {
+                    sessions[i] = Session{Date: date, StationID: station.ID}
+                }
+                return sessions, true
+            }
+        }
+        return nil, false
+    }
+
+    sessions := []Session{}
+    for _, date := range dates {
+        found := false
+        for _, station := range stations {
+            if !taken[slotKey(date, shift, station.ID)] {
+                sessions = append(sessions, Session{Date: date, StationID: station.ID})
+                found = true
+                break
+            }
+        }
+        if !found {
+            return nil, false
+        }
+    }
+    return sessions, true
+}
+
+// feasibleShifts lists the shifts a patient's transport allows, preferred ones first in their order
+func feasibleShifts(needs models.DialysisNeeds, minutes int) []string {
+    ordered := []string{}
+    seen := map[string]bool{}
+    for _, shift := range append(append([]string{}, needs.PreferredShifts...), models.ShiftOrder...) {
+        if _, ok := models.ShiftStartTimes[shift]; !ok || seen[shift] {
+            continue
+        }
+        seen[shift] = true
+        if fitsTransport(needs, shift, minutes) {
+            ordered = append(ordered, shift)
+        }
+    }
+    return ordered
+}
+
+// fitsTransport reports whether a session on shift starts after the patient can arrive and ends before they must leave
+func fitsTransport(needs models.DialysisNeeds, shift string, minutes int) bool {
+    start, err := time.Parse(models.ClockLayout, models.ShiftStartTimes[shift])
+    if err != nil {
+        return false
+    }
+    if needs.ArriveFrom != "" {
+        if from, err := time.Parse(models.ClockLayout, needs.ArriveFrom); err == nil && start.Before(from) {
+            return false
+        }
+    }
+    if needs.LeaveBy != "" {
+        if until, err := time.Parse(models.ClockLayout, needs.LeaveBy); err == nil && start.Add(time.Duration(minutes)*time.Minute).After(until) {
+            return false
+        }
+    }
+    return true
+}
+
+// daySets lists every choice of n free clinic days, most evenly spaced across the week first.
+// Days already booked count towards the spacing, closed days are left out.
+func daySets(n int, booked, closed map[time.Weekday]bool) [][]time.Weekday {
+    free := []time.Weekday{}
+    for _, day := range ClinicDays {
+        if !booked[day] && !closed[day] {
+            free = append(free, day)
+        }
+    }
+
+    sets := [][]time.Weekday{}
+    var choose func(start int, chosen []time.Weekday)
+    choose = func(start int, chosen []time.Weekday) {
+        if len(chosen) == n {
+            sets = append(sets, append([]time.Weekday{}, chosen...))
+            return
+        }
+        for i := start; i < len(free); i++ {
+            choose(i+1, append(chosen, free[i]))
+        }
+    }
+    choose(0, nil)
+
+    sort.SliceStable(sets, func(i, j int) bool {
+        longestI, spreadI := gaps(sets[i], booked)
+        longestJ, spreadJ := gaps(sets[j], booked)
+        if longestI != longestJ {
+            return longestI < longestJ
+        }
+        return spreadI < spreadJ
+    })
+    return sets
+}
+
+// gaps measures the days between sessions, wrapping round into the next week. It returns the longest gap
+// and the sum of the squared gaps, which is smallest when the sessions are spread evenly.
+func gaps(days []time.Weekday, booked map[time.Weekday]bool) (int, int) {
+    all := append([]time.Weekday{}, days...)
+    for day := range booked {
+        all = append(all, day)
+    }
+    sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+    longest, spread := 0, 0
+    for i := range all {
+        gap := int(all[0]) + 7 - int(all[len(all)-1])
+        if i > 0 {
+            gap = int(all[i] - all[i-1])
+        }
+        if gap > longest {
+            longest = gap
+        }
+        spread += gap * gap
+    }
+    return longest, spread
+}
+
+// noRoomReason explains why a patient who could in principle be planned did not fit
+func noRoomReason(c candidate) string {
+    return fmt.Sprintf("every station %s is taken on the %s shift(s) for any %d-session pattern",
+        stationKind(c.Group), strings.Join(c.shifts, ", "), c.needed)
+}
+
+func stationKind(group string) string {
+    if group != "" {
+        return "in " + group + " isolation"
+    }
+    return "outside isolation"
+}
+
+func transportWindow(needs models.DialysisNeeds) string {
+    from, until := needs.ArriveFrom, needs.LeaveBy
+    if from == "" {
+        from = "any time"
+    }
+    if until == "" {
+        until = "any time"
+    }
+    return from + " to " + until
+}
+
+func slotKey(date, shift string, stationID int) string {
+    return fmt.Sprintf("%s|%s|%d", date, shift, stationID)
+}
@@ -0,0 +1,308 @@
+package scheduler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrianKasina/dialysis-scheduling/models"
+)
+
+// weekStart is a Monday
+var weekStart = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFeasibleShifts(t *testing.T) {
+    tests := []struct {
+        name    string
+        needs   models.DialysisNeeds
+        minutes int
+        want    []string
+    }{
+        {"no transport window", models.DialysisNeeds{}, 240, []string{"morning", "afternoon", "evening"}},
+        {"preferred shifts first", models.DialysisNeeds{PreferredShifts: []string{"evening"}}, 240, []string{"evening", "morning", "afternoon"}},
+        {"unknown preferred shift ignored", models.DialysisNeeds{PreferredShifts: []string{"night"}}, 240, []string{"morning", "afternoon", "evening"}},
+        {"arrives late morning", models.DialysisNeeds{ArriveFrom: "10:00"}, 240, []string{"afternoon", "evening"}},
+        {"must leave early afternoon", models.DialysisNeeds{LeaveBy: "14:00"}, 240, []string{"morning"}},
+        {"session ending exactly at leave time fits", models.DialysisNeeds{LeaveBy: "15:00"}, 240, []string{"morning", "afternoon"}},
+        {"longer session no longer fits", models.DialysisNeeds{LeaveBy: "15:00"}, 300, []string{"morning"}},
+        {"window too narrow for any shift", models.DialysisNeeds{ArriveFrom: "07:00", LeaveBy: "12:00"}, 240, []string{}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := feasibleShifts(tt.needs, tt.minutes)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("feasibleShifts() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestBuild(t *testing.T) {
+    threeAWeek := models.DialysisNeeds{SessionsPerWeek: 3}
+    mornings := models.DialysisNeeds{SessionsPerWeek: 3, LeaveBy: "10:00"}
+
+    tests := []struct {
+        name      string
+        input     Input
+        shifts    map[int]string   // shift each placed patient should be on
+        stations  map[int]int      // station each placed patient should sit at all week
+        dates     map[int][]string // session dates expected for a placed patient
+        unplaced  map[int]string   // reason, or part of it, for each patient left out
+        scheduled []int
+    }{
+        {
+            name: "evenly spaced days on one station",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: threeAWeek}},
+                Stations:  []Station{{ID: 10}},
+            },
+            shifts:   map[int]string{1: "morning"},
+            stations: map[int]int{1: 10},
+            dates:    map[int][]string{1: {"2024-01-01", "2024-01-03", "2024-01-05"}},
+        },
+        {
+            name: "preferred shift with room is used",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: models.DialysisNeeds{SessionsPerWeek: 3, PreferredShifts: []string{"evening"}}}},
+                Stations:  []Station{{ID: 10}},
+            },
+            shifts: map[int]string{1: "evening"},
+        },
+        {
+            name: "transport window picks the shift",
+            input: Input{
+                WeekStart: weekStart,
+                Patients: []Patient{
+                    {ID: 1, Needs: models.DialysisNeeds{SessionsPerWeek: 3, ArriveFrom: "10:00", LeaveBy: "16:00"}},
+                    {ID: 2, Needs: models.DialysisNeeds{SessionsPerWeek: 3, ArriveFrom: "15:00"}},
+                },
+                Stations: []Station{{ID: 10}},
+            },
+            shifts: map[int]string{1: "afternoon", 2: "evening"},
+        },
+        {
+            name: "no shift fits the transport window",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: models.DialysisNeeds{SessionsPerWeek: 3, ArriveFrom: "07:00", LeaveBy: "12:00"}}},
+                Stations:  []Station{{ID: 10}},
+            },
+            unplaced: map[int]string{1: "transport window 07:00 to 12:00"},
+        },
+        {
+            name: "isolated patient seated in their group",
+            input: Input{
+                WeekStart: weekStart,
+                Patients: []Patient{
+                    {ID: 1, Needs: threeAWeek},
+                    {ID: 2, Needs: threeAWeek, Group: "hbv"},
+                },
+                Stations: []Station{{ID: 10}, {ID: 11, Group: "hbv"}},
+            },
+            shifts:   map[int]string{1: "morning", 2: "morning"},
+            stations: map[int]int{1: 10, 2: 11},
+        },
+        {
+            name: "isolated patient without a station of their group",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: threeAWeek, Group: "hcv"}},
+                Stations:  []Station{{ID: 10}, {ID: 11, Group: "hbv"}},
+            },
+            unplaced: map[int]string{1: "no active station in hcv isolation"},
+        },
+        {
+            name: "patient without isolation kept off isolation stations",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: threeAWeek}},
+                Stations:  []Station{{ID: 11, Group: "hbv"}},
+            },
+            unplaced: map[int]string{1: "no active station outside isolation"},
+        },
+        {
+            name: "capacity overflow reported as unplaced",
+            input: Input{
+                WeekStart: weekStart,
+                Patients: []Patient{
+                    {ID: 1, Needs: mornings},
+                    {ID: 2, Needs: mornings},
+                    {ID: 3, Needs: mornings},
+                },
+                Stations: []Station{{ID: 10}},
+            },
+            shifts:   map[int]string{1: "morning", 2: "morning"},
+            dates:    map[int][]string{1: {"2024-01-01", "2024-01-03", "2024-01-05"}, 2: {"2024-01-02", "2024-01-04", "2024-01-06"}},
+            unplaced: map[int]string{3: "every station outside isolation is taken on the morning shift(s)"},
+        },
+        {
+            name: "taken stations are not planned over",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: mornings}},
+                Stations:  []Station{{ID: 10}, {ID: 11}},
+                Taken:     []Booking{{Date: "2024-01-03", Shift: "morning", StationID: 10}},
+            },
+            shifts:   map[int]string{1: "morning"},
+            stations: map[int]int{1: 11},
+        },
+        {
+            name: "closed days are skipped",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: threeAWeek}},
+                Stations:  []Station{{ID: 10}},
+                Closed:    []string{"2024-01-01"},
+            },
+            dates: map[int][]string{1: {"2024-01-02", "2024-01-04", "2024-01-06"}},
+        },
+        {
+            name: "booked sessions count towards the week",
+            input: Input{
+                WeekStart: weekStart,
+                Patients: []Patient{
+                    {ID: 1, Needs: threeAWeek, BookedDates: []string{"2024-01-01", "2024-01-03", "2024-01-05"}},
+                    {ID: 2, Needs: threeAWeek, BookedDates: []string{"2024-01-01", "2024-01-03"}},
+                },
+                Stations: []Station{{ID: 10}},
+            },
+            dates:     map[int][]string{2: {"2024-01-05"}},
+            scheduled: []int{1},
+        },
+        {
+            name: "too few free days",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1, Needs: models.DialysisNeeds{SessionsPerWeek: 4}}},
+                Stations:  []Station{{ID: 10}},
+                Closed:    []string{"2024-01-01", "2024-01-02", "2024-01-03"},
+            },
+            unplaced: map[int]string{1: "needs 4 more sessions but only 3 clinic days are free"},
+        },
+        {
+            name: "sessions per week not set",
+            input: Input{
+                WeekStart: weekStart,
+                Patients:  []Patient{{ID: 1}},
+                Stations:  []Station{{ID: 10}},
+            },
+            unplaced: map[int]string{1: "no sessions per week"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            plan := Build(tt.input)
+            if !reflect.DeepEqual(plan, Build(tt.input)) {
+                t.Fatal("Build() gave different plans for the same input")
+            }
+
+            placed := map[int]Assignment{}
+            used := map[string]bool{}
+            for _, booking := range tt.input.Taken {
+                used[slotKey(booking.Date, booking.Shift, booking.StationID)] = true
+            }
+            for _, assignment := range plan.Assignments {
+                placed[assignment.PatientID] = assignment
+                for _, session := range assignment.Sessions {
+                    key := slotKey(session.Date, assignment.Shift, session.StationID)
+                    if used[key] {
+                        t.Errorf("station %d on %s %s is planned twice", session.StationID, session.Date, assignment.Shift)
+                    }
+                    used[key] = true
+                }
+            }
+
+            for id, shift := range tt.shifts {
+                if got, ok := placed[id]; !ok || got.Shift != shift {
+                    t.Errorf("patient %d shift = %q, want %q", id, got.Shift, shift)
+                }
+            }
+            for id, stationID := range tt.stations {
+                for _, session := range placed[id].Sessions {
+                    if session.StationID != stationID {
+                        t.Errorf("patient %d seated at station %d on %s, want %d", id, session.StationID, session.Date, stationID)
+                    }
+                }
+            }
+            for id, want := range tt.dates {
+                got := []string{}
+                for _, session := range placed[id].Sessions {
+                    got = append(got, session.Date)
+                }
+                if !reflect.DeepEqual(got, want) {
+                    t.Errorf("patient %d dates = %v, want %v", id, got, want)
+                }
+            }
+
+            if len(plan.Unplaced) != len(tt.unplaced) {
+                t.Errorf("Build() left %d patients unplaced, want %d: %+v", len(plan.Unplaced), len(tt.unplaced), plan.Unplaced)
+            }
+            for _, unplaced := range plan.Unplaced {
+                want, ok := tt.unplaced[unplaced.PatientID]
+                if !ok {
+                    t.Errorf("patient %d unexpectedly unplaced: %s", unplaced.PatientID, unplaced.Reason)
+                    continue
+                }
+                if !strings.Contains(unplaced.Reason, want) {
+                    t.Errorf("patient %d reason = %q, want it to mention %q", unplaced.PatientID, unplaced.Reason, want)
+                }
+                if _, ok := placed[unplaced.PatientID]; ok {
+                    t.Errorf("patient %d is both placed and unplaced", unplaced.PatientID)
+                }
+            }
+
+            scheduled := tt.scheduled
+            if scheduled == nil {
+                scheduled = []int{}
+            }
+            if !reflect.DeepEqual(plan.AlreadyScheduled, scheduled) {
+                t.Errorf("AlreadyScheduled = %v, want %v", plan.AlreadyScheduled, scheduled)
+            }
+        })
+    }
+}
+
+func TestPlanAppointments(t *testing.T) {
+    plan := Build(Input{
+        WeekStart:      weekStart,
+        SessionMinutes: 180,
+        Patients:       []Patient{{ID: 1, Name: "Jane", Needs: models.DialysisNeeds{SessionsPerWeek: 2, PreferredShifts: []string{"afternoon"}}}},
+        Stations:       []Station{{ID: 10}},
+    })
+
+    appointments := plan.Appointments()
+    if len(appointments) != 2 {
+        t.Fatalf("Appointments() returned %d appointments, want 2", len(appointments))
+    }
+    for _, appointment := range appointments {
+        if appointment.PatientID != 1 || appointment.PatientName != "Jane" || appointment.StationID != 10 ||
+            appointment.Shift != "afternoon" || appointment.Time != "11:00" || appointment.DurationMinutes != 180 {
+            t.Errorf("unexpected appointment %+v", appointment)
+        }
+    }
+}
+
+func TestPlanVersion(t *testing.T) {
+    input := Input{
+        WeekStart: weekStart,
+        Patients:  []Patient{{ID: 1, Name: "Jane", Needs: models.DialysisNeeds{SessionsPerWeek: 2, PreferredShifts: []string{"afternoon"}}}},
+        Stations:  []Station{{ID: 10}, {ID: 11}},
+    }
+    version := Build(input).Version
+    if version == "" {
+        t.Fatal("plan has no version")
+    }
+    if again := Build(input).Version; again != version {
+        t.Errorf("version = %s for the same input, want %s", again, version)
+    }
+
+    input.Taken = []Booking{{Date: "2024-01-01", Shift: "afternoon", StationID: 10}}
+    if changed := Build(input).Version; changed == version {
+        t.Errorf("version stayed %s after the planned station was taken", changed)
+    }
+}
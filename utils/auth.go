@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// AuthMiddleware rejects requests without a valid bearer access token and stores the decoded claims in the request context
+func (j *JWTUtil) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		tokenString := strings.TrimPrefix(header, "Bearer ")
+		if header == "" || tokenString == header {
+			ErrorHandler(w, http.StatusUnauthorized, errors.New("missing bearer token"), "Authentication required")
+			return
+		}
+
+		claims, err := j.Decode(tokenString)
+		if err != nil {
+			ErrorHandler(w, http.StatusUnauthorized, err, "Authentication required")
+			return
+		}
+
+		// Refresh tokens may only be exchanged at /auth/refresh
+		if claims["token_type"] != "access" {
+			ErrorHandler(w, http.StatusUnauthorized, errors.New("not an access token"), "Authentication required")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "claims", claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetClaims returns the token claims stored in the request context by AuthMiddleware
+func GetClaims(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value("claims").(map[string]interface{})
+	return claims
+}
+
+// GetAccountID returns the account ID of the authenticated caller, or 0 if there is none
+func GetAccountID(r *http.Request) int {
+	// JSON numbers in the token are decoded as float64
+	id, _ := GetClaims(r)["sub"].(float64)
+	return int(id)
+}
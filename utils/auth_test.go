@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testSecret = "test-secret"
+
+func token(t *testing.T, secret string, claims map[string]interface{}, ttl time.Duration) string {
+	t.Helper()
+	signed, err := NewJWTUtil(secret).Encode(claims, ttl)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	return signed
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	access := map[string]interface{}{"sub": 42, "username": "jane", "token_type": "access"}
+	refresh := map[string]interface{}{"sub": 42, "username": "jane", "token_type": "refresh"}
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"sub": 42, "token_type": "access", "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"not a bearer token", "Basic amFuZTpzZWNyZXQ=", http.StatusUnauthorized},
+		{"malformed token", "Bearer not.a.token", http.StatusUnauthorized},
+		{"signed with another key", "Bearer " + token(t, "other-secret", access, time.Hour), http.StatusUnauthorized},
+		{"unsigned token", "Bearer " + unsigned, http.StatusUnauthorized},
+		{"expired", "Bearer " + token(t, testSecret, access, -time.Minute), http.StatusUnauthorized},
+		{"refresh token", "Bearer " + token(t, testSecret, refresh, time.Hour), http.StatusUnauthorized},
+		{"valid access token", "Bearer " + token(t, testSecret, access, time.Hour), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached *http.Request
+			handler := NewJWTUtil(testSecret).AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = r
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/patients", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				if reached != nil {
+					t.Error("the request reached the handler without a valid access token")
+				}
+				return
+			}
+			if got := GetAccountID(reached); got != 42 {
+				t.Errorf("GetAccountID() = %d, want 42", got)
+			}
+			if got := GetClaims(reached)["username"]; got != "jane" {
+				t.Errorf("username claim = %v, want jane", got)
+			}
+		})
+	}
+}
+
+func TestGetAccountIDWithoutClaims(t *testing.T) {
+	if got := GetAccountID(httptest.NewRequest(http.MethodGet, "/patients", nil)); got != 0 {
+		t.Errorf("GetAccountID() = %d, want 0 for a request that was never authenticated", got)
+	}
+}
@@ -3,6 +3,7 @@ package utils
 import (
     "context"
     "fmt"
+    "net/url"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/mongo/options"
@@ -10,20 +11,28 @@ import (
 )
 
 type Database struct {
-    Host     string
-    Name     string
-    User     string
-    Port     string
-    Password string
-    Client   *mongo.Client
+    Host       string
+    Name       string
+    User       string
+    Port       string
+    Password   string
+    ReplicaSet string
+    Client     *mongo.Client
 }
 
-func NewDatabase(port,host, name, user, password string) (*Database, error) {
-    db := &Database{Host: host, Name: name, User: user, Password: password, Port: port}
+// NewDatabase connects to MongoDB. With a host it connects to that server as a member of replicaSet, otherwise
+// to the Atlas cluster named after the database. Either way bookings need transactions, so a server that
+// cannot run them is refused.
+func NewDatabase(host, port, name, user, password, replicaSet string) (*Database, error) {
+    db := &Database{Host: host, Name: name, User: user, Password: password, Port: port, ReplicaSet: replicaSet}
     err := db.connect()
     if err != nil {
         return nil, err
     }
+    if err := db.checkTransactions(); err != nil {
+        db.Close()
+        return nil, err
+    }
     return db, nil
 }
 
@@ -34,6 +43,10 @@ func (db *Database) connect() error {
     // Format the URI with the necessary credentials and options
     uri := fmt.Sprintf("mongodb+srv://%s:%s@%s.pbt7o.mongodb.net/?retryWrites=true&w=majority&appName=dialysis-database",
     db.User, db.Password, db.Name)
+    if db.Host != "" {
+        uri = fmt.Sprintf("mongodb://%s:%s@%s:%s/?authSource=admin&replicaSet=%s&retryWrites=true&w=majority&appName=dialysis-database",
+            url.QueryEscape(db.User), url.QueryEscape(db.Password), db.Host, db.Port, url.QueryEscape(db.ReplicaSet))
+    }
 
     clientOptions := options.Client().ApplyURI(uri).SetServerAPIOptions(serverAPI)
 
@@ -48,7 +61,10 @@ func (db *Database) connect() error {
     }
 
     // Ping the database to ensure the connection is successful
-    if err := client.Database("admin").RunCommand(ctx, bson.D{{"ping", 1}}).Err(); err != nil {
+    if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Err(); err != nil {
+        if db.Host != "" {
+            return fmt.Errorf("ping failed, is %s:%s running as replica set %q? %v", db.Host, db.Port, db.ReplicaSet, err)
+        }
         return fmt.Errorf("ping failed: %v", err)
     }
 
@@ -58,6 +74,24 @@ func (db *Database) connect() error {
 }
 
 
+// checkTransactions makes sure the server is a replica set member or a mongos, since a standalone mongod
+// cannot run the transactions bookings are made in
+func (db *Database) checkTransactions() error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    var hello struct {
+        SetName string `bson:"setName"`
+        Msg     string `bson:"msg"`
+    }
+    if err := db.Client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+        return fmt.Errorf("hello failed: %v", err)
+    }
+    if hello.SetName == "" && hello.Msg != "isdbgrid" {
+        return fmt.Errorf("MongoDB at %s is a standalone server, which cannot run the transactions bookings need: start mongod with --replSet and initiate the replica set", db.Host)
+    }
+    return nil
+}
 
 // GetConnection returns the MongoDB database
 func (db *Database) GetConnection() (*mongo.Database, error) {
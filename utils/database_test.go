@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckTransactions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name    string
+		hello   bson.E
+		wantErr bool
+	}{
+		{"replica set member", bson.E{Key: "setName", Value: "rs0"}, false},
+		{"mongos", bson.E{Key: "msg", Value: "isdbgrid"}, false},
+		{"standalone", bson.E{Key: "isWritablePrimary", Value: true}, true},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(tt.hello))
+			db := &Database{Host: "mongo", Client: mt.Client}
+			if err := db.checkTransactions(); (err != nil) != tt.wantErr {
+				mt.Errorf("checkTransactions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"runtime"
 )
@@ -10,6 +11,10 @@ import (
 func ErrorHandler(w http.ResponseWriter, statusCode int, err error, message string) {
 	//capture the file and line where the error occured
 	_, file, line, _ := runtime.Caller(1)
+	// Keep the body shape the same when callers have no underlying error
+	if err == nil {
+		err = errors.New(http.StatusText(statusCode))
+	}
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"code":  statusCode,
@@ -19,3 +24,17 @@ func ErrorHandler(w http.ResponseWriter, statusCode int, err error, message stri
 		"line":   line,
 	})
 }
+
+// ConflictHandler reports a 409 with the same body as ErrorHandler plus the records that caused the conflict
+func ConflictHandler(w http.ResponseWriter, err error, message string, conflicts interface{}) {
+	_, file, line, _ := runtime.Caller(1)
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":      http.StatusConflict,
+		"error":     err.Error(),
+		"message":   message,
+		"conflicts": conflicts,
+		"file":      file,
+		"line":      line,
+	})
+}
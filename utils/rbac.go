@@ -0,0 +1,191 @@
+package utils
+
+import "net/http"
+
+// Roles that can be carried in an access token
+const (
+	RoleSystemAdmin  = "system_admin"
+	RoleNurse        = "nurse"
+	RoleNephrologist = "nephrologist"
+	RoleFrontDesk    = "front_desk"
+	RoleTechnician   = "technician"
+	RolePatient      = "patient"
+)
+
+var (
+	readOnly  = []string{http.MethodGet}
+	readWrite = []string{http.MethodGet, http.MethodPost, http.MethodPut}
+	allAccess = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+)
+
+// permissions maps each role to the methods it may use on each resource.
+// Appointments are keyed by type so dialysis and nephrologist bookings can be granted separately, and cancelling
+// one is keyed apart again so patients can cancel their own without being able to change them otherwise.
+var permissions = map[string]map[string][]string{
+	RoleNurse: {
+		"patients":                     readOnly,
+		"appointments:dialysis":        {http.MethodGet, http.MethodPut},
+		"appointments:dialysis:cancel": {http.MethodPut},
+		"appointments:nephrologist":    readOnly,
+		"dialysis_schedules":           {http.MethodGet, http.MethodPut},
+		"hospital_staff":               readOnly,
+		"notifications":                {http.MethodGet, http.MethodPost},
+		"posts":                        readOnly,
+		"patient_history":              {http.MethodGet, http.MethodPost},
+		"credentials":                  {http.MethodPut},
+		"stations":                     {http.MethodGet, http.MethodPut},
+		"availability:slots":           readOnly,
+		"availability:hours":           readOnly,
+		"availability:exceptions":      readOnly,
+		"run_sheet":                    readOnly,
+		"waitlist":                     readOnly,
+		"adherence":                    readOnly,
+		"chair_plan":                   readOnly,
+		"closures":                     readOnly,
+		"transient_patients":           readOnly,
+		"machines":                     readOnly,
+		"machines:disinfect":           {http.MethodPost},
+		"treatment_records":            readWrite,
+		"adequacy":                     readOnly,
+		"fluid":                        readOnly,
+		"lab_results":                  {http.MethodGet, http.MethodPost},
+		"medications":                  readOnly,
+		"medications:doses":            {http.MethodGet, http.MethodPost},
+	},
+	RoleNephrologist: {
+		"patients":                         {http.MethodGet, http.MethodPut},
+		"appointments:dialysis":            readOnly,
+		"appointments:nephrologist":        {http.MethodGet, http.MethodPut},
+		"appointments:nephrologist:cancel": {http.MethodPut},
+		"dialysis_schedules":               readOnly,
+		"hospital_staff":                   readOnly,
+		"notifications":                    {http.MethodGet, http.MethodPost},
+		"posts":                            readOnly,
+		"patient_history":                  {http.MethodGet, http.MethodPost},
+		"credentials":                      {http.MethodPut},
+		"stations":                         readOnly,
+		"availability:slots":               readOnly,
+		"availability:book":                {http.MethodPost},
+		"availability:hours":               allAccess,
+		"availability:exceptions":          allAccess,
+		"run_sheet":                        readOnly,
+		"waitlist":                         readOnly,
+		"adherence":                        readOnly,
+		"chair_plan":                       readOnly,
+		"closures":                         readOnly,
+		"transient_patients":               readOnly,
+		"machines":                         readOnly,
+		"treatment_records":                readOnly,
+		"adequacy":                         readOnly,
+		"fluid":                            {http.MethodGet, http.MethodPost, http.MethodDelete},
+		"lab_results":                      readOnly,
+		"medications":                      {http.MethodGet, http.MethodPost},
+		"medications:doses":                readOnly,
+	},
+	RoleFrontDesk: {
+		"patients":                         readWrite,
+		"appointments:dialysis":            allAccess,
+		"appointments:nephrologist":        allAccess,
+		"appointments:dialysis:cancel":     {http.MethodPut},
+		"appointments:nephrologist:cancel": {http.MethodPut},
+		"dialysis_schedules":               allAccess,
+		"hospital_staff":                   readOnly,
+		"notifications":                    allAccess,
+		"posts":                            readOnly,
+		"payment_details":                  readWrite,
+		"credentials":                      {http.MethodPut},
+		"stations":                         readOnly,
+		"availability:slots":               readOnly,
+		"availability:book":                {http.MethodPost},
+		"availability:hours":               readOnly,
+		"availability:exceptions":          readOnly,
+		"run_sheet":                        readOnly,
+		"waitlist":                         allAccess,
+		"adherence":                        readOnly,
+		"chair_plan":                       {http.MethodGet, http.MethodPost},
+		"closures":                         allAccess,
+		"transient_patients":               allAccess,
+		"machines":                         readOnly,
+		"adequacy":                         readOnly,
+	},
+	RoleTechnician: {
+		"hospital_staff":     readOnly,
+		"notifications":      readOnly,
+		"posts":              readOnly,
+		"credentials":        {http.MethodPut},
+		"stations":           {http.MethodGet, http.MethodPut},
+		"run_sheet":          readOnly,
+		"closures":           readOnly,
+		"machines":           readWrite,
+		"machines:disinfect": {http.MethodPost},
+	},
+	// Patients are further limited to their own records by PatientScope
+	RolePatient: {
+		"posts":                            readOnly,
+		"notifications":                    readOnly,
+		"appointments:dialysis":            readOnly,
+		"appointments:nephrologist":        {http.MethodGet, http.MethodPost},
+		"appointments:dialysis:cancel":     {http.MethodPut},
+		"appointments:nephrologist:cancel": {http.MethodPut},
+		"dialysis_schedules":               readOnly,
+		"patient_history":                  readOnly,
+		"payment_details":                  readOnly,
+		"credentials":                      {http.MethodPut},
+		"availability:slots":               readOnly,
+		"availability:book":                {http.MethodPost},
+		"waitlist":                         {http.MethodGet, http.MethodPost, http.MethodDelete},
+		"adherence":                        readOnly,
+		"closures":                         readOnly,
+		"treatment_records":                readOnly,
+		"adequacy":                         readOnly,
+		"fluid":                            readOnly,
+		"lab_results":                      readOnly,
+		"medications":                      readOnly,
+		"medications:doses":                readOnly,
+	},
+}
+
+// IsStaffRole reports whether role is one a member of hospital staff can hold
+func IsStaffRole(role string) bool {
+	switch role {
+	case RoleNurse, RoleNephrologist, RoleFrontDesk, RoleTechnician:
+		return true
+	}
+	return false
+}
+
+// Authorize reports whether role may use method on resource. System admins may do anything.
+func Authorize(role, resource, method string) bool {
+	if role == RoleSystemAdmin {
+		return true
+	}
+	for _, allowed := range permissions[role][resource] {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRole returns the role of the authenticated caller
+func GetRole(r *http.Request) string {
+	role, _ := GetClaims(r)["role"].(string)
+	return role
+}
+
+// PatientScope returns the caller's patient ID when the caller is a patient, or 0 for staff and admins
+func PatientScope(r *http.Request) int {
+	if GetRole(r) != RolePatient {
+		return 0
+	}
+	return GetAccountID(r)
+}
+
+// NephrologistScope returns the caller's staff ID when the caller is a nephrologist, who may only manage their
+// own working hours and exceptions, or 0 for everyone else
+func NephrologistScope(r *http.Request) int {
+	if GetRole(r) != RoleNephrologist {
+		return 0
+	}
+	return GetAccountID(r)
+}
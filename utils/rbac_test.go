@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		role, resource, method string
+		want                   bool
+	}{
+		{RoleSystemAdmin, "patients", http.MethodDelete, true},
+		{RoleSystemAdmin, "anything", http.MethodPost, true},
+
+		{RoleFrontDesk, "patients", http.MethodPost, true},
+		{RoleFrontDesk, "patients", http.MethodDelete, false},
+		{RoleFrontDesk, "appointments:dialysis", http.MethodDelete, true},
+		{RoleFrontDesk, "payment_details", http.MethodPut, true},
+		{RoleFrontDesk, "hospital_staff", http.MethodPost, false},
+		{RoleFrontDesk, "dialysis_schedules", http.MethodDelete, true},
+
+		{RoleNurse, "appointments:dialysis", http.MethodPut, true},
+		{RoleNurse, "appointments:dialysis", http.MethodPost, false},
+		{RoleNurse, "appointments:nephrologist", http.MethodPut, false},
+		{RoleNurse, "patient_history", http.MethodPost, true},
+		{RoleNurse, "payment_details", http.MethodGet, false},
+		{RoleNurse, "dialysis_schedules", http.MethodPut, true},
+		{RoleNurse, "dialysis_schedules", http.MethodPost, false},
+
+		{RoleNephrologist, "appointments:nephrologist", http.MethodPut, true},
+		{RoleNephrologist, "appointments:dialysis", http.MethodPut, false},
+		{RoleNephrologist, "patients", http.MethodPut, true},
+		{RoleNephrologist, "patients", http.MethodDelete, false},
+		{RoleNephrologist, "availability:hours", http.MethodPost, true},
+		{RoleNephrologist, "availability:exceptions", http.MethodDelete, true},
+		{RoleFrontDesk, "availability:hours", http.MethodPost, false},
+		{RoleFrontDesk, "availability:book", http.MethodPost, true},
+		{RoleNurse, "availability:book", http.MethodPost, false},
+
+		{RolePatient, "posts", http.MethodGet, true},
+		{RolePatient, "posts", http.MethodPost, false},
+		{RolePatient, "patients", http.MethodGet, false},
+		{RolePatient, "appointments:dialysis", http.MethodGet, true},
+		{RolePatient, "appointments:dialysis", http.MethodPost, false},
+		{RolePatient, "appointments:nephrologist", http.MethodPost, true},
+		{RolePatient, "appointments:nephrologist", http.MethodPut, false},
+		{RolePatient, "appointments:nephrologist", http.MethodDelete, false},
+		{RolePatient, "appointments:dialysis:cancel", http.MethodPut, true},
+		{RolePatient, "appointments:nephrologist:cancel", http.MethodPut, true},
+		{RoleNurse, "appointments:dialysis:cancel", http.MethodPut, true},
+		{RoleNurse, "appointments:nephrologist:cancel", http.MethodPut, false},
+		{RoleTechnician, "appointments:dialysis:cancel", http.MethodPut, false},
+		{RolePatient, "patient_history", http.MethodGet, true},
+		{RolePatient, "patient_history", http.MethodPost, false},
+		{RolePatient, "payment_details", http.MethodGet, true},
+		{RolePatient, "payment_details", http.MethodPut, false},
+		{RolePatient, "dialysis_schedules", http.MethodGet, true},
+		{RolePatient, "dialysis_schedules", http.MethodPut, false},
+		{RolePatient, "availability:slots", http.MethodGet, true},
+		{RolePatient, "availability:book", http.MethodPost, true},
+		{RolePatient, "availability:hours", http.MethodGet, false},
+		{RolePatient, "run_sheet", http.MethodGet, false},
+		{RoleNurse, "run_sheet", http.MethodGet, true},
+		{RoleNurse, "run_sheet", http.MethodPost, false},
+		{RolePatient, "waitlist", http.MethodPost, true},
+		{RolePatient, "waitlist", http.MethodPut, false},
+		{RoleNurse, "waitlist", http.MethodPost, false},
+		{RoleFrontDesk, "waitlist", http.MethodDelete, true},
+		{RolePatient, "adherence", http.MethodGet, true},
+		{RoleNurse, "adherence", http.MethodPost, false},
+		{RoleFrontDesk, "chair_plan", http.MethodPost, true},
+		{RoleNurse, "chair_plan", http.MethodPost, false},
+		{RolePatient, "chair_plan", http.MethodGet, false},
+		{RoleFrontDesk, "closures", http.MethodDelete, true},
+		{RoleNurse, "closures", http.MethodPost, false},
+		{RolePatient, "closures", http.MethodGet, true},
+		{RoleFrontDesk, "transient_patients", http.MethodPost, true},
+		{RoleNurse, "transient_patients", http.MethodPost, false},
+		{RolePatient, "transient_patients", http.MethodGet, false},
+		{RoleNurse, "machines:disinfect", http.MethodPost, true},
+		{RoleNurse, "machines", http.MethodPost, false},
+		{RoleFrontDesk, "machines:disinfect", http.MethodPost, false},
+		{RoleTechnician, "machines", http.MethodPut, true},
+		{RoleTechnician, "machines", http.MethodDelete, false},
+		{RoleTechnician, "machines:disinfect", http.MethodPost, true},
+		{RoleNurse, "treatment_records", http.MethodPut, true},
+		{RoleNephrologist, "treatment_records", http.MethodGet, true},
+		{RoleNephrologist, "treatment_records", http.MethodPost, false},
+		{RoleFrontDesk, "treatment_records", http.MethodGet, false},
+		{RolePatient, "treatment_records", http.MethodPost, false},
+		{RoleNephrologist, "adequacy", http.MethodGet, true},
+		{RoleNurse, "adequacy", http.MethodPost, false},
+		{RoleTechnician, "adequacy", http.MethodGet, false},
+		{RoleNephrologist, "fluid", http.MethodPost, true},
+		{RoleNephrologist, "fluid", http.MethodPut, false},
+		{RoleNurse, "fluid", http.MethodPost, false},
+		{RolePatient, "fluid", http.MethodGet, true},
+		{RoleNurse, "lab_results", http.MethodPost, true},
+		{RoleNurse, "lab_results", http.MethodDelete, false},
+		{RoleNephrologist, "lab_results", http.MethodPost, false},
+		{RoleFrontDesk, "lab_results", http.MethodGet, false},
+		{RolePatient, "lab_results", http.MethodGet, true},
+		{RoleNurse, "medications:doses", http.MethodPost, true},
+		{RoleNurse, "medications", http.MethodPost, false},
+		{RoleNephrologist, "medications", http.MethodPost, true},
+		{RoleNephrologist, "medications:doses", http.MethodPost, false},
+		{RolePatient, "medications:doses", http.MethodGet, true},
+		{RoleTechnician, "stations", http.MethodPost, false},
+		{RoleTechnician, "patients", http.MethodGet, false},
+		{RolePatient, "system_admins", http.MethodGet, false},
+
+		// Appointments without a type match no permission
+		{RoleFrontDesk, "appointments:", http.MethodGet, false},
+		{"", "posts", http.MethodGet, false},
+		{"superuser", "posts", http.MethodGet, false},
+	}
+
+	for _, tt := range tests {
+		if got := Authorize(tt.role, tt.resource, tt.method); got != tt.want {
+			t.Errorf("Authorize(%q, %q, %s) = %v, want %v", tt.role, tt.resource, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionsUseKnownMethods(t *testing.T) {
+	known := map[string]bool{http.MethodGet: true, http.MethodPost: true, http.MethodPut: true, http.MethodDelete: true}
+	for role, resources := range permissions {
+		for resource, methods := range resources {
+			for _, method := range methods {
+				if !known[method] {
+					t.Errorf("%s on %s allows unknown method %q", role, resource, method)
+				}
+			}
+		}
+	}
+}
+
+func TestGetRole(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/posts", nil)
+	if got := GetRole(r); got != "" {
+		t.Errorf("GetRole() without claims = %q, want empty", got)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), "claims", map[string]interface{}{"role": RoleNurse}))
+	if got := GetRole(r); got != RoleNurse {
+		t.Errorf("GetRole() = %q, want %q", got, RoleNurse)
+	}
+}
+
+func TestPatientScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   int
+	}{
+		{"patient", map[string]interface{}{"role": RolePatient, "sub": float64(7)}, 7},
+		{"staff", map[string]interface{}{"role": RoleFrontDesk, "sub": float64(7)}, 0},
+		{"admin", map[string]interface{}{"role": RoleSystemAdmin, "sub": float64(1)}, 0},
+		{"no claims", nil, 0},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/appointments", nil)
+		if tt.claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), "claims", tt.claims))
+		}
+		if got := PatientScope(r); got != tt.want {
+			t.Errorf("%s: PatientScope() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNephrologistScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   int
+	}{
+		{"nephrologist", map[string]interface{}{"role": RoleNephrologist, "sub": float64(4)}, 4},
+		{"front desk", map[string]interface{}{"role": RoleFrontDesk, "sub": float64(4)}, 0},
+		{"patient", map[string]interface{}{"role": RolePatient, "sub": float64(4)}, 0},
+		{"no claims", nil, 0},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/availability", nil)
+		if tt.claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), "claims", tt.claims))
+		}
+		if got := NephrologistScope(r); got != tt.want {
+			t.Errorf("%s: NephrologistScope() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}